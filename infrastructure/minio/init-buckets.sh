@@ -10,11 +10,16 @@ echo "Creating buckets..."
 
 mc mb minio/public --ignore-existing || echo "Bucket 'public' already exists"
 mc mb minio/tracks --ignore-existing || echo "Bucket 'tracks' already exists"
+# 30-секундные превью для неавторизованных слушателей (PREVIEW_BUCKET транскодера)
+mc mb minio/previews --ignore-existing || echo "Bucket 'previews' already exists"
+# Ключи зашифрованного HLS: бакет остаётся приватным, ключи отдаёт gateway после проверки JWT
+mc mb minio/hls-keys --ignore-existing || echo "Bucket 'hls-keys' already exists"
 
 echo "Setting bucket policies..."
 
 mc anonymous set public minio/public || echo "Failed to set public policy for 'public' bucket"
 mc anonymous set public minio/tracks || echo "Failed to set public policy for 'tracks' bucket"
+mc anonymous set download minio/previews || echo "Failed to set download policy for 'previews' bucket"
 
 echo "Created buckets:"
 mc ls minio
@@ -12,6 +12,13 @@ rpk topic create transcoder-tasks \
     --topic-config retention.ms=604800000 \
     --topic-config compression.type=snappy
 
+rpk topic create transcoder-tasks-dlq \
+    --brokers redpanda:9092 \
+    --partitions 1 \
+    --replicas 1 \
+    --topic-config retention.ms=2592000000 \
+    --topic-config compression.type=snappy
+
 echo "Topics created successfully!"
 
 rpk topic list --brokers redpanda:9092
@@ -18,6 +18,8 @@ def _categorize_resource(resource: str) -> str:
         return "init_segment"
     if resource_lower.endswith(".m4s"):
         return "media_segment"
+    if resource_lower.endswith("media.mp4"):
+        return "media_file"
     if resource_lower.endswith(".json"):
         return "static_asset"
     return "other"
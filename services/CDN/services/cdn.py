@@ -13,6 +13,37 @@ from core.config import Settings
 logger = logging.getLogger(__name__)
 
 
+_UNSATISFIABLE = (-1, -1)
+
+
+def _parse_range(header: str | None, size: int) -> tuple[int, int] | None:
+    """
+    Parse a single-range "bytes=" header into inclusive offsets.
+    Returns None to serve the whole object (no header, multiple or malformed ranges).
+    """
+    if not header or not header.startswith("bytes=") or "," in header:
+        return None
+    first, sep, last = header[len("bytes=") :].strip().partition("-")
+    if not sep:
+        return None
+    try:
+        if first == "":
+            # suffix range: the last N bytes
+            length = int(last)
+            if length <= 0:
+                return _UNSATISFIABLE
+            return max(size - length, 0), size - 1
+        start = int(first)
+        end = int(last) if last else size - 1
+    except ValueError:
+        return None
+    if end < start:
+        return None
+    if start >= size:
+        return _UNSATISFIABLE
+    return start, min(end, size - 1)
+
+
 class CDNService:
     """CDN service that caches content from origin and proxies requests."""
 
@@ -58,6 +89,8 @@ class CDNService:
             return "init_segment"
         if lowered.endswith(".m4s"):
             return "media_segment"
+        if lowered.endswith("media.mp4"):
+            return "media_file"
         if lowered.endswith(".json"):
             return "static_asset"
         return "other"
@@ -100,10 +133,11 @@ class CDNService:
                 logger.info(f"Cache HIT: {resource_path}")
             metadata = cached_entry.as_metadata()
             ttl_remaining = max(0, int(metadata["ttl_remaining"]))
-            return Response(
-                content=cached_entry.content,
-                media_type=cached_entry.content_type,
-                headers={
+            return self._build_response(
+                request,
+                cached_entry.content,
+                cached_entry.content_type,
+                {
                     "Cache-Control": f"public, max-age={max(ttl_remaining, 0)}",
                     "X-CDN-Cache": "HIT",
                     "X-CDN-TTL-Remaining": str(ttl_remaining),
@@ -149,10 +183,11 @@ class CDNService:
                 resource_category = self._get_resource_category(resource_path)
                 ttl_int = int(ttl)
                 resource_descriptor = origin_path
-                return Response(
-                    content=content,
-                    media_type=content_type,
-                    headers={
+                return self._build_response(
+                    request,
+                    content,
+                    content_type,
+                    {
                         "Cache-Control": f"public, max-age={max(ttl_int, 0)}",
                         "X-CDN-Cache": "MISS",
                         "X-CDN-TTL": str(ttl_int),
@@ -169,6 +204,32 @@ class CDNService:
                 media_type="text/plain",
             )
 
+    def _build_response(
+        self, request: Request, content: bytes, content_type: str, headers: dict[str, str]
+    ) -> Response:
+        """
+        Answer a single byte range from the whole cached object, as players do for
+        single-file HLS variants (EXT-X-BYTERANGE). Anything else gets the full object.
+        """
+        headers = {**headers, "Accept-Ranges": "bytes"}
+        byte_range = _parse_range(request.headers.get("range"), len(content))
+        if byte_range is None:
+            return Response(content=content, media_type=content_type, headers=headers)
+        if byte_range == _UNSATISFIABLE:
+            return Response(
+                status_code=status.HTTP_416_REQUESTED_RANGE_NOT_SATISFIABLE,
+                headers={**headers, "Content-Range": f"bytes */{len(content)}"},
+            )
+
+        start, end = byte_range
+        headers["Content-Range"] = f"bytes {start}-{end}/{len(content)}"
+        return Response(
+            content=content[start : end + 1],
+            status_code=status.HTTP_206_PARTIAL_CONTENT,
+            media_type=content_type,
+            headers=headers,
+        )
+
     async def close(self) -> None:
         """Close HTTP client."""
         await self._client.aclose()
@@ -18,11 +18,13 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -37,6 +39,8 @@ import (
 	pb "github.com/MusicSocial/api-gateway/proto/users/v1"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
 	httpSwagger "github.com/swaggo/http-swagger"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -53,6 +57,8 @@ type Gateway struct {
 	playlistClient playlistpb.PlaylistServiceClient
 	uploadClient   uploadpb.UploadServiceClient
 	jwtSecret      []byte
+	keyStore       *minio.Client
+	keyBucket      string
 }
 
 type ErrorResponse struct {
@@ -97,6 +103,15 @@ func main() {
 	}
 	defer uploadConn.Close()
 
+	// Key store for encrypted HLS (private MinIO bucket, not exposed publicly)
+	keyStore, err := minio.New(getEnv("MINIO_ENDPOINT", "minio:9000"), &minio.Options{
+		Creds:  credentials.NewStaticV4(getEnv("MINIO_ACCESS_KEY", "minioadmin"), getEnv("MINIO_SECRET_KEY", "minioadmin"), ""),
+		Secure: false,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create HLS key store client: %v", err)
+	}
+
 	gateway := &Gateway{
 		userClient:     pb.NewUserServiceClient(userConn),
 		artistClient:   artistpb.NewArtistServiceClient(artistConn),
@@ -104,6 +119,8 @@ func main() {
 		playlistClient: playlistpb.NewPlaylistServiceClient(playlistConn),
 		uploadClient:   uploadpb.NewUploadServiceClient(uploadConn),
 		jwtSecret:      []byte(getEnv("JWT_SECRET", "your-super-secret-access-key-change-in-production")),
+		keyStore:       keyStore,
+		keyBucket:      getEnv("HLS_KEY_BUCKET", "hls-keys"),
 	}
 
 	r := mux.NewRouter()
@@ -135,6 +152,17 @@ func main() {
 	// Upload endpoint (no JWT required)
 	r.HandleFunc("/api/v1/upload/track", gateway.uploadTrackHandler).Methods("POST", "OPTIONS")
 
+	// Resumable uploads over tus (no JWT required, like the single-request upload)
+	r.HandleFunc(uploadsBasePath, gateway.createUploadHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc(uploadsBasePath+"/{uploadId}", gateway.headUploadHandler).Methods("HEAD")
+	r.HandleFunc(uploadsBasePath+"/{uploadId}", gateway.patchUploadHandler).Methods("PATCH", "OPTIONS")
+	r.HandleFunc(uploadsBasePath+"/{uploadId}", gateway.deleteUploadHandler).Methods("DELETE")
+	r.HandleFunc(uploadsBasePath+"/{uploadId}", gateway.getUploadHandler).Methods("GET")
+
+	// HLS key delivery (JWT required). The token is only accepted in the Authorization header:
+	// a long-lived JWT in the query string would end up in access logs and player caches
+	r.Handle("/api/v1/keys/{trackId}/{keyId}", gateway.jwtMiddleware(http.HandlerFunc(gateway.getTrackKeyHandler))).Methods("GET", "OPTIONS")
+
 	// Protected endpoints (JWT required)
 	protected := r.PathPrefix("/api/v1").Subrouter()
 	protected.Use(gateway.jwtMiddleware)
@@ -170,10 +198,14 @@ func main() {
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, HEAD, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+strings.Join(tusHeaders, ", "))
+		w.Header().Set("Access-Control-Expose-Headers", "Location, "+strings.Join(tusHeaders, ", "))
 
 		if r.Method == "OPTIONS" {
+			if strings.HasPrefix(r.URL.Path, uploadsBasePath) {
+				tusOptions(w)
+			}
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -207,12 +239,7 @@ func (g *Gateway) jwtMiddleware(next http.Handler) http.Handler {
 			writeError(w, "Token is required", http.StatusUnauthorized)
 			return
 		}
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return g.jwtSecret, nil
-		})
+		token, err := jwt.Parse(tokenString, g.jwtKeyFunc)
 
 		if err != nil || !token.Valid {
 			writeError(w, "Invalid token", http.StatusUnauthorized)
@@ -229,6 +256,85 @@ func (g *Gateway) jwtMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+func (g *Gateway) jwtKeyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return g.jwtSecret, nil
+}
+
+// isAuthenticated проверяет JWT, не отказывая в доступе: публичные эндпоинты решают по нему, что отдавать
+func (g *Gateway) isAuthenticated(r *http.Request) bool {
+	authHeader := r.Header.Get("Authorization")
+	var tokenString string
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		tokenString = strings.TrimPrefix(authHeader, "Bearer ")
+	} else if strings.HasPrefix(authHeader, "Bearer:") {
+		tokenString = strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer:"))
+	}
+	if tokenString == "" {
+		return false
+	}
+
+	token, err := jwt.Parse(tokenString, g.jwtKeyFunc)
+	return err == nil && token.Valid
+}
+
+// previewOnlyResponse заменяет в ответе tracks-service полное аудио на превью.
+// Применяется к публичным эндпоинтам треков, когда запрос без валидного JWT.
+func previewOnlyResponse(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return nil
+	}
+
+	// Список (tracks), поиск (items) или один трек
+	for _, key := range []string{"tracks", "items"} {
+		if list, ok := payload[key].([]interface{}); ok {
+			for _, item := range list {
+				if track, ok := item.(map[string]interface{}); ok {
+					restrictToPreview(track)
+				}
+			}
+		}
+	}
+	if _, ok := payload["id"]; ok {
+		restrictToPreview(payload)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return nil
+}
+
+// restrictToPreview оставляет у трека только превью: audio_url указывает на фрагмент,
+// а у треков без превью полного аудио в ответе нет вовсе
+func restrictToPreview(track map[string]interface{}) {
+	delete(track, "dash_url")
+	if preview, ok := track["preview_url"].(string); ok && preview != "" {
+		track["audio_url"] = preview
+	} else {
+		delete(track, "audio_url")
+	}
+	track["preview_only"] = true
+}
+
 // healthHandler godoc
 //
 //	@Summary		Проверка состояния сервиса
@@ -816,7 +922,7 @@ func (g *Gateway) createTrackHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // @Summary Обновить информацию о треке
-// @Description Обновление информации о треке (cover_url, audio_url, duration)
+// @Description Обновление информации о треке (cover_url, audio_url, dash_url, duration)
 // @Tags tracks
 // @Accept json
 // @Produce json
@@ -836,6 +942,8 @@ func (g *Gateway) updateTrackInfoHandler(w http.ResponseWriter, r *http.Request)
 	var req struct {
 		CoverUrl    string `json:"cover_url"`
 		AudioUrl    string `json:"audio_url"`
+		DashUrl     string `json:"dash_url"`
+		WaveformUrl string `json:"waveform_url"`
 		DurationSec int32  `json:"duration_sec"`
 	}
 
@@ -848,6 +956,8 @@ func (g *Gateway) updateTrackInfoHandler(w http.ResponseWriter, r *http.Request)
 		TrackId:     trackId,
 		CoverUrl:    req.CoverUrl,
 		AudioUrl:    req.AudioUrl,
+		DashUrl:     req.DashUrl,
+		WaveformUrl: req.WaveformUrl,
 		DurationSec: req.DurationSec,
 	}
 
@@ -1232,7 +1342,8 @@ func (g *Gateway) removeTrackFromPlaylistHandler(w http.ResponseWriter, r *http.
 // uploadTrackHandler godoc
 //
 //	@Summary		Загрузить трек
-//	@Description	Загрузка аудиофайла трека через multipart/form-data
+//	@Description	Загрузка аудиофайла трека через multipart/form-data. Файл передаётся в Upload Service потоком, поэтому поля track_name, genre и artist_ids должны идти в форме до file
+//	@Description	Размер файла ограничен UPLOAD_MAX_SIZE_MB Upload Service (по умолчанию 1024 МиБ), при превышении загрузка прерывается с 413
 //	@Tags			Upload
 //	@Accept			multipart/form-data
 //	@Produce		json
@@ -1242,41 +1353,72 @@ func (g *Gateway) removeTrackFromPlaylistHandler(w http.ResponseWriter, r *http.
 //	@Param			genre		formData	string	true	"Жанр трека"
 //	@Success		200			{object}	object{success=bool,message=string,track_id=string}
 //	@Failure		400			{object}	ErrorResponse
+//	@Failure		413			{object}	ErrorResponse
 //	@Failure		500			{object}	ErrorResponse
 //	@Router			/api/v1/upload/track [post]
 func (g *Gateway) uploadTrackHandler(w http.ResponseWriter, r *http.Request) {
-	// Parse multipart form (max 100MB)
-	err := r.ParseMultipartForm(100 << 20) // 100MB
+	// The form is read part by part and the file is forwarded to the upload service as it
+	// arrives, so neither the gateway nor the upload service holds the whole file. The fields
+	// therefore have to come before the file.
+	reader, err := r.MultipartReader()
 	if err != nil {
 		writeError(w, "Failed to parse multipart form: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Get file
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		writeError(w, "File is required: "+err.Error(), http.StatusBadRequest)
+	var (
+		trackName    string
+		genre        string
+		artistIDsStr []string
+		file         *multipart.Part
+	)
+	for file == nil {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, "Failed to parse multipart form: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == "file" {
+			file = part
+			break
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, maxFormValueSize))
+		if err != nil {
+			writeError(w, "Failed to parse multipart form: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch part.FormName() {
+		case "track_name":
+			trackName = string(value)
+		case "genre":
+			genre = string(value)
+		case "artist_ids":
+			artistIDsStr = append(artistIDsStr, string(value))
+		}
+	}
+
+	if file == nil {
+		writeError(w, "File is required", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
-	_ = header // Suppress unused variable warning
 
 	// Get metadata
-	trackName := r.FormValue("track_name")
 	if trackName == "" {
-		writeError(w, "track_name is required", http.StatusBadRequest)
+		writeError(w, "track_name is required and must precede the file", http.StatusBadRequest)
 		return
 	}
 
-	genre := r.FormValue("genre")
 	if genre == "" {
-		writeError(w, "genre is required", http.StatusBadRequest)
+		writeError(w, "genre is required and must precede the file", http.StatusBadRequest)
 		return
 	}
 
-	artistIDsStr := r.Form["artist_ids"]
 	if len(artistIDsStr) == 0 {
-		writeError(w, "at least one artist_id is required", http.StatusBadRequest)
+		writeError(w, "at least one artist_id is required and must precede the file", http.StatusBadRequest)
 		return
 	}
 
@@ -1302,7 +1444,9 @@ func (g *Gateway) uploadTrackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := stream.Send(metadataReq); err != nil {
-		writeError(w, "Failed to send metadata: "+err.Error(), http.StatusInternalServerError)
+		// the upload service has ended the stream; its status comes with CloseAndRecv
+		_, err = stream.CloseAndRecv()
+		handleUploadError(w, err)
 		return
 	}
 
@@ -1320,7 +1464,9 @@ func (g *Gateway) uploadTrackHandler(w http.ResponseWriter, r *http.Request) {
 			}
 
 			if err := stream.Send(chunkReq); err != nil {
-				writeError(w, "Failed to send chunk: "+err.Error(), http.StatusInternalServerError)
+				// e.g. an unsupported format or a file over the size limit
+				_, err = stream.CloseAndRecv()
+				handleUploadError(w, err)
 				return
 			}
 		}
@@ -1329,7 +1475,8 @@ func (g *Gateway) uploadTrackHandler(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 		if err != nil {
-			writeError(w, "Failed to read file: "+err.Error(), http.StatusInternalServerError)
+			// returning cancels the stream, and the upload service drops what it received
+			writeError(w, "Failed to read file: "+err.Error(), http.StatusBadRequest)
 			return
 		}
 	}
@@ -1337,7 +1484,7 @@ func (g *Gateway) uploadTrackHandler(w http.ResponseWriter, r *http.Request) {
 	// Close and receive response
 	resp, err := stream.CloseAndRecv()
 	if err != nil {
-		handleGrpcError(w, err)
+		handleUploadError(w, err)
 		return
 	}
 
@@ -1360,12 +1507,19 @@ func (g *Gateway) uploadTrackHandler(w http.ResponseWriter, r *http.Request) {
 //
 //	@Summary		Получить список треков
 //	@Description	Возвращает список треков с пагинацией
+//	@Description	Без авторизации audio_url указывает на 30-секундное превью, dash_url не возвращается, preview_only=true
 //	@Tags			Tracks
 //	@Accept			json
 //	@Produce		json
 //	@Param			limit		query		int		false	"Количество записей на странице"	default(20)
 //	@Param			offset		query		int		false	"Смещение"	default(0)
 //	@Param			artist_id	query		string	false	"ID артиста для фильтрации"
+//	@Param			min_bpm		query		number	false	"Минимальный темп (BPM)"
+//	@Param			max_bpm		query		number	false	"Максимальный темп (BPM)"
+//	@Param			key			query		string	false	"Тональность: название (A minor) или код Camelot (8A)"
+//	@Param			min_energy	query		number	false	"Минимальная энергия (0..1)"
+//	@Param			max_energy	query		number	false	"Максимальная энергия (0..1)"
+//	@Param			min_danceability	query	number	false	"Минимальная танцевальность (0..1)"
 //	@Success		200			{object}	object{tracks=[]object,limit=int,offset=int}
 //	@Failure		500			{object}	ErrorResponse
 //	@Router			/api/v1/tracks [get]
@@ -1380,6 +1534,9 @@ func (g *Gateway) getTracksHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Создаем прокси
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	if !g.isAuthenticated(r) {
+		proxy.ModifyResponse = previewOnlyResponse
+	}
 	
 	// Модифицируем запрос
 	r.URL.Path = "/api/tracks"
@@ -1395,6 +1552,7 @@ func (g *Gateway) getTracksHandler(w http.ResponseWriter, r *http.Request) {
 //
 //	@Summary		Поиск треков
 //	@Description	Поиск треков по названию
+//	@Description	Без авторизации audio_url указывает на 30-секундное превью, dash_url не возвращается, preview_only=true
 //	@Tags			Tracks
 //	@Accept			json
 //	@Produce		json
@@ -1415,6 +1573,9 @@ func (g *Gateway) searchTracksHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Создаем прокси
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	if !g.isAuthenticated(r) {
+		proxy.ModifyResponse = previewOnlyResponse
+	}
 	
 	// Модифицируем запрос
 	r.URL.Path = "/api/tracks/search"
@@ -1430,6 +1591,7 @@ func (g *Gateway) searchTracksHandler(w http.ResponseWriter, r *http.Request) {
 //
 //	@Summary		Получить трек по ID
 //	@Description	Возвращает информацию о треке по его ID
+//	@Description	Без авторизации audio_url указывает на 30-секундное превью, dash_url не возвращается, preview_only=true
 //	@Tags			Tracks
 //	@Accept			json
 //	@Produce		json
@@ -1452,6 +1614,9 @@ func (g *Gateway) getTrackByIdHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Создаем прокси
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	if !g.isAuthenticated(r) {
+		proxy.ModifyResponse = previewOnlyResponse
+	}
 	
 	// Модифицируем запрос
 	r.URL.Path = "/api/tracks/" + trackId
@@ -1462,3 +1627,67 @@ func (g *Gateway) getTrackByIdHandler(w http.ResponseWriter, r *http.Request) {
 	// Проксируем запрос
 	proxy.ServeHTTP(w, r)
 }
+
+// getTrackKeyHandler godoc
+//
+//	@Summary		Получить ключ расшифровки HLS
+//	@Description	Возвращает 16-байтовый AES-128 ключ для зашифрованных сегментов трека. URI ключа прописан в плейлистах вариантов (#EXT-X-KEY). Токен передаётся только в заголовке Authorization
+//	@Tags			Tracks
+//	@Produce		application/octet-stream
+//	@Param			trackId	path		string	true	"ID трека"
+//	@Param			keyId	path		string	true	"ID ключа"
+//	@Success		200		{file}		binary
+//	@Failure		401		{object}	ErrorResponse
+//	@Failure		404		{object}	ErrorResponse
+//	@Failure		500		{object}	ErrorResponse
+//	@Security		BearerAuth
+//	@Router			/api/v1/keys/{trackId}/{keyId} [get]
+func (g *Gateway) getTrackKeyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	trackId := vars["trackId"]
+	keyId := vars["keyId"]
+
+	// Не даём выйти за пределы каталога трека в бакете ключей
+	if !isHexID(keyId) || strings.ContainsAny(trackId, "/.") {
+		writeError(w, "Key not found", http.StatusNotFound)
+		return
+	}
+
+	object, err := g.keyStore.GetObject(r.Context(), g.keyBucket, trackId+"/"+keyId+".key", minio.GetObjectOptions{})
+	if err != nil {
+		writeError(w, "Failed to read key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer object.Close()
+
+	key, err := io.ReadAll(io.LimitReader(object, 64))
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			writeError(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		writeError(w, "Failed to read key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(key) != 16 {
+		writeError(w, "Invalid key", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(key)
+}
+
+func isHexID(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, c := range value {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -16,6 +16,8 @@ type CreateTrackResponse struct {
 type UpdateTrackInfoRequest struct {
 	CoverUrl    string `json:"cover_url" example:"https://example.com/cover.jpg"`
 	AudioUrl    string `json:"audio_url" example:"https://example.com/audio.mp3"`
+	DashUrl     string `json:"dash_url" example:"https://example.com/manifest.mpd"`
+	WaveformUrl string `json:"waveform_url" example:"https://example.com/waveform.json"`
 	DurationSec int32  `json:"duration_sec" example:"180"`
 }
 
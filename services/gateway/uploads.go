@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	uploadpb "github.com/MusicSocial/api-gateway/proto/upload"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Resumable uploads follow the tus 1.0.0 protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, termination and expiration extensions, on top of the upload sessions of
+// the Upload Service.
+const (
+	tusVersion      = "1.0.0"
+	tusExtensions   = "creation,termination,expiration"
+	tusContentType  = "application/offset+octet-stream"
+	uploadsBasePath = "/api/v1/uploads"
+	// maxFormValueSize bounds a text field of the multipart upload form.
+	maxFormValueSize = 64 << 10
+)
+
+// tusHeaders are the tus request headers browsers must be allowed to send and read.
+var tusHeaders = []string{"Tus-Resumable", "Tus-Version", "Tus-Extension", "Upload-Length", "Upload-Offset", "Upload-Metadata", "Upload-Expires", "Upload-Track-Id"}
+
+func setTusHeaders(w http.ResponseWriter, session *uploadpb.UploadSession) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+	if session == nil {
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Size, 10))
+	w.Header().Set("Upload-Expires", time.Unix(session.ExpiresAt, 0).UTC().Format(http.TimeFormat))
+	if session.TrackId != "" {
+		w.Header().Set("Upload-Track-Id", session.TrackId)
+	}
+}
+
+// tusOptions answers the tus discovery request; CORS preflight goes through the same request.
+func tusOptions(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+}
+
+// checkTusResumable rejects requests of other protocol versions.
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") == tusVersion {
+		return true
+	}
+	w.Header().Set("Tus-Version", tusVersion)
+	writeError(w, "Unsupported Tus-Resumable version, expected "+tusVersion, http.StatusPreconditionFailed)
+	return false
+}
+
+// parseUploadMetadata decodes Upload-Metadata: comma-separated "key base64(value)" pairs.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.New("invalid Upload-Metadata value for " + key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// handleUploadError maps upload errors: a finalized or incomplete session, or one being
+// finalized by another request, is a conflict, and
+// a file over the size limit of the upload service is too large.
+func handleUploadError(w http.ResponseWriter, err error) {
+	if st, ok := status.FromError(err); ok {
+		switch st.Code() {
+		case codes.FailedPrecondition, codes.Aborted:
+			writeError(w, st.Message(), http.StatusConflict)
+			return
+		case codes.ResourceExhausted:
+			writeError(w, st.Message(), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+	handleGrpcError(w, err)
+}
+
+// createUploadHandler godoc
+//
+//	@Summary		Создать сессию возобновляемой загрузки (tus)
+//	@Description	Создание загрузки по протоколу tus 1.0.0. Upload-Metadata содержит пары "ключ base64(значение)": track_name, genre, artist_ids (через запятую), filename
+//	@Description	URL загрузки возвращается в заголовке Location, срок жизни — в Upload-Expires
+//	@Tags			Upload
+//	@Param			Tus-Resumable	header	string	true	"Версия протокола"	default(1.0.0)
+//	@Param			Upload-Length	header	int		true	"Размер файла в байтах"
+//	@Param			Upload-Metadata	header	string	true	"Метаданные трека"
+//	@Success		201
+//	@Failure		400	{object}	ErrorResponse
+//	@Failure		412	{object}	ErrorResponse
+//	@Failure		413	{object}	ErrorResponse
+//	@Failure		500	{object}	ErrorResponse
+//	@Router			/api/v1/uploads [post]
+func (g *Gateway) createUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	setTusHeaders(w, nil)
+
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size <= 0 {
+		writeError(w, "Upload-Length is required; deferred length is not supported", http.StatusBadRequest)
+		return
+	}
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	trackName := metadata["track_name"]
+	if trackName == "" {
+		writeError(w, "track_name is required", http.StatusBadRequest)
+		return
+	}
+	genre := metadata["genre"]
+	if genre == "" {
+		writeError(w, "genre is required", http.StatusBadRequest)
+		return
+	}
+	var artistIDs []string
+	for _, id := range strings.Split(metadata["artist_ids"], ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			artistIDs = append(artistIDs, id)
+		}
+	}
+	if len(artistIDs) == 0 {
+		writeError(w, "at least one artist_id is required", http.StatusBadRequest)
+		return
+	}
+
+	session, err := g.uploadClient.CreateUploadSession(r.Context(), &uploadpb.CreateUploadSessionRequest{
+		Metadata: &uploadpb.TrackMetadata{
+			ArtistIds: artistIDs,
+			TrackName: trackName,
+			Genre:     genre,
+		},
+		Size:     size,
+		Filename: metadata["filename"],
+	})
+	if err != nil {
+		handleUploadError(w, err)
+		return
+	}
+
+	setTusHeaders(w, session)
+	w.Header().Set("Location", uploadsBasePath+"/"+session.SessionId)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// headUploadHandler godoc
+//
+//	@Summary		Смещение возобновляемой загрузки (tus)
+//	@Description	Возвращает в Upload-Offset, сколько байт с начала файла уже принято; с этого места клиент продолжает загрузку
+//	@Tags			Upload
+//	@Param			uploadId		path	string	true	"ID загрузки"
+//	@Param			Tus-Resumable	header	string	true	"Версия протокола"	default(1.0.0)
+//	@Success		200
+//	@Failure		404	{object}	ErrorResponse
+//	@Router			/api/v1/uploads/{uploadId} [head]
+func (g *Gateway) headUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	setTusHeaders(w, nil)
+
+	session, err := g.uploadClient.GetUploadSession(r.Context(), &uploadpb.GetUploadSessionRequest{
+		SessionId: mux.Vars(r)["uploadId"],
+	})
+	if err != nil {
+		handleUploadError(w, err)
+		return
+	}
+	setTusHeaders(w, session)
+	w.WriteHeader(http.StatusOK)
+}
+
+// patchUploadHandler godoc
+//
+//	@Summary		Отправить данные возобновляемой загрузки (tus)
+//	@Description	Тело — байты файла начиная с Upload-Offset, любой длины. Всё принятое сохраняется, в том числе при обрыве соединения, и Upload-Offset в ответе и в HEAD указывает на конец принятых данных
+//	@Description	Когда принят весь файл, загрузка завершается: создаётся трек, его ID возвращается в заголовке Upload-Track-Id
+//	@Tags			Upload
+//	@Accept			application/offset+octet-stream
+//	@Param			uploadId		path	string	true	"ID загрузки"
+//	@Param			Tus-Resumable	header	string	true	"Версия протокола"	default(1.0.0)
+//	@Param			Upload-Offset	header	int		true	"Смещение начала тела в файле"
+//	@Success		204
+//	@Failure		400	{object}	ErrorResponse
+//	@Failure		404	{object}	ErrorResponse
+//	@Failure		409	{object}	ErrorResponse
+//	@Failure		415	{object}	ErrorResponse
+//	@Router			/api/v1/uploads/{uploadId} [patch]
+func (g *Gateway) patchUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	setTusHeaders(w, nil)
+	if r.Header.Get("Content-Type") != tusContentType {
+		writeError(w, "Content-Type must be "+tusContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, "Upload-Offset is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	sessionID := mux.Vars(r)["uploadId"]
+	session, err := g.uploadClient.GetUploadSession(ctx, &uploadpb.GetUploadSessionRequest{SessionId: sessionID})
+	if err != nil {
+		handleUploadError(w, err)
+		return
+	}
+	if offset != session.Offset {
+		setTusHeaders(w, session)
+		writeError(w, "Upload-Offset "+strconv.FormatInt(offset, 10)+" does not match the current offset "+strconv.FormatInt(session.Offset, 10), http.StatusConflict)
+		return
+	}
+
+	// the body is forwarded up to each part boundary as it arrives; the upload service keeps a
+	// piece that does not reach the boundary until the next request continues it, so every
+	// byte received is stored, also when the client goes away
+	buffer := make([]byte, session.PartSize)
+	for session.Offset < session.Size {
+		boundary := min((session.Offset/session.PartSize+1)*session.PartSize, session.Size)
+		n, readErr := io.ReadFull(r.Body, buffer[:boundary-session.Offset])
+		if n > 0 {
+			// a broken connection cancels the request context; what arrived is still stored
+			session, err = g.uploadClient.UploadChunk(context.WithoutCancel(ctx), &uploadpb.UploadChunkRequest{
+				SessionId: sessionID,
+				Offset:    session.Offset,
+				Data:      buffer[:n],
+			})
+			if err != nil {
+				handleUploadError(w, err)
+				return
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			// the client went away; what was stored is reported by the next HEAD
+			return
+		}
+	}
+
+	if session.Offset == session.Size && session.TrackId == "" {
+		// an empty PATCH at the end retries a failed finalize
+		resp, err := g.uploadClient.FinalizeUploadSession(ctx, &uploadpb.FinalizeUploadSessionRequest{SessionId: sessionID})
+		if err != nil {
+			setTusHeaders(w, session)
+			handleUploadError(w, err)
+			return
+		}
+		session.TrackId = resp.TrackId
+	}
+
+	setTusHeaders(w, session)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUploadHandler godoc
+//
+//	@Summary		Отменить возобновляемую загрузку (tus)
+//	@Description	Удаляет незавершённую загрузку и принятые части
+//	@Tags			Upload
+//	@Param			uploadId		path	string	true	"ID загрузки"
+//	@Param			Tus-Resumable	header	string	true	"Версия протокола"	default(1.0.0)
+//	@Success		204
+//	@Failure		404	{object}	ErrorResponse
+//	@Failure		409	{object}	ErrorResponse
+//	@Router			/api/v1/uploads/{uploadId} [delete]
+func (g *Gateway) deleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	setTusHeaders(w, nil)
+
+	_, err := g.uploadClient.AbortUploadSession(r.Context(), &uploadpb.AbortUploadSessionRequest{
+		SessionId: mux.Vars(r)["uploadId"],
+	})
+	if err != nil {
+		handleUploadError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getUploadHandler godoc
+//
+//	@Summary		Состояние возобновляемой загрузки
+//	@Description	JSON-описание загрузки для клиентов без tus: размер части, принятые байты, срок жизни и track_id после завершения
+//	@Tags			Upload
+//	@Produce		json
+//	@Param			uploadId	path		string	true	"ID загрузки"
+//	@Success		200			{object}	object{upload_id=string,size=int,part_size=int,offset=int,received_bytes=int,expires_at=string,track_id=string}
+//	@Failure		404			{object}	ErrorResponse
+//	@Router			/api/v1/uploads/{uploadId} [get]
+func (g *Gateway) getUploadHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := g.uploadClient.GetUploadSession(r.Context(), &uploadpb.GetUploadSessionRequest{
+		SessionId: mux.Vars(r)["uploadId"],
+	})
+	if err != nil {
+		handleUploadError(w, err)
+		return
+	}
+
+	result := map[string]interface{}{
+		"upload_id":      session.SessionId,
+		"size":           session.Size,
+		"part_size":      session.PartSize,
+		"offset":         session.Offset,
+		"received_bytes": session.ReceivedBytes,
+		"expires_at":     time.Unix(session.ExpiresAt, 0).UTC().Format(time.RFC3339),
+		"track_id":       session.TrackId,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
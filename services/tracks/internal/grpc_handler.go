@@ -57,7 +57,7 @@ func (h *GRPCHandler) CreateTrack(ctx context.Context, req *tracks.CreateTrackRe
 	}, nil
 }
 
-// UpdateTrackInfo обновляет информацию о треке (cover_url, audio_url)
+// UpdateTrackInfo обновляет информацию о треке (cover_url, audio_url, dash_url)
 func (h *GRPCHandler) UpdateTrackInfo(ctx context.Context, req *tracks.UpdateTrackInfoRequest) (*tracks.UpdateTrackInfoResponse, error) {
 	// Валидация
 	if req.TrackId == "" {
@@ -76,11 +76,54 @@ func (h *GRPCHandler) UpdateTrackInfo(ctx context.Context, req *tracks.UpdateTra
 	}
 
 	// Обновляем URLs трека
-	err = h.service.UpdateTrackURLsAndDuration(ctx, trackID, req.CoverUrl, req.AudioUrl, int(req.DurationSec))
+	info := TrackInfoUpdate{
+		CoverURL:    req.CoverUrl,
+		AudioURL:    req.AudioUrl,
+		DashURL:     req.DashUrl,
+		WaveformURL: req.WaveformUrl,
+		PreviewURL:  req.PreviewUrl,
+		DurationSec: int(req.DurationSec),
+	}
+	if sm := req.GetSuggested(); sm != nil {
+		info.Suggested = &SuggestedMetadata{
+			Title:       sm.Title,
+			Artists:     sm.Artists,
+			Album:       sm.Album,
+			TrackNumber: int(sm.TrackNumber),
+			Year:        int(sm.Year),
+			ISRC:        sm.Isrc,
+			Genre:       sm.Genre,
+			Explicit:    sm.Explicit,
+		}
+	}
+
+	if an := req.GetAnalysis(); an != nil {
+		info.Analysis = &AudioAnalysis{
+			BPM:          an.Bpm,
+			Key:          an.Key,
+			Camelot:      an.Camelot,
+			Energy:       an.Energy,
+			Danceability: an.Danceability,
+		}
+	}
+
+	if sq := req.GetSourceQuality(); sq != nil {
+		info.SourceQuality = &SourceQuality{
+			SuspectedTranscode: sq.SuspectedTranscode,
+			Confidence:         sq.Confidence,
+			CutoffHz:           int(sq.CutoffHz),
+			ExpectedCutoffHz:   int(sq.ExpectedCutoffHz),
+		}
+	}
+
+	err = h.service.UpdateTrackURLsAndDuration(ctx, trackID, info)
 	if err != nil {
 		if err == ErrNotFound {
 			return nil, status.Error(codes.NotFound, "track not found")
 		}
+		if err == ErrInvalidTransition {
+			return nil, status.Error(codes.FailedPrecondition, "track cannot become ready from its current status")
+		}
 		log.Printf("Error updating track info: %v", err)
 		return nil, status.Error(codes.Internal, "failed to update track info")
 	}
@@ -89,3 +132,101 @@ func (h *GRPCHandler) UpdateTrackInfo(ctx context.Context, req *tracks.UpdateTra
 		Success: true,
 	}, nil
 }
+
+// UpdateTrackStatus меняет статус обработки трека (processing, failed)
+func (h *GRPCHandler) UpdateTrackStatus(ctx context.Context, req *tracks.UpdateTrackStatusRequest) (*tracks.UpdateTrackStatusResponse, error) {
+	if req.TrackId == "" {
+		return nil, status.Error(codes.InvalidArgument, "track_id is required")
+	}
+
+	trackID, err := uuid.Parse(req.TrackId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid track_id format")
+	}
+
+	// ready выставляется только через UpdateTrackInfo вместе с результатами обработки
+	if req.Status != StatusProcessing && req.Status != StatusFailed {
+		return nil, status.Error(codes.InvalidArgument, "status must be processing or failed")
+	}
+
+	err = h.service.UpdateTrackStatus(ctx, trackID, req.Status, req.FailureReason)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, status.Error(codes.NotFound, "track not found")
+		}
+		if err == ErrInvalidTransition {
+			track, getErr := h.service.GetTrack(ctx, trackID)
+			if getErr != nil {
+				return nil, status.Error(codes.FailedPrecondition, "invalid status transition")
+			}
+			return nil, status.Errorf(codes.FailedPrecondition, "invalid status transition %s -> %s", track.Status, req.Status)
+		}
+		log.Printf("Error updating track status: %v", err)
+		return nil, status.Error(codes.Internal, "failed to update track status")
+	}
+
+	return &tracks.UpdateTrackStatusResponse{
+		Status: req.Status,
+	}, nil
+}
+
+// DeleteUploadedTrack удаляет трек, оригинал которого так и не был загружен
+func (h *GRPCHandler) DeleteUploadedTrack(ctx context.Context, req *tracks.DeleteUploadedTrackRequest) (*tracks.DeleteUploadedTrackResponse, error) {
+	if req.TrackId == "" {
+		return nil, status.Error(codes.InvalidArgument, "track_id is required")
+	}
+
+	trackID, err := uuid.Parse(req.TrackId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid track_id format")
+	}
+
+	err = h.service.DeleteUploadedTrack(ctx, trackID)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, status.Error(codes.NotFound, "track not found")
+		}
+		if err == ErrInvalidTransition {
+			return nil, status.Error(codes.FailedPrecondition, "only an uploaded track can be deleted")
+		}
+		log.Printf("Error deleting uploaded track: %v", err)
+		return nil, status.Error(codes.Internal, "failed to delete track")
+	}
+
+	return &tracks.DeleteUploadedTrackResponse{}, nil
+}
+
+// StoreFingerprint сохраняет акустический отпечаток трека и возвращает найденные дубликаты
+func (h *GRPCHandler) StoreFingerprint(ctx context.Context, req *tracks.StoreFingerprintRequest) (*tracks.StoreFingerprintResponse, error) {
+	if req.TrackId == "" {
+		return nil, status.Error(codes.InvalidArgument, "track_id is required")
+	}
+
+	trackID, err := uuid.Parse(req.TrackId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid track_id format")
+	}
+
+	if len(req.Hashes) != len(req.Offsets) {
+		return nil, status.Error(codes.InvalidArgument, "hashes and offsets must have the same length")
+	}
+
+	duplicates, err := h.service.StoreFingerprint(ctx, trackID, req.Hashes, req.Offsets)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, status.Error(codes.NotFound, "track not found")
+		}
+		log.Printf("Error storing fingerprint: %v", err)
+		return nil, status.Error(codes.Internal, "failed to store fingerprint")
+	}
+
+	resp := &tracks.StoreFingerprintResponse{}
+	for _, d := range duplicates {
+		resp.Matches = append(resp.Matches, &tracks.FingerprintMatch{
+			TrackId:       d.DuplicateOf.String(),
+			Score:         d.Score,
+			MatchedHashes: int32(d.MatchedHashes),
+		})
+	}
+	return resp, nil
+}
@@ -26,6 +26,8 @@ func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
 	// Admin API
 	mux.HandleFunc("/api/admin/tracks", h.handleAdminTracks)
 	mux.HandleFunc("/api/admin/tracks/", h.handleAdminTrack)
+	mux.HandleFunc("/api/admin/duplicates", h.handleAdminDuplicates)
+	mux.HandleFunc("/api/admin/suspected-transcodes", h.handleAdminSuspectedTranscodes)
 
 	// Health
 	mux.HandleFunc("/health", h.health)
@@ -33,6 +35,7 @@ func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
 
 // GET /api/tracks - список треков
 // GET /api/tracks?artist_id=uuid&limit=20&offset=0
+// GET /api/tracks?min_bpm=120&max_bpm=128&key=8A&min_energy=0.6 - фильтры по результатам анализа аудио
 func (h *Handler) handleTracks(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -42,14 +45,30 @@ func (h *Handler) handleTracks(w http.ResponseWriter, r *http.Request) {
 	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
 	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
 
-	var artistID *uuid.UUID
+	var filter TrackFilter
 	if aid := r.URL.Query().Get("artist_id"); aid != "" {
 		if id, err := uuid.Parse(aid); err == nil {
-			artistID = &id
+			filter.ArtistID = &id
 		}
 	}
+	filter.Key = r.URL.Query().Get("key")
+
+	for name, dest := range map[string]**float64{
+		"min_bpm":          &filter.MinBPM,
+		"max_bpm":          &filter.MaxBPM,
+		"min_energy":       &filter.MinEnergy,
+		"max_energy":       &filter.MaxEnergy,
+		"min_danceability": &filter.MinDanceability,
+	} {
+		value, err := parseFloatParam(r.URL.Query(), name)
+		if err != nil {
+			http.Error(w, "Invalid "+name, http.StatusBadRequest)
+			return
+		}
+		*dest = value
+	}
 
-	tracks, err := h.service.ListTracks(r.Context(), limit, offset, artistID)
+	tracks, err := h.service.ListTracks(r.Context(), limit, offset, filter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -115,6 +134,7 @@ func (h *Handler) handleTrack(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, track)
 }
 
+// GET /api/admin/tracks?status=failed&limit=20&offset=0 - треки по статусу (с причиной ошибки)
 // POST /api/admin/tracks - создать трек
 func (h *Handler) handleAdminTracks(w http.ResponseWriter, r *http.Request) {
 	// Простая проверка роли через header
@@ -123,6 +143,11 @@ func (h *Handler) handleAdminTracks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.Method == http.MethodGet {
+		h.listAdminTracks(w, r)
+		return
+	}
+
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -160,6 +185,7 @@ func (h *Handler) handleAdminTracks(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusCreated, track)
 }
 
+// GET /api/admin/tracks/:id - трек со статусом обработки и причиной ошибки
 // PUT /api/admin/tracks/:id - обновить трек
 // DELETE /api/admin/tracks/:id - удалить трек
 func (h *Handler) handleAdminTrack(w http.ResponseWriter, r *http.Request) {
@@ -176,6 +202,19 @@ func (h *Handler) handleAdminTrack(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	switch r.Method {
+	case http.MethodGet:
+		track, err := h.service.GetTrack(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Track not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, NewAdminTrack(track))
+
 	case http.MethodPut:
 		var req struct {
 			Title     string   `json:"title"`
@@ -228,6 +267,109 @@ func (h *Handler) handleAdminTrack(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *Handler) listAdminTracks(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case StatusUploaded, StatusProcessing, StatusReady, StatusFailed:
+	case "":
+		status = StatusFailed
+	default:
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+
+	tracks, err := h.service.ListTracksByStatus(r.Context(), status, limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	items := make([]AdminTrack, 0, len(tracks))
+	for _, track := range tracks {
+		items = append(items, NewAdminTrack(track))
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"status": status,
+		"tracks": items,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// GET /api/admin/duplicates?track_id=uuid&limit=20&offset=0 - вероятные дубликаты по акустическому отпечатку
+func (h *Handler) handleAdminDuplicates(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-User-Role") != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var trackID *uuid.UUID
+	if tid := r.URL.Query().Get("track_id"); tid != "" {
+		id, err := uuid.Parse(tid)
+		if err != nil {
+			http.Error(w, "Invalid track ID", http.StatusBadRequest)
+			return
+		}
+		trackID = &id
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+
+	duplicates, err := h.service.ListDuplicates(r.Context(), trackID, limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"duplicates": duplicates,
+		"limit":      limit,
+		"offset":     offset,
+	})
+}
+
+// GET /api/admin/suspected-transcodes?limit=20&offset=0 - треки, оригинал которых похож на lossy,
+// сохранённый как lossless (спектральная проверка транскодера), самые уверенные сверху
+func (h *Handler) handleAdminSuspectedTranscodes(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-User-Role") != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+
+	tracks, err := h.service.ListSuspectedTranscodes(r.Context(), limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	items := make([]AdminTrack, 0, len(tracks))
+	for _, track := range tracks {
+		items = append(items, NewAdminTrack(track))
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"tracks": items,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
 func (h *Handler) health(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
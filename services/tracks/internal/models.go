@@ -15,18 +15,133 @@ const (
 	StatusFailed     = "failed"
 )
 
+// statusTransitions из каких статусов можно перейти в целевой.
+// ready -> processing запрещён: повторная обработка не должна скрывать готовый трек из выдачи,
+// а ready -> failed не даёт неудачной перекодировке испортить рабочий трек.
+var statusTransitions = map[string][]string{
+	StatusProcessing: {StatusUploaded, StatusProcessing, StatusFailed},
+	StatusFailed:     {StatusUploaded, StatusProcessing, StatusFailed},
+	StatusReady:      {StatusUploaded, StatusProcessing, StatusFailed, StatusReady},
+}
+
+// maxFailureReasonLen ограничение длины причины ошибки (вывод ffmpeg может быть огромным)
+const maxFailureReasonLen = 1000
+
 // Track модель трека
 type Track struct {
-	ID        uuid.UUID   `json:"id"`
-	Title     string      `json:"title"`
-	ArtistIDs []uuid.UUID `json:"artist_ids"` // Массив ID артистов (информация об артистах хранится в artists-service)
-	Genre     string      `json:"genre,omitempty"`
-	AudioURL  string      `json:"audio_url,omitempty"`
-	CoverURL  string      `json:"cover_url,omitempty"`
-	Duration  int         `json:"duration_seconds"`
-	Status    string      `json:"status"`
-	CreatedAt time.Time   `json:"created_at"`
-	UpdatedAt time.Time   `json:"updated_at"`
+	ID            uuid.UUID   `json:"id"`
+	Title         string      `json:"title"`
+	ArtistIDs     []uuid.UUID `json:"artist_ids"` // Массив ID артистов (информация об артистах хранится в artists-service)
+	Genre         string      `json:"genre,omitempty"`
+	AudioURL      string      `json:"audio_url,omitempty"`
+	DashURL       string      `json:"dash_url,omitempty"`
+	CoverURL      string      `json:"cover_url,omitempty"`
+	WaveformURL   string      `json:"waveform_url,omitempty"` // Пики для скраббера (рядом лежит бинарный waveform.dat)
+	PreviewURL    string      `json:"preview_url,omitempty"`  // Короткий фрагмент для неавторизованных слушателей
+	Album         string      `json:"album,omitempty"`
+	TrackNumber   int         `json:"track_number,omitempty"`
+	Year          int         `json:"year,omitempty"`
+	ISRC          string      `json:"isrc,omitempty"`
+	Explicit      *bool       `json:"explicit,omitempty"`
+	TagArtists    []string    `json:"tag_artists,omitempty"`  // Имена артистов из тегов файла, для ручной сверки с ArtistIDs
+	BPM           *float64    `json:"bpm,omitempty"`          // Темп, NULL если не определён
+	Key           string      `json:"key,omitempty"`          // Тональность, например "A minor"
+	Camelot       string      `json:"camelot,omitempty"`      // Тональность в нотации Camelot, например "8A"
+	Energy        *float64    `json:"energy,omitempty"`       // 0..1
+	Danceability  *float64    `json:"danceability,omitempty"` // 0..1
+	Duration      int         `json:"duration_seconds"`
+	Status        string      `json:"status"`
+	FailureReason string      `json:"-"` // Причина последней ошибки обработки, отдаётся только в admin API
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+
+	// SourceQuality проверка оригинала на транскод, nil если не проводилась; отдаётся только в admin API
+	SourceQuality *SourceQuality `json:"-"`
+}
+
+// AdminTrack представление трека для admin API
+type AdminTrack struct {
+	*Track
+	FailureReason string         `json:"failure_reason,omitempty"`
+	SourceQuality *SourceQuality `json:"source_quality,omitempty"`
+}
+
+// NewAdminTrack добавляет к треку поля, скрытые из публичного API
+func NewAdminTrack(track *Track) AdminTrack {
+	return AdminTrack{Track: track, FailureReason: track.FailureReason, SourceQuality: track.SourceQuality}
+}
+
+// SourceQuality спектральная проверка оригинала транскодером: MP3, пересохранённый во FLAC/WAV,
+// обрывается на частоте среза lossy-кодера, а не там, где позволяет заявленный формат
+type SourceQuality struct {
+	SuspectedTranscode bool    `json:"suspected_transcode"`
+	Confidence         float64 `json:"confidence"`         // 0..1
+	CutoffHz           int     `json:"cutoff_hz"`          // Где обрывается спектр
+	ExpectedCutoffHz   int     `json:"expected_cutoff_hz"` // Где должен обрываться для заявленного кодека, 0 — неизвестно
+}
+
+// TrackInfoUpdate результаты обработки трека, которые присылает транскодер
+type TrackInfoUpdate struct {
+	CoverURL      string
+	AudioURL      string
+	DashURL       string
+	WaveformURL   string
+	PreviewURL    string
+	DurationSec   int
+	Suggested     *SuggestedMetadata // Теги из файла, заполняют только пустые поля трека
+	Analysis      *AudioAnalysis     // Темп, тональность и энергия, перезаписываются при каждой обработке
+	SourceQuality *SourceQuality     // Проверка оригинала на транскод, перезаписывается при каждой обработке
+}
+
+// AudioAnalysis результаты анализа аудио. Нулевой BPM и пустая тональность означают «не определено»
+type AudioAnalysis struct {
+	BPM          float64
+	Key          string
+	Camelot      string
+	Energy       float64
+	Danceability float64
+}
+
+// TrackFilter фильтры списка треков, nil и пустые значения не ограничивают выборку
+type TrackFilter struct {
+	ArtistID        *uuid.UUID
+	MinBPM          *float64
+	MaxBPM          *float64
+	Key             string // Название тональности ("A minor") или код Camelot ("8A")
+	MinEnergy       *float64
+	MaxEnergy       *float64
+	MinDanceability *float64
+}
+
+// SuggestedMetadata метаданные из тегов файла (ID3/Vorbis/MP4)
+type SuggestedMetadata struct {
+	Title       string
+	Artists     []string
+	Album       string
+	TrackNumber int
+	Year        int
+	ISRC        string
+	Genre       string
+	Explicit    *bool
+}
+
+// Пороги поиска дубликатов по отпечатку. У одной и той же записи совпавшие хеши
+// собираются на одном сдвиге по времени, а случайные совпадения разбросаны по разным сдвигам.
+const (
+	duplicateMinScore   = 0.1 // доля хешей нового трека, совпавших с одним сдвигом
+	duplicateMinMatches = 30  // защита от коротких треков, где доля набирается случайно
+	maxDuplicateMatches = 10
+)
+
+// TrackDuplicate трек, отпечаток которого совпал с более ранним треком
+type TrackDuplicate struct {
+	TrackID          uuid.UUID `json:"track_id"`
+	TrackTitle       string    `json:"track_title,omitempty"`
+	DuplicateOf      uuid.UUID `json:"duplicate_of"`
+	DuplicateOfTitle string    `json:"duplicate_of_title,omitempty"`
+	Score            float64   `json:"score"`          // Доля хешей, совпавших с одинаковым сдвигом
+	MatchedHashes    int       `json:"matched_hashes"` // Число таких хешей
+	CreatedAt        time.Time `json:"created_at"`
 }
 
 // Ошибки
@@ -34,4 +149,6 @@ var (
 	ErrNotFound     = errors.New("track not found")
 	ErrUnauthorized = errors.New("unauthorized")
 	ErrBadRequest   = errors.New("bad request")
+
+	ErrInvalidTransition = errors.New("invalid status transition")
 )
@@ -7,6 +7,7 @@ import (
 	"fmt"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 type Repository struct {
@@ -17,18 +18,62 @@ func NewRepository(db *sql.DB) *Repository {
 	return &Repository{db: db}
 }
 
-// GetByID получить трек по ID
-func (r *Repository) GetByID(ctx context.Context, id uuid.UUID) (*Track, error) {
-	query := `
-        SELECT id, title, genre, audio_url, cover_url,
-               duration_seconds, status, created_at, updated_at
-        FROM tracks WHERE id = $1
-    `
+// trackColumns список колонок трека, порядок совпадает со scanTrack
+const trackColumns = `t.id, t.title, t.genre, t.audio_url, t.dash_url, t.cover_url, t.waveform_url, t.preview_url,
+               t.album, t.track_number, t.release_year, t.isrc, t.explicit, t.tag_artists,
+               t.bpm, t.musical_key, t.camelot_key, t.energy, t.danceability,
+               t.suspected_transcode, t.transcode_confidence, t.spectral_cutoff_hz, t.expected_cutoff_hz,
+               t.duration_seconds, t.status, t.failure_reason, t.created_at, t.updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanTrack читает строку, выбранную через trackColumns
+func scanTrack(row rowScanner) (*Track, error) {
 	track := &Track{}
-	err := r.db.QueryRowContext(ctx, query, id).Scan(
-		&track.ID, &track.Title, &track.Genre, &track.AudioURL, &track.CoverURL,
-		&track.Duration, &track.Status, &track.CreatedAt, &track.UpdatedAt,
+	var explicit sql.NullBool
+	var bpm, energy, danceability sql.NullFloat64
+	var suspected sql.NullBool
+	var confidence sql.NullFloat64
+	var cutoff, expectedCutoff sql.NullInt64
+	err := row.Scan(
+		&track.ID, &track.Title, &track.Genre, &track.AudioURL, &track.DashURL, &track.CoverURL, &track.WaveformURL, &track.PreviewURL,
+		&track.Album, &track.TrackNumber, &track.Year, &track.ISRC, &explicit, pq.Array(&track.TagArtists),
+		&bpm, &track.Key, &track.Camelot, &energy, &danceability,
+		&suspected, &confidence, &cutoff, &expectedCutoff,
+		&track.Duration, &track.Status, &track.FailureReason, &track.CreatedAt, &track.UpdatedAt,
 	)
+	if err != nil {
+		return nil, err
+	}
+	if explicit.Valid {
+		track.Explicit = &explicit.Bool
+	}
+	if bpm.Valid {
+		track.BPM = &bpm.Float64
+	}
+	if energy.Valid {
+		track.Energy = &energy.Float64
+	}
+	if danceability.Valid {
+		track.Danceability = &danceability.Float64
+	}
+	if suspected.Valid {
+		track.SourceQuality = &SourceQuality{
+			SuspectedTranscode: suspected.Bool,
+			Confidence:         confidence.Float64,
+			CutoffHz:           int(cutoff.Int64),
+			ExpectedCutoffHz:   int(expectedCutoff.Int64),
+		}
+	}
+	return track, nil
+}
+
+// GetByID получить трек по ID
+func (r *Repository) GetByID(ctx context.Context, id uuid.UUID) (*Track, error) {
+	query := `SELECT ` + trackColumns + ` FROM tracks t WHERE t.id = $1`
+	track, err := scanTrack(r.db.QueryRowContext(ctx, query, id))
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, ErrNotFound
 	}
@@ -46,25 +91,48 @@ func (r *Repository) GetByID(ctx context.Context, id uuid.UUID) (*Track, error)
 	return track, nil
 }
 
-// List получить список треков
-func (r *Repository) List(ctx context.Context, limit, offset int, artistID *uuid.UUID) ([]*Track, error) {
-	query := `
-        SELECT t.id, t.title, t.genre, t.audio_url, t.cover_url,
-               t.duration_seconds, t.status, t.created_at, t.updated_at
-        FROM tracks t
-    `
+// List получить список треков с фильтрами по артисту, темпу, тональности и энергии
+func (r *Repository) List(ctx context.Context, limit, offset int, filter TrackFilter) ([]*Track, error) {
+	query := `SELECT ` + trackColumns + ` FROM tracks t`
 	args := []interface{}{StatusReady}
 	argPos := 2
 
-	if artistID != nil {
+	if filter.ArtistID != nil {
 		query += ` INNER JOIN track_artists ta ON t.id = ta.track_id 
 		           WHERE t.status = $1 AND ta.artist_id = $2`
-		args = append(args, *artistID)
+		args = append(args, *filter.ArtistID)
 		argPos = 3
 	} else {
 		query += ` WHERE t.status = $1`
 	}
 
+	// Треки без результатов анализа под числовые фильтры не попадают: NULL не проходит сравнение
+	addCondition := func(condition string, value interface{}) {
+		query += fmt.Sprintf(" AND "+condition, argPos)
+		args = append(args, value)
+		argPos++
+	}
+	if filter.MinBPM != nil {
+		addCondition("t.bpm >= $%d", *filter.MinBPM)
+	}
+	if filter.MaxBPM != nil {
+		addCondition("t.bpm <= $%d", *filter.MaxBPM)
+	}
+	if filter.Key != "" {
+		query += fmt.Sprintf(" AND (LOWER(t.musical_key) = LOWER($%d) OR UPPER(t.camelot_key) = UPPER($%d))", argPos, argPos)
+		args = append(args, filter.Key)
+		argPos++
+	}
+	if filter.MinEnergy != nil {
+		addCondition("t.energy >= $%d", *filter.MinEnergy)
+	}
+	if filter.MaxEnergy != nil {
+		addCondition("t.energy <= $%d", *filter.MaxEnergy)
+	}
+	if filter.MinDanceability != nil {
+		addCondition("t.danceability >= $%d", *filter.MinDanceability)
+	}
+
 	query += fmt.Sprintf(" ORDER BY t.created_at DESC LIMIT $%d OFFSET $%d", argPos, argPos+1)
 	args = append(args, limit, offset)
 
@@ -77,11 +145,7 @@ func (r *Repository) List(ctx context.Context, limit, offset int, artistID *uuid
 	var tracks []*Track
 	var trackIDs []uuid.UUID
 	for rows.Next() {
-		track := &Track{}
-		err := rows.Scan(
-			&track.ID, &track.Title, &track.Genre, &track.AudioURL, &track.CoverURL,
-			&track.Duration, &track.Status, &track.CreatedAt, &track.UpdatedAt,
-		)
+		track, err := scanTrack(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -114,9 +178,7 @@ func (r *Repository) Search(ctx context.Context, query string, limit, offset int
 	}
 
 	searchQuery := fmt.Sprintf("%%%s%%", query)
-	sqlQuery := `
-        SELECT t.id, t.title, t.genre, t.audio_url, t.cover_url,
-               t.duration_seconds, t.status, t.created_at, t.updated_at
+	sqlQuery := `SELECT ` + trackColumns + `
         FROM tracks t
         WHERE t.status = $1 AND t.title ILIKE $2
         ORDER BY t.created_at DESC
@@ -132,11 +194,7 @@ func (r *Repository) Search(ctx context.Context, query string, limit, offset int
 	var tracks []*Track
 	var trackIDs []uuid.UUID
 	for rows.Next() {
-		track := &Track{}
-		err := rows.Scan(
-			&track.ID, &track.Title, &track.Genre, &track.AudioURL, &track.CoverURL,
-			&track.Duration, &track.Status, &track.CreatedAt, &track.UpdatedAt,
-		)
+		track, err := scanTrack(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -181,14 +239,14 @@ func (r *Repository) Update(ctx context.Context, track *Track) error {
 	query := `
         UPDATE tracks SET 
             title = $1, genre = $2,
-            audio_url = $3, cover_url = $4, duration_seconds = $5,
-            status = $6, updated_at = $7
-        WHERE id = $8
+            updated_at = $3
+        WHERE id = $4
     `
+	// Статус и медиа-поля (audio_url, cover_url, duration_seconds) здесь не пишутся: их меняют только
+	// TransitionStatus и UpdateURLsAndDuration, иначе устаревшая копия трека откатила бы результат транскодера
 	result, err := r.db.ExecContext(ctx, query,
 		track.Title, track.Genre,
-		track.AudioURL, track.CoverURL, track.Duration,
-		track.Status, track.UpdatedAt, track.ID,
+		track.UpdatedAt, track.ID,
 	)
 	if err != nil {
 		return err
@@ -206,8 +264,8 @@ func (r *Repository) Update(ctx context.Context, track *Track) error {
 	return r.CreateTrackArtists(ctx, track.ID, track.ArtistIDs)
 }
 
-// UpdateURLs обновить только URLs трека (cover_url, audio_url, duration) без изменения других полей
-func (r *Repository) UpdateURLsAndDuration(ctx context.Context, trackID uuid.UUID, coverURL, audioURL string, durationSec int) error {
+// UpdateURLsAndDuration обновить только URLs трека (cover_url, audio_url, dash_url, waveform_url, preview_url, duration) без изменения других полей
+func (r *Repository) UpdateURLsAndDuration(ctx context.Context, trackID uuid.UUID, info TrackInfoUpdate) error {
 	// Дефолтная обложка для всех треков
 	const defaultCoverURL = "https://mir-s3-cdn-cf.behance.net/projects/202/e2ba0e187042211.Y3JvcCw4MDgsNjMyLDAsMA.png"
 
@@ -216,11 +274,12 @@ func (r *Repository) UpdateURLsAndDuration(ctx context.Context, trackID uuid.UUI
 	args := []interface{}{}
 	argPos := 1
 
-	if len(audioURL) == 0 {
+	if len(info.AudioURL) == 0 {
 		return ErrBadRequest
 	}
 
-	// Используем дефолтную обложку, если не указана
+	// Используем дефолтную обложку, только если транскодер не нашёл встроенную в файле
+	coverURL := info.CoverURL
 	if len(coverURL) == 0 {
 		coverURL = defaultCoverURL
 	}
@@ -230,14 +289,83 @@ func (r *Repository) UpdateURLsAndDuration(ctx context.Context, trackID uuid.UUI
 	argPos++
 
 	query += fmt.Sprintf(", audio_url = $%d", argPos)
-	args = append(args, audioURL)
+	args = append(args, info.AudioURL)
+	argPos++
+
+	// DASH манифест перезаписывается всегда: у зашифрованных треков его нет, и старая ссылка
+	// указывала бы на манифест, который транскодер удалил
+	query += fmt.Sprintf(", dash_url = $%d", argPos)
+	args = append(args, info.DashURL)
 	argPos++
 
+	if len(info.WaveformURL) > 0 {
+		query += fmt.Sprintf(", waveform_url = $%d", argPos)
+		args = append(args, info.WaveformURL)
+		argPos++
+	}
+
+	if len(info.PreviewURL) > 0 {
+		query += fmt.Sprintf(", preview_url = $%d", argPos)
+		args = append(args, info.PreviewURL)
+		argPos++
+	}
+
 	query += fmt.Sprintf(", duration_seconds = $%d", argPos)
-	args = append(args, durationSec)
+	args = append(args, info.DurationSec)
 	argPos++
 
-	// Обновляем статус на ready после успешного транскодирования
+	// Теги из файла только дополняют трек: значения, которые указал загрузивший, не перезаписываются
+	if sm := info.Suggested; sm != nil {
+		fillEmpty := func(column, emptyValue string, value interface{}) {
+			query += fmt.Sprintf(", %s = COALESCE(NULLIF(%s, %s), $%d)", column, column, emptyValue, argPos)
+			args = append(args, value)
+			argPos++
+		}
+		if sm.Title != "" {
+			fillEmpty("title", "''", sm.Title)
+		}
+		if sm.Genre != "" {
+			fillEmpty("genre", "''", sm.Genre)
+		}
+		if sm.Album != "" {
+			fillEmpty("album", "''", sm.Album)
+		}
+		if sm.TrackNumber > 0 {
+			fillEmpty("track_number", "0", sm.TrackNumber)
+		}
+		if sm.Year > 0 {
+			fillEmpty("release_year", "0", sm.Year)
+		}
+		if sm.ISRC != "" {
+			fillEmpty("isrc", "''", sm.ISRC)
+		}
+		if len(sm.Artists) > 0 {
+			fillEmpty("tag_artists", "'{}'", pq.Array(sm.Artists))
+		}
+		if sm.Explicit != nil {
+			query += fmt.Sprintf(", explicit = COALESCE(explicit, $%d)", argPos)
+			args = append(args, *sm.Explicit)
+			argPos++
+		}
+	}
+
+	// Анализ пересчитывается при каждой обработке, поэтому перезаписывает прежние значения
+	if a := info.Analysis; a != nil {
+		query += fmt.Sprintf(", bpm = NULLIF($%d::real, 0), musical_key = $%d, camelot_key = $%d, energy = $%d, danceability = $%d",
+			argPos, argPos+1, argPos+2, argPos+3, argPos+4)
+		args = append(args, a.BPM, a.Key, a.Camelot, a.Energy, a.Danceability)
+		argPos += 5
+	}
+
+	if q := info.SourceQuality; q != nil {
+		query += fmt.Sprintf(", suspected_transcode = $%d, transcode_confidence = $%d, spectral_cutoff_hz = $%d, expected_cutoff_hz = $%d",
+			argPos, argPos+1, argPos+2, argPos+3)
+		args = append(args, q.SuspectedTranscode, q.Confidence, q.CutoffHz, q.ExpectedCutoffHz)
+		argPos += 4
+	}
+
+	// Обновляем статус на ready после успешного транскодирования, причина прошлой ошибки больше не актуальна
+	query += ", failure_reason = ''"
 	query += fmt.Sprintf(", status = $%d", argPos)
 	args = append(args, StatusReady)
 	argPos++
@@ -247,20 +375,15 @@ func (r *Repository) UpdateURLsAndDuration(ctx context.Context, trackID uuid.UUI
 		return ErrBadRequest
 	}
 
-	query += fmt.Sprintf(" WHERE id = $%d", argPos)
-	args = append(args, trackID)
+	// Переход в ready проверяется тем же UPDATE, что и в TransitionStatus
+	query += fmt.Sprintf(" WHERE id = $%d AND status = ANY($%d)", argPos, argPos+1)
+	args = append(args, trackID, pq.Array(statusTransitions[StatusReady]))
 
 	result, err := r.db.ExecContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
-
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		return ErrNotFound
-	}
-
-	return nil
+	return r.checkTransition(ctx, result, trackID)
 }
 
 // Delete удалить трек
@@ -278,19 +401,131 @@ func (r *Repository) Delete(ctx context.Context, id uuid.UUID) error {
 	return nil
 }
 
-// UpdateStatus обновить статус
+// DeleteUploaded удалить трек, если он ещё в статусе uploaded; иначе ErrInvalidTransition.
+// Условие проверяется в самом DELETE, поэтому трек, который уже взял транскодер, не удаляется
+func (r *Repository) DeleteUploaded(ctx context.Context, id uuid.UUID) error {
+	result, err := r.db.ExecContext(ctx, `DELETE FROM tracks WHERE id = $1 AND status = $2`, id, StatusUploaded)
+	if err != nil {
+		return err
+	}
+	return r.checkTransition(ctx, result, id)
+}
+
+// UpdateStatus обновить статус без причины ошибки; правила переходов те же, что у TransitionStatus
 func (r *Repository) UpdateStatus(ctx context.Context, id uuid.UUID, status string) error {
-	query := `UPDATE tracks SET status = $1, updated_at = NOW() WHERE id = $2`
-	result, err := r.db.ExecContext(ctx, query, status, id)
+	return r.TransitionStatus(ctx, id, status, "")
+}
+
+// TransitionStatus сменить статус, если переход допустим из текущего статуса.
+// Проверка и запись делаются одним UPDATE, поэтому параллельные вызовы не обходят правила.
+func (r *Repository) TransitionStatus(ctx context.Context, id uuid.UUID, status, failureReason string) error {
+	allowed, ok := statusTransitions[status]
+	if !ok {
+		return ErrInvalidTransition
+	}
+
+	query := `
+        UPDATE tracks SET status = $1, failure_reason = $2, updated_at = NOW()
+        WHERE id = $3 AND status = ANY($4)
+    `
+	result, err := r.db.ExecContext(ctx, query, status, failureReason, id, pq.Array(allowed))
 	if err != nil {
 		return err
 	}
+	return r.checkTransition(ctx, result, id)
+}
 
+// checkTransition разбирает результат UPDATE со сменой статуса
+func (r *Repository) checkTransition(ctx context.Context, result sql.Result, id uuid.UUID) error {
 	rows, _ := result.RowsAffected()
-	if rows == 0 {
+	if rows > 0 {
+		return nil
+	}
+
+	// Ничего не обновилось: либо трека нет, либо переход из текущего статуса запрещён
+	var exists bool
+	if err := r.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM tracks WHERE id = $1)`, id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
 		return ErrNotFound
 	}
-	return nil
+	return ErrInvalidTransition
+}
+
+// ListByStatus получить треки с указанным статусом (для admin API), новые сверху
+func (r *Repository) ListByStatus(ctx context.Context, status string, limit, offset int) ([]*Track, error) {
+	query := `SELECT ` + trackColumns + ` FROM tracks t
+        WHERE t.status = $1
+        ORDER BY t.updated_at DESC
+        LIMIT $2 OFFSET $3`
+	rows, err := r.db.QueryContext(ctx, query, status, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tracks []*Track
+	var trackIDs []uuid.UUID
+	for rows.Next() {
+		track, err := scanTrack(rows)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, track)
+		trackIDs = append(trackIDs, track.ID)
+	}
+
+	// Batch загрузка ID артистов для всех треков
+	if len(trackIDs) > 0 {
+		artistIDsMap, err := r.GetTracksArtistIDs(ctx, trackIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, track := range tracks {
+			track.ArtistIDs = artistIDsMap[track.ID]
+		}
+	}
+
+	return tracks, nil
+}
+
+// ListSuspectedTranscodes получить треки, оригинал которых похож на транскод из lossy (для admin API),
+// самые уверенные сверху
+func (r *Repository) ListSuspectedTranscodes(ctx context.Context, limit, offset int) ([]*Track, error) {
+	query := `SELECT ` + trackColumns + ` FROM tracks t
+        WHERE t.suspected_transcode
+        ORDER BY t.transcode_confidence DESC, t.updated_at DESC
+        LIMIT $1 OFFSET $2`
+	rows, err := r.db.QueryContext(ctx, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tracks []*Track
+	var trackIDs []uuid.UUID
+	for rows.Next() {
+		track, err := scanTrack(rows)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, track)
+		trackIDs = append(trackIDs, track.ID)
+	}
+
+	// Batch загрузка ID артистов для всех треков
+	if len(trackIDs) > 0 {
+		artistIDsMap, err := r.GetTracksArtistIDs(ctx, trackIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, track := range tracks {
+			track.ArtistIDs = artistIDsMap[track.ID]
+		}
+	}
+
+	return tracks, nil
 }
 
 // GetTracksArtistIDs получить ID артистов для нескольких треков (batch загрузка)
@@ -384,3 +619,121 @@ func (r *Repository) DeleteTrackArtists(ctx context.Context, trackID uuid.UUID)
 	_, err := r.db.ExecContext(ctx, query, trackID)
 	return err
 }
+
+// ReplaceFingerprint заменить отпечаток трека: при повторной обработке старые хеши удаляются
+func (r *Repository) ReplaceFingerprint(ctx context.Context, trackID uuid.UUID, hashes, offsets []int64) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM track_fingerprints WHERE track_id = $1`, trackID); err != nil {
+		return err
+	}
+	query := `
+        INSERT INTO track_fingerprints (track_id, hash, frame_offset)
+        SELECT $1, f.hash, f.frame_offset FROM unnest($2::int[], $3::int[]) AS f(hash, frame_offset)
+    `
+	if _, err := tx.ExecContext(ctx, query, trackID, pq.Int64Array(hashes), pq.Int64Array(offsets)); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" { // foreign_key_violation
+			return ErrNotFound
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// FindFingerprintMatches найти более ранние треки с общими хешами.
+// Для каждого трека берётся лучший сдвиг по времени: у одной записи совпадения выстраиваются
+// на одной диагонали, поэтому считается число хешей с одинаковой разницей frame_offset.
+func (r *Repository) FindFingerprintMatches(ctx context.Context, trackID uuid.UUID, minMatches, limit int) ([]TrackDuplicate, error) {
+	query := `
+        WITH aligned AS (
+            SELECT f.track_id, f.frame_offset - q.frame_offset AS delta, COUNT(*) AS hits
+            FROM track_fingerprints q
+            INNER JOIN track_fingerprints f ON f.hash = q.hash AND f.track_id <> q.track_id
+            INNER JOIN tracks t ON t.id = f.track_id
+            WHERE q.track_id = $1
+              AND t.created_at < (SELECT created_at FROM tracks WHERE id = $1)
+            GROUP BY f.track_id, delta
+        )
+        SELECT track_id, MAX(hits) AS best
+        FROM aligned
+        GROUP BY track_id
+        HAVING MAX(hits) >= $2
+        ORDER BY best DESC
+        LIMIT $3
+    `
+	rows, err := r.db.QueryContext(ctx, query, trackID, minMatches, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []TrackDuplicate
+	for rows.Next() {
+		match := TrackDuplicate{TrackID: trackID}
+		if err := rows.Scan(&match.DuplicateOf, &match.MatchedHashes); err != nil {
+			return nil, err
+		}
+		matches = append(matches, match)
+	}
+	return matches, rows.Err()
+}
+
+// ReplaceDuplicates сохранить найденные дубликаты трека вместо прежних
+func (r *Repository) ReplaceDuplicates(ctx context.Context, trackID uuid.UUID, duplicates []TrackDuplicate) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM track_duplicates WHERE track_id = $1`, trackID); err != nil {
+		return err
+	}
+	for _, d := range duplicates {
+		_, err := tx.ExecContext(ctx, `
+            INSERT INTO track_duplicates (track_id, duplicate_of, score, matched_hashes)
+            VALUES ($1, $2, $3, $4)
+        `, trackID, d.DuplicateOf, d.Score, d.MatchedHashes)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListDuplicates получить вероятные дубликаты (для admin API), новые сверху.
+// Если передан trackID, возвращаются пары, где трек стоит с любой стороны.
+func (r *Repository) ListDuplicates(ctx context.Context, trackID *uuid.UUID, limit, offset int) ([]TrackDuplicate, error) {
+	query := `
+        SELECT d.track_id, t.title, d.duplicate_of, o.title, d.score, d.matched_hashes, d.created_at
+        FROM track_duplicates d
+        INNER JOIN tracks t ON t.id = d.track_id
+        INNER JOIN tracks o ON o.id = d.duplicate_of`
+	args := []interface{}{limit, offset}
+	if trackID != nil {
+		query += ` WHERE d.track_id = $3 OR d.duplicate_of = $3`
+		args = append(args, *trackID)
+	}
+	query += ` ORDER BY d.created_at DESC, d.score DESC LIMIT $1 OFFSET $2`
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	duplicates := []TrackDuplicate{}
+	for rows.Next() {
+		var d TrackDuplicate
+		if err := rows.Scan(&d.TrackID, &d.TrackTitle, &d.DuplicateOf, &d.DuplicateOfTitle, &d.Score, &d.MatchedHashes, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		duplicates = append(duplicates, d)
+	}
+	return duplicates, rows.Err()
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"context"
+	"log"
 	"time"
 
 	"github.com/google/uuid"
@@ -21,20 +22,20 @@ func (s *Service) GetTrack(ctx context.Context, id uuid.UUID) (*Track, error) {
 }
 
 // ListTracks список треков
-func (s *Service) ListTracks(ctx context.Context, limit, offset int, artistID *uuid.UUID) ([]*Track, error) {
+func (s *Service) ListTracks(ctx context.Context, limit, offset int, filter TrackFilter) ([]*Track, error) {
 	if limit <= 0 || limit > 100 {
 		limit = 20
 	}
 	if offset < 0 {
 		offset = 0
 	}
-	return s.repo.List(ctx, limit, offset, artistID)
+	return s.repo.List(ctx, limit, offset, filter)
 }
 
 // SearchTracks поиск треков по названию
 func (s *Service) SearchTracks(ctx context.Context, query string, limit, offset int) ([]*Track, error) {
 	if query == "" {
-		return s.ListTracks(ctx, limit, offset, nil)
+		return s.ListTracks(ctx, limit, offset, TrackFilter{})
 	}
 	if limit <= 0 || limit > 100 {
 		limit = 20
@@ -106,8 +107,98 @@ func (s *Service) DeleteTrack(ctx context.Context, id uuid.UUID) error {
 	return s.repo.Delete(ctx, id)
 }
 
-// UpdateTrackURLs обновить URLs трека (cover_url, audio_url, duration_sec)
-func (s *Service) UpdateTrackURLsAndDuration(ctx context.Context, trackID uuid.UUID, coverURL, audioURL string, durationSec int) error {
+// DeleteUploadedTrack удалить трек, для которого не удалось загрузить оригинал (вызывает Upload Service)
+func (s *Service) DeleteUploadedTrack(ctx context.Context, id uuid.UUID) error {
+	return s.repo.DeleteUploaded(ctx, id)
+}
+
+// UpdateTrackURLsAndDuration обновить URLs трека (cover_url, audio_url, dash_url, duration_sec)
+func (s *Service) UpdateTrackURLsAndDuration(ctx context.Context, trackID uuid.UUID, info TrackInfoUpdate) error {
 	// Используем специальный метод для обновления только URLs
-	return s.repo.UpdateURLsAndDuration(ctx, trackID, coverURL, audioURL, durationSec)
+	return s.repo.UpdateURLsAndDuration(ctx, trackID, info)
+}
+
+// UpdateTrackStatus сменить статус обработки трека (вызывает транскодер)
+func (s *Service) UpdateTrackStatus(ctx context.Context, trackID uuid.UUID, status, failureReason string) error {
+	if status != StatusFailed {
+		failureReason = ""
+	}
+	if r := []rune(failureReason); len(r) > maxFailureReasonLen {
+		failureReason = string(r[:maxFailureReasonLen])
+	}
+	return s.repo.TransitionStatus(ctx, trackID, status, failureReason)
+}
+
+// ListTracksByStatus список треков по статусу (admin)
+func (s *Service) ListTracksByStatus(ctx context.Context, status string, limit, offset int) ([]*Track, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return s.repo.ListByStatus(ctx, status, limit, offset)
+}
+
+// StoreFingerprint сохранить отпечаток трека и отметить его как вероятный дубликат,
+// если он совпал с более ранним треком (вызывает транскодер)
+func (s *Service) StoreFingerprint(ctx context.Context, trackID uuid.UUID, hashes, offsets []uint32) ([]TrackDuplicate, error) {
+	if len(hashes) != len(offsets) {
+		return nil, ErrBadRequest
+	}
+
+	h := make([]int64, len(hashes))
+	o := make([]int64, len(offsets))
+	for i := range hashes {
+		// hash хранится в INTEGER: uint32 переносится в int32 без потери битов
+		h[i], o[i] = int64(int32(hashes[i])), int64(offsets[i])
+	}
+	if err := s.repo.ReplaceFingerprint(ctx, trackID, h, o); err != nil {
+		return nil, err
+	}
+
+	// У тишины и очень коротких треков хешей нет, сравнивать нечего
+	var duplicates []TrackDuplicate
+	if len(hashes) > 0 {
+		matches, err := s.repo.FindFingerprintMatches(ctx, trackID, duplicateMinMatches, maxDuplicateMatches)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			m.Score = float64(m.MatchedHashes) / float64(len(hashes))
+			if m.Score >= duplicateMinScore {
+				duplicates = append(duplicates, m)
+			}
+		}
+	}
+
+	if err := s.repo.ReplaceDuplicates(ctx, trackID, duplicates); err != nil {
+		return nil, err
+	}
+	for _, d := range duplicates {
+		log.Printf("Track %s is a likely duplicate of %s (score=%.2f, matched=%d)", trackID, d.DuplicateOf, d.Score, d.MatchedHashes)
+	}
+	return duplicates, nil
+}
+
+// ListSuspectedTranscodes список треков с оригиналом, похожим на транскод из lossy (admin)
+func (s *Service) ListSuspectedTranscodes(ctx context.Context, limit, offset int) ([]*Track, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return s.repo.ListSuspectedTranscodes(ctx, limit, offset)
+}
+
+// ListDuplicates список вероятных дубликатов (admin)
+func (s *Service) ListDuplicates(ctx context.Context, trackID *uuid.UUID, limit, offset int) ([]TrackDuplicate, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return s.repo.ListDuplicates(ctx, trackID, limit, offset)
 }
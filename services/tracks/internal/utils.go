@@ -1,6 +1,9 @@
 package internal
 
 import (
+	"net/url"
+	"strconv"
+
 	"github.com/google/uuid"
 )
 
@@ -17,3 +20,15 @@ func parseUUIDs(uuidStrings []string) ([]uuid.UUID, error) {
 	return uuids, nil
 }
 
+// parseFloatParam читает необязательный числовой query-параметр, nil если он не передан
+func parseFloatParam(query url.Values, name string) (*float64, error) {
+	raw := query.Get(name)
+	if raw == "" {
+		return nil, nil
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
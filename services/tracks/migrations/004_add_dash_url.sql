@@ -0,0 +1,2 @@
+-- URL DASH манифеста (manifest.mpd), который транскодер пишет рядом с HLS master.m3u8
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS dash_url TEXT DEFAULT '';
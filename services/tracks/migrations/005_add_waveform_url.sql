@@ -0,0 +1,2 @@
+-- URL пиков волны (metadata/waveform.json), которые транскодер считает для скраббера плеера
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS waveform_url TEXT DEFAULT '';
@@ -0,0 +1,10 @@
+-- Метаданные из тегов файла (ID3/Vorbis/MP4), которые транскодер присылает как подсказки.
+-- Заполняются только если поле пустое и не было указано при загрузке.
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS album VARCHAR(255) DEFAULT '';
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS track_number INTEGER DEFAULT 0;
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS release_year INTEGER DEFAULT 0;
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS isrc VARCHAR(12) DEFAULT '';
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS explicit BOOLEAN;
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS tag_artists TEXT[] DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS idx_tracks_isrc ON tracks(isrc) WHERE isrc <> '';
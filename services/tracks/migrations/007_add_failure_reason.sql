@@ -0,0 +1,5 @@
+-- Причина последней ошибки обработки, которую присылает транскодер вместе со статусом failed.
+-- Очищается, когда трек становится ready.
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS failure_reason TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_tracks_status_updated ON tracks(status, updated_at DESC);
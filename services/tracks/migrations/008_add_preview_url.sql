@@ -0,0 +1,2 @@
+-- Плейлист 30-секундного фрагмента (<track_id>/index.m3u8 в бакете превью) для неавторизованных слушателей
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS preview_url TEXT DEFAULT '';
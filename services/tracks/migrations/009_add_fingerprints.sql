@@ -0,0 +1,23 @@
+-- Индекс акустических отпечатков: пары спектральных пиков, которые присылает транскодер.
+-- hash кодирует частоты двух пиков и расстояние между ними, frame_offset — кадр первого пика.
+CREATE TABLE IF NOT EXISTS track_fingerprints (
+    track_id UUID NOT NULL REFERENCES tracks(id) ON DELETE CASCADE,
+    hash INTEGER NOT NULL,
+    frame_offset INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_track_fingerprints_hash ON track_fingerprints(hash);
+CREATE INDEX IF NOT EXISTS idx_track_fingerprints_track ON track_fingerprints(track_id);
+
+-- Вероятные дубликаты: новый трек совпал по отпечатку с уже существующим
+CREATE TABLE IF NOT EXISTS track_duplicates (
+    track_id UUID NOT NULL REFERENCES tracks(id) ON DELETE CASCADE,
+    duplicate_of UUID NOT NULL REFERENCES tracks(id) ON DELETE CASCADE,
+    score DOUBLE PRECISION NOT NULL,
+    matched_hashes INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (track_id, duplicate_of)
+);
+
+CREATE INDEX IF NOT EXISTS idx_track_duplicates_duplicate_of ON track_duplicates(duplicate_of);
+CREATE INDEX IF NOT EXISTS idx_track_duplicates_created ON track_duplicates(created_at DESC);
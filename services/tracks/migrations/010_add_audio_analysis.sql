@@ -0,0 +1,11 @@
+-- Результаты анализа аудио от транскодера (metadata/analysis.json).
+-- NULL и пустая строка означают, что значение не удалось определить.
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS bpm REAL;
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS musical_key VARCHAR(16) NOT NULL DEFAULT '';
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS camelot_key VARCHAR(3) NOT NULL DEFAULT '';
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS energy REAL;
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS danceability REAL;
+
+-- Фильтры каталога: диапазон темпа и тональность среди готовых треков
+CREATE INDEX IF NOT EXISTS idx_tracks_ready_bpm ON tracks(bpm) WHERE status = 'ready';
+CREATE INDEX IF NOT EXISTS idx_tracks_ready_camelot ON tracks(camelot_key) WHERE status = 'ready';
@@ -0,0 +1,9 @@
+-- Спектральная проверка оригинала от транскодера (tech_meta.json, поле spectral).
+-- NULL означает, что проверка не проводилась (трек обработан до её появления).
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS suspected_transcode BOOLEAN;
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS transcode_confidence REAL;
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS spectral_cutoff_hz INTEGER;
+ALTER TABLE tracks ADD COLUMN IF NOT EXISTS expected_cutoff_hz INTEGER;
+
+-- Очередь модерации: подозрительные треки, самые уверенные сверху
+CREATE INDEX IF NOT EXISTS idx_tracks_suspected_transcode ON tracks(transcode_confidence DESC) WHERE suspected_transcode;
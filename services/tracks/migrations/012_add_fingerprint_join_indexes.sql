@@ -0,0 +1,9 @@
+-- Поиск дубликатов соединяет track_fingerprints саму с собой по hash. Составные индексы
+-- содержат все колонки соединения, поэтому обе стороны читаются index-only scan:
+-- (track_id, hash, frame_offset) — хеши нового трека, (hash, track_id, frame_offset) — их совпадения.
+CREATE INDEX IF NOT EXISTS idx_track_fingerprints_track_hash ON track_fingerprints(track_id, hash, frame_offset);
+CREATE INDEX IF NOT EXISTS idx_track_fingerprints_hash_track ON track_fingerprints(hash, track_id, frame_offset);
+
+-- Одиночные индексы покрываются составными по первой колонке
+DROP INDEX IF EXISTS idx_track_fingerprints_hash;
+DROP INDEX IF EXISTS idx_track_fingerprints_track;
@@ -3,26 +3,44 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/MusicSocial/transcoder/internal/admin"
 	"github.com/MusicSocial/transcoder/internal/broker"
 	"github.com/MusicSocial/transcoder/internal/config"
+	"github.com/MusicSocial/transcoder/internal/history"
+	"github.com/MusicSocial/transcoder/internal/retranscode"
 	"github.com/MusicSocial/transcoder/internal/storage"
 	"github.com/MusicSocial/transcoder/internal/tracks"
 	"github.com/MusicSocial/transcoder/internal/transcoder"
 )
 
 func main() {
-	cfg := config.Load()
-
 	logger := log.New(os.Stdout, "[transcoder] ", log.LstdFlags|log.Lmicroseconds)
 
-	minioClient, err := storage.NewMinIO(cfg.MinIO)
+	cfg, err := config.Load()
+	if err != nil {
+		logger.Fatalf("failed to load config: %v", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "replay-dlq" {
+		runReplay(cfg, os.Args[2:], logger)
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "retranscode" {
+		runRetranscode(cfg, os.Args[2:], logger)
+		return
+	}
+
+	store, err := newStorage(cfg)
 	if err != nil {
-		logger.Fatalf("failed to init minio client: %v", err)
+		logger.Fatalf("failed to init storage: %v", err)
 	}
 
 	trackClient, err := tracks.NewTrackClient(&cfg.TrackService)
@@ -35,9 +53,18 @@ func main() {
 		}
 	}()
 
-	worker := transcoder.NewFFmpegTranscoder(minioClient, trackClient, cfg.WorkDir, logger)
+	worker := transcoder.NewFFmpegTranscoder(store, storage.NewPublicURLs(cfg.Storage.PublicBaseURL), trackClient, transcoder.ExecRunner{}, cfg.Transcoding, cfg.Workers, cfg.WorkDir, logger)
+	if err := worker.CheckEncoders(context.Background()); err != nil {
+		logger.Fatalf("ffmpeg cannot encode the configured ladder: %v", err)
+	}
+
+	jobs, err := history.Open(cfg.Admin.HistoryFile, cfg.Admin.HistorySize, logger)
+	if err != nil {
+		logger.Fatalf("failed to open job history: %v", err)
+	}
+	defer jobs.Close()
 
-	consumer, err := broker.NewConsumer(cfg.Kafka, worker, logger)
+	consumer, err := broker.NewConsumer(cfg.Kafka, cfg.Workers, worker, trackClient, jobs, logger)
 	if err != nil {
 		logger.Fatalf("failed to create consumer: %v", err)
 	}
@@ -47,10 +74,28 @@ func main() {
 		}
 	}()
 
+	if cfg.Admin.Addr != "" {
+		adminServer := admin.NewServer(cfg.Admin.Addr, cfg.Admin.Token, jobs, consumer.Ready, logger)
+		adminServer.Start()
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := adminServer.Shutdown(ctx); err != nil {
+				logger.Printf("failed to stop admin server: %v", err)
+			}
+		}()
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
+	go func() {
+		// the first signal starts the drain; restoring the default handlers lets a second one kill the process
+		<-ctx.Done()
+		stop()
+	}()
 
-	logger.Printf("starting consumer (topic=%s, group=%s)", cfg.Kafka.Topic, cfg.Kafka.GroupID)
+	logger.Printf("starting consumer (topic=%s, group=%s, workers=%d, variant_parallelism=%d, instance=%s)",
+		cfg.Kafka.Topic, cfg.Kafka.GroupID, cfg.Workers.Count, cfg.Workers.VariantParallelism, cfg.Workers.InstanceID)
 
 	if err := consumer.Start(ctx); err != nil && !errors.Is(err, context.Canceled) {
 		logger.Fatalf("consumer stopped with error: %v", err)
@@ -58,3 +103,117 @@ func main() {
 
 	logger.Println("consumer stopped")
 }
+
+func newStorage(cfg config.Config) (storage.Storage, error) {
+	if cfg.Storage.Backend == "local" {
+		return storage.NewLocal(cfg.Storage.LocalDir, cfg.MinIO.BucketName), nil
+	}
+	return storage.NewMinIO(cfg.MinIO)
+}
+
+// runReplay moves dead-lettered tasks back onto the work topic: transcoder replay-dlq [-limit N]
+func runReplay(cfg config.Config, args []string, logger *log.Logger) {
+	fs := flag.NewFlagSet("replay-dlq", flag.ExitOnError)
+	limit := fs.Int("limit", 0, "maximum number of tasks to replay (0 = all)")
+	idle := fs.Duration("idle-timeout", 10*time.Second, "stop after the dead-letter topic has been idle this long")
+	_ = fs.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	logger.Printf("replaying %s -> %s", cfg.Kafka.DeadLetterTopic, cfg.Kafka.Topic)
+	replayed, err := broker.ReplayDeadLetters(ctx, cfg.Kafka, broker.ReplayOptions{Limit: *limit, IdleTimeout: *idle}, logger)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		logger.Fatalf("replay stopped after %d task(s): %v", replayed, err)
+	}
+	logger.Printf("replayed %d task(s)", replayed)
+}
+
+// runRetranscode enqueues catalog tracks again, e.g. after a ladder change:
+// transcoder retranscode [-source storage|tracks] [-artist ID] [-genre G] [-since D] [-until D] [-dry-run] ...
+func runRetranscode(cfg config.Config, args []string, logger *log.Logger) {
+	fs := flag.NewFlagSet("retranscode", flag.ExitOnError)
+	source := fs.String("source", retranscode.SourceStorage, "where to list tracks: storage (original/ objects) or tracks (Track Service)")
+	artist := fs.String("artist", "", "only tracks of this artist ID")
+	genre := fs.String("genre", "", "only tracks of this genre (tracks source only)")
+	since := fs.String("since", "", "only tracks created at or after this date (2006-01-02 or RFC 3339)")
+	until := fs.String("until", "", "only tracks created before this date (2006-01-02 or RFC 3339)")
+	profile := fs.String("profile", "", "ladder profile for the tasks (empty = default)")
+	force := fs.Bool("force", false, "reprocess even if the outputs are up to date")
+	rate := fs.Float64("rate", 5, "maximum tasks per second (0 = unlimited)")
+	limit := fs.Int("limit", 0, "maximum number of tasks to enqueue (0 = all)")
+	dryRun := fs.Bool("dry-run", false, "log the tasks instead of publishing them")
+	progress := fs.String("progress", "", "file recording enqueued track IDs; a rerun skips them")
+	_ = fs.Parse(args)
+
+	opts := retranscode.Options{
+		Source:       *source,
+		ArtistID:     *artist,
+		Genre:        *genre,
+		Profile:      *profile,
+		Force:        *force,
+		Rate:         *rate,
+		Limit:        *limit,
+		DryRun:       *dryRun,
+		ProgressFile: *progress,
+	}
+	var err error
+	if opts.Since, err = parseDate(*since); err != nil {
+		logger.Fatalf("invalid -since: %v", err)
+	}
+	if opts.Until, err = parseDate(*until); err != nil {
+		logger.Fatalf("invalid -until: %v", err)
+	}
+	if *profile != "" {
+		if _, ok := cfg.Transcoding.Profiles[*profile]; !ok {
+			logger.Fatalf("unknown ladder profile %q", *profile)
+		}
+	}
+
+	store, err := newStorage(cfg)
+	if err != nil {
+		logger.Fatalf("failed to init storage: %v", err)
+	}
+	var catalog retranscode.Catalog
+	if opts.Source == retranscode.SourceTracks {
+		catalog = tracks.NewCatalog(cfg.TrackService.HTTPURL)
+	}
+	var publisher retranscode.Publisher
+	if !opts.DryRun {
+		taskPublisher, err := broker.NewTaskPublisher(cfg.Kafka)
+		if err != nil {
+			logger.Fatalf("failed to create publisher: %v", err)
+		}
+		defer func() {
+			if err := taskPublisher.Close(); err != nil {
+				logger.Printf("failed to close publisher: %v", err)
+			}
+		}()
+		publisher = taskPublisher
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	logger.Printf("retranscoding from %s -> %s (dry_run=%t)", opts.Source, cfg.Kafka.Topic, opts.DryRun)
+	stats, err := retranscode.Run(ctx, opts, store, catalog, publisher, logger)
+	logger.Printf("listed=%d filtered=%d already_done=%d missing_original=%d enqueued=%d",
+		stats.Listed, stats.Filtered, stats.Done, stats.NoOriginal, stats.Enqueued)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		logger.Fatalf("retranscode stopped: %v", err)
+	}
+}
+
+func parseDate(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither 2006-01-02 nor RFC 3339", raw)
+	}
+	return t, nil
+}
@@ -0,0 +1,140 @@
+// Package admin serves the operator endpoints: health probes, Prometheus metrics and the job history.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MusicSocial/transcoder/internal/history"
+	"github.com/MusicSocial/transcoder/internal/metrics"
+)
+
+const (
+	defaultJobsLimit = 50
+	maxJobsLimit     = 500
+)
+
+// ReadinessCheck reports why the service cannot take work, or nil when it can.
+type ReadinessCheck func() error
+
+type Server struct {
+	server  *http.Server
+	history *history.Store
+	ready   ReadinessCheck
+	logger  *log.Logger
+}
+
+// NewServer builds the admin server. A non-empty token guards the job history, which exposes
+// track and artist IDs and error details; the probes and /metrics stay open for the orchestrator.
+func NewServer(addr, token string, jobs *history.Store, ready ReadinessCheck, logger *log.Logger) *Server {
+	s := &Server{history: jobs, ready: ready, logger: logger}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.handleHealth)
+	mux.HandleFunc("GET /readyz", s.handleReady)
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.Handle("GET /jobs", requireToken(token, http.HandlerFunc(s.handleJobs)))
+	mux.Handle("GET /jobs/{id}", requireToken(token, http.HandlerFunc(s.handleJob)))
+
+	s.server = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return s
+}
+
+// Start serves in the background; a server that cannot listen is logged, not fatal,
+// since transcoding does not depend on it.
+func (s *Server) Start() {
+	go func() {
+		s.logger.Printf("admin server listening on %s", s.server.Addr)
+		if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Printf("admin server stopped: %v", err)
+		}
+	}()
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if err := s.ready(); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready", "error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// handleJobs lists recent jobs, newest first: GET /jobs?track_id=&status=&limit=
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := defaultJobsLimit
+	if raw := query.Get("limit"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 1 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(v, maxJobsLimit)
+	}
+
+	jobs := s.history.List(history.Filter{
+		TrackID: query.Get("track_id"),
+		Status:  query.Get("status"),
+		Limit:   limit,
+	})
+	writeJSON(w, http.StatusOK, map[string]any{"jobs": jobs})
+}
+
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid job id")
+		return
+	}
+	job, ok := s.history.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// requireToken rejects requests without "Authorization: Bearer <token>"; an empty token lets everything through.
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "missing or invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
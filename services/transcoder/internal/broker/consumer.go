@@ -4,23 +4,48 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/MusicSocial/transcoder/internal/config"
+	"github.com/MusicSocial/transcoder/internal/history"
+	"github.com/MusicSocial/transcoder/internal/tracks"
 	"github.com/MusicSocial/transcoder/internal/transcoder"
 	"github.com/segmentio/kafka-go"
 )
 
 type Consumer struct {
 	reader     *kafka.Reader
+	deadLetter *deadLetterWriter
 	transcoder transcoder.Transcoder
+	tracks     tracks.Client
+	retry      config.RetryConfig
+	workers    int
+	drain      time.Duration
+	offsets    *offsetTracker
+	history    *history.Store
 	logger     *log.Logger
+
+	running      atomic.Bool
+	draining     atomic.Bool
+	fetchFailing atomic.Bool
 }
 
-func NewConsumer(cfg config.KafkaConfig, worker transcoder.Transcoder, logger *log.Logger) (*Consumer, error) {
+func NewConsumer(cfg config.KafkaConfig, workers config.WorkerConfig, worker transcoder.Transcoder, trackClient tracks.Client, jobs *history.Store, logger *log.Logger) (*Consumer, error) {
 	if len(cfg.Brokers) == 0 {
 		return nil, errors.New("kafka brokers not configured")
 	}
+	if cfg.DeadLetterTopic == "" {
+		return nil, errors.New("dead-letter topic not configured")
+	}
+	if workers.Count < 1 {
+		workers.Count = 1
+	}
 	reader := kafka.NewReader(kafka.ReaderConfig{
 		Brokers:        cfg.Brokers,
 		Topic:          cfg.Topic,
@@ -32,43 +57,301 @@ func NewConsumer(cfg config.KafkaConfig, worker transcoder.Transcoder, logger *l
 
 	return &Consumer{
 		reader:     reader,
+		deadLetter: newDeadLetterWriter(cfg),
 		transcoder: worker,
+		tracks:     trackClient,
+		retry:      cfg.Retry,
+		workers:    workers.Count,
+		drain:      workers.DrainTimeout,
+		offsets:    newOffsetTracker(),
+		history:    jobs,
 		logger:     logger,
 	}, nil
 }
 
+// Ready reports whether the consumer is running and the last fetch from Kafka succeeded.
+func (c *Consumer) Ready() error {
+	if c.draining.Load() {
+		return errors.New("consumer is draining")
+	}
+	if !c.running.Load() {
+		return errors.New("consumer is not running")
+	}
+	if c.fetchFailing.Load() {
+		return errors.New("failed to fetch from kafka")
+	}
+	return nil
+}
+
+// Start fetches tasks and runs up to workers of them concurrently. Offsets are committed per
+// partition only up to the oldest unfinished message, so a crash never skips an unprocessed task.
+//
+// Cancelling ctx stops fetching. Running jobs get the drain timeout to finish and be committed;
+// after that they are cancelled and left uncommitted, so they are redelivered.
 func (c *Consumer) Start(ctx context.Context) error {
+	slots := make(chan struct{}, c.workers)
+	var wg sync.WaitGroup
+
+	// jobs outlive ctx by up to the drain timeout, and their commits outlive both
+	jobCtx, cancelJobs := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelJobs()
+	commitCtx := context.WithoutCancel(ctx)
+
+	c.running.Store(true)
+	defer c.running.Store(false)
+	defer c.wait(ctx, &wg, cancelJobs)
+
+	fetchFailures := 0
 	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+
 		msg, err := c.reader.FetchMessage(ctx)
 		if err != nil {
+			<-slots
 			if errors.Is(err, context.Canceled) {
 				return nil
 			}
-			c.logger.Printf("failed to fetch message: %v", err)
+			c.fetchFailing.Store(true)
+			fetchFailures++
+			delay := c.backoff(fetchFailures)
+			c.logger.Printf("failed to fetch message, retrying in %s: %v", delay, err)
+			// an unreachable broker would otherwise be polled in a tight loop
+			if !transcoder.Sleep(ctx, nil, delay) {
+				return nil
+			}
 			continue
 		}
+		fetchFailures = 0
+		c.fetchFailing.Store(false)
+		consumerLag.WithLabelValues(strconv.Itoa(msg.Partition)).Set(float64(max(msg.HighWaterMark-msg.Offset-1, 0)))
 
-		var task transcoder.Task
-		if err := json.Unmarshal(msg.Value, &task); err != nil {
-			c.logger.Printf("failed to decode task: %v", err)
-			if commitErr := c.reader.CommitMessages(ctx, msg); commitErr != nil {
-				c.logger.Printf("failed to commit poison pill: %v", commitErr)
+		entry := c.offsets.track(msg)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if !c.handle(jobCtx, ctx.Done(), msg) {
+				return
 			}
-			continue
+			c.offsets.complete(entry, func(last kafka.Message) {
+				if err := c.reader.CommitMessages(commitCtx, last); err != nil {
+					c.logger.Printf("failed to commit offset %d (partition %d): %v", last.Offset, last.Partition, err)
+				}
+			})
+		}()
+	}
+}
+
+// wait drains the running jobs once fetching stopped and cancels whatever is still running when
+// the drain timeout expires.
+func (c *Consumer) wait(ctx context.Context, wg *sync.WaitGroup, cancelJobs context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	c.draining.Store(true)
+	defer c.draining.Store(false)
+	if ctx.Err() != nil {
+		c.logger.Printf("draining running jobs for up to %s", c.drain)
+	}
+	timer := time.NewTimer(c.drain)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+	c.logger.Printf("drain timeout of %s expired, interrupting running jobs", c.drain)
+	cancelJobs()
+	<-done
+}
+
+// handle processes one message and reports whether its offset may be committed. Closing stop
+// ends retries, so a draining consumer does not start another attempt.
+func (c *Consumer) handle(ctx context.Context, stop <-chan struct{}, msg kafka.Message) bool {
+	jobsInProgress.Inc()
+	defer jobsInProgress.Dec()
+
+	job := history.Job{Partition: msg.Partition, Offset: msg.Offset, StartedAt: time.Now().UTC()}
+	var task transcoder.Task
+	if err := json.Unmarshal(msg.Value, &task); err != nil {
+		c.logger.Printf("failed to decode task: %v", err)
+		id := c.history.Start(job)
+		letter := newDeadLetter(msg, nil, err, true, 0)
+		letter.RawPayload = msg.Value
+		if !c.publishDeadLetter(ctx, msg, letter) {
+			c.finishJob(id, job.StartedAt, history.StatusInterrupted, 0, nil, err)
+			return false
 		}
+		jobsFailed.WithLabelValues(failureInvalidPayload).Inc()
+		c.finishJob(id, job.StartedAt, history.StatusFailed, 0, nil, err)
+		return true
+	}
 
-		if err := c.transcoder.Transcode(ctx, task); err != nil {
-			c.logger.Printf("transcode failed for track_id=%s: %v", task.TrackID, err)
-			// do not commit to retry later
-			continue
+	job.TrackID, job.ArtistID, job.Profile = task.TrackID, task.ArtistID, task.Profile
+	id := c.history.Start(job)
+	c.setStatus(ctx, task.TrackID, tracks.StatusProcessing, "")
+
+	attempts, report, err := c.process(ctx, stop, task)
+	if ctx.Err() != nil || errors.Is(err, errDraining) {
+		// shutting down: leave the offset uncommitted so the task is picked up again
+		c.finishJob(id, job.StartedAt, history.StatusInterrupted, attempts, report, err)
+		return false
+	}
+	if err != nil {
+		permanent := transcoder.IsPermanent(err)
+		c.logger.Printf("transcode failed for track_id=%s after %d attempt(s) (permanent=%t), moving to dead-letter topic: %v",
+			task.TrackID, attempts, permanent, err)
+		if !c.publishDeadLetter(ctx, msg, newDeadLetter(msg, &task, err, permanent, attempts)) {
+			c.finishJob(id, job.StartedAt, history.StatusInterrupted, attempts, report, err)
+			return false
+		}
+		c.setStatus(ctx, task.TrackID, tracks.StatusFailed, err.Error())
+		if permanent {
+			jobsFailed.WithLabelValues(failurePermanent).Inc()
+		} else {
+			jobsFailed.WithLabelValues(failureRetriesExhausted).Inc()
+		}
+		c.finishJob(id, job.StartedAt, history.StatusFailed, attempts, report, err)
+		return true
+	}
+
+	status := history.StatusSucceeded
+	if report.Skipped() {
+		status = history.StatusSkipped
+	}
+	c.finishJob(id, job.StartedAt, status, attempts, report, nil)
+	return true
+}
+
+// finishJob updates the job history and, for committed tasks, the job metrics.
+func (c *Consumer) finishJob(id int64, started time.Time, status string, attempts int, report *transcoder.Report, err error) {
+	finished := time.Now().UTC()
+	elapsed := finished.Sub(started).Seconds()
+	if status != history.StatusInterrupted {
+		jobsProcessed.WithLabelValues(status).Inc()
+		jobDuration.WithLabelValues(status).Observe(elapsed)
+	}
+
+	c.history.Update(id, func(job *history.Job) {
+		job.Status = status
+		job.Attempts = attempts
+		job.FinishedAt = &finished
+		job.DurationSec = elapsed
+		job.Timings = report.Timings()
+		job.Outputs = report.Outputs()
+		if err != nil {
+			job.Error = err.Error()
+			job.Permanent = transcoder.IsPermanent(err)
+			job.Verification = transcoder.VerificationFailures(err)
+		}
+	})
+}
+
+// setStatus reports the task lifecycle to Track Service. It is best effort: a status that could
+// not be stored must not block transcoding or the commit of a dead-lettered task.
+func (c *Consumer) setStatus(ctx context.Context, trackID, status, reason string) {
+	if trackID == "" {
+		return
+	}
+	err := c.tracks.UpdateTrackStatus(ctx, trackID, status, reason)
+	switch {
+	case err == nil:
+	case tracks.IsInvalidTransition(err):
+		// a ready track being reprocessed keeps its status
+		c.logger.Printf("track_id=%s keeps its status instead of %s: %v", trackID, status, err)
+	default:
+		c.logger.Printf("failed to mark track_id=%s as %s: %v", trackID, status, err)
+	}
+}
+
+// errDraining ends the retries of a task when the consumer shuts down between attempts.
+var errDraining = errors.New("consumer is draining, task left for redelivery")
+
+// process runs the task, retrying transient failures with exponential backoff until stop is closed.
+// The returned report belongs to the last attempt.
+func (c *Consumer) process(ctx context.Context, stop <-chan struct{}, task transcoder.Task) (int, *transcoder.Report, error) {
+	for attempt := 1; ; attempt++ {
+		report := &transcoder.Report{}
+		err := c.transcoder.Transcode(ctx, task, report)
+		if err == nil || transcoder.IsPermanent(err) || attempt >= c.retry.MaxAttempts {
+			return attempt, report, err
 		}
 
-		if err := c.reader.CommitMessages(ctx, msg); err != nil {
-			c.logger.Printf("failed to commit message: %v", err)
+		delay := c.backoff(attempt)
+		c.logger.Printf("transcode attempt %d/%d failed for track_id=%s, retrying in %s: %v",
+			attempt, c.retry.MaxAttempts, task.TrackID, delay, err)
+		select {
+		case <-stop:
+			return attempt, report, fmt.Errorf("%w: %v", errDraining, err)
+		default:
 		}
+		if !transcoder.Sleep(ctx, stop, delay) {
+			if ctx.Err() != nil {
+				return attempt, report, ctx.Err()
+			}
+			return attempt, report, fmt.Errorf("%w: %v", errDraining, err)
+		}
+	}
+}
+
+// publishDeadLetter stores the letter before the source offset may be committed. Committing
+// earlier would lose the task, so publishing is retried until it succeeds; false is returned
+// only when ctx is cancelled in the meantime.
+func (c *Consumer) publishDeadLetter(ctx context.Context, msg kafka.Message, letter DeadLetter) bool {
+	for attempt := 1; ; attempt++ {
+		err := c.deadLetter.Publish(ctx, msg.Key, letter)
+		if err == nil {
+			break
+		}
+		delay := c.backoff(attempt)
+		c.logger.Printf("failed to publish dead letter (offset %d), retrying in %s: %v", msg.Offset, delay, err)
+		if !transcoder.Sleep(ctx, nil, delay) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Consumer) backoff(attempt int) time.Duration {
+	delay := c.retry.InitialBackoff
+	for i := 1; i < attempt && delay < c.retry.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if c.retry.MaxBackoff > 0 && delay > c.retry.MaxBackoff {
+		delay = c.retry.MaxBackoff
+	}
+	// up to 20% jitter so partitions that failed together do not retry in lockstep
+	if delay > 0 {
+		delay += time.Duration(rand.Int63n(int64(delay)/5 + 1))
+	}
+	return delay
+}
+
+func newDeadLetter(msg kafka.Message, task *transcoder.Task, err error, permanent bool, attempts int) DeadLetter {
+	return DeadLetter{
+		Task:         task,
+		Error:        err.Error(),
+		Permanent:    permanent,
+		Verification: transcoder.VerificationFailures(err),
+		Attempts:     attempts,
+		SourceTopic:  msg.Topic,
+		Partition:    msg.Partition,
+		Offset:       msg.Offset,
+		FailedAt:     time.Now().UTC(),
 	}
 }
 
 func (c *Consumer) Close() error {
-	return c.reader.Close()
+	readerErr := c.reader.Close()
+	if err := c.deadLetter.Close(); err != nil && readerErr == nil {
+		return err
+	}
+	return readerErr
 }
@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/MusicSocial/transcoder/internal/config"
+	"github.com/MusicSocial/transcoder/internal/transcoder"
+	"github.com/segmentio/kafka-go"
+)
+
+// DeadLetter is the envelope published to the dead-letter topic.
+type DeadLetter struct {
+	Task *transcoder.Task `json:"task,omitempty"`
+	// RawPayload keeps the original message when it could not be decoded into a Task.
+	RawPayload []byte `json:"raw_payload,omitempty"`
+	Error      string `json:"error"`
+	Permanent  bool   `json:"permanent"`
+	// Verification lists the failed output checks when the encode did not pass verification.
+	Verification []transcoder.VerificationFailure `json:"verification,omitempty"`
+	Attempts     int                              `json:"attempts"`
+	SourceTopic  string                           `json:"source_topic"`
+	Partition    int                              `json:"partition"`
+	Offset       int64                            `json:"offset"`
+	FailedAt     time.Time                        `json:"failed_at"`
+}
+
+type deadLetterWriter struct {
+	writer *kafka.Writer
+}
+
+func newDeadLetterWriter(cfg config.KafkaConfig) *deadLetterWriter {
+	return &deadLetterWriter{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Brokers...),
+			Topic:        cfg.DeadLetterTopic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		},
+	}
+}
+
+func (w *deadLetterWriter) Publish(ctx context.Context, key []byte, letter DeadLetter) error {
+	payload, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
+	}
+	return w.writer.WriteMessages(ctx, kafka.Message{Key: key, Value: payload})
+}
+
+func (w *deadLetterWriter) Close() error {
+	return w.writer.Close()
+}
+
+// ReplayOptions bounds a single replay run.
+type ReplayOptions struct {
+	// Limit stops after this many replayed tasks; zero means no limit.
+	Limit int
+	// IdleTimeout ends the replay once the topic has been quiet for this long.
+	IdleTimeout time.Duration
+}
+
+// ReplayDeadLetters moves tasks from the dead-letter topic back onto the work topic.
+// It returns the number of replayed tasks.
+func ReplayDeadLetters(ctx context.Context, cfg config.KafkaConfig, opts ReplayOptions, logger *log.Logger) (int, error) {
+	if len(cfg.Brokers) == 0 {
+		return 0, errors.New("kafka brokers not configured")
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = 10 * time.Second
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  cfg.Brokers,
+		Topic:    cfg.DeadLetterTopic,
+		GroupID:  cfg.GroupID + "-dlq-replay",
+		MinBytes: cfg.MinBytes,
+		MaxBytes: cfg.MaxBytes,
+	})
+	defer reader.Close()
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(cfg.Brokers...),
+		Topic:        cfg.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}
+	defer writer.Close()
+
+	replayed := 0
+	for opts.Limit == 0 || replayed < opts.Limit {
+		fetchCtx, cancel := context.WithTimeout(ctx, opts.IdleTimeout)
+		msg, err := reader.FetchMessage(fetchCtx)
+		cancel()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				return replayed, nil
+			}
+			return replayed, err
+		}
+
+		var letter DeadLetter
+		if err := json.Unmarshal(msg.Value, &letter); err != nil || letter.Task == nil {
+			logger.Printf("skipping dead letter at offset %d: no replayable task", msg.Offset)
+			if err := reader.CommitMessages(ctx, msg); err != nil {
+				return replayed, fmt.Errorf("failed to commit dead letter: %w", err)
+			}
+			continue
+		}
+
+		payload, err := json.Marshal(letter.Task)
+		if err != nil {
+			return replayed, fmt.Errorf("failed to marshal task: %w", err)
+		}
+		if err := writer.WriteMessages(ctx, kafka.Message{Key: []byte(letter.Task.TrackID), Value: payload}); err != nil {
+			return replayed, fmt.Errorf("failed to republish task %s: %w", letter.Task.TrackID, err)
+		}
+		if err := reader.CommitMessages(ctx, msg); err != nil {
+			return replayed, fmt.Errorf("failed to commit dead letter: %w", err)
+		}
+
+		replayed++
+		logger.Printf("replayed track_id=%s (failed after %d attempts: %s)", letter.Task.TrackID, letter.Attempts, letter.Error)
+	}
+	return replayed, nil
+}
@@ -0,0 +1,38 @@
+package broker
+
+import (
+	"github.com/MusicSocial/transcoder/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Failure reasons of transcoder_jobs_failed_total.
+const (
+	failureInvalidPayload   = "invalid_payload"
+	failurePermanent        = "permanent"
+	failureRetriesExhausted = "retries_exhausted"
+)
+
+var (
+	jobsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "transcoder_jobs_processed_total",
+		Help: "Tasks whose offset was committed, by result (succeeded, skipped or failed).",
+	}, []string{"result"})
+	jobsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "transcoder_jobs_failed_total",
+		Help: "Tasks moved to the dead-letter topic, by reason.",
+	}, []string{"reason"})
+	jobsInProgress = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "transcoder_jobs_in_progress",
+		Help: "Tasks currently being processed.",
+	})
+	jobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "transcoder_job_duration_seconds",
+		Help:    "Time from taking a task to committing it, including retries.",
+		Buckets: metrics.DefaultBuckets,
+	}, []string{"result"})
+	consumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "transcoder_consumer_lag",
+		Help: "Messages behind the partition high watermark when the last task was fetched.",
+	}, []string{"partition"})
+)
@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type inflightMessage struct {
+	msg  kafka.Message
+	done bool
+}
+
+// offsetTracker keeps messages of each partition in fetch order so that concurrent workers
+// finishing out of order only ever commit a contiguous prefix.
+type offsetTracker struct {
+	mu      sync.Mutex
+	pending map[int][]*inflightMessage
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{pending: make(map[int][]*inflightMessage)}
+}
+
+func (t *offsetTracker) track(msg kafka.Message) *inflightMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry := &inflightMessage{msg: msg}
+	t.pending[msg.Partition] = append(t.pending[msg.Partition], entry)
+	return entry
+}
+
+// complete marks entry as processed and, if that extends the finished prefix of its partition,
+// calls commit with the last message of the prefix. commit runs under the tracker lock so
+// commits of one partition never go backwards.
+func (t *offsetTracker) complete(entry *inflightMessage, commit func(kafka.Message)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry.done = true
+	queue := t.pending[entry.msg.Partition]
+	n := 0
+	for n < len(queue) && queue[n].done {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	last := queue[n-1].msg
+	t.pending[entry.msg.Partition] = queue[n:]
+	commit(last)
+}
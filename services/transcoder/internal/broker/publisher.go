@@ -0,0 +1,46 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/MusicSocial/transcoder/internal/config"
+	"github.com/MusicSocial/transcoder/internal/transcoder"
+	"github.com/segmentio/kafka-go"
+)
+
+// TaskPublisher enqueues tasks on the work topic, keyed by track so one track stays on one partition.
+type TaskPublisher struct {
+	writer *kafka.Writer
+}
+
+func NewTaskPublisher(cfg config.KafkaConfig) (*TaskPublisher, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, errors.New("kafka brokers not configured")
+	}
+	return &TaskPublisher{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Brokers...),
+			Topic:        cfg.Topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		},
+	}, nil
+}
+
+func (p *TaskPublisher) Publish(ctx context.Context, task transcoder.Task) error {
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return fmt.Errorf("failed to marshal task: %w", err)
+	}
+	if err := p.writer.WriteMessages(ctx, kafka.Message{Key: []byte(task.TrackID), Value: payload}); err != nil {
+		return fmt.Errorf("failed to publish task %s: %w", task.TrackID, err)
+	}
+	return nil
+}
+
+func (p *TaskPublisher) Close() error {
+	return p.writer.Close()
+}
@@ -1,18 +1,38 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type Config struct {
 	Kafka        KafkaConfig
+	Storage      StorageConfig
 	MinIO        MinIOConfig
 	TrackService TrackServiceConfig
+	Transcoding  TranscodingConfig
+	Workers      WorkerConfig
+	Admin        AdminConfig
 	WorkDir      string
 }
 
+// AdminConfig controls the operator HTTP server: health probes, metrics and the job history.
+type AdminConfig struct {
+	// Addr is the listen address; empty (ADMIN_ADDR=off) disables the server.
+	Addr string
+	// HistorySize is how many recent jobs are kept.
+	HistorySize int
+	// HistoryFile keeps the job history across restarts; empty (JOB_HISTORY_FILE=off) keeps it in memory only.
+	HistoryFile string
+	// Token, when set, is the bearer token /jobs requires; probes and /metrics stay open.
+	Token string
+}
+
 type KafkaConfig struct {
 	Brokers        []string
 	Topic          string
@@ -20,6 +40,46 @@ type KafkaConfig struct {
 	MinBytes       int
 	MaxBytes       int
 	CommitInterval time.Duration
+	Retry          RetryConfig
+	// DeadLetterTopic receives tasks that failed permanently or ran out of retry attempts.
+	DeadLetterTopic string
+}
+
+// RetryConfig controls in-process retries of transient transcode failures.
+type RetryConfig struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// WorkerConfig bounds how much of the host one transcoder instance uses and how it hands jobs
+// over to other instances.
+type WorkerConfig struct {
+	// Count is the number of tasks processed at the same time.
+	Count int
+	// VariantParallelism is how many variants of one task are encoded concurrently.
+	VariantParallelism int
+	// FFmpegThreads caps threads per ffmpeg encode; 0 leaves the choice to ffmpeg.
+	FFmpegThreads int
+	// DrainTimeout is how long running jobs may finish after a shutdown signal before they are cancelled.
+	DrainTimeout time.Duration
+	// InstanceID names this instance in job leases; defaults to the hostname.
+	InstanceID string
+	// LeaseTTL is how long a lease stays valid without a heartbeat.
+	LeaseTTL time.Duration
+	// HeartbeatInterval is how often a running job renews its lease.
+	HeartbeatInterval time.Duration
+}
+
+// StorageConfig selects the object store. The local backend keeps buckets as directories
+// under LocalDir, which lets the pipeline run without MinIO.
+type StorageConfig struct {
+	// Backend is minio or local.
+	Backend  string
+	LocalDir string
+	// PublicBaseURL prefixes the bucket/key of every URL reported to Track Service, e.g. the CDN host.
+	// It defaults to the MinIO endpoint; with the local backend and no base, URLs are bare bucket/key paths.
+	PublicBaseURL string
 }
 
 type MinIOConfig struct {
@@ -31,9 +91,94 @@ type MinIOConfig struct {
 
 type TrackServiceConfig struct {
 	Address string
+	// HTTPURL is the Track Service REST API, used by bulk tools to page through the catalog.
+	HTTPURL string
+}
+
+type TranscodingConfig struct {
+	DefaultProfile string
+	Profiles       map[string]LadderProfile
+	Loudness       LoudnessConfig
+	Encryption     EncryptionConfig
+	Preview        PreviewConfig
+	Silence        SilenceConfig
+	// SegmentDurationSec is the HLS target segment duration for profiles that do not set their own.
+	SegmentDurationSec float64
+	Verify             VerifyConfig
+	// Fingerprint enables acoustic fingerprinting for duplicate detection in Track Service.
+	Fingerprint bool
+}
+
+// VerifyConfig controls the checks of the encoded renditions before a track is reported ready.
+type VerifyConfig struct {
+	Enabled bool
+	// DurationToleranceSec is how far a rendition may be off the expected duration.
+	DurationToleranceSec float64
+}
+
+// SilenceConfig controls leading/trailing silence handling; tasks may override Policy.
+type SilenceConfig struct {
+	// Policy is off, record (only write the offsets to tech_meta.json) or trim.
+	Policy      string
+	ThresholdDB float64
+	// MinDurationSec is the shortest stretch treated as silence.
+	MinDurationSec float64
 }
 
-func Load() Config {
+// PreviewConfig describes the short clip served to signed-out listeners.
+type PreviewConfig struct {
+	Enabled     bool
+	DurationSec float64
+	// OffsetSec is where the clip starts; a negative value picks the loudest section automatically.
+	OffsetSec float64
+	FadeSec   float64
+	Codec     string
+	BitrateK  int
+	// Bucket holds the clips, apart from the renditions, so a preview URL never reveals the
+	// key of the full track.
+	Bucket string
+}
+
+// EncryptionConfig turns on AES-128 HLS. Keys are stored in a private bucket and served to
+// authenticated players by the gateway, never next to the segments.
+type EncryptionConfig struct {
+	// Mode is off or aes-128.
+	Mode      string
+	KeyBucket string
+	// KeyURIBase is the public key-delivery endpoint; playlists reference KeyURIBase/<track_id>/<key_id>.
+	KeyURIBase string
+}
+
+// LoudnessConfig holds the default normalization settings; tasks may override Mode and TargetLUFS.
+type LoudnessConfig struct {
+	// Mode is one of: off (measure only), loudnorm (two-pass gain correction), replaygain (write track gain).
+	Mode       string
+	TargetLUFS float64
+	TruePeak   float64
+	LRA        float64
+}
+
+// LadderProfile is a named set of HLS renditions produced for a track.
+type LadderProfile struct {
+	Name     string          `json:"name"`
+	Variants []VariantConfig `json:"variants"`
+	// SegmentMode is segments (one object per fMP4 segment, the default) or single_file
+	// (one fMP4 file per variant addressed with EXT-X-BYTERANGE).
+	SegmentMode string `json:"segment_mode,omitempty"`
+	// SegmentDurationSec overrides TranscodingConfig.SegmentDurationSec for this profile.
+	SegmentDurationSec float64 `json:"segment_duration_sec,omitempty"`
+}
+
+type VariantConfig struct {
+	Name string `json:"name"`
+	// Codec is one of: aac, he-aac, he-aac-v2, opus, flac.
+	Codec      string `json:"codec"`
+	BitrateK   int    `json:"bitrate_k"`
+	Channels   int    `json:"channels,omitempty"`
+	SampleRate int    `json:"sample_rate,omitempty"`
+}
+
+func Load() (Config, error) {
 	cfg := Config{
 		Kafka: KafkaConfig{
 			Brokers:        splitAndTrim(getEnv("KAFKA_BROKERS", "localhost:9092")),
@@ -42,6 +187,17 @@ func Load() Config {
 			MinBytes:       1,
 			MaxBytes:       10 * 1024 * 1024,
 			CommitInterval: time.Second,
+			Retry: RetryConfig{
+				MaxAttempts:    getEnvInt("TRANSCODER_MAX_ATTEMPTS", 3),
+				InitialBackoff: getEnvDuration("TRANSCODER_RETRY_BACKOFF", 5*time.Second),
+				MaxBackoff:     getEnvDuration("TRANSCODER_RETRY_MAX_BACKOFF", 2*time.Minute),
+			},
+			DeadLetterTopic: getEnv("TRANSCODER_DLQ_TOPIC", "transcoder-tasks-dlq"),
+		},
+		Storage: StorageConfig{
+			Backend:       getEnv("STORAGE_BACKEND", "minio"),
+			LocalDir:      getEnv("LOCAL_STORAGE_DIR", "/var/lib/transcoder/objects"),
+			PublicBaseURL: getEnv("PUBLIC_BASE_URL", ""),
 		},
 		MinIO: MinIOConfig{
 			Endpoint:        getEnv("MINIO_ENDPOINT", "minio:9000"),
@@ -51,11 +207,247 @@ func Load() Config {
 		},
 		TrackService: TrackServiceConfig{
 			Address: getEnv("TRACK_SERVICE_ADDR", "track-service:50052"),
+			HTTPURL: getEnv("TRACK_SERVICE_HTTP_URL", "http://tracks-service:8080"),
+		},
+		Transcoding: TranscodingConfig{
+			DefaultProfile: getEnv("TRANSCODER_DEFAULT_PROFILE", "standard"),
+			Profiles:       defaultProfiles(),
+			Loudness: LoudnessConfig{
+				Mode:       getEnv("LOUDNESS_MODE", "off"),
+				TargetLUFS: getEnvFloat("LOUDNESS_TARGET_LUFS", -14),
+				TruePeak:   getEnvFloat("LOUDNESS_TRUE_PEAK", -2),
+				LRA:        getEnvFloat("LOUDNESS_LRA", 7),
+			},
+			Preview: PreviewConfig{
+				Enabled:     getEnv("PREVIEW_ENABLED", "true") == "true",
+				DurationSec: getEnvFloat("PREVIEW_DURATION_SEC", 30),
+				OffsetSec:   getEnvFloat("PREVIEW_OFFSET_SEC", -1),
+				FadeSec:     getEnvFloat("PREVIEW_FADE_SEC", 1.5),
+				Codec:       getEnv("PREVIEW_CODEC", "aac"),
+				BitrateK:    getEnvInt("PREVIEW_BITRATE_K", 64),
+				Bucket:      getEnv("PREVIEW_BUCKET", "previews"),
+			},
+			Silence: SilenceConfig{
+				Policy:         getEnv("SILENCE_POLICY", "record"),
+				ThresholdDB:    getEnvFloat("SILENCE_THRESHOLD_DB", -50),
+				MinDurationSec: getEnvFloat("SILENCE_MIN_SEC", 0.5),
+			},
+			SegmentDurationSec: getEnvFloat("HLS_SEGMENT_SEC", 2),
+			Verify: VerifyConfig{
+				Enabled:              getEnv("VERIFY_OUTPUTS", "true") == "true",
+				DurationToleranceSec: getEnvFloat("VERIFY_DURATION_TOLERANCE_SEC", 0.5),
+			},
+			Fingerprint: getEnv("FINGERPRINT_ENABLED", "true") == "true",
+			Encryption: EncryptionConfig{
+				Mode:       getEnv("HLS_ENCRYPTION", "off"),
+				KeyBucket:  getEnv("HLS_KEY_BUCKET", "hls-keys"),
+				KeyURIBase: strings.TrimRight(getEnv("HLS_KEY_URI_BASE", "http://localhost:8080/api/v1/keys"), "/"),
+			},
+		},
+		Workers: WorkerConfig{
+			Count:              getEnvInt("TRANSCODER_WORKERS", 2),
+			VariantParallelism: getEnvInt("TRANSCODER_VARIANT_PARALLELISM", 1),
+			FFmpegThreads:      getEnvInt("TRANSCODER_FFMPEG_THREADS", 0),
+			DrainTimeout:       getEnvDuration("TRANSCODER_DRAIN_TIMEOUT", 60*time.Second),
+			InstanceID:         getEnv("TRANSCODER_INSTANCE_ID", hostname()),
+			LeaseTTL:           getEnvDuration("TRANSCODER_LEASE_TTL", 90*time.Second),
+			HeartbeatInterval:  getEnvDuration("TRANSCODER_HEARTBEAT_INTERVAL", 30*time.Second),
 		},
 		WorkDir: getEnv("TRANSCODER_WORKDIR", os.TempDir()),
 	}
+	cfg.Admin = AdminConfig{
+		Addr:        getEnv("ADMIN_ADDR", ":9090"),
+		HistorySize: getEnvInt("JOB_HISTORY_SIZE", 500),
+		HistoryFile: getEnv("JOB_HISTORY_FILE", filepath.Join(cfg.WorkDir, "job_history.json")),
+		Token:       os.Getenv("ADMIN_TOKEN"),
+	}
+	if cfg.Storage.PublicBaseURL == "" && cfg.Storage.Backend != "local" {
+		cfg.Storage.PublicBaseURL = endpointURL(cfg.MinIO.Endpoint)
+	}
+	if cfg.Admin.Addr == "off" {
+		cfg.Admin.Addr = ""
+	}
+	if cfg.Admin.HistoryFile == "off" {
+		cfg.Admin.HistoryFile = ""
+	}
+
+	if file := os.Getenv("TRANSCODER_PROFILES_FILE"); file != "" {
+		profiles, err := loadProfiles(file)
+		if err != nil {
+			return Config{}, err
+		}
+		for name, profile := range profiles {
+			cfg.Transcoding.Profiles[name] = profile
+		}
+	}
+
+	if cfg.Kafka.Retry.MaxAttempts < 1 {
+		return Config{}, fmt.Errorf("TRANSCODER_MAX_ATTEMPTS must be at least 1, got %d", cfg.Kafka.Retry.MaxAttempts)
+	}
+
+	if cfg.Admin.HistorySize < 1 {
+		return Config{}, fmt.Errorf("JOB_HISTORY_SIZE must be at least 1, got %d", cfg.Admin.HistorySize)
+	}
+
+	if cfg.Workers.Count < 1 {
+		return Config{}, fmt.Errorf("TRANSCODER_WORKERS must be at least 1, got %d", cfg.Workers.Count)
+	}
+	if cfg.Workers.VariantParallelism < 1 {
+		return Config{}, fmt.Errorf("TRANSCODER_VARIANT_PARALLELISM must be at least 1, got %d", cfg.Workers.VariantParallelism)
+	}
+	if cfg.Workers.DrainTimeout < 0 {
+		return Config{}, fmt.Errorf("TRANSCODER_DRAIN_TIMEOUT must not be negative, got %s", cfg.Workers.DrainTimeout)
+	}
+	if cfg.Workers.HeartbeatInterval <= 0 || cfg.Workers.LeaseTTL <= cfg.Workers.HeartbeatInterval {
+		return Config{}, fmt.Errorf("TRANSCODER_LEASE_TTL (%s) must exceed a positive TRANSCODER_HEARTBEAT_INTERVAL (%s)",
+			cfg.Workers.LeaseTTL, cfg.Workers.HeartbeatInterval)
+	}
+	if cfg.Workers.FFmpegThreads < 0 {
+		return Config{}, fmt.Errorf("TRANSCODER_FFMPEG_THREADS must not be negative, got %d", cfg.Workers.FFmpegThreads)
+	}
+
+	switch cfg.Storage.Backend {
+	case "minio", "local":
+	default:
+		return Config{}, fmt.Errorf("unknown storage backend %q", cfg.Storage.Backend)
+	}
+
+	switch cfg.Transcoding.Loudness.Mode {
+	case "off", "loudnorm", "replaygain":
+	default:
+		return Config{}, fmt.Errorf("unknown loudness mode %q", cfg.Transcoding.Loudness.Mode)
+	}
+
+	if preview := cfg.Transcoding.Preview; preview.Enabled {
+		if preview.DurationSec <= 0 || preview.BitrateK <= 0 {
+			return Config{}, fmt.Errorf("preview duration and bitrate must be positive")
+		}
+		if preview.FadeSec < 0 || preview.FadeSec*2 > preview.DurationSec {
+			return Config{}, fmt.Errorf("PREVIEW_FADE_SEC must be between 0 and half of the preview duration")
+		}
+		if preview.Bucket == "" || preview.Bucket == cfg.MinIO.BucketName {
+			return Config{}, fmt.Errorf("PREVIEW_BUCKET must be set and differ from the renditions bucket %q", cfg.MinIO.BucketName)
+		}
+	}
+
+	switch cfg.Transcoding.Silence.Policy {
+	case "off", "record", "trim":
+	default:
+		return Config{}, fmt.Errorf("unknown silence policy %q", cfg.Transcoding.Silence.Policy)
+	}
+	if cfg.Transcoding.Silence.ThresholdDB >= 0 || cfg.Transcoding.Silence.MinDurationSec <= 0 {
+		return Config{}, fmt.Errorf("SILENCE_THRESHOLD_DB must be negative and SILENCE_MIN_SEC positive")
+	}
+
+	switch cfg.Transcoding.Encryption.Mode {
+	case "off":
+	case "aes-128":
+		if cfg.Transcoding.Encryption.KeyBucket == cfg.MinIO.BucketName {
+			return Config{}, fmt.Errorf("HLS_KEY_BUCKET must not be the public bucket %q", cfg.MinIO.BucketName)
+		}
+	default:
+		return Config{}, fmt.Errorf("unknown HLS encryption mode %q", cfg.Transcoding.Encryption.Mode)
+	}
+
+	if d := cfg.Transcoding.SegmentDurationSec; d < 1 || d > 30 {
+		return Config{}, fmt.Errorf("HLS_SEGMENT_SEC must be between 1 and 30, got %g", d)
+	}
+	if cfg.Transcoding.Verify.DurationToleranceSec <= 0 {
+		return Config{}, fmt.Errorf("VERIFY_DURATION_TOLERANCE_SEC must be positive, got %g", cfg.Transcoding.Verify.DurationToleranceSec)
+	}
+	for name, profile := range cfg.Transcoding.Profiles {
+		switch profile.SegmentMode {
+		case "", "segments":
+		case "single_file":
+			// ffmpeg cannot encrypt a single-file variant segment by segment
+			if cfg.Transcoding.Encryption.Mode != "off" {
+				return Config{}, fmt.Errorf("ladder profile %q: single_file segments do not support HLS encryption", name)
+			}
+		default:
+			return Config{}, fmt.Errorf("ladder profile %q: unknown segment mode %q", name, profile.SegmentMode)
+		}
+		if d := profile.SegmentDurationSec; d != 0 && (d < 1 || d > 30) {
+			return Config{}, fmt.Errorf("ladder profile %q: segment duration must be between 1 and 30, got %g", name, d)
+		}
+	}
+
+	if _, ok := cfg.Transcoding.Profiles[cfg.Transcoding.DefaultProfile]; !ok {
+		return Config{}, fmt.Errorf("default ladder profile %q is not defined", cfg.Transcoding.DefaultProfile)
+	}
+
+	return cfg, nil
+}
+
+// Profile returns the ladder profile by name, falling back to the default one when name is empty.
+func (c TranscodingConfig) Profile(name string) (LadderProfile, error) {
+	if name == "" {
+		name = c.DefaultProfile
+	}
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return LadderProfile{}, fmt.Errorf("unknown ladder profile %q", name)
+	}
+	return profile, nil
+}
+
+func defaultProfiles() map[string]LadderProfile {
+	return map[string]LadderProfile{
+		"standard": {
+			Name: "standard",
+			Variants: []VariantConfig{
+				{Name: "aac_256", Codec: "aac", BitrateK: 256, Channels: 2},
+				{Name: "aac_160", Codec: "aac", BitrateK: 160, Channels: 2},
+				{Name: "aac_96", Codec: "aac", BitrateK: 96, Channels: 2},
+			},
+		},
+		"mobile": {
+			Name: "mobile",
+			Variants: []VariantConfig{
+				{Name: "opus_96", Codec: "opus", BitrateK: 96, Channels: 2, SampleRate: 48000},
+				{Name: "opus_64", Codec: "opus", BitrateK: 64, Channels: 2, SampleRate: 48000},
+				{Name: "heaac_48", Codec: "he-aac", BitrateK: 48, Channels: 2, SampleRate: 44100},
+				{Name: "heaac_v2_32", Codec: "he-aac-v2", BitrateK: 32, Channels: 2, SampleRate: 44100},
+			},
+		},
+		"premium": {
+			Name: "premium",
+			Variants: []VariantConfig{
+				{Name: "flac", Codec: "flac", BitrateK: 1411},
+				{Name: "aac_256", Codec: "aac", BitrateK: 256, Channels: 2},
+				{Name: "aac_160", Codec: "aac", BitrateK: 160, Channels: 2},
+				{Name: "aac_96", Codec: "aac", BitrateK: 96, Channels: 2},
+			},
+		},
+	}
+}
+
+func loadProfiles(file string) (map[string]LadderProfile, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ladder profiles %s: %w", file, err)
+	}
+
+	var list []LadderProfile
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse ladder profiles %s: %w", file, err)
+	}
 
-	return cfg
+	profiles := make(map[string]LadderProfile, len(list))
+	for _, profile := range list {
+		if profile.Name == "" {
+			return nil, fmt.Errorf("ladder profile without name in %s", file)
+		}
+		if len(profile.Variants) == 0 {
+			return nil, fmt.Errorf("ladder profile %q has no variants", profile.Name)
+		}
+		for _, variant := range profile.Variants {
+			if variant.Name == "" || variant.Codec == "" {
+				return nil, fmt.Errorf("ladder profile %q has a variant without name or codec", profile.Name)
+			}
+		}
+		profiles[profile.Name] = profile
+	}
+	return profiles, nil
 }
 
 func getEnv(key, fallback string) string {
@@ -65,6 +457,41 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+func getEnvFloat(key string, fallback float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			return v
+		}
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	if value := os.Getenv(key); value != "" {
+		if v, err := strconv.Atoi(value); err == nil {
+			return v
+		}
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if v, err := time.ParseDuration(value); err == nil {
+			return v
+		}
+	}
+	return fallback
+}
+
+// hostname identifies the instance in job leases; container hostnames are unique per replica.
+func hostname() string {
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
+	}
+	return "transcoder-" + strconv.Itoa(os.Getpid())
+}
+
 func splitAndTrim(value string) []string {
 	parts := strings.Split(value, ",")
 	result := make([]string, 0, len(parts))
@@ -76,3 +503,12 @@ func splitAndTrim(value string) []string {
 	}
 	return result
 }
+
+// endpointURL turns a host:port endpoint into a base URL.
+func endpointURL(endpoint string) string {
+	endpoint = strings.TrimRight(strings.TrimSpace(endpoint), "/")
+	if endpoint == "" || strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		return endpoint
+	}
+	return "http://" + endpoint
+}
@@ -0,0 +1,247 @@
+// Package history keeps a bounded log of recent jobs for the admin API, optionally mirrored
+// to a JSON file so it survives restarts. The file is rewritten at most once per flushInterval
+// rather than on every change, so a busy worker does not serialize the whole history per job step.
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/MusicSocial/transcoder/internal/transcoder"
+)
+
+// flushInterval bounds how much of the history a crash can lose.
+const flushInterval = 5 * time.Second
+
+// Job statuses.
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	// StatusSkipped means the outputs were already up to date.
+	StatusSkipped = "skipped"
+	// StatusFailed means the task was moved to the dead-letter topic.
+	StatusFailed = "failed"
+	// StatusInterrupted means the worker shut down mid-job; the task is redelivered.
+	StatusInterrupted = "interrupted"
+)
+
+type Job struct {
+	ID         int64      `json:"id"`
+	TrackID    string     `json:"track_id"`
+	ArtistID   string     `json:"artist_id,omitempty"`
+	Profile    string     `json:"profile,omitempty"`
+	Partition  int        `json:"partition"`
+	Offset     int64      `json:"offset"`
+	Status     string     `json:"status"`
+	Attempts   int        `json:"attempts"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// DurationSec covers all attempts including retry backoff.
+	DurationSec float64 `json:"duration_sec,omitempty"`
+	Error       string  `json:"error,omitempty"`
+	Permanent   bool    `json:"permanent,omitempty"`
+	// Verification lists the failed output checks of the last attempt.
+	Verification []transcoder.VerificationFailure `json:"verification,omitempty"`
+	// Timings and Outputs come from the last attempt.
+	Timings []transcoder.StageTiming `json:"timings,omitempty"`
+	Outputs *transcoder.Outputs      `json:"outputs,omitempty"`
+}
+
+// Filter narrows List; zero values match everything.
+type Filter struct {
+	TrackID string
+	Status  string
+	Limit   int
+}
+
+type Store struct {
+	mu     sync.Mutex
+	jobs   []Job // oldest first
+	nextID int64
+	size   int
+	file   string
+	logger *log.Logger
+	// dirty is set by every change and cleared when the file is written.
+	dirty bool
+
+	// writeMu keeps a flush and the final one in Close from writing the file concurrently.
+	writeMu sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Open loads the history from file when it exists. An empty file path keeps the history in memory.
+func Open(file string, size int, logger *log.Logger) (*Store, error) {
+	s := &Store{size: size, file: file, logger: logger, nextID: 1}
+	if file == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		s.startFlusher()
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job history: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.jobs); err != nil {
+		return nil, fmt.Errorf("failed to parse job history %s: %w", file, err)
+	}
+	for i := range s.jobs {
+		// the previous process died before finishing these
+		if s.jobs[i].Status == StatusRunning {
+			s.jobs[i].Status = StatusInterrupted
+		}
+		s.nextID = max(s.nextID, s.jobs[i].ID+1)
+	}
+	s.trim()
+	s.startFlusher()
+	return s, nil
+}
+
+// Close writes pending changes and stops the background flush.
+func (s *Store) Close() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.flush()
+}
+
+func (s *Store) startFlusher() {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.flush()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Start records a new running job and returns its ID.
+func (s *Store) Start(job Job) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job.ID = s.nextID
+	s.nextID++
+	job.Status = StatusRunning
+	s.jobs = append(s.jobs, job)
+	s.trim()
+	s.dirty = true
+	return job.ID
+}
+
+// Update applies fn to the job if it is still in the history.
+func (s *Store) Update(id int64, fn func(*Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		if s.jobs[i].ID == id {
+			fn(&s.jobs[i])
+			s.dirty = true
+			return
+		}
+	}
+}
+
+// List returns matching jobs, newest first.
+func (s *Store) List(filter Filter) []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := []Job{}
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		job := s.jobs[i]
+		if filter.TrackID != "" && job.TrackID != filter.TrackID {
+			continue
+		}
+		if filter.Status != "" && job.Status != filter.Status {
+			continue
+		}
+		jobs = append(jobs, job)
+		if filter.Limit > 0 && len(jobs) == filter.Limit {
+			break
+		}
+	}
+	return jobs
+}
+
+func (s *Store) Get(id int64) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, job := range s.jobs {
+		if job.ID == id {
+			return job, true
+		}
+	}
+	return Job{}, false
+}
+
+func (s *Store) trim() {
+	if extra := len(s.jobs) - s.size; extra > 0 {
+		s.jobs = append(s.jobs[:0:0], s.jobs[extra:]...)
+	}
+}
+
+// flush rewrites the file atomically when the history changed since the last write. The history
+// is a debugging aid, so a failed write is only logged and retried on the next flush; the in-memory
+// copy stays authoritative.
+func (s *Store) flush() {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(s.jobs)
+	s.dirty = false
+	s.mu.Unlock()
+
+	if err == nil {
+		err = writeFileAtomic(s.file, data)
+	}
+	if err != nil {
+		s.logger.Printf("failed to save job history to %s: %v", s.file, err)
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+}
+
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
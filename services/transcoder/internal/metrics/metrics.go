@@ -0,0 +1,18 @@
+// Package metrics exposes the Prometheus metrics of the service. Metrics are declared with promauto
+// next to the code they measure, so they land in the default registry that Handler serves together
+// with the Go runtime and process collectors.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultBuckets suit job stages that take from a fraction of a second to several minutes.
+var DefaultBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// Handler serves every registered metric.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,338 @@
+// Package retranscode re-enqueues catalog tracks, e.g. after a ladder change, at a bounded rate
+// and with progress that survives restarts.
+package retranscode
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/MusicSocial/transcoder/internal/storage"
+	"github.com/MusicSocial/transcoder/internal/tracks"
+	"github.com/MusicSocial/transcoder/internal/transcoder"
+)
+
+// Sources of the track list.
+const (
+	// SourceStorage lists <artist>/<track>/original/ objects in the bucket.
+	SourceStorage = "storage"
+	// SourceTracks pages through published tracks in Track Service.
+	SourceTracks = "tracks"
+)
+
+type Options struct {
+	Source   string
+	ArtistID string
+	// Genre matches case-insensitively and needs the tracks source; storage keys carry no genre.
+	Genre string
+	// Since (inclusive) and Until (exclusive) bound the track creation time, or the original's
+	// upload time for the storage source. Zero values are open bounds.
+	Since time.Time
+	Until time.Time
+	// Profile and Force are copied into every task.
+	Profile string
+	Force   bool
+	// Rate caps published tasks per second; zero means unlimited.
+	Rate float64
+	// Limit stops after this many tasks; zero means no limit.
+	Limit int
+	// DryRun logs the tasks instead of publishing them and leaves the progress file untouched.
+	DryRun bool
+	// ProgressFile records enqueued track IDs so an interrupted run resumes where it stopped.
+	ProgressFile string
+}
+
+type Stats struct {
+	Listed     int `json:"listed"`
+	Filtered   int `json:"filtered"`
+	Done       int `json:"already_done"`
+	NoOriginal int `json:"missing_original"`
+	Enqueued   int `json:"enqueued"`
+}
+
+type Catalog interface {
+	ListTracks(ctx context.Context, artistID string, limit, offset int) ([]tracks.CatalogTrack, error)
+}
+
+type Publisher interface {
+	Publish(ctx context.Context, task transcoder.Task) error
+}
+
+// candidate is a track with a known original, before filtering.
+type candidate struct {
+	trackID   string
+	artistID  string
+	key       string
+	createdAt time.Time
+}
+
+type run struct {
+	opts      Options
+	store     storage.Storage
+	publisher Publisher
+	logger    *log.Logger
+
+	done     map[string]bool
+	progress *os.File
+	ticker   *time.Ticker
+	stats    Stats
+}
+
+// errLimit ends listing once Options.Limit tasks were enqueued.
+var errLimit = errors.New("limit reached")
+
+// Run lists the tracks from the configured source and enqueues a task for each match.
+// catalog may be nil for the storage source.
+func Run(ctx context.Context, opts Options, store storage.Storage, catalog Catalog, publisher Publisher, logger *log.Logger) (Stats, error) {
+	switch opts.Source {
+	case SourceStorage:
+		if opts.Genre != "" {
+			return Stats{}, errors.New("genre filter requires the tracks source")
+		}
+	case SourceTracks:
+		if catalog == nil {
+			return Stats{}, errors.New("tracks source requires a catalog")
+		}
+	default:
+		return Stats{}, fmt.Errorf("unknown source %q (expected storage or tracks)", opts.Source)
+	}
+	if opts.Rate < 0 || opts.Limit < 0 {
+		return Stats{}, errors.New("rate and limit must not be negative")
+	}
+
+	r := &run{opts: opts, store: store, publisher: publisher, logger: logger}
+	var err error
+	if r.done, err = loadProgress(opts.ProgressFile); err != nil {
+		return Stats{}, err
+	}
+	if len(r.done) > 0 {
+		logger.Printf("resuming: %d track(s) already enqueued according to %s", len(r.done), opts.ProgressFile)
+	}
+	if opts.ProgressFile != "" && !opts.DryRun {
+		r.progress, err = os.OpenFile(opts.ProgressFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return Stats{}, fmt.Errorf("failed to open progress file: %w", err)
+		}
+		defer r.progress.Close()
+	}
+	if opts.Rate > 0 && !opts.DryRun {
+		r.ticker = time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+		defer r.ticker.Stop()
+	}
+
+	if opts.Source == SourceStorage {
+		err = r.fromStorage(ctx)
+	} else {
+		err = r.fromCatalog(ctx, catalog)
+	}
+	if errors.Is(err, errLimit) {
+		err = nil
+	}
+	return r.stats, err
+}
+
+// fromStorage walks <artist>/<track>/ level by level and only lists inside original/, so the
+// renditions and metadata of the catalogue, most of the bucket, are never listed.
+func (r *run) fromStorage(ctx context.Context) error {
+	bucket := r.store.Bucket()
+	listArtist := func(artistPrefix string) error {
+		return r.store.ListPrefixes(ctx, bucket, artistPrefix, func(trackPrefix string) error {
+			original, found, err := r.findOriginal(ctx, trackPrefix)
+			if err != nil || !found {
+				return err
+			}
+			r.stats.Listed++
+			return r.consider(ctx, candidate{
+				trackID:   strings.TrimSuffix(strings.TrimPrefix(trackPrefix, artistPrefix), "/"),
+				artistID:  strings.TrimSuffix(artistPrefix, "/"),
+				key:       original.Key,
+				createdAt: original.LastModified,
+			})
+		})
+	}
+	if r.opts.ArtistID != "" {
+		return listArtist(r.opts.ArtistID + "/")
+	}
+	return r.store.ListPrefixes(ctx, bucket, "", listArtist)
+}
+
+// findOriginal returns the first object right under trackPrefix/original/; anything else there
+// is a stray upload.
+func (r *run) findOriginal(ctx context.Context, trackPrefix string) (storage.ObjectInfo, bool, error) {
+	prefix := trackPrefix + "original/"
+	var original storage.ObjectInfo
+	err := r.store.ListObjects(ctx, r.store.Bucket(), prefix, func(obj storage.ObjectInfo) error {
+		name := strings.TrimPrefix(obj.Key, prefix)
+		if original.Key == "" && name != "" && !strings.Contains(name, "/") {
+			original = obj
+		}
+		return nil
+	})
+	if err != nil {
+		return storage.ObjectInfo{}, false, fmt.Errorf("failed to find original under %s: %w", trackPrefix, err)
+	}
+	return original, original.Key != "", nil
+}
+
+// fromCatalog pages newest first. Tracks published during the run shift the offsets, which can
+// only repeat already seen tracks; the done set drops those.
+func (r *run) fromCatalog(ctx context.Context, catalog Catalog) error {
+	for offset := 0; ; offset += tracks.CatalogPageSize {
+		page, err := catalog.ListTracks(ctx, r.opts.ArtistID, tracks.CatalogPageSize, offset)
+		if err != nil {
+			return err
+		}
+		for _, track := range page {
+			r.stats.Listed++
+			if !r.opts.Since.IsZero() && track.CreatedAt.Before(r.opts.Since) {
+				// everything after this is older
+				return nil
+			}
+			if r.opts.Genre != "" && !strings.EqualFold(track.Genre, r.opts.Genre) {
+				r.stats.Filtered++
+				continue
+			}
+			artistID, ok := publishedArtist(track)
+			if !ok {
+				r.stats.NoOriginal++
+				r.logger.Printf("skipping track_id=%s: audio_url %q is not a published rendition", track.ID, track.AudioURL)
+				continue
+			}
+			c := candidate{trackID: track.ID, artistID: artistID, createdAt: track.CreatedAt}
+			// only tracks that will be enqueued cost a bucket listing
+			if !r.done[c.trackID] && r.inRange(c.createdAt) {
+				original, found, err := r.findOriginal(ctx, path.Join(c.artistID, c.trackID)+"/")
+				if err != nil {
+					return err
+				}
+				if !found {
+					r.stats.NoOriginal++
+					r.logger.Printf("skipping track_id=%s: no original under %s/%s/original/", c.trackID, c.artistID, c.trackID)
+					continue
+				}
+				c.key = original.Key
+			}
+			if err := r.consider(ctx, c); err != nil {
+				return err
+			}
+		}
+		if len(page) < tracks.CatalogPageSize {
+			return nil
+		}
+	}
+}
+
+// publishedArtist returns the artist the track's objects are stored under. That is the artist
+// the upload was made by, which need not be the first of ArtistIDs once featured artists are
+// added, so it is read from the published master playlist: .../<artist>/<track>/transcoded/master.m3u8.
+func publishedArtist(track tracks.CatalogTrack) (string, bool) {
+	u, err := url.Parse(track.AudioURL)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(u.Path, "/")
+	for i := 1; i+1 < len(parts); i++ {
+		if parts[i] == track.ID && parts[i+1] == "transcoded" && parts[i-1] != "" {
+			return parts[i-1], true
+		}
+	}
+	return "", false
+}
+
+func (r *run) inRange(t time.Time) bool {
+	if !r.opts.Since.IsZero() && t.Before(r.opts.Since) {
+		return false
+	}
+	return r.opts.Until.IsZero() || t.Before(r.opts.Until)
+}
+
+// consider applies the remaining filters and enqueues the track.
+func (r *run) consider(ctx context.Context, c candidate) error {
+	if r.done[c.trackID] {
+		r.stats.Done++
+		return nil
+	}
+	if !r.inRange(c.createdAt) {
+		r.stats.Filtered++
+		return nil
+	}
+
+	task := transcoder.Task{
+		SchemaVersion:  transcoder.TaskSchemaVersion,
+		TrackID:        c.trackID,
+		ArtistID:       c.artistID,
+		Source:         &transcoder.SourceObject{Bucket: r.store.Bucket(), Key: c.key},
+		Profile:        r.opts.Profile,
+		ForceReprocess: r.opts.Force,
+	}
+	if r.opts.DryRun {
+		r.logger.Printf("dry run: would enqueue track_id=%s artist_id=%s source=%s/%s", task.TrackID, task.ArtistID, task.Source.Bucket, task.Source.Key)
+	} else {
+		if r.ticker != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-r.ticker.C:
+			}
+		}
+		if err := r.publisher.Publish(ctx, task); err != nil {
+			return err
+		}
+		if err := r.record(c.trackID); err != nil {
+			return err
+		}
+	}
+
+	r.done[c.trackID] = true
+	r.stats.Enqueued++
+	if r.stats.Enqueued%100 == 0 {
+		r.logger.Printf("enqueued %d track(s) so far", r.stats.Enqueued)
+	}
+	if r.opts.Limit > 0 && r.stats.Enqueued >= r.opts.Limit {
+		return errLimit
+	}
+	return nil
+}
+
+func (r *run) record(trackID string) error {
+	if r.progress == nil {
+		return nil
+	}
+	if _, err := fmt.Fprintln(r.progress, trackID); err != nil {
+		return fmt.Errorf("failed to record progress: %w", err)
+	}
+	return nil
+}
+
+func loadProgress(file string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	if file == "" {
+		return done, nil
+	}
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read progress file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if id := strings.TrimSpace(scanner.Text()); id != "" {
+			done[id] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read progress file: %w", err)
+	}
+	return done, nil
+}
@@ -0,0 +1,235 @@
+package retranscode
+
+import (
+	"context"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MusicSocial/transcoder/internal/storage"
+	"github.com/MusicSocial/transcoder/internal/tracks"
+	"github.com/MusicSocial/transcoder/internal/transcoder"
+)
+
+const testBucket = "tracks"
+
+// testObjects is a bucket of two artists: a published track with segments and metadata, a track
+// with a stray upload in a subdirectory of original/, a track without an original and a fresh upload.
+var testObjects = []string{
+	"artist-1/track-1/original/source.flac",
+	"artist-1/track-1/transcoded/master.m3u8",
+	"artist-1/track-1/transcoded/aac_256/chunk_00000.m4s",
+	"artist-1/track-1/transcoded/aac_256/chunk_00001.m4s",
+	"artist-1/track-1/metadata/outputs.json",
+	"artist-1/track-2/original/source.mp3",
+	"artist-1/track-2/original/retry/source.mp3",
+	"artist-2/track-3/transcoded/master.m3u8",
+	"artist-2/track-4/original/source.wav",
+}
+
+// listingStore records the prefixes ListObjects was asked for.
+type listingStore struct {
+	storage.Storage
+
+	mu       sync.Mutex
+	prefixes []string
+}
+
+func (s *listingStore) ListObjects(ctx context.Context, bucket, prefix string, fn func(storage.ObjectInfo) error) error {
+	s.mu.Lock()
+	s.prefixes = append(s.prefixes, prefix)
+	s.mu.Unlock()
+	return s.Storage.ListObjects(ctx, bucket, prefix, fn)
+}
+
+type fakePublisher struct {
+	tasks []transcoder.Task
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, task transcoder.Task) error {
+	p.tasks = append(p.tasks, task)
+	return nil
+}
+
+type fakeCatalog []tracks.CatalogTrack
+
+func (c fakeCatalog) ListTracks(ctx context.Context, artistID string, limit, offset int) ([]tracks.CatalogTrack, error) {
+	if offset >= len(c) {
+		return nil, nil
+	}
+	return c[offset:min(offset+limit, len(c))], nil
+}
+
+func newTestStore(t *testing.T) *listingStore {
+	t.Helper()
+	local := storage.NewLocal(t.TempDir(), testBucket)
+	for _, key := range testObjects {
+		if err := local.UploadBytes(context.Background(), testBucket, key, []byte("data"), ""); err != nil {
+			t.Fatalf("UploadBytes(%s) error = %v", key, err)
+		}
+	}
+	return &listingStore{Storage: local}
+}
+
+// sources returns "artist track key" per published task.
+func sources(tasks []transcoder.Task) []string {
+	var got []string
+	for _, task := range tasks {
+		got = append(got, task.ArtistID+" "+task.TrackID+" "+task.Source.Key)
+	}
+	return got
+}
+
+func TestRunFromStorage(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      Options
+		want      []string
+		wantStats Stats
+	}{
+		{
+			name: "whole bucket",
+			opts: Options{Source: SourceStorage},
+			want: []string{
+				"artist-1 track-1 artist-1/track-1/original/source.flac",
+				"artist-1 track-2 artist-1/track-2/original/source.mp3",
+				"artist-2 track-4 artist-2/track-4/original/source.wav",
+			},
+			wantStats: Stats{Listed: 3, Enqueued: 3},
+		},
+		{
+			name: "one artist",
+			opts: Options{Source: SourceStorage, ArtistID: "artist-2"},
+			want: []string{
+				"artist-2 track-4 artist-2/track-4/original/source.wav",
+			},
+			wantStats: Stats{Listed: 1, Enqueued: 1},
+		},
+		{
+			name: "limit",
+			opts: Options{Source: SourceStorage, Limit: 1},
+			want: []string{
+				"artist-1 track-1 artist-1/track-1/original/source.flac",
+			},
+			wantStats: Stats{Listed: 1, Enqueued: 1},
+		},
+		{
+			name:      "until before every upload",
+			opts:      Options{Source: SourceStorage, Until: time.Now().Add(-time.Hour)},
+			wantStats: Stats{Listed: 3, Filtered: 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			publisher := &fakePublisher{}
+			stats, err := Run(context.Background(), tt.opts, store, nil, publisher, log.New(io.Discard, "", 0))
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if got := sources(publisher.tasks); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("published %v, want %v", got, tt.want)
+			}
+			if stats != tt.wantStats {
+				t.Errorf("stats = %+v, want %+v", stats, tt.wantStats)
+			}
+			for _, prefix := range store.prefixes {
+				if !strings.HasSuffix(prefix, "/original/") {
+					t.Errorf("listed objects under %q, want only original/ prefixes", prefix)
+				}
+			}
+		})
+	}
+}
+
+func TestRunFromCatalog(t *testing.T) {
+	now := time.Now()
+	catalog := fakeCatalog{
+		// a featured artist was added in front of the uploader
+		{ID: "track-1", ArtistIDs: []string{"artist-9", "artist-1"}, Genre: "Rock", CreatedAt: now,
+			AudioURL: "https://cdn.example.com/tracks/artist-1/track-1/transcoded/master.m3u8"},
+		{ID: "track-2", ArtistIDs: []string{"artist-1"}, Genre: "jazz", CreatedAt: now.Add(-time.Minute),
+			AudioURL: "tracks/artist-1/track-2/transcoded/master.m3u8"},
+		{ID: "track-3", ArtistIDs: []string{"artist-2"}, Genre: "rock", CreatedAt: now.Add(-2 * time.Minute),
+			AudioURL: "https://cdn.example.com/tracks/artist-2/track-3/transcoded/master.m3u8"},
+		{ID: "track-4", ArtistIDs: []string{"artist-2"}, Genre: "rock", CreatedAt: now.Add(-3 * time.Minute)},
+	}
+
+	tests := []struct {
+		name      string
+		opts      Options
+		want      []string
+		wantStats Stats
+	}{
+		{
+			name: "all tracks",
+			opts: Options{Source: SourceTracks},
+			want: []string{
+				"artist-1 track-1 artist-1/track-1/original/source.flac",
+				"artist-1 track-2 artist-1/track-2/original/source.mp3",
+			},
+			// track-3 has no original and track-4 was never published
+			wantStats: Stats{Listed: 4, NoOriginal: 2, Enqueued: 2},
+		},
+		{
+			name: "genre",
+			opts: Options{Source: SourceTracks, Genre: "rock"},
+			want: []string{
+				"artist-1 track-1 artist-1/track-1/original/source.flac",
+			},
+			wantStats: Stats{Listed: 4, Filtered: 1, NoOriginal: 2, Enqueued: 1},
+		},
+		{
+			name:      "since stops at the first older track",
+			opts:      Options{Source: SourceTracks, Since: now.Add(-30 * time.Second)},
+			want:      []string{"artist-1 track-1 artist-1/track-1/original/source.flac"},
+			wantStats: Stats{Listed: 2, Enqueued: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			publisher := &fakePublisher{}
+			stats, err := Run(context.Background(), tt.opts, store, catalog, publisher, log.New(io.Discard, "", 0))
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if got := sources(publisher.tasks); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("published %v, want %v", got, tt.want)
+			}
+			if stats != tt.wantStats {
+				t.Errorf("stats = %+v, want %+v", stats, tt.wantStats)
+			}
+		})
+	}
+}
+
+func TestPublishedArtist(t *testing.T) {
+	tests := []struct {
+		name     string
+		audioURL string
+		want     string
+		wantOK   bool
+	}{
+		{name: "cdn url", audioURL: "https://cdn.example.com/tracks/artist-1/track-1/transcoded/master.m3u8", want: "artist-1", wantOK: true},
+		{name: "base with a path", audioURL: "https://example.com/media/tracks/artist-1/track-1/transcoded/master.m3u8", want: "artist-1", wantOK: true},
+		{name: "bare bucket path", audioURL: "tracks/artist-1/track-1/transcoded/master.m3u8", want: "artist-1", wantOK: true},
+		{name: "not published", audioURL: ""},
+		{name: "other track", audioURL: "https://cdn.example.com/tracks/artist-1/track-2/transcoded/master.m3u8"},
+		{name: "no artist segment", audioURL: "/track-1/transcoded/master.m3u8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := publishedArtist(tracks.CatalogTrack{ID: "track-1", AudioURL: tt.audioURL})
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("publishedArtist(%q) = (%q, %t), want (%q, %t)", tt.audioURL, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Local stores objects as files under root/<bucket>/<key>. Content types are not kept. ETags are
+// the MD5 of the content, as for single-part S3 uploads.
+type Local struct {
+	root       string
+	bucketName string
+
+	// conditional serializes conditional writes with each other; Local serves one process.
+	conditional sync.Mutex
+}
+
+func NewLocal(root, bucket string) *Local {
+	return &Local{root: root, bucketName: bucket}
+}
+
+func (l *Local) Bucket() string {
+	return l.bucketName
+}
+
+// bucketPath maps a bucket to its directory, which must be right under root:
+// "." would put it at root itself and ".." above it.
+func (l *Local) bucketPath(bucket string) (string, error) {
+	if bucket == "" || bucket == "." || bucket == ".." || strings.ContainsAny(bucket, `/\`) {
+		return "", fmt.Errorf("invalid bucket %q", bucket)
+	}
+	return filepath.Join(l.root, bucket), nil
+}
+
+func (l *Local) objectPath(bucket, objectKey string) (string, error) {
+	root, err := l.bucketPath(bucket)
+	if err != nil {
+		return "", err
+	}
+	clean := path.Clean("/" + objectKey)
+	if clean == "/" {
+		return "", fmt.Errorf("invalid object %s/%s", bucket, objectKey)
+	}
+	return filepath.Join(root, filepath.FromSlash(clean)), nil
+}
+
+func (l *Local) DownloadToFile(ctx context.Context, bucket, objectKey, destPath string) error {
+	src, err := l.objectPath(bucket, objectKey)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(destPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create directories for %s: %w", destPath, err)
+	}
+	if err := copyFile(src, destPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %s/%s", ErrObjectNotFound, bucket, objectKey)
+		}
+		return fmt.Errorf("failed to copy object %s/%s to %s: %w", bucket, objectKey, destPath, err)
+	}
+	return nil
+}
+
+func (l *Local) ReadJSON(ctx context.Context, bucket, objectKey string, v interface{}) error {
+	src, err := l.objectPath(bucket, objectKey)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %s/%s", ErrObjectNotFound, bucket, objectKey)
+		}
+		return fmt.Errorf("failed to read %s/%s: %w", bucket, objectKey, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to decode %s/%s: %w", bucket, objectKey, err)
+	}
+	return nil
+}
+
+func (l *Local) Exists(ctx context.Context, bucket, objectKey string) (bool, error) {
+	src, err := l.objectPath(bucket, objectKey)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(src); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to stat %s/%s: %w", bucket, objectKey, err)
+	}
+	return true, nil
+}
+
+func (l *Local) UploadFile(ctx context.Context, bucket, objectKey, filePath, contentType string) error {
+	dest, err := l.objectPath(bucket, objectKey)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return fmt.Errorf("failed to create directories for %s: %w", dest, err)
+	}
+	if err := copyFile(filePath, dest); err != nil {
+		return fmt.Errorf("failed to upload %s to %s: %w", filePath, objectKey, err)
+	}
+	return nil
+}
+
+func (l *Local) UploadBytes(ctx context.Context, bucket, objectKey string, data []byte, contentType string) error {
+	dest, err := l.objectPath(bucket, objectKey)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return fmt.Errorf("failed to create directories for %s: %w", dest, err)
+	}
+	// write next to the object and rename, so readers see the old or the new object whole, as in MinIO
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to upload object %s: %w", objectKey, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload object %s: %w", objectKey, err)
+	}
+	return nil
+}
+
+func (l *Local) UploadJSON(ctx context.Context, bucket, objectKey string, payload interface{}) error {
+	data, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal json for %s: %w", objectKey, err)
+	}
+	return l.UploadBytes(ctx, bucket, objectKey, data, "application/json")
+}
+
+func (l *Local) ReadJSONVersion(ctx context.Context, bucket, objectKey string, v interface{}) (string, error) {
+	l.conditional.Lock()
+	defer l.conditional.Unlock()
+
+	data, etag, err := l.readVersion(bucket, objectKey)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return "", fmt.Errorf("failed to decode %s/%s: %w", bucket, objectKey, err)
+	}
+	return etag, nil
+}
+
+func (l *Local) UploadJSONIf(ctx context.Context, bucket, objectKey string, payload interface{}, matchETag string) (string, error) {
+	data, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal json for %s: %w", objectKey, err)
+	}
+
+	l.conditional.Lock()
+	defer l.conditional.Unlock()
+
+	_, current, err := l.readVersion(bucket, objectKey)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return "", err
+	}
+	if current != matchETag {
+		return "", fmt.Errorf("%w: %s/%s", ErrPreconditionFailed, bucket, objectKey)
+	}
+	if err := l.UploadBytes(ctx, bucket, objectKey, data, "application/json"); err != nil {
+		return "", err
+	}
+	return contentETag(data), nil
+}
+
+// readVersion returns the object and its ETag; a missing object has an empty ETag.
+func (l *Local) readVersion(bucket, objectKey string) ([]byte, string, error) {
+	src, err := l.objectPath(bucket, objectKey)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, "", fmt.Errorf("%w: %s/%s", ErrObjectNotFound, bucket, objectKey)
+		}
+		return nil, "", fmt.Errorf("failed to read %s/%s: %w", bucket, objectKey, err)
+	}
+	return data, contentETag(data), nil
+}
+
+func contentETag(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (l *Local) UploadDirectory(ctx context.Context, bucket, prefix, dir string) error {
+	return filepath.WalkDir(dir, func(entryPath string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, entryPath)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path for %s: %w", entryPath, err)
+		}
+
+		objectKey := path.Join(prefix, filepath.ToSlash(rel))
+		return l.UploadFile(ctx, bucket, objectKey, entryPath, "")
+	})
+}
+
+func (l *Local) Delete(ctx context.Context, bucket, objectKey string) error {
+	dest, err := l.objectPath(bucket, objectKey)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(dest); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete %s/%s: %w", bucket, objectKey, err)
+	}
+	return nil
+}
+
+func (l *Local) ListObjects(ctx context.Context, bucket, prefix string, fn func(ObjectInfo) error) error {
+	root, err := l.bucketPath(bucket)
+	if err != nil {
+		return err
+	}
+	// only the directory holding the prefix can contain matches, so the walk starts there
+	start := filepath.Join(root, filepath.FromSlash(path.Dir(path.Clean("/"+prefix+"x"))))
+	if _, err := os.Stat(start); errors.Is(err, os.ErrNotExist) {
+		// a bucket or prefix that was never written to is empty
+		return nil
+	}
+	return filepath.WalkDir(start, func(entryPath string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, entryPath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+	})
+}
+
+func (l *Local) ListPrefixes(ctx context.Context, bucket, prefix string, fn func(prefix string) error) error {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		return fmt.Errorf("invalid prefix %s/%s: must end with a slash", bucket, prefix)
+	}
+	root, err := l.bucketPath(bucket)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(filepath.Join(root, filepath.FromSlash(path.Clean("/"+prefix))))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list %s/%s: %w", bucket, prefix, err)
+	}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			continue
+		}
+		if err := fn(prefix + entry.Name() + "/"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalObjectPath(t *testing.T) {
+	root := t.TempDir()
+	l := NewLocal(root, "tracks")
+
+	tests := []struct {
+		name    string
+		bucket  string
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{name: "nested key", bucket: "tracks", key: "a/b/original/c.flac", want: filepath.Join(root, "tracks", "a", "b", "original", "c.flac")},
+		{name: "key cannot climb out of the bucket", bucket: "tracks", key: "../../etc/passwd", want: filepath.Join(root, "tracks", "etc", "passwd")},
+		{name: "empty bucket", bucket: "", key: "a", wantErr: true},
+		{name: "current directory bucket", bucket: ".", key: "tracks/a", wantErr: true},
+		{name: "parent directory bucket", bucket: "..", key: "a", wantErr: true},
+		{name: "bucket with a slash", bucket: "tracks/a", key: "b", wantErr: true},
+		{name: "bucket with a backslash", bucket: `..\tracks`, key: "b", wantErr: true},
+		{name: "empty key", bucket: "tracks", key: "", wantErr: true},
+		{name: "key of only dots", bucket: "tracks", key: "../..", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := l.objectPath(tt.bucket, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("objectPath(%q, %q) error = %v, wantErr %t", tt.bucket, tt.key, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("objectPath(%q, %q) = %q, want %q", tt.bucket, tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalUploadJSONIf(t *testing.T) {
+	ctx := context.Background()
+	l := NewLocal(t.TempDir(), "tracks")
+
+	first, err := l.UploadJSONIf(ctx, "tracks", "lease.json", map[string]string{"job": "a"}, "")
+	if err != nil {
+		t.Fatalf("create: UploadJSONIf() error = %v", err)
+	}
+	if _, err := l.UploadJSONIf(ctx, "tracks", "lease.json", map[string]string{"job": "b"}, ""); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("second create: UploadJSONIf() error = %v, want ErrPreconditionFailed", err)
+	}
+
+	var got map[string]string
+	etag, err := l.ReadJSONVersion(ctx, "tracks", "lease.json", &got)
+	if err != nil {
+		t.Fatalf("ReadJSONVersion() error = %v", err)
+	}
+	if etag != first || got["job"] != "a" {
+		t.Fatalf("ReadJSONVersion() = %v, %q, want job a, %q", got, etag, first)
+	}
+
+	second, err := l.UploadJSONIf(ctx, "tracks", "lease.json", map[string]string{"job": "a", "beat": "1"}, first)
+	if err != nil {
+		t.Fatalf("update: UploadJSONIf() error = %v", err)
+	}
+	if second == first {
+		t.Errorf("update kept the ETag %q", first)
+	}
+	if _, err := l.UploadJSONIf(ctx, "tracks", "lease.json", map[string]string{"job": "b"}, first); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("stale update: UploadJSONIf() error = %v, want ErrPreconditionFailed", err)
+	}
+	if _, err := l.ReadJSONVersion(ctx, "tracks", "missing.json", &got); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("ReadJSONVersion() of a missing object error = %v, want ErrObjectNotFound", err)
+	}
+}
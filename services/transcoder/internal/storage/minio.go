@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -17,10 +18,15 @@ import (
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
+var (
+	ErrObjectNotFound = errors.New("object not found")
+	// ErrPreconditionFailed is returned by conditional writes that lost to another writer.
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
 type MinIO struct {
 	client     *minio.Client
 	bucketName string
-	endpoint   string
 }
 
 func NewMinIO(cfg config.MinIOConfig) (*MinIO, error) {
@@ -35,13 +41,9 @@ func NewMinIO(cfg config.MinIOConfig) (*MinIO, error) {
 	return &MinIO{
 		client:     client,
 		bucketName: cfg.BucketName,
-		endpoint:   cfg.Endpoint,
 	}, nil
 }
 
-func (m *MinIO) Endpoint() string {
-	return m.endpoint
-}
 func (m *MinIO) Bucket() string {
 	return m.bucketName
 }
@@ -64,12 +66,64 @@ func (m *MinIO) DownloadToFile(ctx context.Context, bucket, objectKey, destPath
 	defer dest.Close()
 
 	if _, err := io.Copy(dest, reader); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return fmt.Errorf("%w: %s/%s", ErrObjectNotFound, bucket, objectKey)
+		}
 		return fmt.Errorf("failed to copy object data to %s: %w", destPath, err)
 	}
 
 	return nil
 }
 
+// ReadJSON decodes a JSON object; a missing object is reported as ErrObjectNotFound.
+func (m *MinIO) ReadJSON(ctx context.Context, bucket, objectKey string, v interface{}) error {
+	reader, err := m.client.GetObject(ctx, bucket, objectKey, minio.GetObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get object %s/%s: %w", bucket, objectKey, err)
+	}
+	defer reader.Close()
+
+	if err := json.NewDecoder(reader).Decode(v); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return fmt.Errorf("%w: %s/%s", ErrObjectNotFound, bucket, objectKey)
+		}
+		return fmt.Errorf("failed to decode %s/%s: %w", bucket, objectKey, err)
+	}
+	return nil
+}
+
+func (m *MinIO) ReadJSONVersion(ctx context.Context, bucket, objectKey string, v interface{}) (string, error) {
+	reader, err := m.client.GetObject(ctx, bucket, objectKey, minio.GetObjectOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get object %s/%s: %w", bucket, objectKey, err)
+	}
+	defer reader.Close()
+
+	// the ETag comes from the same GET response as the body
+	info, err := reader.Stat()
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return "", fmt.Errorf("%w: %s/%s", ErrObjectNotFound, bucket, objectKey)
+		}
+		return "", fmt.Errorf("failed to get object %s/%s: %w", bucket, objectKey, err)
+	}
+	if err := json.NewDecoder(reader).Decode(v); err != nil {
+		return "", fmt.Errorf("failed to decode %s/%s: %w", bucket, objectKey, err)
+	}
+	return info.ETag, nil
+}
+
+func (m *MinIO) Exists(ctx context.Context, bucket, objectKey string) (bool, error) {
+	_, err := m.client.StatObject(ctx, bucket, objectKey, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to stat %s/%s: %w", bucket, objectKey, err)
+	}
+	return true, nil
+}
+
 func (m *MinIO) UploadFile(ctx context.Context, bucket, objectKey, filePath, contentType string) error {
 	if contentType == "" {
 		contentType = contentTypeFor(filePath)
@@ -107,6 +161,27 @@ func (m *MinIO) UploadJSON(ctx context.Context, bucket, objectKey string, payloa
 	return m.UploadBytes(ctx, bucket, objectKey, data, "application/json")
 }
 
+func (m *MinIO) UploadJSONIf(ctx context.Context, bucket, objectKey string, payload interface{}, matchETag string) (string, error) {
+	data, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal json for %s: %w", objectKey, err)
+	}
+	opts := minio.PutObjectOptions{ContentType: "application/json"}
+	if matchETag == "" {
+		opts.SetMatchETagExcept("*")
+	} else {
+		opts.SetMatchETag(matchETag)
+	}
+	info, err := m.client.PutObject(ctx, bucket, objectKey, bytes.NewReader(data), int64(len(data)), opts)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == minio.PreconditionFailed {
+			return "", fmt.Errorf("%w: %s/%s", ErrPreconditionFailed, bucket, objectKey)
+		}
+		return "", fmt.Errorf("failed to upload object %s: %w", objectKey, err)
+	}
+	return info.ETag, nil
+}
+
 func (m *MinIO) UploadDirectory(ctx context.Context, bucket, prefix, dir string) error {
 	return filepath.WalkDir(dir, func(entryPath string, d os.DirEntry, err error) error {
 		if err != nil {
@@ -126,6 +201,47 @@ func (m *MinIO) UploadDirectory(ctx context.Context, bucket, prefix, dir string)
 	})
 }
 
+func (m *MinIO) Delete(ctx context.Context, bucket, objectKey string) error {
+	if err := m.client.RemoveObject(ctx, bucket, objectKey, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to delete %s/%s: %w", bucket, objectKey, err)
+	}
+	return nil
+}
+
+func (m *MinIO) ListObjects(ctx context.Context, bucket, prefix string, fn func(ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for object := range m.client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return fmt.Errorf("failed to list %s/%s: %w", bucket, prefix, object.Err)
+		}
+		if err := fn(ObjectInfo{Key: object.Key, Size: object.Size, LastModified: object.LastModified}); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func (m *MinIO) ListPrefixes(ctx context.Context, bucket, prefix string, fn func(prefix string) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// without Recursive the listing uses the "/" delimiter and reports common prefixes as keys ending in it
+	for object := range m.client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return fmt.Errorf("failed to list %s/%s: %w", bucket, prefix, object.Err)
+		}
+		if !strings.HasSuffix(object.Key, "/") {
+			continue
+		}
+		if err := fn(object.Key); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
 func contentTypeFor(filename string) string {
 	ext := strings.ToLower(filepath.Ext(filename))
 	switch ext {
@@ -133,6 +249,8 @@ func contentTypeFor(filename string) string {
 		return "application/json"
 	case ".m3u8":
 		return "application/vnd.apple.mpegurl"
+	case ".mpd":
+		return "application/dash+xml"
 	case ".mp4":
 		return "video/mp4"
 	case ".m4s":
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// ObjectInfo describes a listed object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Storage is the object store sources are read from and renditions are published to.
+// MinIO is used in production; Local keeps objects on disk for development and tests.
+type Storage interface {
+	Bucket() string
+	DownloadToFile(ctx context.Context, bucket, objectKey, destPath string) error
+	// ReadJSON decodes a JSON object; a missing object is reported as ErrObjectNotFound.
+	ReadJSON(ctx context.Context, bucket, objectKey string, v interface{}) error
+	Exists(ctx context.Context, bucket, objectKey string) (bool, error)
+	UploadFile(ctx context.Context, bucket, objectKey, filePath, contentType string) error
+	UploadBytes(ctx context.Context, bucket, objectKey string, data []byte, contentType string) error
+	UploadJSON(ctx context.Context, bucket, objectKey string, payload interface{}) error
+	// ReadJSONVersion is ReadJSON that also returns the ETag of the object it decoded.
+	ReadJSONVersion(ctx context.Context, bucket, objectKey string, v interface{}) (string, error)
+	// UploadJSONIf writes the object only while its ETag is still matchETag, or only if it does
+	// not exist when matchETag is empty, and returns the new ETag. A write that lost to another
+	// writer is reported as ErrPreconditionFailed.
+	UploadJSONIf(ctx context.Context, bucket, objectKey string, payload interface{}, matchETag string) (string, error)
+	UploadDirectory(ctx context.Context, bucket, prefix, dir string) error
+	// Delete removes an object; removing a missing object is not an error.
+	Delete(ctx context.Context, bucket, objectKey string) error
+	// ListObjects calls fn for every object under prefix in key order; an error from fn stops the listing.
+	ListObjects(ctx context.Context, bucket, prefix string, fn func(ObjectInfo) error) error
+	// ListPrefixes calls fn for every "directory" right under prefix, which is empty or ends with
+	// a slash, in key order and with the trailing slash; objects right under prefix are skipped.
+	// Unlike ListObjects it does not descend, so walking a layout level by level lists only what
+	// the walk needs.
+	ListPrefixes(ctx context.Context, bucket, prefix string, fn func(prefix string) error) error
+}
+
+var (
+	_ Storage = (*MinIO)(nil)
+	_ Storage = (*Local)(nil)
+)
@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"path"
+	"strings"
+)
+
+// PublicURLs builds the URLs clients fetch published objects from. It is the only place that
+// knows the public host (a CDN in production), so neither tasks nor the storage endpoint decide it.
+type PublicURLs struct {
+	base string
+}
+
+// NewPublicURLs returns a builder for base/bucket/key URLs; an empty base yields bare bucket/key paths.
+func NewPublicURLs(base string) PublicURLs {
+	return PublicURLs{base: strings.TrimRight(strings.TrimSpace(base), "/")}
+}
+
+func (u PublicURLs) Object(bucket, objectKey string) string {
+	if u.base == "" {
+		return path.Join(bucket, objectKey)
+	}
+	return u.base + "/" + path.Join(bucket, objectKey)
+}
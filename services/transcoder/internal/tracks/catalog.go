@@ -0,0 +1,69 @@
+package tracks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CatalogPageSize is the largest page the Track Service HTTP API returns.
+const CatalogPageSize = 100
+
+// CatalogTrack is the part of a published track the bulk tools need.
+type CatalogTrack struct {
+	ID        string   `json:"id"`
+	ArtistIDs []string `json:"artist_ids"`
+	// AudioURL is the published master playlist; its path locates the track's objects.
+	AudioURL  string    `json:"audio_url"`
+	Genre     string    `json:"genre"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Catalog reads published tracks from the Track Service HTTP API. The gRPC API has no listing.
+type Catalog struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewCatalog(baseURL string) *Catalog {
+	return &Catalog{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// ListTracks returns one page of ready tracks, newest first; artistID may be empty.
+func (c *Catalog) ListTracks(ctx context.Context, artistID string, limit, offset int) ([]CatalogTrack, error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("offset", strconv.Itoa(offset))
+	if artistID != "" {
+		query.Set("artist_id", artistID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/tracks?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build catalog request: %w", err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tracks: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list tracks: track service returned %s", resp.Status)
+	}
+	var page struct {
+		Tracks []CatalogTrack `json:"tracks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("failed to decode track list: %w", err)
+	}
+	return page.Tracks, nil
+}
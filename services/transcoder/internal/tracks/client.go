@@ -7,11 +7,78 @@ import (
 	"github.com/MusicSocial/transcoder/internal/config"
 	trackspb "github.com/MusicSocial/transcoder/proto/tracks/v1"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
+// TrackInfo describes the processed outputs reported back to Track Service.
+// It is also stored in the output manifest so a skipped job can report the same values again.
+type TrackInfo struct {
+	AudioURL    string `json:"audio_url"`
+	DashURL     string `json:"dash_url,omitempty"`
+	WaveformURL string `json:"waveform_url,omitempty"`
+	CoverURL    string `json:"cover_url,omitempty"`
+	// PreviewURL is the playlist of the short clip for signed-out listeners.
+	PreviewURL  string `json:"preview_url,omitempty"`
+	DurationSec int32  `json:"duration_sec"`
+	// Suggested is tag metadata found in the file; Track Service only uses it to fill empty fields.
+	Suggested *SuggestedMetadata `json:"suggested,omitempty"`
+	Analysis  *Analysis          `json:"analysis,omitempty"`
+	// SourceQuality is the verdict on whether the source was converted from a lossy file.
+	SourceQuality *SourceQuality `json:"source_quality,omitempty"`
+}
+
+// SourceQuality flags sources whose bandwidth is well below what their codec should carry,
+// e.g. MP3s saved as FLAC. Track Service shows it in the admin API.
+type SourceQuality struct {
+	SuspectedTranscode bool    `json:"suspected_transcode"`
+	Confidence         float64 `json:"confidence"`
+	CutoffHz           int32   `json:"cutoff_hz"`
+	ExpectedCutoffHz   int32   `json:"expected_cutoff_hz"`
+}
+
+// Analysis is the tempo, key and energy estimate Track Service stores for filtering.
+// Zero BPM or an empty key mean the value is unknown.
+type Analysis struct {
+	BPM          float64 `json:"bpm,omitempty"`
+	Key          string  `json:"key,omitempty"`
+	Camelot      string  `json:"camelot,omitempty"`
+	Energy       float64 `json:"energy"`
+	Danceability float64 `json:"danceability"`
+}
+
+type SuggestedMetadata struct {
+	Title       string   `json:"title,omitempty"`
+	Artists     []string `json:"artists,omitempty"`
+	Album       string   `json:"album,omitempty"`
+	TrackNumber int32    `json:"track_number,omitempty"`
+	Year        int32    `json:"year,omitempty"`
+	ISRC        string   `json:"isrc,omitempty"`
+	Genre       string   `json:"genre,omitempty"`
+	Explicit    *bool    `json:"explicit,omitempty"`
+}
+
+// FingerprintMatch is an earlier track Track Service considers the same recording.
+type FingerprintMatch struct {
+	TrackID       string
+	Score         float64
+	MatchedHashes int32
+}
+
+// Processing statuses the transcoder may set; ready is implied by a successful UpdateTrackInfo.
+const (
+	StatusProcessing = "processing"
+	StatusFailed     = "failed"
+)
+
+// maxFailureReasonLen keeps ffmpeg output embedded in errors from bloating the request.
+const maxFailureReasonLen = 1000
+
 type Client interface {
-	UpdateTrackInfo(ctx context.Context, trackID, audioURL string, duration int32, coverURL string) error
+	UpdateTrackInfo(ctx context.Context, trackID string, info TrackInfo) error
+	UpdateTrackStatus(ctx context.Context, trackID, status, failureReason string) error
+	StoreFingerprint(ctx context.Context, trackID string, hashes, offsets []uint32) ([]FingerprintMatch, error)
 	Close() error
 }
 
@@ -32,15 +99,47 @@ func NewTrackClient(cfg *config.TrackServiceConfig) (*GRPCClient, error) {
 	}, nil
 }
 
-func (c *GRPCClient) UpdateTrackInfo(ctx context.Context, trackID, audioURL string, duration int32, coverURL string) error {
+func (c *GRPCClient) UpdateTrackInfo(ctx context.Context, trackID string, info TrackInfo) error {
 	if trackID == "" {
 		return fmt.Errorf("trackID is required")
 	}
 	req := &trackspb.UpdateTrackInfoRequest{
 		TrackId:     trackID,
-		AudioUrl:    audioURL,
-		CoverUrl:    coverURL,
-		DurationSec: duration, // Используем DurationSec вместо Duration
+		AudioUrl:    info.AudioURL,
+		DashUrl:     info.DashURL,
+		WaveformUrl: info.WaveformURL,
+		CoverUrl:    info.CoverURL,
+		PreviewUrl:  info.PreviewURL,
+		DurationSec: info.DurationSec, // Используем DurationSec вместо Duration
+	}
+	if s := info.Suggested; s != nil {
+		req.Suggested = &trackspb.SuggestedMetadata{
+			Title:       s.Title,
+			Artists:     s.Artists,
+			Album:       s.Album,
+			TrackNumber: s.TrackNumber,
+			Year:        s.Year,
+			Isrc:        s.ISRC,
+			Genre:       s.Genre,
+			Explicit:    s.Explicit,
+		}
+	}
+	if a := info.Analysis; a != nil {
+		req.Analysis = &trackspb.AudioAnalysis{
+			Bpm:          a.BPM,
+			Key:          a.Key,
+			Camelot:      a.Camelot,
+			Energy:       a.Energy,
+			Danceability: a.Danceability,
+		}
+	}
+	if q := info.SourceQuality; q != nil {
+		req.SourceQuality = &trackspb.SourceQuality{
+			SuspectedTranscode: q.SuspectedTranscode,
+			Confidence:         q.Confidence,
+			CutoffHz:           q.CutoffHz,
+			ExpectedCutoffHz:   q.ExpectedCutoffHz,
+		}
 	}
 	_, err := c.client.UpdateTrackInfo(ctx, req)
 	if err != nil {
@@ -49,6 +148,61 @@ func (c *GRPCClient) UpdateTrackInfo(ctx context.Context, trackID, audioURL stri
 	return nil
 }
 
+func (c *GRPCClient) UpdateTrackStatus(ctx context.Context, trackID, status, failureReason string) error {
+	if trackID == "" {
+		return fmt.Errorf("trackID is required")
+	}
+	if r := []rune(failureReason); len(r) > maxFailureReasonLen {
+		failureReason = string(r[:maxFailureReasonLen])
+	}
+	_, err := c.client.UpdateTrackStatus(ctx, &trackspb.UpdateTrackStatusRequest{
+		TrackId:       trackID,
+		Status:        status,
+		FailureReason: failureReason,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set track status %s: %w", status, err)
+	}
+	return nil
+}
+
+// StoreFingerprint replaces the track's fingerprint in Track Service and returns the earlier
+// tracks it matched, which Track Service has flagged as likely duplicates.
+func (c *GRPCClient) StoreFingerprint(ctx context.Context, trackID string, hashes, offsets []uint32) ([]FingerprintMatch, error) {
+	if trackID == "" {
+		return nil, fmt.Errorf("trackID is required")
+	}
+	resp, err := c.client.StoreFingerprint(ctx, &trackspb.StoreFingerprintRequest{
+		TrackId: trackID,
+		Hashes:  hashes,
+		Offsets: offsets,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store fingerprint: %w", err)
+	}
+	matches := make([]FingerprintMatch, 0, len(resp.Matches))
+	for _, m := range resp.Matches {
+		matches = append(matches, FingerprintMatch{TrackID: m.TrackId, Score: m.Score, MatchedHashes: m.MatchedHashes})
+	}
+	return matches, nil
+}
+
+// IsInvalidTransition reports whether Track Service refused a status change, e.g. because the
+// track is already ready and is only being reprocessed.
+func IsInvalidTransition(err error) bool {
+	return status.Code(err) == codes.FailedPrecondition
+}
+
+// IsPermanent reports whether Track Service rejected the call in a way a retry cannot fix.
+func IsPermanent(err error) bool {
+	switch status.Code(err) {
+	case codes.NotFound, codes.InvalidArgument, codes.FailedPrecondition:
+		return true
+	default:
+		return false
+	}
+}
+
 func (c *GRPCClient) Close() error {
 	return c.conn.Close()
 }
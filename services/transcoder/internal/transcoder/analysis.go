@@ -0,0 +1,365 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/cmplx"
+	"strconv"
+)
+
+const (
+	analysisFileName   = "analysis.json"
+	analysisSampleRate = 11025
+	// analysisMaxSec bounds the work for very long uploads; tempo and key settle long before that.
+	analysisMaxSec = 600
+
+	onsetFrameSize  = 1024
+	onsetHop        = 256
+	chromaFrameSize = 4096
+	chromaMinHz     = 55
+	chromaMaxHz     = 2000
+
+	minTempoBPM = 60
+	maxTempoBPM = 200
+	// tempos are weighted towards preferredTempoBPM to avoid half/double tempo picks
+	preferredTempoBPM = 120
+	silenceRMS        = 1e-4
+)
+
+var errAnalysisWindowFull = errors.New("analysis window reached")
+
+var pitchClassNames = [12]string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+
+// Krumhansl-Kessler key profiles, indexed from the tonic.
+var (
+	majorProfile = [12]float64{6.35, 2.23, 3.48, 2.33, 4.38, 4.09, 2.52, 5.19, 2.39, 3.66, 2.29, 2.88}
+	minorProfile = [12]float64{6.33, 2.68, 3.52, 5.38, 2.60, 3.53, 2.54, 4.75, 3.98, 2.69, 3.34, 3.17}
+)
+
+// AudioAnalysis holds the musical descriptors written to metadata/analysis.json.
+// Zero BPM or an empty key mean the value could not be estimated, e.g. for silence or speech.
+type AudioAnalysis struct {
+	BPM           float64 `json:"bpm"`
+	BPMConfidence float64 `json:"bpm_confidence"`
+	Key           string  `json:"key,omitempty"`
+	// Camelot is the DJ wheel notation of Key, e.g. 8A for A minor.
+	Camelot       string  `json:"camelot,omitempty"`
+	KeyConfidence float64 `json:"key_confidence"`
+	// Energy and Danceability are heuristic scores in [0, 1].
+	Energy       float64 `json:"energy"`
+	Danceability float64 `json:"danceability"`
+}
+
+type audioAnalyzer struct {
+	onsetWindow []float64
+	buf         []complex128
+	pending     []float32
+	decoded     int
+	hops        int
+
+	prevSpectrum []float64
+	flux         []float64
+
+	chromaBin []int // pitch class per chroma FFT bin, -1 outside the range
+	chromaBuf []complex128
+	chroma    [12]float64
+
+	voicedHops  int
+	voicedPower float64
+}
+
+func newAudioAnalyzer() *audioAnalyzer {
+	onsetWindow := make([]float64, onsetFrameSize)
+	for i := range onsetWindow {
+		onsetWindow[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(onsetFrameSize-1))
+	}
+	chromaBin := make([]int, chromaFrameSize/2)
+	for bin := range chromaBin {
+		chromaBin[bin] = -1
+		hz := float64(bin) * analysisSampleRate / chromaFrameSize
+		if hz < chromaMinHz || hz > chromaMaxHz {
+			continue
+		}
+		midi := int(math.Round(69 + 12*math.Log2(hz/440)))
+		chromaBin[bin] = midi % 12
+	}
+	return &audioAnalyzer{
+		onsetWindow: onsetWindow,
+		buf:         make([]complex128, onsetFrameSize),
+		chromaBin:   chromaBin,
+		chromaBuf:   make([]complex128, chromaFrameSize),
+	}
+}
+
+// analyzeAudio estimates tempo, key, energy and danceability from the decoded source.
+func (t *FFmpegTranscoder) analyzeAudio(ctx context.Context, input string) (*AudioAnalysis, error) {
+	a := newAudioAnalyzer()
+	err := t.decodePCM(ctx, input, analysisSampleRate, a.write)
+	if err != nil && !errors.Is(err, errAnalysisWindowFull) {
+		return nil, err
+	}
+	return a.result(), nil
+}
+
+func (a *audioAnalyzer) write(samples []float32) error {
+	limit := analysisMaxSec * analysisSampleRate
+	if remaining := limit - a.decoded; len(samples) > remaining {
+		samples = samples[:remaining]
+	}
+	a.decoded += len(samples)
+	a.pending = append(a.pending, samples...)
+
+	// the chroma frame is the longest, so it decides when enough samples are buffered
+	for len(a.pending) >= chromaFrameSize {
+		a.addHop(a.pending[:onsetFrameSize], a.pending[:onsetHop])
+		if a.hops%(chromaFrameSize/onsetHop) == 0 {
+			a.addChroma(a.pending[:chromaFrameSize])
+		}
+		a.pending = a.pending[onsetHop:]
+	}
+	a.pending = append(a.pending[:0:0], a.pending...)
+
+	if a.decoded >= limit {
+		return errAnalysisWindowFull
+	}
+	return nil
+}
+
+// addHop records the spectral flux (onset strength) and loudness of one hop.
+func (a *audioAnalyzer) addHop(frame, hop []float32) {
+	a.hops++
+
+	power := 0.0
+	for _, s := range hop {
+		power += float64(s) * float64(s)
+	}
+	if rms := math.Sqrt(power / float64(len(hop))); rms > silenceRMS {
+		a.voicedHops++
+		a.voicedPower += power / float64(len(hop))
+	}
+
+	for i, s := range frame {
+		a.buf[i] = complex(float64(s)*a.onsetWindow[i], 0)
+	}
+	fft(a.buf)
+
+	spectrum := make([]float64, onsetFrameSize/2)
+	for bin := range spectrum {
+		spectrum[bin] = math.Log1p(100 * cmplx.Abs(a.buf[bin]))
+	}
+	flux := 0.0
+	if a.prevSpectrum != nil {
+		for bin, v := range spectrum {
+			if d := v - a.prevSpectrum[bin]; d > 0 {
+				flux += d
+			}
+		}
+	}
+	a.prevSpectrum = spectrum
+	a.flux = append(a.flux, flux)
+}
+
+func (a *audioAnalyzer) addChroma(frame []float32) {
+	for i, s := range frame {
+		w := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(chromaFrameSize-1))
+		a.chromaBuf[i] = complex(float64(s)*w, 0)
+	}
+	fft(a.chromaBuf)
+	for bin, pc := range a.chromaBin {
+		if pc >= 0 {
+			a.chroma[pc] += cmplx.Abs(a.chromaBuf[bin])
+		}
+	}
+}
+
+func (a *audioAnalyzer) result() *AudioAnalysis {
+	fps := float64(analysisSampleRate) / onsetHop
+	analysis := &AudioAnalysis{}
+
+	bpm, confidence := estimateTempo(a.flux, fps)
+	analysis.BPM = roundToDecimals(bpm, 1)
+	analysis.BPMConfidence = roundToDecimals(confidence, 2)
+
+	if tonic, minor, keyConfidence, ok := estimateKey(a.chroma); ok {
+		mode := "major"
+		if minor {
+			mode = "minor"
+		}
+		analysis.Key = pitchClassNames[tonic] + " " + mode
+		analysis.Camelot = camelotKey(tonic, minor)
+		analysis.KeyConfidence = roundToDecimals(keyConfidence, 2)
+	}
+
+	// loudness of the non-silent parts, -30 dBFS RMS and below counts as calm, -6 dBFS as maximal
+	loudness := 0.0
+	if a.voicedHops > 0 {
+		rmsDB := 10 * math.Log10(a.voicedPower/float64(a.voicedHops))
+		loudness = clamp01((rmsDB + 30) / 24)
+	}
+	seconds := float64(a.hops) / fps
+	onsetRate := 0.0
+	if seconds > 0 {
+		onsetRate = float64(countOnsets(a.flux)) / seconds
+	}
+	analysis.Energy = roundToDecimals(0.7*loudness+0.3*clamp01(onsetRate/6), 2)
+
+	// a steady, pronounced beat in a walking-to-running tempo range
+	if bpm > 0 {
+		tempoFit := math.Exp(-0.5 * math.Pow(math.Log2(bpm/preferredTempoBPM)/0.5, 2))
+		analysis.Danceability = roundToDecimals(clamp01(confidence/0.4)*tempoFit, 2)
+	}
+	return analysis
+}
+
+// estimateTempo picks the autocorrelation lag of the onset envelope with the strongest
+// periodicity, weighted towards preferredTempoBPM, and refines it on the fourth beat.
+func estimateTempo(envelope []float64, fps float64) (bpm, confidence float64) {
+	minLag := int(math.Floor(fps * 60 / maxTempoBPM))
+	maxLag := int(math.Ceil(fps * 60 / minTempoBPM))
+	if len(envelope) < maxLag*4 {
+		return 0, 0
+	}
+
+	mean := 0.0
+	for _, v := range envelope {
+		mean += v
+	}
+	mean /= float64(len(envelope))
+	e := make([]float64, len(envelope))
+	for i, v := range envelope {
+		e[i] = v - mean
+	}
+
+	acf := func(lag int) float64 {
+		sum := 0.0
+		for i := 0; i+lag < len(e); i++ {
+			sum += e[i] * e[i+lag]
+		}
+		return sum / float64(len(e)-lag)
+	}
+	zero := acf(0)
+	if zero <= 0 {
+		return 0, 0
+	}
+
+	bestLag, bestScore := 0, 0.0
+	for lag := minLag; lag <= maxLag; lag++ {
+		weight := math.Exp(-0.5 * math.Pow(math.Log2(fps*60/float64(lag)/preferredTempoBPM), 2))
+		if score := acf(lag) * weight; score > bestScore {
+			bestLag, bestScore = lag, score
+		}
+	}
+	if bestLag == 0 {
+		return 0, 0
+	}
+
+	// four beats later the lag error is four times smaller relative to the period
+	period := float64(bestLag)
+	if far := bestLag * 4; far+1 < len(e)/2 {
+		peak := far
+		for lag := far - 2; lag <= far+2; lag++ {
+			if acf(lag) > acf(peak) {
+				peak = lag
+			}
+		}
+		period = (float64(peak) + parabolicOffset(acf(peak-1), acf(peak), acf(peak+1))) / 4
+	}
+
+	return fps * 60 / period, clamp01(acf(bestLag) / zero)
+}
+
+// parabolicOffset is the sub-sample position of a peak from its neighbours.
+func parabolicOffset(left, centre, right float64) float64 {
+	denom := left - 2*centre + right
+	if denom == 0 {
+		return 0
+	}
+	offset := 0.5 * (left - right) / denom
+	return math.Max(-0.5, math.Min(0.5, offset))
+}
+
+// estimateKey correlates the chroma vector with every rotation of the major and minor profiles.
+func estimateKey(chroma [12]float64) (tonic int, minor bool, confidence float64, ok bool) {
+	total := 0.0
+	for _, v := range chroma {
+		total += v
+	}
+	if total == 0 {
+		return 0, false, 0, false
+	}
+
+	best := math.Inf(-1)
+	for root := 0; root < 12; root++ {
+		for _, isMinor := range []bool{false, true} {
+			profile := majorProfile
+			if isMinor {
+				profile = minorProfile
+			}
+			var rotated [12]float64
+			for i := range rotated {
+				rotated[i] = profile[(i-root+12)%12]
+			}
+			if r := pearson(chroma[:], rotated[:]); r > best {
+				best, tonic, minor = r, root, isMinor
+			}
+		}
+	}
+	return tonic, minor, clamp01(best), true
+}
+
+// camelotKey maps a key to the Camelot wheel: C major is 8B, its relative A minor is 8A,
+// and each step clockwise is a fifth up.
+func camelotKey(tonic int, minor bool) string {
+	letter := "B"
+	if minor {
+		tonic = (tonic + 3) % 12 // relative major
+		letter = "A"
+	}
+	number := (tonic*7+7)%12 + 1
+	return strconv.Itoa(number) + letter
+}
+
+// countOnsets counts local maxima of the onset envelope that stand out from its average.
+func countOnsets(envelope []float64) int {
+	if len(envelope) < 3 {
+		return 0
+	}
+	mean, sq := 0.0, 0.0
+	for _, v := range envelope {
+		mean += v
+		sq += v * v
+	}
+	n := float64(len(envelope))
+	mean /= n
+	threshold := mean + math.Sqrt(math.Max(sq/n-mean*mean, 0))
+
+	count := 0
+	for i := 1; i+1 < len(envelope); i++ {
+		if v := envelope[i]; v > threshold && v >= envelope[i-1] && v > envelope[i+1] {
+			count++
+		}
+	}
+	return count
+}
+
+func pearson(x, y []float64) float64 {
+	n := float64(len(x))
+	var sx, sy, sxx, syy, sxy float64
+	for i := range x {
+		sx += x[i]
+		sy += y[i]
+		sxx += x[i] * x[i]
+		syy += y[i] * y[i]
+		sxy += x[i] * y[i]
+	}
+	denom := math.Sqrt((sxx - sx*sx/n) * (syy - sy*sy/n))
+	if denom == 0 {
+		return 0
+	}
+	return (sxy - sx*sy/n) / denom
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
@@ -0,0 +1,62 @@
+package transcoder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// coverSizes are the square renditions produced from embedded artwork.
+var coverSizes = []int{1200, 600, 300}
+
+const (
+	coverPrimarySize = 600
+	coverDirName     = "cover"
+)
+
+type coverFormat struct {
+	ext  string
+	args []string
+}
+
+var coverFormats = []coverFormat{
+	{ext: "jpg", args: []string{"-c:v", "mjpeg", "-q:v", "3", "-pix_fmt", "yuvj420p"}},
+	{ext: "webp", args: []string{"-c:v", "libwebp", "-quality", "85"}},
+}
+
+func coverFileName(size int, ext string) string {
+	return fmt.Sprintf("cover_%d.%s", size, ext)
+}
+
+// extractCoverArt renders the attached picture stream (ID3 APIC, FLAC PICTURE, MP4 covr)
+// into square JPEG/WebP renditions inside outputDir.
+func (t *FFmpegTranscoder) extractCoverArt(ctx context.Context, input string, streamIndex int, outputDir string) error {
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create cover directory: %w", err)
+	}
+
+	for _, size := range coverSizes {
+		filter := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=increase,crop=%d:%d", size, size, size, size)
+		for _, format := range coverFormats {
+			args := []string{
+				"-hide_banner",
+				"-y",
+				"-i", input,
+				"-map", fmt.Sprintf("0:%d", streamIndex),
+				"-vf", filter,
+				"-frames:v", "1",
+			}
+			args = append(args, format.args...)
+			args = append(args, filepath.Join(outputDir, coverFileName(size, format.ext)))
+
+			var stderr bytes.Buffer
+			if err := t.runner.Run(ctx, t.ffmpegPath, args, &stderr, &stderr); err != nil {
+				return fmt.Errorf("ffmpeg failed for cover %dpx %s: %w (output=%s)", size, format.ext, err, stderr.String())
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package transcoder
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const (
+	dashManifestName = "manifest.mpd"
+	dashTimescale    = 1000
+)
+
+type mpd struct {
+	XMLName                   xml.Name  `xml:"MPD"`
+	Xmlns                     string    `xml:"xmlns,attr"`
+	Profiles                  string    `xml:"profiles,attr"`
+	Type                      string    `xml:"type,attr"`
+	MediaPresentationDuration string    `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string    `xml:"minBufferTime,attr"`
+	Period                    mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	ID             string             `xml:"id,attr"`
+	Start          string             `xml:"start,attr"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ID               int                 `xml:"id,attr"`
+	ContentType      string              `xml:"contentType,attr"`
+	MimeType         string              `xml:"mimeType,attr"`
+	SegmentAlignment bool                `xml:"segmentAlignment,attr"`
+	Representations  []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID                string           `xml:"id,attr"`
+	Codecs            string           `xml:"codecs,attr"`
+	Bandwidth         int              `xml:"bandwidth,attr"`
+	AudioSamplingRate int              `xml:"audioSamplingRate,attr,omitempty"`
+	ChannelConfig     mpdChannelConfig `xml:"AudioChannelConfiguration"`
+	SegmentList       mpdSegmentList   `xml:"SegmentList"`
+}
+
+type mpdChannelConfig struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       int    `xml:"value,attr"`
+}
+
+type mpdSegmentList struct {
+	Timescale      int             `xml:"timescale,attr"`
+	Initialization mpdURL          `xml:"Initialization"`
+	Timeline       []mpdTimelineS  `xml:"SegmentTimeline>S"`
+	SegmentURLs    []mpdSegmentURL `xml:"SegmentURL"`
+}
+
+type mpdURL struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr,omitempty"`
+}
+
+type mpdSegmentURL struct {
+	Media      string `xml:"media,attr"`
+	MediaRange string `xml:"mediaRange,attr,omitempty"`
+}
+
+type mpdTimelineS struct {
+	T *int64 `xml:"t,attr,omitempty"`
+	D int64  `xml:"d,attr"`
+	R int    `xml:"r,attr,omitempty"`
+}
+
+// writeDASHManifest builds an MPD that points at the fMP4 segments already produced for HLS,
+// so both manifests share a single set of media objects. Single-file variants are addressed
+// with the same byte ranges as in the HLS playlists.
+func (t *FFmpegTranscoder) writeDASHManifest(outputDir string, variants []rendition, sourceSampleRate int) error {
+	manifest := mpd{
+		Xmlns:         "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:      "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:          "static",
+		MinBufferTime: "PT2S",
+		Period:        mpdPeriod{ID: "0", Start: "PT0S"},
+	}
+
+	setsByCodec := make(map[string]int)
+	var duration float64
+
+	for _, variant := range variants {
+		playlist, err := parseMediaPlaylist(filepath.Join(outputDir, variant.Name, "index.m3u8"))
+		if err != nil {
+			return err
+		}
+		if playlist.InitURI == "" {
+			return fmt.Errorf("variant %s has no init segment", variant.Name)
+		}
+		duration = math.Max(duration, playlist.totalDuration())
+
+		sampleRate := variant.SampleRate
+		if sampleRate == 0 {
+			sampleRate = sourceSampleRate
+		}
+
+		representation := mpdRepresentation{
+			ID:                variant.Name,
+			Codecs:            variant.codec.hlsCodec,
+			Bandwidth:         variant.bandwidth(),
+			AudioSamplingRate: sampleRate,
+			ChannelConfig: mpdChannelConfig{
+				SchemeIDURI: "urn:mpeg:dash:23003:3:audio_channel_configuration:2011",
+				Value:       variant.Channels,
+			},
+			SegmentList: mpdSegmentList{
+				Timescale: dashTimescale,
+				Initialization: mpdURL{
+					SourceURL: path.Join(variant.Name, playlist.InitURI),
+					Range:     playlist.InitByteRange.dashRange(),
+				},
+				Timeline: buildSegmentTimeline(playlist.Segments),
+			},
+		}
+		for _, segment := range playlist.Segments {
+			representation.SegmentList.SegmentURLs = append(representation.SegmentList.SegmentURLs, mpdSegmentURL{
+				Media:      path.Join(variant.Name, segment.URI),
+				MediaRange: segment.ByteRange.dashRange(),
+			})
+		}
+
+		idx, ok := setsByCodec[variant.codec.hlsCodec]
+		if !ok {
+			idx = len(manifest.Period.AdaptationSets)
+			setsByCodec[variant.codec.hlsCodec] = idx
+			manifest.Period.AdaptationSets = append(manifest.Period.AdaptationSets, mpdAdaptationSet{
+				ID:               idx,
+				ContentType:      "audio",
+				MimeType:         "audio/mp4",
+				SegmentAlignment: true,
+			})
+		}
+		set := &manifest.Period.AdaptationSets[idx]
+		set.Representations = append(set.Representations, representation)
+	}
+
+	manifest.MediaPresentationDuration = fmt.Sprintf("PT%.3fS", duration)
+
+	data, err := xml.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal dash manifest: %w", err)
+	}
+	data = append([]byte(xml.Header), data...)
+
+	if err := os.WriteFile(filepath.Join(outputDir, dashManifestName), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write dash manifest: %w", err)
+	}
+	return nil
+}
+
+// buildSegmentTimeline collapses consecutive segments of equal duration into a single S element.
+func buildSegmentTimeline(segments []mediaSegment) []mpdTimelineS {
+	var timeline []mpdTimelineS
+	for _, segment := range segments {
+		d := int64(math.Round(segment.DurationSec * dashTimescale))
+		if n := len(timeline); n > 0 && timeline[n-1].D == d {
+			timeline[n-1].R++
+			continue
+		}
+		entry := mpdTimelineS{D: d}
+		if len(timeline) == 0 {
+			var start int64
+			entry.T = &start
+		}
+		timeline = append(timeline, entry)
+	}
+	return timeline
+}
@@ -0,0 +1,103 @@
+package transcoder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/MusicSocial/transcoder/internal/config"
+)
+
+// CheckEncoders compares the ladder profiles and the preview clip with the encoders of the ffmpeg
+// build, so a misconfigured image is caught at startup instead of failing every job. A profile
+// other than the default that needs a missing encoder is disabled with a warning, and tasks that
+// ask for it fail permanently; the default profile and the preview must be encodable.
+func (t *FFmpegTranscoder) CheckEncoders(ctx context.Context) error {
+	var stdout, stderr bytes.Buffer
+	if err := t.runner.Run(ctx, t.ffmpegPath, []string{"-hide_banner", "-encoders"}, &stdout, &stderr); err != nil {
+		return fmt.Errorf("failed to list ffmpeg encoders: %w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	usable, disabled, err := usableProfiles(parseEncoders(stdout.Bytes()), t.settings)
+	if err != nil {
+		return err
+	}
+	for _, reason := range disabled {
+		t.logger.Printf("warning: ladder profile disabled, %s", reason)
+	}
+	t.settings.Profiles = usable
+	return nil
+}
+
+// parseEncoders returns the encoder names of `ffmpeg -encoders`, which follow a line of dashes
+// as " A....D name    description".
+func parseEncoders(output []byte) map[string]bool {
+	encoders := make(map[string]bool)
+	listing := false
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !listing {
+			listing = strings.HasPrefix(line, "---")
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			encoders[fields[1]] = true
+		}
+	}
+	return encoders
+}
+
+// usableProfiles returns the profiles whose encoders are all available and why the others were
+// left out. A missing encoder of the default profile or of the preview is an error.
+func usableProfiles(available map[string]bool, settings config.TranscodingConfig) (map[string]config.LadderProfile, []string, error) {
+	missing := func(owner string, variants []config.VariantConfig) []string {
+		var found []string
+		for _, v := range variants {
+			spec, ok := codecSpecs[strings.ToLower(v.Codec)]
+			if !ok {
+				continue // resolveLadder reports unknown codecs
+			}
+			if name := spec.encoderName(); name != "" && !available[name] {
+				found = append(found, fmt.Sprintf("%s variant %s needs %s", owner, v.Name, name))
+			}
+		}
+		return found
+	}
+
+	var fatal, disabled []string
+	usable := make(map[string]config.LadderProfile, len(settings.Profiles))
+	for name, profile := range settings.Profiles {
+		gaps := missing("profile "+name, profile.Variants)
+		switch {
+		case len(gaps) == 0:
+			usable[name] = profile
+		case name == settings.DefaultProfile:
+			fatal = append(fatal, gaps...)
+		default:
+			disabled = append(disabled, strings.Join(gaps, "; "))
+		}
+	}
+	if preview := settings.Preview; preview.Enabled {
+		fatal = append(fatal, missing("preview", []config.VariantConfig{{Name: previewDirName, Codec: preview.Codec}})...)
+	}
+	sort.Strings(disabled)
+	if len(fatal) > 0 {
+		sort.Strings(fatal)
+		return nil, disabled, fmt.Errorf("ffmpeg is missing encoders: %s", strings.Join(fatal, "; "))
+	}
+	return usable, disabled, nil
+}
+
+// encoderName is the ffmpeg encoder selected by -c:a.
+func (c codecSpec) encoderName() string {
+	for i := 0; i+1 < len(c.encoderArgs); i++ {
+		if c.encoderArgs[i] == "-c:a" {
+			return c.encoderArgs[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,60 @@
+package transcoder
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const encryptionAES128 = "aes-128"
+
+// hlsKey is the per-track AES-128 content key. A new key id is minted on every full run, so
+// playlists cached by players keep resolving the key they were encrypted with.
+type hlsKey struct {
+	id  string
+	key []byte
+	uri string
+	// file is the local copy of the key, set by writeKeyInfo.
+	file string
+}
+
+func newHLSKey(uriBase, trackID string) (*hlsKey, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate key id: %w", err)
+	}
+
+	k := &hlsKey{id: hex.EncodeToString(id), key: key}
+	k.uri = fmt.Sprintf("%s/%s/%s", uriBase, trackID, k.id)
+	return k, nil
+}
+
+// objectKey is where the key lives in the key bucket: <track_id>/<key_id>.key
+func (k *hlsKey) objectKey(trackID string) string {
+	return path.Join(trackID, k.id+".key")
+}
+
+// writeKeyInfo writes the key and the ffmpeg key info file into dir, which must not be uploaded.
+// The IV line is omitted so every segment uses its media sequence number as IV, as HLS specifies.
+func (k *hlsKey) writeKeyInfo(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create key directory: %w", err)
+	}
+	keyFile := filepath.Join(dir, k.id+".key")
+	if err := os.WriteFile(keyFile, k.key, 0o600); err != nil {
+		return "", fmt.Errorf("failed to write key: %w", err)
+	}
+	k.file = keyFile
+	infoFile := filepath.Join(dir, "key_info.txt")
+	if err := os.WriteFile(infoFile, []byte(k.uri+"\n"+keyFile+"\n"), 0o600); err != nil {
+		return "", fmt.Errorf("failed to write key info: %w", err)
+	}
+	return infoFile, nil
+}
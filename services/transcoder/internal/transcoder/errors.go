@@ -0,0 +1,29 @@
+package transcoder
+
+import "errors"
+
+// PermanentError marks failures that will not go away on retry (bad input, unknown profile,
+// missing source object). The consumer sends such tasks straight to the dead-letter topic.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
@@ -0,0 +1,246 @@
+package transcoder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCommand replays one recorded tool invocation. The first command whose tool and match
+// accept the arguments handles the call.
+type fakeCommand struct {
+	tool  string // ffmpeg or ffprobe
+	match func(args []string) bool
+	// stdout and stderr name testdata files written to the corresponding stream.
+	stdout string
+	stderr string
+	// run produces what cannot be recorded as a stream, e.g. HLS files or decoded PCM.
+	run func(args []string, stdout io.Writer) error
+	err error
+}
+
+// fakeRunner implements Runner without executing anything.
+type fakeRunner struct {
+	t        *testing.T
+	commands []fakeCommand
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *fakeRunner) Run(ctx context.Context, name string, args []string, stdout, stderr io.Writer) error {
+	tool := filepath.Base(name)
+	r.mu.Lock()
+	r.calls = append(r.calls, tool+" "+strings.Join(args, " "))
+	r.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, cmd := range r.commands {
+		if cmd.tool != tool || (cmd.match != nil && !cmd.match(args)) {
+			continue
+		}
+		if err := replay(cmd.stdout, stdout); err != nil {
+			return err
+		}
+		if err := replay(cmd.stderr, stderr); err != nil {
+			return err
+		}
+		if cmd.run != nil {
+			if stdout == nil {
+				stdout = io.Discard
+			}
+			if err := cmd.run(args, stdout); err != nil {
+				return err
+			}
+		}
+		return cmd.err
+	}
+	r.t.Errorf("unexpected command: %s %s", tool, strings.Join(args, " "))
+	return errors.New("no recorded output for command")
+}
+
+// callCount returns how many calls contained every given fragment.
+func (r *fakeRunner) callCount(fragments ...string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, call := range r.calls {
+		matched := true
+		for _, fragment := range fragments {
+			if !strings.Contains(call, fragment) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			n++
+		}
+	}
+	return n
+}
+
+func replay(file string, w io.Writer) error {
+	if file == "" || w == nil {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join("testdata", file))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// argValue returns the value following flag, or "".
+func argValue(args []string, flag string) string {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == flag {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+func withArg(flag, prefix string) func(args []string) bool {
+	return func(args []string) bool {
+		return strings.HasPrefix(argValue(args, flag), prefix)
+	}
+}
+
+// writeHLSVariant stands in for an fMP4 HLS encode: it writes the recorded media playlist to the
+// output path and empty init and media segments next to it, or a single media file with
+// -hls_flags single_file.
+func writeHLSVariant(args []string, _ io.Writer) error {
+	indexPath := args[len(args)-1]
+	dir := filepath.Dir(indexPath)
+	singleFile := argValue(args, "-hls_flags") == "single_file"
+	recorded := "hls_index.m3u8"
+	if singleFile {
+		recorded = "hls_single_file.m3u8"
+	}
+	playlist, err := os.ReadFile(filepath.Join("testdata", recorded))
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(indexPath, playlist, 0o644); err != nil {
+		return err
+	}
+	if singleFile {
+		// verification requires the byte ranges to cover the media file exactly
+		parsed, err := parseMediaPlaylist(indexPath)
+		if err != nil {
+			return err
+		}
+		last := parsed.Segments[len(parsed.Segments)-1].ByteRange
+		return os.WriteFile(argValue(args, "-hls_segment_filename"), make([]byte, last.Offset+last.Length), 0o644)
+	}
+	segments := []string{"init.mp4"}
+	for i := 0; i < 4; i++ {
+		segments = append(segments, fmt.Sprintf("chunk_%05d.m4s", i))
+	}
+	for _, name := range segments {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("fmp4"), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isClipEncode matches encodes limited with -t, e.g. the preview or a trimmed track, which the
+// recorded 8 s playlists do not fit.
+func isClipEncode(args []string) bool {
+	return argValue(args, "-f") == "hls" && argValue(args, "-t") != ""
+}
+
+// writeClipVariant stands in for an fMP4 HLS encode of -t seconds: it writes a media playlist of
+// -hls_time segments and empty init and media segments next to it. Clips are never single-file.
+func writeClipVariant(args []string, _ io.Writer) error {
+	indexPath := args[len(args)-1]
+	dir := filepath.Dir(indexPath)
+	duration, err := strconv.ParseFloat(argValue(args, "-t"), 64)
+	if err != nil {
+		return fmt.Errorf("clip encode called without -t: %w", err)
+	}
+	segmentSec, err := strconv.ParseFloat(argValue(args, "-hls_time"), 64)
+	if err != nil {
+		return fmt.Errorf("encode called without -hls_time: %w", err)
+	}
+
+	var playlist strings.Builder
+	fmt.Fprintf(&playlist, "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(segmentSec)))
+	playlist.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n")
+	playlist.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n#EXT-X-MAP:URI=\"init.mp4\"\n")
+	for i := 0; float64(i)*segmentSec < duration-1e-9; i++ {
+		name := fmt.Sprintf("chunk_%05d.m4s", i)
+		fmt.Fprintf(&playlist, "#EXTINF:%.6f,\n%s\n", math.Min(segmentSec, duration-float64(i)*segmentSec), name)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("fmp4"), 0o644); err != nil {
+			return err
+		}
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+	if err := os.WriteFile(filepath.Join(dir, "init.mp4"), []byte("fmp4"), 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(indexPath, []byte(playlist.String()), 0o644)
+}
+
+// probeRendition stands in for ffprobe -count_packets on a rendition playlist: a stereo 44.1 kHz
+// AAC stream as long as the playlist, or seconds long when seconds is positive.
+func probeRendition(seconds float64) func(args []string, stdout io.Writer) error {
+	return func(args []string, stdout io.Writer) error {
+		duration := seconds
+		if duration <= 0 {
+			playlist, err := parseMediaPlaylist(args[len(args)-1])
+			if err != nil {
+				return err
+			}
+			duration = playlist.totalDuration()
+		}
+		framing := codecFraming["aac"]
+		packets := int(math.Ceil((duration*44100 + float64(framing.delay)) / float64(framing.frame)))
+		_, err := fmt.Fprintf(stdout, `{"streams": [{"codec_type": "audio", "codec_name": "aac", "sample_rate": "44100", "channels": 2, "nb_read_packets": "%d"}], "format": {"duration": "%.6f"}}`,
+			packets, duration)
+		return err
+	}
+}
+
+// isSourceProbe matches the ffprobe call that reads the source's streams and format.
+func isSourceProbe(args []string) bool {
+	return slices.Contains(args, "-show_format")
+}
+
+// isRenditionProbe matches ffprobe calls on a rendition playlist rather than on the source.
+func isRenditionProbe(args []string) bool {
+	return strings.HasSuffix(args[len(args)-1], ".m3u8")
+}
+
+// decodeTone stands in for the PCM decoder with seconds of a 440 Hz tone at the requested rate.
+func decodeTone(seconds float64) func(args []string, stdout io.Writer) error {
+	return func(args []string, stdout io.Writer) error {
+		rate, err := strconv.Atoi(argValue(args, "-ar"))
+		if err != nil {
+			return fmt.Errorf("decoder called without -ar: %w", err)
+		}
+		samples := int(seconds * float64(rate))
+		buf := make([]byte, samples*2)
+		for i := 0; i < samples; i++ {
+			v := 0.5 * math.Sin(2*math.Pi*440*float64(i)/float64(rate))
+			binary.LittleEndian.PutUint16(buf[i*2:], uint16(int16(v*32767)))
+		}
+		_, err = stdout.Write(buf)
+		return err
+	}
+}
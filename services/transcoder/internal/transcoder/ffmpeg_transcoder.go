@@ -11,20 +11,25 @@ import (
 	"math/rand"
 	"net/url"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/MusicSocial/transcoder/internal/config"
 	"github.com/MusicSocial/transcoder/internal/storage"
 	"github.com/MusicSocial/transcoder/internal/tracks"
 )
 
 type FFmpegTranscoder struct {
-	storage     *storage.MinIO
+	storage     storage.Storage
+	urls        storage.PublicURLs
 	trackClient tracks.Client
+	runner      Runner
+	settings    config.TranscodingConfig
+	limits      config.WorkerConfig
 	bucketName  string
 	workDir     string
 	logger      *log.Logger
@@ -32,13 +37,29 @@ type FFmpegTranscoder struct {
 	ffprobePath string
 }
 
-func NewFFmpegTranscoder(storage *storage.MinIO, trackClient tracks.Client, workDir string, logger *log.Logger) *FFmpegTranscoder {
+func NewFFmpegTranscoder(storage storage.Storage, urls storage.PublicURLs, trackClient tracks.Client, runner Runner, settings config.TranscodingConfig, limits config.WorkerConfig, workDir string, logger *log.Logger) *FFmpegTranscoder {
 	if workDir == "" {
 		workDir = os.TempDir()
 	}
+	if limits.VariantParallelism < 1 {
+		limits.VariantParallelism = 1
+	}
+	if limits.InstanceID == "" {
+		limits.InstanceID = "transcoder"
+	}
+	if limits.HeartbeatInterval <= 0 {
+		limits.HeartbeatInterval = 30 * time.Second
+	}
+	if limits.LeaseTTL <= limits.HeartbeatInterval {
+		limits.LeaseTTL = 3 * limits.HeartbeatInterval
+	}
 	return &FFmpegTranscoder{
 		storage:     storage,
+		urls:        urls,
 		trackClient: trackClient,
+		runner:      runner,
+		settings:    settings,
+		limits:      limits,
 		bucketName:  storage.Bucket(),
 		workDir:     workDir,
 		logger:      logger,
@@ -47,82 +68,453 @@ func NewFFmpegTranscoder(storage *storage.MinIO, trackClient tracks.Client, work
 	}
 }
 
-func (t *FFmpegTranscoder) Transcode(ctx context.Context, task Task) error {
+func (t *FFmpegTranscoder) Transcode(ctx context.Context, task Task, report *Report) error {
+	profile, err := t.settings.Profile(task.Profile)
+	if err != nil {
+		return Permanent(err)
+	}
+	ladder, err := resolveLadder(profile)
+	if err != nil {
+		return Permanent(err)
+	}
+	loudnessSettings, err := resolveLoudness(t.settings.Loudness, task)
+	if err != nil {
+		return Permanent(err)
+	}
+	segments := resolveSegments(t.settings, profile)
+	previewSettings := resolvePreview(t.settings.Preview, task)
+	silenceSettings, err := resolveSilence(t.settings.Silence, task)
+	if err != nil {
+		return Permanent(err)
+	}
+
 	jobDir, err := os.MkdirTemp(t.workDir, fmt.Sprintf("transcode-%s-%s-", task.ArtistID, shortID()))
 	if err != nil {
 		return fmt.Errorf("failed to create job workspace: %w", err)
 	}
 	defer os.RemoveAll(jobDir)
 
-	bucket, objectKey, baseURL, err := parseTrackURL(task.TrackURL)
+	source, err := task.ResolveSource(t.bucketName)
 	if err != nil {
-		return err
-	}
-	if bucket == "" {
-		bucket = t.bucketName
+		return Permanent(err)
 	}
+	bucket := source.Bucket
 
-	if baseURL == "" {
-		baseURL = defaultBaseURL(t.storage.Endpoint())
+	stageStart := time.Now()
+	lease, err := t.acquireLease(ctx, bucket, LeaseKey(task.ArtistID, task.TrackID), task.TrackID)
+	if err != nil {
+		return err
 	}
+	defer lease.release(ctx)
+	// a lease taken over by another job cancels the rest of this one before it uploads anything
+	ctx = lease.ctx
+	report.since("lease", stageStart)
 
-	sourceFile := filepath.Join(jobDir, filepath.Base(objectKey))
-	if err := t.storage.DownloadToFile(ctx, bucket, objectKey, sourceFile); err != nil {
+	sourceFile := filepath.Join(jobDir, filepath.Base(source.Key))
+	stageStart = time.Now()
+	if err := t.storage.DownloadToFile(ctx, bucket, source.Key, sourceFile); err != nil {
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			return Permanent(fmt.Errorf("failed to download source audio: %w", err))
+		}
 		return fmt.Errorf("failed to download source audio: %w", err)
 	}
 
+	report.since("download", stageStart)
 	t.logger.Printf("downloaded source audio to %s", sourceFile)
 
+	sourceHash, err := hashFile(sourceFile)
+	if err != nil {
+		return fmt.Errorf("failed to hash source audio: %w", err)
+	}
+	if err := checkSource(source, sourceFile, sourceHash); err != nil {
+		return Permanent(err)
+	}
+	encryption := t.settings.Encryption.Mode
+	version, err := ladderVersion(profile, segments, loudnessSettings, encryption, previewSettings, silenceSettings)
+	if err != nil {
+		return fmt.Errorf("failed to compute ladder version: %w", err)
+	}
+
+	metadataPrefix := path.Join(task.ArtistID, task.TrackID, "metadata")
+	transcodedPrefix := path.Join(task.ArtistID, task.TrackID, "transcoded")
+	coverPrefix := path.Join(task.ArtistID, task.TrackID, coverDirName)
+	manifestKey := path.Join(metadataPrefix, manifestFileName)
+	masterKey := path.Join(transcodedPrefix, "master.m3u8")
+
+	if !task.ForceReprocess {
+		done, err := t.completedManifest(ctx, bucket, manifestKey, masterKey, profile.Name, version, sourceHash)
+		if err != nil {
+			// an unreadable manifest only costs a full run
+			t.logger.Printf("ignoring output manifest for track_id=%s: %v", task.TrackID, err)
+		} else if done != nil {
+			t.logger.Printf("outputs for track_id=%s are up to date (profile=%s, ladder=%s), skipping transcoding", task.TrackID, profile.Name, version)
+			// URLs are rebuilt so a changed public base reaches Track Service without re-encoding
+			info := done.TrackInfo
+			t.setObjectURLs(&info, bucket, task.ArtistID, task.TrackID, info.DashURL != "", info.PreviewURL != "", info.CoverURL != "")
+			report.setSkipped(newOutputs(bucket, manifestKey, info))
+			return t.reportTrackInfo(ctx, task.TrackID, info)
+		}
+	}
+
+	stageStart = time.Now()
 	techMeta, err := t.extractTechMetadata(ctx, sourceFile)
 	if err != nil {
+		// ffprobe rejecting a fully downloaded file means the upload itself is broken
+		if ctx.Err() == nil {
+			return Permanent(fmt.Errorf("failed to extract metadata: %w", err))
+		}
 		return fmt.Errorf("failed to extract metadata: %w", err)
 	}
+	techMeta.SourceSHA256 = sourceHash
+	techMeta.SourceContentType = source.ContentType
+	report.since("probe", stageStart)
 
-	loudness, err := t.measureLoudness(ctx, sourceFile)
+	stageStart = time.Now()
+	loudness, err := t.measureLoudness(ctx, sourceFile, loudnessSettings)
 	if err != nil {
 		return fmt.Errorf("failed to measure loudness: %w", err)
 	}
+	report.since("loudness", stageStart)
+
+	encode := encodeOptions{
+		audioFilter:      loudness.normalizationFilter(loudnessSettings),
+		tags:             loudness.gainTags(loudnessSettings),
+		sourceSampleRate: techMeta.SampleRate,
+		segments:         segments,
+		report:           report,
+	}
+	if loudnessSettings.mode != normalizationOff && loudness.Silent {
+		t.logger.Printf("skipping loudness normalization for track_id=%s: input is silent", task.TrackID)
+		loudness.Normalization.Mode = normalizationOff
+	}
+
+	// renditions cover the audible part when trimming; tech_meta.json keeps the source timeline
+	playedDuration := techMeta.DurationSec
+	if silenceSettings.Policy != silencePolicyOff {
+		stageStart = time.Now()
+		silence, err := t.detectSilence(ctx, sourceFile, silenceSettings, techMeta.DurationSec)
+		if err != nil {
+			return fmt.Errorf("failed to detect silence: %w", err)
+		}
+		report.since("silence", stageStart)
+		if silenceSettings.Policy == silencePolicyTrim && (silence.LeadingSec > 0 || silence.TrailingSec > 0) {
+			silence.Trimmed = true
+			playedDuration = silence.AudioEndSec - silence.AudioStartSec
+			encode.clip = &PreviewWindow{OffsetSec: silence.AudioStartSec, DurationSec: playedDuration}
+		}
+		techMeta.Silence = silence
+	}
+
+	var key *hlsKey
+	if encryption == encryptionAES128 {
+		key, err = newHLSKey(t.settings.Encryption.KeyURIBase, task.TrackID)
+		if err != nil {
+			return err
+		}
+		// kept outside transcodedDir, which is uploaded to the public bucket as is
+		encode.keyInfoFile, err = key.writeKeyInfo(filepath.Join(jobDir, "keys"))
+		if err != nil {
+			return err
+		}
+	}
+
+	stageStart = time.Now()
+	waveform, err := t.generateWaveform(ctx, sourceFile)
+	if err != nil {
+		return fmt.Errorf("failed to generate waveform: %w", err)
+	}
+	report.since("waveform", stageStart)
+
+	var fingerprint *Fingerprint
+	if t.settings.Fingerprint {
+		stageStart = time.Now()
+		fingerprint, err = t.generateFingerprint(ctx, sourceFile)
+		if err != nil {
+			t.logger.Printf("failed to fingerprint track_id=%s: %v", task.TrackID, err)
+		}
+		report.since("fingerprint", stageStart)
+	}
+
+	// tempo and key only enrich the catalogue, so a failed analysis does not fail the track
+	stageStart = time.Now()
+	analysis, err := t.analyzeAudio(ctx, sourceFile)
+	if err != nil {
+		t.logger.Printf("failed to analyze audio for track_id=%s: %v", task.TrackID, err)
+		analysis = nil
+	}
+	report.since("analysis", stageStart)
+
+	// a suspected transcode is only flagged for moderation, so a failed check does not fail the track
+	stageStart = time.Now()
+	techMeta.Spectral, err = t.analyzeSpectrum(ctx, sourceFile, techMeta)
+	if err != nil {
+		t.logger.Printf("failed to analyze spectrum for track_id=%s: %v", task.TrackID, err)
+		techMeta.Spectral = nil
+	} else if techMeta.Spectral.SuspectedTranscode {
+		t.logger.Printf("track_id=%s is a suspected transcode (confidence %.2f): %s",
+			task.TrackID, techMeta.Spectral.Confidence, techMeta.Spectral.Reason)
+	}
+	report.since("spectral", stageStart)
 
 	transcodedDir := filepath.Join(jobDir, "transcoded")
 	if err := os.MkdirAll(transcodedDir, 0o755); err != nil {
 		return fmt.Errorf("failed to create transcoded directory: %w", err)
 	}
 
-	if err := t.generateHLS(ctx, sourceFile, transcodedDir); err != nil {
+	stageStart = time.Now()
+	if err := t.generateHLS(ctx, sourceFile, transcodedDir, ladder, encode); err != nil {
 		return fmt.Errorf("failed to generate HLS outputs: %w", err)
 	}
+	report.since("encode", stageStart)
+	if techMeta.durationEstimated {
+		playedDuration = t.measuredDuration(task.TrackID, transcodedDir, ladder, playedDuration)
+		if encode.clip == nil {
+			techMeta.DurationSec = roundToDecimals(playedDuration, 1)
+		}
+	}
+	delays := t.probeEncoderDelays(ctx, transcodedDir, ladder, encode.segments)
+	if err := newGaplessInfo(ladder, playedDuration, techMeta.SampleRate, techMeta.Silence, delays).write(transcodedDir); err != nil {
+		return err
+	}
 
-	metadataPrefix := path.Join(task.ArtistID, task.TrackID, "metadata")
+	// DASH players cannot decrypt HLS AES-128 segments, so encrypted tracks are HLS only
+	if key == nil {
+		if err := t.writeDASHManifest(transcodedDir, ladder, techMeta.SampleRate); err != nil {
+			return fmt.Errorf("failed to generate DASH manifest: %w", err)
+		}
+	}
+
+	// the clip is built outside transcodedDir: it goes to its own bucket, not next to the full track
+	previewDir := filepath.Join(jobDir, previewDirName)
+	hasPreview := false
+	if previewSettings.Enabled {
+		window := choosePreviewWindow(previewSettings, techMeta.DurationSec, waveform)
+		// the full track is still playable for signed-in users, so a failed clip only loses the preview
+		if err := t.generatePreview(ctx, sourceFile, jobDir, previewSettings, window, encode); err != nil {
+			t.logger.Printf("failed to generate preview for track_id=%s: %v", task.TrackID, err)
+			_ = os.RemoveAll(previewDir)
+		} else {
+			hasPreview = true
+			techMeta.Preview = &window
+		}
+	}
+
+	coverDir := filepath.Join(jobDir, coverDirName)
+	hasCover := false
+	if techMeta.HasCoverArt {
+		// broken artwork must not fail the track; Track Service falls back to the default cover
+		if err := t.extractCoverArt(ctx, sourceFile, techMeta.coverStreamIndex, coverDir); err != nil {
+			t.logger.Printf("failed to extract cover art for track_id=%s: %v", task.TrackID, err)
+		} else {
+			hasCover = true
+		}
+	}
+
+	// checked before the upload, so broken renditions never replace published ones
+	if t.settings.Verify.Enabled {
+		stageStart = time.Now()
+		checks := make([]renditionCheck, 0, len(ladder))
+		for _, variant := range ladder {
+			checks = append(checks, renditionCheck{variant: variant, dir: filepath.Join(transcodedDir, variant.Name), durationSec: playedDuration})
+		}
+		var keyFile string
+		if key != nil {
+			keyFile = key.file
+		}
+		verifyDir := filepath.Join(jobDir, "verify")
+		failures, err := t.verifyRenditions(ctx, checks, segments, keyFile, verifyDir, techMeta.SampleRate)
+		if err != nil {
+			return fmt.Errorf("failed to verify renditions: %w", err)
+		}
+		if len(failures) > 0 {
+			return verificationError(failures)
+		}
+
+		if hasPreview {
+			variant, err := previewRendition(previewSettings)
+			if err == nil {
+				check := renditionCheck{variant: variant, dir: previewDir, durationSec: techMeta.Preview.DurationSec}
+				failures, err = t.verifyRenditions(ctx, []renditionCheck{check}, segments, "", verifyDir, techMeta.SampleRate)
+			}
+			if err == nil && len(failures) > 0 {
+				err = &VerificationError{Failures: failures}
+			}
+			if err != nil {
+				t.logger.Printf("dropping preview for track_id=%s: %v", task.TrackID, err)
+				_ = os.RemoveAll(previewDir)
+				hasPreview = false
+				techMeta.Preview = nil
+			}
+		}
+		report.since("verify", stageStart)
+	}
+
+	stageStart = time.Now()
+	if hasPreview {
+		if err := t.storage.UploadDirectory(ctx, previewSettings.Bucket, task.TrackID, previewDir); err != nil {
+			t.logger.Printf("dropping preview for track_id=%s: %v", task.TrackID, err)
+			hasPreview = false
+			techMeta.Preview = nil
+		}
+	}
 	if err := t.storage.UploadJSON(ctx, bucket, path.Join(metadataPrefix, "tech_meta.json"), techMeta); err != nil {
 		return fmt.Errorf("failed to upload tech_meta.json: %w", err)
 	}
 	if err := t.storage.UploadJSON(ctx, bucket, path.Join(metadataPrefix, "loudness.json"), loudness); err != nil {
 		return fmt.Errorf("failed to upload loudness.json: %w", err)
 	}
+	if err := t.storage.UploadJSON(ctx, bucket, path.Join(metadataPrefix, "tags.json"), techMeta.tags); err != nil {
+		return fmt.Errorf("failed to upload tags.json: %w", err)
+	}
+	// the preview window was picked on the source timeline, the scrubber follows the renditions
+	if silence := techMeta.Silence; silence != nil && silence.Trimmed {
+		waveform = trimWaveform(waveform, silence.LeadingSec, silence.TrailingSec)
+	}
+	waveformJSON, err := json.Marshal(waveform)
+	if err != nil {
+		return fmt.Errorf("failed to marshal waveform: %w", err)
+	}
+	waveformKey := path.Join(metadataPrefix, "waveform.json")
+	if err := t.storage.UploadBytes(ctx, bucket, waveformKey, waveformJSON, "application/json"); err != nil {
+		return fmt.Errorf("failed to upload waveform.json: %w", err)
+	}
+	if err := t.storage.UploadBytes(ctx, bucket, path.Join(metadataPrefix, "waveform.dat"), waveform.EncodeDAT(), "application/octet-stream"); err != nil {
+		return fmt.Errorf("failed to upload waveform.dat: %w", err)
+	}
+
+	if analysis != nil {
+		if err := t.storage.UploadJSON(ctx, bucket, path.Join(metadataPrefix, analysisFileName), analysis); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", analysisFileName, err)
+		}
+	}
+
+	// the key must be retrievable before any playlist referencing it is published
+	if key != nil {
+		if err := t.storage.UploadBytes(ctx, t.settings.Encryption.KeyBucket, key.objectKey(task.TrackID), key.key, "application/octet-stream"); err != nil {
+			return fmt.Errorf("failed to store HLS key: %w", err)
+		}
+	}
 
-	transcodedPrefix := path.Join(task.ArtistID, task.TrackID, "transcoded")
 	if err := t.storage.UploadDirectory(ctx, bucket, transcodedPrefix, transcodedDir); err != nil {
 		return fmt.Errorf("failed to upload transcoded assets: %w", err)
 	}
+	// a DASH manifest from an unencrypted run would keep pointing at the replaced segments
+	if key != nil {
+		if err := t.storage.Delete(ctx, bucket, path.Join(transcodedPrefix, dashManifestName)); err != nil {
+			return fmt.Errorf("failed to remove stale DASH manifest: %w", err)
+		}
+	}
 
-	if t.trackClient != nil {
-		masterKey := path.Join(transcodedPrefix, "master.m3u8")
-		masterURL := t.buildObjectURL(baseURL, bucket, masterKey)
+	if err := t.removeLegacyPreview(ctx, bucket, transcodedPrefix); err != nil {
+		return err
+	}
 
-		rounded := int64(math.Round(techMeta.DurationSec))
-		var duration32 int32
-		switch {
-		case rounded < 0:
-			duration32 = 0
-		case rounded > math.MaxInt32:
-			duration32 = math.MaxInt32
-		default:
-			duration32 = int32(rounded)
+	if hasCover {
+		if err := t.storage.UploadDirectory(ctx, bucket, coverPrefix, coverDir); err != nil {
+			return fmt.Errorf("failed to upload cover art: %w", err)
+		}
+	}
+
+	report.since("upload", stageStart)
+
+	coverKey := path.Join(coverPrefix, coverFileName(coverPrimarySize, "jpg"))
+	if t.settings.Verify.Enabled {
+		stageStart = time.Now()
+		extraKeys := []string{path.Join(metadataPrefix, "tech_meta.json"), waveformKey}
+		if hasCover {
+			extraKeys = append(extraKeys, coverKey)
+		}
+		failures, err := t.verifyUploaded(ctx, bucket, transcodedPrefix, transcodedDir, extraKeys)
+		if err != nil {
+			return fmt.Errorf("failed to verify uploads: %w", err)
 		}
+		if len(failures) > 0 {
+			return verificationError(failures)
+		}
+		report.since("verify_upload", stageStart)
+	}
+
+	rounded := int64(math.Round(playedDuration))
+	var duration32 int32
+	switch {
+	case rounded < 0:
+		duration32 = 0
+	case rounded > math.MaxInt32:
+		duration32 = math.MaxInt32
+	default:
+		duration32 = int32(rounded)
+	}
+
+	info := tracks.TrackInfo{DurationSec: duration32}
+	t.setObjectURLs(&info, bucket, task.ArtistID, task.TrackID, key == nil, hasPreview, hasCover)
+	if tags := techMeta.tags; !tags.empty() {
+		info.Suggested = &tracks.SuggestedMetadata{
+			Title:       tags.Title,
+			Artists:     tags.Artists,
+			Album:       tags.Album,
+			TrackNumber: int32(tags.TrackNumber),
+			Year:        int32(tags.Year),
+			ISRC:        tags.ISRC,
+			Genre:       tags.Genre,
+			Explicit:    tags.Explicit,
+		}
+	}
+	if analysis != nil {
+		info.Analysis = &tracks.Analysis{
+			BPM:          analysis.BPM,
+			Key:          analysis.Key,
+			Camelot:      analysis.Camelot,
+			Energy:       analysis.Energy,
+			Danceability: analysis.Danceability,
+		}
+	}
+	if spectral := techMeta.Spectral; spectral != nil {
+		info.SourceQuality = &tracks.SourceQuality{
+			SuspectedTranscode: spectral.SuspectedTranscode,
+			Confidence:         spectral.Confidence,
+			CutoffHz:           int32(spectral.CutoffHz),
+			ExpectedCutoffHz:   int32(spectral.ExpectedCutoffHz),
+		}
+	}
 
-		if err := t.trackClient.UpdateTrackInfo(ctx, task.TrackID, masterURL, duration32, ""); err != nil {
-			return fmt.Errorf("failed to update track info: %w", err)
+	manifest := OutputManifest{
+		Profile:       profile.Name,
+		LadderVersion: version,
+		SourceSHA256:  sourceHash,
+		TrackInfo:     info,
+		CompletedAt:   time.Now().UTC(),
+	}
+	for _, key := range []string{"tech_meta.json", "loudness.json", "tags.json", "waveform.json", "waveform.dat"} {
+		manifest.Outputs = append(manifest.Outputs, path.Join(metadataPrefix, key))
+	}
+	if analysis != nil {
+		manifest.Outputs = append(manifest.Outputs, path.Join(metadataPrefix, analysisFileName))
+	}
+	transcodedKeys, err := objectKeys(transcodedPrefix, transcodedDir)
+	if err != nil {
+		return fmt.Errorf("failed to list transcoded assets: %w", err)
+	}
+	manifest.Outputs = append(manifest.Outputs, transcodedKeys...)
+	if hasCover {
+		coverKeys, err := objectKeys(coverPrefix, coverDir)
+		if err != nil {
+			return fmt.Errorf("failed to list cover art: %w", err)
 		}
+		manifest.Outputs = append(manifest.Outputs, coverKeys...)
+	}
+	// written last: a manifest only exists for jobs whose every output was uploaded
+	if err := t.storage.UploadJSON(ctx, bucket, manifestKey, manifest); err != nil {
+		return fmt.Errorf("failed to upload output manifest: %w", err)
+	}
+	report.setOutputs(newOutputs(bucket, manifestKey, info))
+
+	// flagged before the track becomes ready, so moderators see duplicates as soon as they appear
+	if fingerprint != nil {
+		t.storeFingerprint(ctx, task.TrackID, fingerprint)
+	}
+
+	if err := t.reportTrackInfo(ctx, task.TrackID, info); err != nil {
+		return err
 	}
 
 	t.logger.Printf("successfully processed track_id=%s artist_id=%s", task.TrackID, task.ArtistID)
@@ -138,31 +530,56 @@ type TechMetadata struct {
 	OriginalBitrate int     `json:"original_bitrate,omitempty"`
 	FileSize        int64   `json:"file_size"`
 	ChannelLayout   string  `json:"channel_layout,omitempty"`
+	HasCoverArt     bool    `json:"has_cover_art"`
+	SourceSHA256    string  `json:"source_sha256"`
+	// SourceContentType is what the uploader declared; empty for version 1 tasks.
+	SourceContentType string `json:"source_content_type,omitempty"`
+	// Preview is set when the preview clip was produced.
+	Preview *PreviewWindow `json:"preview,omitempty"`
+	// Silence is set unless the silence policy is off.
+	Silence *SilenceInfo `json:"silence,omitempty"`
+	// Spectral is missing when the bandwidth check failed.
+	Spectral *SpectralInfo `json:"spectral,omitempty"`
+
+	coverStreamIndex int
+	tags             TrackTags
+	// durationEstimated is set when ffprobe extrapolated DurationSec from the bitrate, which can
+	// be far off; the encoded renditions then measure the real duration.
+	durationEstimated bool
 }
 
-type LoudnessMetrics struct {
-	InputI         float64 `json:"input_i"`
-	InputTP        float64 `json:"input_tp"`
-	InputLRA       float64 `json:"input_lra"`
-	InputThreshold float64 `json:"input_thresh"`
-	TargetOffset   float64 `json:"target_offset"`
+func (t *FFmpegTranscoder) reportTrackInfo(ctx context.Context, trackID string, info tracks.TrackInfo) error {
+	if t.trackClient == nil {
+		return nil
+	}
+	if err := t.trackClient.UpdateTrackInfo(ctx, trackID, info); err != nil {
+		if tracks.IsPermanent(err) {
+			return Permanent(fmt.Errorf("failed to update track info: %w", err))
+		}
+		return fmt.Errorf("failed to update track info: %w", err)
+	}
+	return nil
 }
 
+// durationEstimateWarning is what ffprobe logs when the container has no duration, e.g. a VBR MP3
+// without a Xing header, and it extrapolates one from the first frames' bitrate instead.
+const durationEstimateWarning = "Estimating duration from bitrate"
+
 func (t *FFmpegTranscoder) extractTechMetadata(ctx context.Context, input string) (*TechMetadata, error) {
-	cmd := exec.CommandContext(ctx, t.ffprobePath,
-		"-v", "quiet",
+	var output, warnings bytes.Buffer
+	err := t.runner.Run(ctx, t.ffprobePath, []string{
+		"-v", "warning",
 		"-print_format", "json",
 		"-show_format",
 		"-show_streams",
 		input,
-	)
-	output, err := cmd.Output()
+	}, &output, &warnings)
 	if err != nil {
 		return nil, fmt.Errorf("ffprobe failed: %w", err)
 	}
 
 	var probe ffprobeOutput
-	if err := json.Unmarshal(output, &probe); err != nil {
+	if err := json.Unmarshal(output.Bytes(), &probe); err != nil {
 		return nil, fmt.Errorf("failed to parse ffprobe output: %w", err)
 	}
 
@@ -172,13 +589,14 @@ func (t *FFmpegTranscoder) extractTechMetadata(ctx context.Context, input string
 	}
 
 	metadata := &TechMetadata{
-		DurationSec:     roundToDecimals(probe.formatDuration(), 1),
-		SampleRate:      stream.sampleRate(),
-		Channels:        stream.Channels,
-		OriginalCodec:   strings.ToUpper(stream.CodecName),
-		OriginalBitrate: probe.formatBitrate(),
-		FileSize:        probe.formatSize(),
-		ChannelLayout:   stream.ChannelLayout,
+		DurationSec:       roundToDecimals(probe.formatDuration(), 1),
+		durationEstimated: strings.Contains(warnings.String(), durationEstimateWarning),
+		SampleRate:        stream.sampleRate(),
+		Channels:          stream.Channels,
+		OriginalCodec:     strings.ToUpper(stream.CodecName),
+		OriginalBitrate:   probe.formatBitrate(),
+		FileSize:          probe.formatSize(),
+		ChannelLayout:     stream.ChannelLayout,
 	}
 
 	if metadata.OriginalBitrate == 0 && stream.BitRate != "" {
@@ -195,6 +613,13 @@ func (t *FFmpegTranscoder) extractTechMetadata(ctx context.Context, input string
 		metadata.BitDepth = &depth
 	}
 
+	metadata.tags = probe.extractTags()
+
+	if cover := probe.attachedPicture(); cover != nil {
+		metadata.HasCoverArt = true
+		metadata.coverStreamIndex = cover.Index
+	}
+
 	if metadata.DurationSec == 0 && probe.Format.Duration != "" {
 		if v, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
 			metadata.DurationSec = roundToDecimals(v, 1)
@@ -204,94 +629,121 @@ func (t *FFmpegTranscoder) extractTechMetadata(ctx context.Context, input string
 	return metadata, nil
 }
 
-func (t *FFmpegTranscoder) measureLoudness(ctx context.Context, input string) (*LoudnessMetrics, error) {
-	cmd := exec.CommandContext(ctx, t.ffmpegPath,
-		"-hide_banner",
-		"-i", input,
-		"-af", "loudnorm=I=-14:LRA=7:TP=-2:print_format=json",
-		"-f", "null",
-		"-",
-	)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, fmt.Errorf("ffmpeg loudnorm failed: %w (output=%s)", err, string(output))
-	}
-
-	jsonPayload, err := extractJSONBlock(output)
-	if err != nil {
-		return nil, fmt.Errorf("failed to extract loudness json: %w", err)
-	}
-
-	var raw loudnessRaw
-	if err := json.Unmarshal(jsonPayload, &raw); err != nil {
-		return nil, fmt.Errorf("failed to parse loudness json: %w", err)
-	}
-
-	return &LoudnessMetrics{
-		InputI:         raw.InputI,
-		InputTP:        raw.InputTP,
-		InputLRA:       raw.InputLRA,
-		InputThreshold: raw.InputThresh,
-		TargetOffset:   raw.TargetOffset,
-	}, nil
+type encodeOptions struct {
+	// audioFilter is applied to every rendition, e.g. the second loudnorm pass.
+	audioFilter string
+	// tags are KEY=value metadata written into the fMP4 of every rendition, e.g. ReplayGain.
+	tags []string
+	// sourceSampleRate is kept for renditions without an explicit rate, since loudnorm resamples to 192 kHz.
+	sourceSampleRate int
+	// keyInfoFile enables AES-128 segment encryption (ffmpeg -hls_key_info_file).
+	keyInfoFile string
+	// clip limits the encode to a part of the source, e.g. the preview or the audible part after trimming.
+	clip *PreviewWindow
+	// segments selects the segment duration and whether a variant is one file or many.
+	segments segmentLayout
+	// report receives the per-variant encode timings; may be nil.
+	report *Report
 }
 
-func (t *FFmpegTranscoder) generateHLS(ctx context.Context, input string, outputDir string) error {
-	variants := []struct {
-		Name      string
-		BitrateK  int
-		Bandwidth int
-	}{
-		{"aac_256", 256, 256000},
-		{"aac_160", 160, 160000},
-		{"aac_96", 96, 96000},
-	}
+func (t *FFmpegTranscoder) generateHLS(ctx context.Context, input string, outputDir string, variants []rendition, opts encodeOptions) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
+	slots := make(chan struct{}, t.limits.VariantParallelism)
+	errs := make(chan error, len(variants))
+	var wg sync.WaitGroup
 	for _, variant := range variants {
-		dir := filepath.Join(outputDir, variant.Name)
-		if err := os.MkdirAll(dir, 0o755); err != nil {
-			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
 		}
-
-		segmentPattern := filepath.ToSlash(filepath.Join(dir, "chunk_%05d.m4s"))
-		indexPath := filepath.Join(dir, "index.m3u8")
-
-		args := []string{
-			"-hide_banner",
-			"-y",
-			"-i", input,
-			"-map", "0:a:0",
-			"-c:a", "aac",
-			"-b:a", fmt.Sprintf("%dk", variant.BitrateK),
-			"-ac", "2",
-			"-movflags", "+faststart",
-			"-f", "hls",
-			"-hls_time", "2",
-			"-hls_playlist_type", "vod",
-			"-hls_segment_type", "fmp4",
-			"-hls_fmp4_init_filename", "init.mp4",
-			"-hls_segment_filename", segmentPattern,
-			indexPath,
+		if ctx.Err() != nil {
+			break
 		}
 
-		cmd := exec.CommandContext(ctx, t.ffmpegPath, args...)
-		var stderr bytes.Buffer
-		cmd.Stdout = &stderr
-		cmd.Stderr = &stderr
-
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("ffmpeg failed for variant %s: %w (output=%s)", variant.Name, err, stderr.String())
-		}
+		wg.Add(1)
+		go func(variant rendition) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := t.encodeVariant(ctx, input, outputDir, variant, opts); err != nil {
+				errs <- err
+				// stop the remaining encodes, the task fails as a whole anyway
+				cancel()
+			}
+		}(variant)
+	}
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
 	return t.writeMasterPlaylist(outputDir, variants)
 }
 
-func (t *FFmpegTranscoder) writeMasterPlaylist(outputDir string, variants []struct {
-	Name      string
-	BitrateK  int
-	Bandwidth int
-}) error {
+func (t *FFmpegTranscoder) encodeVariant(ctx context.Context, input string, outputDir string, variant rendition, opts encodeOptions) error {
+	dir := filepath.Join(outputDir, variant.Name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+
+	indexPath := filepath.Join(dir, "index.m3u8")
+
+	args := []string{"-hide_banner", "-y"}
+	if opts.clip != nil {
+		// input seeking restarts timestamps at zero, which the preview fades rely on
+		args = append(args,
+			"-ss", strconv.FormatFloat(opts.clip.OffsetSec, 'f', 3, 64),
+			"-t", strconv.FormatFloat(opts.clip.DurationSec, 'f', 3, 64),
+		)
+	}
+	args = append(args, "-i", input, "-map", "0:a:0")
+	if t.limits.FFmpegThreads > 0 {
+		args = append(args, "-threads", strconv.Itoa(t.limits.FFmpegThreads))
+	}
+	if opts.audioFilter != "" {
+		args = append(args, "-af", opts.audioFilter)
+	}
+	args = append(args, variant.encoderArgs(opts.sourceSampleRate)...)
+	for _, tag := range opts.tags {
+		args = append(args, "-metadata", tag)
+	}
+	args = append(args,
+		"-movflags", "+faststart",
+		// the hls muxer would otherwise shift the negative timestamps of the priming samples to
+		// zero before the mp4 muxer sees them, and the edit list that skips them would be lost
+		"-avoid_negative_ts", "disabled",
+		"-f", "hls",
+	)
+	args = append(args, opts.segments.hlsArgs(dir)...)
+	// the edit list in the init section tells players to skip the encoder delay, see gapless.go
+	segmentOptions := []string{"use_editlist=1"}
+	if len(opts.tags) > 0 {
+		// the mp4 muxer only keeps keys outside its own tag set with use_metadata_tags
+		segmentOptions = append(segmentOptions, "movflags=+use_metadata_tags")
+	}
+	args = append(args, "-hls_segment_options", strings.Join(segmentOptions, ":"))
+	if opts.keyInfoFile != "" {
+		args = append(args, "-hls_key_info_file", opts.keyInfoFile)
+	}
+	args = append(args, indexPath)
+
+	var stderr bytes.Buffer
+	start := time.Now()
+	if err := t.runner.Run(ctx, t.ffmpegPath, args, &stderr, &stderr); err != nil {
+		return fmt.Errorf("ffmpeg failed for variant %s: %w (output=%s)", variant.Name, err, stderr.String())
+	}
+	ffmpegDuration.WithLabelValues(variant.Name, variant.Codec).Observe(time.Since(start).Seconds())
+	opts.report.since("encode/"+variant.Name, start)
+	return nil
+}
+
+func (t *FFmpegTranscoder) writeMasterPlaylist(outputDir string, variants []rendition) error {
 	masterPath := filepath.Join(outputDir, "master.m3u8")
 	file, err := os.Create(masterPath)
 	if err != nil {
@@ -303,9 +755,10 @@ func (t *FFmpegTranscoder) writeMasterPlaylist(outputDir string, variants []stru
 	builder.WriteString("#EXTM3U\n")
 	builder.WriteString("#EXT-X-VERSION:7\n")
 	builder.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	builder.WriteString(fmt.Sprintf("#EXT-X-SESSION-DATA:DATA-ID=\"%s\",URI=\"%s\"\n", gaplessDataID, gaplessFileName))
 
 	for _, variant := range variants {
-		builder.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,CODECS=\"mp4a.40.2\",NAME=\"AAC %d\"\n", variant.Bandwidth, variant.Bandwidth, variant.BitrateK))
+		builder.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,CODECS=\"%s\",NAME=\"%s\"\n", variant.bandwidth(), variant.bandwidth(), variant.codec.hlsCodec, variant.displayName()))
 		builder.WriteString(fmt.Sprintf("%s/index.m3u8\n", variant.Name))
 	}
 
@@ -322,6 +775,7 @@ type ffprobeOutput struct {
 }
 
 type ffprobeStream struct {
+	Index         int    `json:"index"`
 	CodecType     string `json:"codec_type"`
 	CodecName     string `json:"codec_name"`
 	SampleRate    string `json:"sample_rate"`
@@ -330,13 +784,22 @@ type ffprobeStream struct {
 	BitsPerRaw    string `json:"bits_per_raw_sample"`
 	BitRate       string `json:"bit_rate"`
 	ChannelLayout string `json:"channel_layout"`
+	// NbReadPackets is only filled with -count_packets.
+	NbReadPackets string `json:"nb_read_packets"`
+	// InitialPadding is the encoder delay in samples, as declared by the container.
+	InitialPadding int `json:"initial_padding"`
+	Disposition    struct {
+		AttachedPic int `json:"attached_pic"`
+	} `json:"disposition"`
+	Tags map[string]string `json:"tags"`
 }
 
 type ffprobeFormat struct {
-	Duration  string `json:"duration"`
-	BitRate   string `json:"bit_rate"`
-	Size      string `json:"size"`
-	CodecName string `json:"format_name"`
+	Duration  string            `json:"duration"`
+	BitRate   string            `json:"bit_rate"`
+	Size      string            `json:"size"`
+	CodecName string            `json:"format_name"`
+	Tags      map[string]string `json:"tags"`
 }
 
 func (o ffprobeOutput) primaryAudioStream() *ffprobeStream {
@@ -348,6 +811,15 @@ func (o ffprobeOutput) primaryAudioStream() *ffprobeStream {
 	return nil
 }
 
+func (o ffprobeOutput) attachedPicture() *ffprobeStream {
+	for i := range o.Streams {
+		if o.Streams[i].CodecType == "video" && o.Streams[i].Disposition.AttachedPic == 1 {
+			return &o.Streams[i]
+		}
+	}
+	return nil
+}
+
 func (o ffprobeOutput) formatDuration() float64 {
 	if o.Format.Duration == "" {
 		return 0
@@ -404,14 +876,6 @@ func (s *ffprobeStream) bitDepth() int {
 	return 0
 }
 
-type loudnessRaw struct {
-	InputI       float64 `json:"input_i,string"`
-	InputTP      float64 `json:"input_tp,string"`
-	InputLRA     float64 `json:"input_lra,string"`
-	InputThresh  float64 `json:"input_thresh,string"`
-	TargetOffset float64 `json:"target_offset,string"`
-}
-
 func extractJSONBlock(output []byte) ([]byte, error) {
 	start := bytes.IndexByte(output, '{')
 	end := bytes.LastIndexByte(output, '}')
@@ -421,29 +885,27 @@ func extractJSONBlock(output []byte) ([]byte, error) {
 	return output[start : end+1], nil
 }
 
-func parseTrackURL(raw string) (bucket string, objectKey string, base string, err error) {
+// parseTrackURL extracts the bucket and key of a version 1 track_url. Its host is ignored:
+// public URLs are built from the configured base.
+func parseTrackURL(raw string) (bucket string, objectKey string, err error) {
 	u, err := url.Parse(raw)
 	if err != nil {
-		return "", "", "", fmt.Errorf("invalid track url: %w", err)
+		return "", "", fmt.Errorf("invalid track url: %w", err)
 	}
 
+	// path-only URLs get a placeholder host for parsing
 	if u.Scheme == "" && strings.HasPrefix(raw, "/") {
 		raw = "http://placeholder" + raw
 		if u, err = url.Parse(raw); err != nil {
-			return "", "", "", fmt.Errorf("invalid track url: %w", err)
+			return "", "", fmt.Errorf("invalid track url: %w", err)
 		}
 	}
 
 	pathParts := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
 	if len(pathParts) < 2 {
-		return "", "", "", fmt.Errorf("track url missing components: %s", raw)
+		return "", "", fmt.Errorf("track url missing components: %s", raw)
 	}
-	bucket = pathParts[0]
-	objectKey = strings.Join(pathParts[1:], "/")
-	if u.Scheme != "" && u.Host != "" {
-		base = strings.TrimRight(u.Scheme+"://"+u.Host, "/")
-	}
-	return bucket, objectKey, base, nil
+	return pathParts[0], strings.Join(pathParts[1:], "/"), nil
 }
 
 func roundToDecimals(v float64, decimals int) float64 {
@@ -465,21 +927,55 @@ func shortID() string {
 	return fmt.Sprintf("%06d", rand.New(rand.NewSource(time.Now().UnixNano())).Intn(999999))
 }
 
-func (t *FFmpegTranscoder) buildObjectURL(base, bucket, objectKey string) string {
-	base = strings.TrimRight(base, "/")
-	if base == "" {
-		return path.Join(bucket, objectKey)
+// setObjectURLs points the URLs of info at the published objects of the track. The master
+// playlist and waveform always exist; the optional outputs are set when they were published.
+func (t *FFmpegTranscoder) setObjectURLs(info *tracks.TrackInfo, bucket, artistID, trackID string, dash, preview, cover bool) {
+	transcodedPrefix := path.Join(artistID, trackID, "transcoded")
+	info.AudioURL = t.urls.Object(bucket, path.Join(transcodedPrefix, "master.m3u8"))
+	info.WaveformURL = t.urls.Object(bucket, path.Join(artistID, trackID, "metadata", "waveform.json"))
+	if dash {
+		info.DashURL = t.urls.Object(bucket, path.Join(transcodedPrefix, dashManifestName))
+	}
+	if preview {
+		info.PreviewURL = t.urls.Object(t.settings.Preview.Bucket, path.Join(trackID, "index.m3u8"))
+	}
+	if cover {
+		info.CoverURL = t.urls.Object(bucket, path.Join(artistID, trackID, coverDirName, coverFileName(coverPrimarySize, "jpg")))
+	}
+}
+
+// removeLegacyPreview deletes a clip published by earlier versions under transcoded/preview/,
+// whose URL showed anonymous listeners where the full renditions are.
+func (t *FFmpegTranscoder) removeLegacyPreview(ctx context.Context, bucket, transcodedPrefix string) error {
+	var keys []string
+	err := t.storage.ListObjects(ctx, bucket, path.Join(transcodedPrefix, previewDirName)+"/", func(object storage.ObjectInfo) error {
+		keys = append(keys, object.Key)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list legacy preview: %w", err)
 	}
-	return base + "/" + path.Join(bucket, objectKey)
+	for _, key := range keys {
+		if err := t.storage.Delete(ctx, bucket, key); err != nil {
+			return fmt.Errorf("failed to remove legacy preview: %w", err)
+		}
+	}
+	return nil
 }
 
-func defaultBaseURL(endpoint string) string {
-	endpoint = strings.TrimSpace(endpoint)
-	if endpoint == "" {
-		return ""
+// checkSource compares the downloaded original with the size and checksum the uploader declared.
+func checkSource(source SourceObject, file, sha256Hex string) error {
+	if source.Size > 0 {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to stat source audio: %w", err)
+		}
+		if stat.Size() != source.Size {
+			return fmt.Errorf("source %s/%s is %d bytes, task declares %d", source.Bucket, source.Key, stat.Size(), source.Size)
+		}
 	}
-	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
-		return strings.TrimRight(endpoint, "/")
+	if source.SHA256 != "" && !strings.EqualFold(source.SHA256, sha256Hex) {
+		return fmt.Errorf("source %s/%s has sha256 %s, task declares %s", source.Bucket, source.Key, sha256Hex, source.SHA256)
 	}
-	return "http://" + strings.TrimRight(endpoint, "/")
+	return nil
 }
@@ -0,0 +1,1201 @@
+package transcoder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/MusicSocial/transcoder/internal/config"
+	"github.com/MusicSocial/transcoder/internal/storage"
+	"github.com/MusicSocial/transcoder/internal/tracks"
+)
+
+const (
+	testBucket        = "tracks"
+	testPreviewBucket = "previews"
+	testSourceKey     = "uploads/artist-1/track-1.flac"
+	testSource        = "fLaC"
+	testLeaseKey      = "artist-1/track-1/metadata/lease.json"
+	testHeartbeat     = 20 * time.Millisecond
+)
+
+func TestParseTrackURL(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        string
+		wantBucket string
+		wantKey    string
+		wantErr    bool
+	}{
+		{
+			name:       "absolute url",
+			raw:        "http://minio:9000/tracks/uploads/a/b.flac",
+			wantBucket: "tracks",
+			wantKey:    "uploads/a/b.flac",
+		},
+		{
+			name:       "escaped key",
+			raw:        "https://cdn.example.com/tracks/uploads/night%20drive.mp3",
+			wantBucket: "tracks",
+			wantKey:    "uploads/night drive.mp3",
+		},
+		{
+			name:       "absolute path",
+			raw:        "/tracks/uploads/a/b.flac",
+			wantBucket: "tracks",
+			wantKey:    "uploads/a/b.flac",
+		},
+		{
+			name:       "relative path",
+			raw:        "tracks/b.flac",
+			wantBucket: "tracks",
+			wantKey:    "b.flac",
+		},
+		{
+			name:    "bucket only",
+			raw:     "http://minio:9000/tracks",
+			wantErr: true,
+		},
+		{
+			name:    "malformed",
+			raw:     "http://[::1/tracks/b.flac",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket, key, err := parseTrackURL(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTrackURL(%q) error = %v, wantErr %t", tt.raw, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if bucket != tt.wantBucket || key != tt.wantKey {
+				t.Errorf("parseTrackURL(%q) = (%q, %q), want (%q, %q)",
+					tt.raw, bucket, key, tt.wantBucket, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestResolveSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		task    Task
+		want    SourceObject
+		wantErr bool
+	}{
+		{
+			name: "source object",
+			task: Task{SchemaVersion: 2, Source: &SourceObject{Bucket: "uploads", Key: "a/b.flac", Size: 4}},
+			want: SourceObject{Bucket: "uploads", Key: "a/b.flac", Size: 4},
+		},
+		{
+			name: "source object without bucket",
+			task: Task{SchemaVersion: 2, Source: &SourceObject{Key: "a/b.flac"}},
+			want: SourceObject{Bucket: testBucket, Key: "a/b.flac"},
+		},
+		{
+			name: "version 1 track url",
+			task: Task{TrackURL: "http://minio:9000/tracks/a/b.flac"},
+			want: SourceObject{Bucket: "tracks", Key: "a/b.flac"},
+		},
+		{
+			name: "source object wins over track url",
+			task: Task{SchemaVersion: 2, Source: &SourceObject{Bucket: "tracks", Key: "new.flac"}, TrackURL: "/tracks/old.flac"},
+			want: SourceObject{Bucket: "tracks", Key: "new.flac"},
+		},
+		{
+			name:    "source object without key",
+			task:    Task{SchemaVersion: 2, Source: &SourceObject{Bucket: "tracks"}},
+			wantErr: true,
+		},
+		{
+			name:    "no source",
+			task:    Task{SchemaVersion: 2},
+			wantErr: true,
+		},
+		{
+			name:    "newer schema",
+			task:    Task{SchemaVersion: TaskSchemaVersion + 1, Source: &SourceObject{Bucket: "tracks", Key: "a.flac"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.task.ResolveSource(testBucket)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveSource() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ResolveSource() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractJSONBlock(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "json after log lines",
+			output: "size=N/A time=00:00:08.00\n[Parsed_loudnorm_0 @ 0x1] \n{\n\t\"input_i\" : \"-18.42\"\n}\n",
+			want:   "{\n\t\"input_i\" : \"-18.42\"\n}",
+		},
+		{
+			name:   "nested objects keep the outer block",
+			output: `noise {"a": {"b": 1}} trailer`,
+			want:   `{"a": {"b": 1}}`,
+		},
+		{
+			name:    "no braces",
+			output:  "ffmpeg version 6.1",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated",
+			output:  `{"input_i" : "-18.42"`,
+			wantErr: true,
+		},
+		{
+			name:    "reversed braces",
+			output:  "} {",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractJSONBlock([]byte(tt.output))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractJSONBlock() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("extractJSONBlock() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractTechMetadata(t *testing.T) {
+	bitDepth := 24
+	tests := []struct {
+		name    string
+		command fakeCommand
+		want    *TechMetadata
+		wantErr string
+	}{
+		{
+			name:    "flac with tags",
+			command: fakeCommand{tool: "ffprobe", stdout: "ffprobe_flac.json"},
+			want: &TechMetadata{
+				DurationSec:     8,
+				SampleRate:      44100,
+				Channels:        2,
+				OriginalCodec:   "FLAC",
+				BitDepth:        &bitDepth,
+				OriginalBitrate: 1834021,
+				FileSize:        1834021,
+				ChannelLayout:   "stereo",
+				tags: TrackTags{
+					Title:       "Night Drive",
+					Artists:     []string{"Lumen", "Kora"},
+					Album:       "Coastline",
+					TrackNumber: 3,
+					Year:        2024,
+					ISRC:        "USRC17607839",
+					Genre:       "Synthwave",
+				},
+			},
+		},
+		{
+			name:    "mp3 with cover art and stream bitrate",
+			command: fakeCommand{tool: "ffprobe", stdout: "ffprobe_mp3_cover.json"},
+			want: &TechMetadata{
+				DurationSec:      185.4,
+				SampleRate:       48000,
+				Channels:         2,
+				OriginalCodec:    "MP3",
+				OriginalBitrate:  320000,
+				FileSize:         7571234,
+				ChannelLayout:    "stereo",
+				HasCoverArt:      true,
+				coverStreamIndex: 1,
+				tags: TrackTags{
+					Title:   "Paper Boats",
+					Artists: []string{"Mira Sol"},
+				},
+			},
+		},
+		{
+			name:    "no audio stream",
+			command: fakeCommand{tool: "ffprobe", stdout: "ffprobe_video_only.json"},
+			wantErr: "no audio stream found",
+		},
+		{
+			name:    "ffprobe rejects the file",
+			command: fakeCommand{tool: "ffprobe", err: errors.New("exit status 1")},
+			wantErr: "ffprobe failed",
+		},
+		{
+			name:    "output is not json",
+			command: fakeCommand{tool: "ffprobe", stdout: "loudnorm.txt"},
+			wantErr: "failed to parse ffprobe output",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{t: t, commands: []fakeCommand{tt.command}}
+			tr := &FFmpegTranscoder{runner: runner, ffprobePath: "ffprobe"}
+
+			got, err := tr.extractTechMetadata(context.Background(), "source")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("extractTechMetadata() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractTechMetadata() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractTechMetadata() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMeasureLoudness(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		output     string
+		want       LoudnessMetrics
+		wantFilter bool
+		wantTags   int
+	}{
+		{
+			name:   "loudnorm",
+			mode:   normalizationLoudnorm,
+			output: "loudnorm.txt",
+			want: LoudnessMetrics{
+				InputI: -18.42, InputTP: -1.37, InputLRA: 4.1, InputThreshold: -28.61, TargetOffset: 0.03,
+				Normalization: LoudnessNormalization{Mode: normalizationLoudnorm, TargetI: -14, TargetTP: -2, TrackGainDB: 4.42, TrackPeak: 0.854083},
+			},
+			wantFilter: true,
+		},
+		{
+			name:   "replaygain",
+			mode:   normalizationReplayGain,
+			output: "loudnorm.txt",
+			want: LoudnessMetrics{
+				InputI: -18.42, InputTP: -1.37, InputLRA: 4.1, InputThreshold: -28.61, TargetOffset: 0.03,
+				Normalization: LoudnessNormalization{Mode: normalizationReplayGain, TargetI: -14, TargetTP: -2, TrackGainDB: 4.42, TrackPeak: 0.854083},
+			},
+			wantTags: 2,
+		},
+		{
+			name:   "silent input",
+			mode:   normalizationReplayGain,
+			output: "loudnorm_silent.txt",
+			want: LoudnessMetrics{
+				InputI: silenceFloorLUFS, InputTP: silenceFloorLUFS, InputThreshold: silenceFloorLUFS, Silent: true,
+				Normalization: LoudnessNormalization{Mode: normalizationReplayGain, TargetI: -14, TargetTP: -2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{t: t, commands: []fakeCommand{{tool: "ffmpeg", stderr: tt.output}}}
+			tr := &FFmpegTranscoder{runner: runner, ffmpegPath: "ffmpeg"}
+			settings := loudnessSettings{mode: tt.mode, cfg: config.LoudnessConfig{TargetLUFS: -14, TruePeak: -2, LRA: 7}}
+
+			got, err := tr.measureLoudness(context.Background(), "source", settings)
+			if err != nil {
+				t.Fatalf("measureLoudness() error = %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("measureLoudness() = %+v, want %+v", *got, tt.want)
+			}
+			// loudness.json is uploaded as is, so every measurement must be encodable
+			if _, err := json.Marshal(got); err != nil {
+				t.Errorf("json.Marshal(metrics) error = %v", err)
+			}
+			if filter := got.normalizationFilter(settings); (filter != "") != tt.wantFilter {
+				t.Errorf("normalizationFilter() = %q, want filter %t", filter, tt.wantFilter)
+			}
+			if tags := got.gainTags(settings); len(tags) != tt.wantTags {
+				t.Errorf("gainTags() = %q, want %d tags", tags, tt.wantTags)
+			}
+		})
+	}
+}
+
+func TestExtractTagsLimits(t *testing.T) {
+	longTitle := strings.Repeat("ж", 300)
+	tests := []struct {
+		name      string
+		tags      map[string]string
+		wantTitle string
+		wantAlbum string
+		wantGenre string
+		wantISRC  string
+	}{
+		{
+			name:      "oversized tags are cut by rune",
+			tags:      map[string]string{"title": longTitle, "album": strings.Repeat("a", 256), "genre": strings.Repeat("ü", 101)},
+			wantTitle: strings.Repeat("ж", 255),
+			wantAlbum: strings.Repeat("a", 255),
+			wantGenre: strings.Repeat("ü", 100),
+		},
+		{
+			name:      "tags at the limit are kept",
+			tags:      map[string]string{"title": strings.Repeat("ж", 255), "album": "Album"},
+			wantTitle: strings.Repeat("ж", 255),
+			wantAlbum: "Album",
+		},
+		{
+			name:      "no trailing space after the cut",
+			tags:      map[string]string{"title": strings.Repeat("a", 254) + " bc"},
+			wantTitle: strings.Repeat("a", 254),
+		},
+		{name: "valid isrc", tags: map[string]string{"isrc": "us-rc1-76-07839"}, wantISRC: "USRC17607839"},
+		{name: "short isrc", tags: map[string]string{"isrc": "USRC1760783"}},
+		{name: "long isrc", tags: map[string]string{"isrc": "USRC176078390"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ffprobeOutput{Format: ffprobeFormat{Tags: tt.tags}}.extractTags()
+			if got.Title != tt.wantTitle {
+				t.Errorf("Title = %d runes, want %d", utf8.RuneCountInString(got.Title), utf8.RuneCountInString(tt.wantTitle))
+			}
+			if got.Album != tt.wantAlbum {
+				t.Errorf("Album = %d runes, want %d", utf8.RuneCountInString(got.Album), utf8.RuneCountInString(tt.wantAlbum))
+			}
+			if got.Genre != tt.wantGenre {
+				t.Errorf("Genre = %d runes, want %d", utf8.RuneCountInString(got.Genre), utf8.RuneCountInString(tt.wantGenre))
+			}
+			if got.ISRC != tt.wantISRC {
+				t.Errorf("ISRC = %q, want %q", got.ISRC, tt.wantISRC)
+			}
+		})
+	}
+}
+
+func TestExtractTagsExplicit(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name string
+		tags map[string]string
+		want *bool
+	}{
+		{name: "itunes explicit", tags: map[string]string{"ITUNESADVISORY": "1"}, want: &yes},
+		{name: "itunes clean", tags: map[string]string{"ITUNESADVISORY": "2"}, want: &no},
+		{name: "itunes none", tags: map[string]string{"ITUNESADVISORY": "0"}},
+		{name: "plain flag", tags: map[string]string{"explicit": "Yes"}, want: &yes},
+		{name: "popularity rating", tags: map[string]string{"rating": "4"}},
+		{name: "unrecognized", tags: map[string]string{"explicit": "maybe"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ffprobeOutput{Format: ffprobeFormat{Tags: tt.tags}}.extractTags().Explicit
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("Explicit = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteMasterPlaylist(t *testing.T) {
+	tests := []struct {
+		name     string
+		variants []config.VariantConfig
+		want     string
+	}{
+		{
+			name: "aac ladder",
+			variants: []config.VariantConfig{
+				{Name: "aac_256", Codec: "aac", BitrateK: 256},
+				{Name: "aac_96", Codec: "aac", BitrateK: 96},
+			},
+			want: "#EXTM3U\n" +
+				"#EXT-X-VERSION:7\n" +
+				"#EXT-X-INDEPENDENT-SEGMENTS\n" +
+				"#EXT-X-SESSION-DATA:DATA-ID=\"com.musicsocial.gapless\",URI=\"gapless.json\"\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=256000,AVERAGE-BANDWIDTH=256000,CODECS=\"mp4a.40.2\",NAME=\"AAC 256\"\n" +
+				"aac_256/index.m3u8\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=96000,AVERAGE-BANDWIDTH=96000,CODECS=\"mp4a.40.2\",NAME=\"AAC 96\"\n" +
+				"aac_96/index.m3u8\n",
+		},
+		{
+			name: "mixed codecs",
+			variants: []config.VariantConfig{
+				{Name: "flac", Codec: "FLAC", BitrateK: 1000},
+				{Name: "opus_160", Codec: "opus", BitrateK: 160},
+				{Name: "he_48", Codec: "he-aac-v2", BitrateK: 48},
+			},
+			want: "#EXTM3U\n" +
+				"#EXT-X-VERSION:7\n" +
+				"#EXT-X-INDEPENDENT-SEGMENTS\n" +
+				"#EXT-X-SESSION-DATA:DATA-ID=\"com.musicsocial.gapless\",URI=\"gapless.json\"\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=1000000,AVERAGE-BANDWIDTH=1000000,CODECS=\"fLaC\",NAME=\"FLAC\"\n" +
+				"flac/index.m3u8\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=160000,AVERAGE-BANDWIDTH=160000,CODECS=\"opus\",NAME=\"Opus 160\"\n" +
+				"opus_160/index.m3u8\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=48000,AVERAGE-BANDWIDTH=48000,CODECS=\"mp4a.40.29\",NAME=\"HE-AACv2 48\"\n" +
+				"he_48/index.m3u8\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ladder, err := resolveLadder(config.LadderProfile{Name: tt.name, Variants: tt.variants})
+			if err != nil {
+				t.Fatalf("resolveLadder() error = %v", err)
+			}
+			dir := t.TempDir()
+			if err := (&FFmpegTranscoder{}).writeMasterPlaylist(dir, ladder); err != nil {
+				t.Fatalf("writeMasterPlaylist() error = %v", err)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "master.m3u8"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("master.m3u8 =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckEncoders(t *testing.T) {
+	hifi := config.LadderProfile{Name: "hifi", Variants: []config.VariantConfig{
+		{Name: "flac", Codec: "flac"},
+		{Name: "opus_160", Codec: "opus", BitrateK: 160},
+	}}
+	mobile := config.LadderProfile{Name: "mobile", Variants: []config.VariantConfig{
+		{Name: "aac_96", Codec: "aac", BitrateK: 96},
+		{Name: "he_48", Codec: "he-aac-v2", BitrateK: 48},
+	}}
+
+	tests := []struct {
+		name           string
+		defaultProfile string
+		previewCodec   string
+		wantProfiles   []string
+		wantErr        string
+	}{
+		{
+			name:           "profile with a missing encoder is disabled",
+			defaultProfile: "hifi",
+			wantProfiles:   []string{"hifi"},
+		},
+		{
+			name:           "default profile with a missing encoder",
+			defaultProfile: "mobile",
+			wantErr:        "profile mobile variant he_48 needs libfdk_aac",
+		},
+		{
+			name:           "preview with a missing encoder",
+			defaultProfile: "hifi",
+			previewCodec:   "he-aac",
+			wantErr:        "preview variant preview needs libfdk_aac",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTranscodeEnv(t, []fakeCommand{{tool: "ffmpeg", match: withArg("-hide_banner", "-encoders"), stdout: "ffmpeg_encoders.txt"}})
+			env.transcoder.settings.Profiles = map[string]config.LadderProfile{hifi.Name: hifi, mobile.Name: mobile}
+			env.transcoder.settings.DefaultProfile = tt.defaultProfile
+			if tt.previewCodec != "" {
+				env.transcoder.settings.Preview.Codec = tt.previewCodec
+			}
+
+			err := env.transcoder.CheckEncoders(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("CheckEncoders() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckEncoders() error = %v", err)
+			}
+			var got []string
+			for name := range env.transcoder.settings.Profiles {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.wantProfiles, ",") {
+				t.Errorf("profiles after CheckEncoders() = %v, want %v", got, tt.wantProfiles)
+			}
+			if _, err := env.transcoder.settings.Profile("mobile"); err == nil {
+				t.Error("disabled profile mobile is still selectable")
+			}
+		})
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	const transcoded = "artist-1/track-1/transcoded/"
+
+	tests := []struct {
+		name string
+		task Task
+		// commands take precedence over the recorded defaults.
+		commands []fakeCommand
+		noSource bool
+		// before runs against the same environment ahead of the checked call.
+		before        func(t *testing.T, env *transcodeEnv)
+		wantErr       bool
+		wantPermanent bool
+		// wantVerification is "<check> <rendition>" of the first failed output check.
+		wantVerification string
+		check            func(t *testing.T, env *transcodeEnv, report *Report)
+	}{
+		{
+			name: "publishes renditions and reports the track",
+			task: testTask(),
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				for _, key := range []string{
+					"artist-1/track-1/metadata/tech_meta.json",
+					"artist-1/track-1/metadata/loudness.json",
+					"artist-1/track-1/metadata/tags.json",
+					"artist-1/track-1/metadata/waveform.json",
+					"artist-1/track-1/metadata/waveform.dat",
+					"artist-1/track-1/metadata/outputs.json",
+					transcoded + "master.m3u8",
+					transcoded + "gapless.json",
+					transcoded + "manifest.mpd",
+					transcoded + "aac_256/index.m3u8",
+					transcoded + "aac_256/chunk_00003.m4s",
+					transcoded + "aac_96/init.mp4",
+				} {
+					env.requireObject(t, key)
+				}
+				if ok, err := env.store.Exists(context.Background(), testPreviewBucket, "track-1/index.m3u8"); err != nil || !ok {
+					t.Errorf("preview not published to its own bucket (err=%v)", err)
+				}
+
+				info := env.tracks.last(t, "track-1")
+				if info.AudioURL != "tracks/"+transcoded+"master.m3u8" {
+					t.Errorf("AudioURL = %q", info.AudioURL)
+				}
+				if info.DashURL != "tracks/"+transcoded+"manifest.mpd" {
+					t.Errorf("DashURL = %q", info.DashURL)
+				}
+				if info.PreviewURL != "previews/track-1/index.m3u8" {
+					t.Errorf("PreviewURL = %q", info.PreviewURL)
+				}
+				if info.DurationSec != 8 {
+					t.Errorf("DurationSec = %d, want 8", info.DurationSec)
+				}
+				if info.Suggested == nil || info.Suggested.Title != "Night Drive" {
+					t.Errorf("Suggested = %+v, want the file tags", info.Suggested)
+				}
+
+				var meta TechMetadata
+				env.readJSON(t, "artist-1/track-1/metadata/tech_meta.json", &meta)
+				want := &SilenceInfo{Policy: "record", LeadingSec: 0.752, TrailingSec: 1.1, AudioStartSec: 0.752, AudioEndSec: 6.9}
+				if !reflect.DeepEqual(meta.Silence, want) {
+					t.Errorf("tech_meta silence = %+v, want %+v", meta.Silence, want)
+				}
+				if meta.SourceContentType != "audio/flac" {
+					t.Errorf("tech_meta source_content_type = %q, want the declared type", meta.SourceContentType)
+				}
+				// the recorded decode is a pure tone, which is too narrow for a verdict
+				if meta.Spectral == nil || meta.Spectral.SuspectedTranscode || info.SourceQuality == nil {
+					t.Errorf("tech_meta spectral = %+v, source quality = %+v, want an inconclusive check", meta.Spectral, info.SourceQuality)
+				}
+
+				if report.Skipped() {
+					t.Error("report marked as skipped")
+				}
+				if outputs := report.Outputs(); outputs == nil || outputs.ManifestKey != "artist-1/track-1/metadata/outputs.json" {
+					t.Errorf("report outputs = %+v", outputs)
+				}
+
+				var lease JobLease
+				env.readJSON(t, testLeaseKey, &lease)
+				if lease.State != LeaseReleased || lease.Instance != "test-worker" || lease.ReleasedAt == nil {
+					t.Errorf("lease after the job = %+v, want released by test-worker", lease)
+				}
+			},
+		},
+		{
+			name: "takes over an abandoned lease",
+			task: testTask(),
+			before: func(t *testing.T, env *transcodeEnv) {
+				env.putLease(t, "dead-worker", time.Now().Add(-time.Minute))
+			},
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				var lease JobLease
+				env.readJSON(t, testLeaseKey, &lease)
+				if lease.Instance != "test-worker" || lease.JobID == "dead-job" || lease.State != LeaseReleased {
+					t.Errorf("lease after the job = %+v, want taken over and released", lease)
+				}
+			},
+		},
+		{
+			name: "waits for a live lease to be released",
+			task: testTask(),
+			before: func(t *testing.T, env *transcodeEnv) {
+				env.putLease(t, "busy-worker", time.Now().Add(time.Hour))
+				go func() {
+					time.Sleep(3 * testHeartbeat)
+					released := time.Now().UTC()
+					lease := JobLease{TrackID: "track-1", Instance: "busy-worker", JobID: "busy-job", State: LeaseReleased, ReleasedAt: &released}
+					_ = env.store.UploadJSON(context.Background(), testBucket, testLeaseKey, lease)
+				}()
+			},
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				for _, timing := range report.Timings() {
+					if timing.Stage == "lease" && timing.DurationSec < (3*testHeartbeat).Seconds() {
+						t.Errorf("waited %.3fs for the lease, want at least %s", timing.DurationSec, 3*testHeartbeat)
+					}
+				}
+				if n := env.runner.callCount("-f hls"); n != 3 {
+					t.Errorf("ffmpeg HLS encodes = %d, want 3 after the lease was released", n)
+				}
+			},
+		},
+		{
+			name: "encryption removes a stale DASH manifest",
+			task: testTask(),
+			before: func(t *testing.T, env *transcodeEnv) {
+				env.transcoder.settings.Encryption = config.EncryptionConfig{Mode: encryptionAES128, KeyBucket: "hls-keys", KeyURIBase: "https://api.example.com/api/v1/keys"}
+				if err := env.store.UploadBytes(context.Background(), testBucket, transcoded+"manifest.mpd", []byte("<MPD/>"), ""); err != nil {
+					t.Fatal(err)
+				}
+			},
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				if ok, _ := env.store.Exists(context.Background(), testBucket, transcoded+"manifest.mpd"); ok {
+					t.Error("DASH manifest of an earlier unencrypted run still published")
+				}
+				if info := env.tracks.last(t, "track-1"); info.DashURL != "" {
+					t.Errorf("DashURL = %q, want none for an encrypted track", info.DashURL)
+				}
+				if n := env.runner.callCount("-hls_key_info_file"); n != 2 {
+					t.Errorf("encrypted encodes = %d, want 2 (the preview stays clear)", n)
+				}
+			},
+		},
+		{
+			name: "removes a preview published next to the renditions",
+			task: testTask(),
+			before: func(t *testing.T, env *transcodeEnv) {
+				if err := env.store.UploadBytes(context.Background(), testBucket, transcoded+"preview/index.m3u8", []byte("#EXTM3U"), ""); err != nil {
+					t.Fatal(err)
+				}
+			},
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				if ok, _ := env.store.Exists(context.Background(), testBucket, transcoded+"preview/index.m3u8"); ok {
+					t.Error("legacy preview still published under transcoded/")
+				}
+			},
+		},
+		{
+			name: "replaygain tags the renditions",
+			task: func() Task {
+				task := testTask()
+				task.Normalization = normalizationReplayGain
+				return task
+			}(),
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				if n := env.runner.callCount("-metadata REPLAYGAIN_TRACK_GAIN=4.42 dB", "movflags=+use_metadata_tags"); n != 3 {
+					t.Errorf("encodes tagged with the track gain = %d, want 3", n)
+				}
+				if n := env.runner.callCount("loudnorm=I=-14.0:LRA=7.0:TP=-2.0:measured_I"); n != 0 {
+					t.Errorf("loudnorm second pass ran %d time(s) in replaygain mode", n)
+				}
+			},
+		},
+		{
+			name: "trims edge silence",
+			task: func() Task {
+				task := testTask()
+				task.SilencePolicy = silencePolicyTrim
+				return task
+			}(),
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				if n := env.runner.callCount("-ss 0.752 -t 6.148", "aac_256/index.m3u8"); n != 1 {
+					t.Errorf("aac_256 encoded %d time(s) from the audible part, want 1", n)
+				}
+				if info := env.tracks.last(t, "track-1"); info.DurationSec != 6 {
+					t.Errorf("DurationSec = %d, want 6", info.DurationSec)
+				}
+				var gapless GaplessInfo
+				env.readJSON(t, transcoded+"gapless.json", &gapless)
+				if gapless.LeadingTrimSec != 0.752 || gapless.TrailingTrimSec != 1.1 {
+					t.Errorf("gapless trims = %v/%v, want 0.752/1.1", gapless.LeadingTrimSec, gapless.TrailingTrimSec)
+				}
+			},
+		},
+		{
+			name: "gapless info takes the encoder delay from the init section",
+			task: testTask(),
+			commands: []fakeCommand{{
+				tool: "ffprobe",
+				match: func(args []string) bool {
+					return argValue(args, "-show_entries") == "stream=initial_padding" && strings.HasSuffix(args[len(args)-1], "aac_96/init.mp4")
+				},
+				stdout: "ffprobe_initial_padding_2112.json",
+			}},
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				if n := env.runner.callCount("-avoid_negative_ts disabled", "-hls_segment_options use_editlist=1"); n != 3 {
+					t.Errorf("encodes writing an edit list = %d, want 3", n)
+				}
+				var gapless GaplessInfo
+				env.readJSON(t, transcoded+"gapless.json", &gapless)
+				want := map[string]VariantGapless{
+					"aac_256": {Codec: "aac", SampleRate: 44100, EncoderDelay: 1024, Padding: 480, ValidSamples: 352800},
+					"aac_96":  {Codec: "aac", SampleRate: 44100, EncoderDelay: 2112, Padding: 416, ValidSamples: 352800},
+				}
+				for name, w := range want {
+					if got := gapless.Variants[name]; got != w {
+						t.Errorf("gapless %s = %+v, want %+v", name, got, w)
+					}
+				}
+			},
+		},
+		{
+			name: "single file profile publishes one media object per variant",
+			task: func() Task {
+				task := testTask()
+				task.Profile = "single"
+				return task
+			}(),
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				if n := env.runner.callCount("-hls_time 6", "-hls_flags single_file", "aac_256/media.mp4"); n != 1 {
+					t.Errorf("single-file aac_256 encodes with 6s segments = %d, want 1", n)
+				}
+				env.requireObject(t, transcoded+"aac_256/media.mp4")
+				if ok, _ := env.store.Exists(context.Background(), testBucket, transcoded+"aac_256/init.mp4"); ok {
+					t.Error("separate init segment published for a single-file variant")
+				}
+
+				mpd := env.readObject(t, transcoded+"manifest.mpd")
+				for _, want := range []string{
+					`<Initialization sourceURL="aac_256/media.mp4" range="0-823">`,
+					`<SegmentURL media="aac_256/media.mp4" mediaRange="824-99127">`,
+					`<SegmentURL media="aac_256/media.mp4" mediaRange="99128-131895">`,
+				} {
+					if !strings.Contains(mpd, want) {
+						t.Errorf("manifest.mpd has no %s:\n%s", want, mpd)
+					}
+				}
+			},
+		},
+		{
+			name: "skips outputs that are up to date",
+			task: testTask(),
+			before: func(t *testing.T, env *transcodeEnv) {
+				if err := env.transcoder.Transcode(context.Background(), testTask(), nil); err != nil {
+					t.Fatalf("first Transcode() error = %v", err)
+				}
+			},
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				if n := env.runner.callCount("-f hls"); n != 3 {
+					t.Errorf("ffmpeg HLS encodes = %d, want 3 from the first run only", n)
+				}
+				if !report.Skipped() {
+					t.Error("report not marked as skipped")
+				}
+				infos := env.tracks.infos["track-1"]
+				if len(infos) != 2 || !reflect.DeepEqual(infos[0], infos[1]) {
+					t.Errorf("track info reported %d time(s), want the same info twice", len(infos))
+				}
+			},
+		},
+		{
+			name: "skipped outputs are reported under the current public base",
+			task: testTask(),
+			before: func(t *testing.T, env *transcodeEnv) {
+				if err := env.transcoder.Transcode(context.Background(), testTask(), nil); err != nil {
+					t.Fatalf("first Transcode() error = %v", err)
+				}
+				env.transcoder.urls = storage.NewPublicURLs("https://cdn.example.com/")
+			},
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				if !report.Skipped() {
+					t.Error("report not marked as skipped")
+				}
+				info := env.tracks.last(t, "track-1")
+				if want := "https://cdn.example.com/tracks/" + transcoded + "master.m3u8"; info.AudioURL != want {
+					t.Errorf("AudioURL = %q, want %q", info.AudioURL, want)
+				}
+				if want := "https://cdn.example.com/previews/track-1/index.m3u8"; info.PreviewURL != want {
+					t.Errorf("PreviewURL = %q, want %q", info.PreviewURL, want)
+				}
+				if info.CoverURL != "" {
+					t.Errorf("CoverURL = %q for a source without cover art", info.CoverURL)
+				}
+			},
+		},
+		{
+			name: "version 1 task is decoded from its track url",
+			task: Task{TrackID: "track-1", ArtistID: "artist-1", TrackURL: "http://minio:9000/" + testBucket + "/" + testSourceKey},
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				info := env.tracks.last(t, "track-1")
+				if info.AudioURL != "tracks/"+transcoded+"master.m3u8" {
+					t.Errorf("AudioURL = %q, want the configured base instead of the track url host", info.AudioURL)
+				}
+			},
+		},
+		{
+			name: "checksum mismatch is permanent",
+			task: func() Task {
+				task := testTask()
+				task.Source.SHA256 = strings.Repeat("0", 64)
+				return task
+			}(),
+			wantErr:       true,
+			wantPermanent: true,
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				if n := env.runner.callCount("ffprobe"); n != 0 {
+					t.Errorf("ffprobe called %d time(s) on a source that does not match the task", n)
+				}
+			},
+		},
+		{
+			name: "force reprocess ignores the manifest",
+			task: func() Task {
+				task := testTask()
+				task.ForceReprocess = true
+				return task
+			}(),
+			before: func(t *testing.T, env *transcodeEnv) {
+				if err := env.transcoder.Transcode(context.Background(), testTask(), nil); err != nil {
+					t.Fatalf("first Transcode() error = %v", err)
+				}
+			},
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				if n := env.runner.callCount("-f hls"); n != 6 {
+					t.Errorf("ffmpeg HLS encodes = %d, want 6", n)
+				}
+			},
+		},
+		{
+			name:          "missing source is permanent",
+			task:          testTask(),
+			noSource:      true,
+			wantErr:       true,
+			wantPermanent: true,
+		},
+		{
+			name: "unknown profile is permanent",
+			task: func() Task {
+				task := testTask()
+				task.Profile = "lossless-9000"
+				return task
+			}(),
+			wantErr:       true,
+			wantPermanent: true,
+		},
+		{
+			name:          "unreadable source is permanent",
+			task:          testTask(),
+			commands:      []fakeCommand{{tool: "ffprobe", err: errors.New("exit status 1")}},
+			wantErr:       true,
+			wantPermanent: true,
+		},
+		{
+			name: "short rendition fails verification before upload",
+			task: testTask(),
+			commands: []fakeCommand{{
+				tool:  "ffprobe",
+				match: func(args []string) bool { return strings.HasSuffix(args[len(args)-1], "aac_96.m3u8") },
+				run:   probeRendition(5),
+			}},
+			wantErr:          true,
+			wantPermanent:    true,
+			wantVerification: "duration aac_96",
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				if ok, _ := env.store.Exists(context.Background(), testBucket, transcoded+"master.m3u8"); ok {
+					t.Error("renditions uploaded although verification failed")
+				}
+				if len(env.tracks.infos["track-1"]) != 0 {
+					t.Error("track info reported although verification failed")
+				}
+			},
+		},
+		{
+			name: "vbr mp3 with an estimated duration takes it from the renditions",
+			task: testTask(),
+			commands: []fakeCommand{{
+				tool:   "ffprobe",
+				match:  isSourceProbe,
+				stdout: "ffprobe_mp3_vbr.json",
+				stderr: "ffprobe_duration_estimate.txt",
+			}},
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				if info := env.tracks.last(t, "track-1"); info.DurationSec != 8 {
+					t.Errorf("DurationSec = %d, want the 8 s the renditions last", info.DurationSec)
+				}
+				var meta TechMetadata
+				env.readJSON(t, "artist-1/track-1/metadata/tech_meta.json", &meta)
+				if meta.DurationSec != 8 {
+					t.Errorf("tech_meta duration_sec = %v, want 8", meta.DurationSec)
+				}
+			},
+		},
+		{
+			name: "duration mismatch against a measured source duration fails verification",
+			task: testTask(),
+			commands: []fakeCommand{{
+				tool:   "ffprobe",
+				match:  isSourceProbe,
+				stdout: "ffprobe_mp3_vbr.json",
+			}},
+			wantErr:          true,
+			wantPermanent:    true,
+			wantVerification: "duration aac_256",
+		},
+		{
+			name: "failed encode is retryable and publishes nothing",
+			task: testTask(),
+			commands: []fakeCommand{{
+				tool:   "ffmpeg",
+				match:  withArg("-f", "hls"),
+				stderr: "loudnorm.txt",
+				err:    errors.New("exit status 187"),
+			}},
+			wantErr: true,
+			check: func(t *testing.T, env *transcodeEnv, report *Report) {
+				if ok, _ := env.store.Exists(context.Background(), testBucket, "artist-1/track-1/metadata/outputs.json"); ok {
+					t.Error("output manifest written for a failed job")
+				}
+				if len(env.tracks.infos["track-1"]) != 0 {
+					t.Error("track info reported for a failed job")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTranscodeEnv(t, append(tt.commands, recordedCommands()...))
+			if !tt.noSource {
+				env.putSource(t)
+			}
+			if tt.before != nil {
+				tt.before(t, env)
+			}
+
+			report := &Report{}
+			err := env.transcoder.Transcode(context.Background(), tt.task, report)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Transcode() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err != nil && IsPermanent(err) != tt.wantPermanent {
+				t.Fatalf("Transcode() error = %v, permanent = %t, want %t", err, IsPermanent(err), tt.wantPermanent)
+			}
+			if tt.wantVerification != "" {
+				failures := VerificationFailures(err)
+				if len(failures) == 0 || failures[0].Check+" "+failures[0].Rendition != tt.wantVerification {
+					t.Errorf("verification failures = %+v, want %s first", failures, tt.wantVerification)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, env, report)
+			}
+		})
+	}
+}
+
+// recordedCommands answers every tool call of a successful job for testdata/ffprobe_flac.json.
+func recordedCommands() []fakeCommand {
+	return []fakeCommand{
+		{tool: "ffprobe", match: isRenditionProbe, run: probeRendition(0)},
+		{tool: "ffprobe", match: withArg("-show_entries", "stream=initial_padding"), stdout: "ffprobe_initial_padding.json"},
+		{tool: "ffprobe", stdout: "ffprobe_flac.json"},
+		{
+			tool:   "ffmpeg",
+			match:  func(args []string) bool { return strings.Contains(argValue(args, "-af"), "print_format=json") },
+			stderr: "loudnorm.txt",
+		},
+		{tool: "ffmpeg", match: withArg("-af", "silencedetect="), stderr: "silencedetect.txt"},
+		{tool: "ffmpeg", match: withArg("-f", "s16le"), run: decodeTone(8)},
+		{tool: "ffmpeg", match: isClipEncode, run: writeClipVariant},
+		{tool: "ffmpeg", match: withArg("-f", "hls"), run: writeHLSVariant},
+	}
+}
+
+func testTask() Task {
+	sum := sha256.Sum256([]byte(testSource))
+	return Task{
+		SchemaVersion: TaskSchemaVersion,
+		TrackID:       "track-1",
+		ArtistID:      "artist-1",
+		Source: &SourceObject{
+			Bucket:      testBucket,
+			Key:         testSourceKey,
+			ContentType: "audio/flac",
+			Size:        int64(len(testSource)),
+			SHA256:      hex.EncodeToString(sum[:]),
+		},
+	}
+}
+
+type transcodeEnv struct {
+	transcoder *FFmpegTranscoder
+	store      *storage.Local
+	runner     *fakeRunner
+	tracks     *fakeTracks
+}
+
+func newTranscodeEnv(t *testing.T, commands []fakeCommand) *transcodeEnv {
+	t.Helper()
+	settings := config.TranscodingConfig{
+		DefaultProfile: "standard",
+		Profiles: map[string]config.LadderProfile{
+			"standard": {Name: "standard", Variants: []config.VariantConfig{
+				{Name: "aac_256", Codec: "aac", BitrateK: 256},
+				{Name: "aac_96", Codec: "aac", BitrateK: 96},
+			}},
+			"single": {Name: "single", SegmentMode: "single_file", SegmentDurationSec: 6, Variants: []config.VariantConfig{
+				{Name: "aac_256", Codec: "aac", BitrateK: 256},
+			}},
+		},
+		Loudness:   config.LoudnessConfig{Mode: normalizationOff, TargetLUFS: -14, TruePeak: -2, LRA: 7},
+		Encryption: config.EncryptionConfig{Mode: "off"},
+		Preview: config.PreviewConfig{
+			Enabled:     true,
+			DurationSec: 4,
+			OffsetSec:   -1,
+			FadeSec:     0.5,
+			Codec:       "aac",
+			BitrateK:    64,
+			Bucket:      testPreviewBucket,
+		},
+		Silence:            config.SilenceConfig{Policy: silencePolicyRecord, ThresholdDB: -50, MinDurationSec: 0.5},
+		SegmentDurationSec: 2,
+		Verify:             config.VerifyConfig{Enabled: true, DurationToleranceSec: 0.5},
+	}
+
+	env := &transcodeEnv{
+		store:  storage.NewLocal(t.TempDir(), testBucket),
+		runner: &fakeRunner{t: t, commands: commands},
+		tracks: &fakeTracks{infos: make(map[string][]tracks.TrackInfo)},
+	}
+	env.transcoder = NewFFmpegTranscoder(env.store, storage.NewPublicURLs(""), env.tracks, env.runner, settings,
+		config.WorkerConfig{Count: 1, VariantParallelism: 2, InstanceID: "test-worker", HeartbeatInterval: testHeartbeat},
+		t.TempDir(), log.New(io.Discard, "", 0))
+	env.transcoder.ffmpegPath = "ffmpeg"
+	env.transcoder.ffprobePath = "ffprobe"
+	return env
+}
+
+func (e *transcodeEnv) putSource(t *testing.T) {
+	t.Helper()
+	if err := e.store.UploadBytes(context.Background(), testBucket, testSourceKey, []byte(testSource), ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (e *transcodeEnv) requireObject(t *testing.T, key string) {
+	t.Helper()
+	ok, err := e.store.Exists(context.Background(), testBucket, key)
+	if err != nil || !ok {
+		t.Errorf("object %s not published (err=%v)", key, err)
+	}
+}
+
+func (e *transcodeEnv) readObject(t *testing.T, key string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), path.Base(key))
+	if err := e.store.DownloadToFile(context.Background(), testBucket, key, file); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// putLease stores a lease held by another instance until expires.
+func (e *transcodeEnv) putLease(t *testing.T, instance string, expires time.Time) {
+	t.Helper()
+	lease := JobLease{
+		TrackID:     "track-1",
+		Instance:    instance,
+		JobID:       strings.TrimSuffix(instance, "-worker") + "-job",
+		State:       LeaseHeld,
+		AcquiredAt:  expires.Add(-2 * time.Minute),
+		HeartbeatAt: expires.Add(-time.Minute),
+		ExpiresAt:   expires,
+	}
+	if err := e.store.UploadJSON(context.Background(), testBucket, testLeaseKey, lease); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (e *transcodeEnv) readJSON(t *testing.T, key string, v interface{}) {
+	t.Helper()
+	if err := e.store.ReadJSON(context.Background(), testBucket, key, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeTracks records what would have been sent to Track Service.
+type fakeTracks struct {
+	mu    sync.Mutex
+	infos map[string][]tracks.TrackInfo
+}
+
+func (f *fakeTracks) UpdateTrackInfo(ctx context.Context, trackID string, info tracks.TrackInfo) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.infos[trackID] = append(f.infos[trackID], info)
+	return nil
+}
+
+func (f *fakeTracks) UpdateTrackStatus(ctx context.Context, trackID, status, failureReason string) error {
+	return nil
+}
+
+func (f *fakeTracks) StoreFingerprint(ctx context.Context, trackID string, hashes, offsets []uint32) ([]tracks.FingerprintMatch, error) {
+	return nil, nil
+}
+
+func (f *fakeTracks) Close() error {
+	return nil
+}
+
+func (f *fakeTracks) last(t *testing.T, trackID string) tracks.TrackInfo {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	infos := f.infos[trackID]
+	if len(infos) == 0 {
+		t.Fatalf("no track info reported for %s", trackID)
+	}
+	return infos[len(infos)-1]
+}
@@ -0,0 +1,258 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/cmplx"
+	"sort"
+)
+
+// Fingerprint parameters. The band is kept below ~2.7 kHz so peaks survive low-bitrate lossy
+// re-encodes, and hashes pack two 9-bit bins and a 6-bit frame delta.
+const (
+	fingerprintSampleRate = 11025
+	fingerprintFrameSize  = 2048
+	fingerprintHop        = 1024
+	fingerprintMinBin     = 8
+	fingerprintMaxBin     = 512
+	// fingerprintMaxSec bounds the request size for very long uploads such as DJ mixes.
+	fingerprintMaxSec = 600
+
+	peakFreqRadius   = 12
+	peakTimeRadius   = 3
+	maxPeaksPerFrame = 5
+	minPeakLevel     = 0.0 // log magnitude; quieter bins are treated as silence
+
+	pairFanOut       = 5
+	pairMaxFrames    = 63
+	pairMaxBinDelta  = 128
+	hashBinBits      = 9
+	hashDeltaBits    = 6
+	hashDeltaMask    = 1<<hashDeltaBits - 1
+	fingerprintLimit = fingerprintMaxSec * fingerprintSampleRate
+)
+
+var errFingerprintWindowFull = errors.New("fingerprint window reached")
+
+// Fingerprint is a constellation of spectral peak pairs. Hashes[i] was anchored at frame Offsets[i];
+// two recordings of the same audio share many hashes at a constant offset difference.
+type Fingerprint struct {
+	Hashes  []uint32
+	Offsets []uint32
+}
+
+type spectralPeak struct {
+	frame int
+	bin   int
+	level float32
+}
+
+type fingerprinter struct {
+	window  []float64
+	buf     []complex128
+	pending []float32
+	decoded int
+
+	// spectra and spread keep the last 2*peakTimeRadius+1 frames; spread is the per-frame maximum
+	// over ±peakFreqRadius bins, so a peak is a bin equal to the maximum of its neighbourhood.
+	spectra [][]float32
+	spread  [][]float32
+	next    int // index of the next frame to be added
+	peaks   []spectralPeak
+}
+
+func newFingerprinter() *fingerprinter {
+	window := make([]float64, fingerprintFrameSize)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(fingerprintFrameSize-1))
+	}
+	return &fingerprinter{
+		window: window,
+		buf:    make([]complex128, fingerprintFrameSize),
+	}
+}
+
+func (t *FFmpegTranscoder) generateFingerprint(ctx context.Context, input string) (*Fingerprint, error) {
+	fp := newFingerprinter()
+	err := t.decodePCM(ctx, input, fingerprintSampleRate, fp.write)
+	if err != nil && !errors.Is(err, errFingerprintWindowFull) {
+		return nil, err
+	}
+	fp.flush()
+	return fp.pairs(), nil
+}
+
+// storeFingerprint hands the fingerprint to Track Service, which flags matching earlier tracks.
+// Duplicate detection is advisory, so failures are only logged.
+func (t *FFmpegTranscoder) storeFingerprint(ctx context.Context, trackID string, fp *Fingerprint) {
+	if t.trackClient == nil {
+		return
+	}
+	matches, err := t.trackClient.StoreFingerprint(ctx, trackID, fp.Hashes, fp.Offsets)
+	if err != nil {
+		t.logger.Printf("failed to store fingerprint for track_id=%s: %v", trackID, err)
+		return
+	}
+	for _, m := range matches {
+		t.logger.Printf("track_id=%s is a likely duplicate of track_id=%s (score=%.2f, matched=%d)", trackID, m.TrackID, m.Score, m.MatchedHashes)
+	}
+}
+
+func (f *fingerprinter) write(samples []float32) error {
+	if remaining := fingerprintLimit - f.decoded; len(samples) > remaining {
+		samples = samples[:remaining]
+	}
+	f.decoded += len(samples)
+	f.pending = append(f.pending, samples...)
+
+	for len(f.pending) >= fingerprintFrameSize {
+		f.addFrame(f.pending[:fingerprintFrameSize])
+		f.pending = f.pending[fingerprintHop:]
+	}
+	// keep the backing array from growing with the track
+	f.pending = append(f.pending[:0:0], f.pending...)
+
+	if f.decoded >= fingerprintLimit {
+		return errFingerprintWindowFull
+	}
+	return nil
+}
+
+func (f *fingerprinter) addFrame(samples []float32) {
+	for i, s := range samples {
+		f.buf[i] = complex(float64(s)*f.window[i], 0)
+	}
+	fft(f.buf)
+
+	spectrum := make([]float32, fingerprintMaxBin)
+	for bin := fingerprintMinBin; bin < fingerprintMaxBin; bin++ {
+		spectrum[bin] = float32(math.Log(cmplx.Abs(f.buf[bin]) + 1e-9))
+	}
+	spread := make([]float32, fingerprintMaxBin)
+	for bin := fingerprintMinBin; bin < fingerprintMaxBin; bin++ {
+		top := spectrum[bin]
+		for nb := bin - peakFreqRadius; nb <= bin+peakFreqRadius; nb++ {
+			if nb >= fingerprintMinBin && nb < fingerprintMaxBin && spectrum[nb] > top {
+				top = spectrum[nb]
+			}
+		}
+		spread[bin] = top
+	}
+
+	f.spectra = append(f.spectra, spectrum)
+	f.spread = append(f.spread, spread)
+	f.next++
+
+	// the middle frame now has peakTimeRadius frames on both sides
+	if len(f.spectra) == 2*peakTimeRadius+1 {
+		f.pickPeaks(peakTimeRadius)
+		f.spectra = f.spectra[1:]
+		f.spread = f.spread[1:]
+	}
+}
+
+// flush evaluates the trailing frames that never got a full neighbourhood.
+func (f *fingerprinter) flush() {
+	start := len(f.spectra) - peakTimeRadius
+	if f.next < 2*peakTimeRadius+1 {
+		start = 0
+	}
+	for i := max(start, 0); i < len(f.spectra); i++ {
+		f.pickPeaks(i)
+	}
+}
+
+// pickPeaks finds local maxima of the frame at index i of the sliding window.
+func (f *fingerprinter) pickPeaks(i int) {
+	frame := f.next - len(f.spectra) + i
+	spectrum := f.spectra[i]
+
+	var candidates []spectralPeak
+	for bin := fingerprintMinBin; bin < fingerprintMaxBin; bin++ {
+		level := spectrum[bin]
+		if level <= minPeakLevel || level < f.spread[i][bin] {
+			continue
+		}
+		isPeak := true
+		for j := max(i-peakTimeRadius, 0); j <= i+peakTimeRadius && j < len(f.spread); j++ {
+			if j != i && f.spread[j][bin] > level {
+				isPeak = false
+				break
+			}
+		}
+		if isPeak {
+			candidates = append(candidates, spectralPeak{frame: frame, bin: bin, level: level})
+		}
+	}
+
+	sort.Slice(candidates, func(a, b int) bool { return candidates[a].level > candidates[b].level })
+	if len(candidates) > maxPeaksPerFrame {
+		candidates = candidates[:maxPeaksPerFrame]
+	}
+	f.peaks = append(f.peaks, candidates...)
+}
+
+// pairs combines every peak with the next few peaks in its target zone.
+func (f *fingerprinter) pairs() *Fingerprint {
+	peaks := f.peaks
+	sort.SliceStable(peaks, func(a, b int) bool {
+		if peaks[a].frame != peaks[b].frame {
+			return peaks[a].frame < peaks[b].frame
+		}
+		return peaks[a].bin < peaks[b].bin
+	})
+
+	fp := &Fingerprint{}
+	for i, anchor := range peaks {
+		paired := 0
+		for _, target := range peaks[i+1:] {
+			delta := target.frame - anchor.frame
+			if delta > pairMaxFrames || paired == pairFanOut {
+				break
+			}
+			if delta == 0 || abs(target.bin-anchor.bin) > pairMaxBinDelta {
+				continue
+			}
+			hash := uint32(anchor.bin)<<(hashBinBits+hashDeltaBits) | uint32(target.bin)<<hashDeltaBits | uint32(delta)&hashDeltaMask
+			fp.Hashes = append(fp.Hashes, hash)
+			fp.Offsets = append(fp.Offsets, uint32(anchor.frame))
+			paired++
+		}
+	}
+	return fp
+}
+
+// fft is an in-place iterative radix-2 transform; len(x) must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		half := size / 2
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < half; k++ {
+				u, v := x[start+k], x[start+k+half]*w
+				x[start+k], x[start+k+half] = u+v, u-v
+				w *= step
+			}
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
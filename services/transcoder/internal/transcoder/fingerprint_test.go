@@ -0,0 +1,177 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// melody synthesizes seconds of two-note chords that change every quarter second, which gives
+// the peak picker a different constellation in every stretch of the signal.
+func melody(seconds float64) []float32 {
+	rng := rand.New(rand.NewSource(7))
+	samples := make([]float32, int(seconds*fingerprintSampleRate))
+	noteLen := fingerprintSampleRate / 4
+	var low, high float64
+	for i := range samples {
+		if i%noteLen == 0 {
+			low = 150 + rng.Float64()*600
+			high = 900 + rng.Float64()*1500
+		}
+		t := float64(i) / fingerprintSampleRate
+		samples[i] = float32(0.4*math.Sin(2*math.Pi*low*t) + 0.3*math.Sin(2*math.Pi*high*t))
+	}
+	return samples
+}
+
+func fingerprintOf(t *testing.T, samples []float32) *Fingerprint {
+	t.Helper()
+	fp := newFingerprinter()
+	// feed in decoder-sized blocks, so frames straddle the writes as in production
+	for start := 0; start < len(samples); start += pcmBlockSamples {
+		end := min(start+pcmBlockSamples, len(samples))
+		if err := fp.write(samples[start:end]); err != nil {
+			t.Fatalf("write() error = %v", err)
+		}
+	}
+	fp.flush()
+	return fp.pairs()
+}
+
+func TestFingerprintPairs(t *testing.T) {
+	fp := &fingerprinter{peaks: []spectralPeak{
+		{frame: 10, bin: 100},
+		{frame: 10, bin: 140}, // same frame as the anchor: never paired with it
+		{frame: 12, bin: 120},
+		{frame: 15, bin: 230}, // more than pairMaxBinDelta above the first anchor
+		{frame: 80, bin: 100}, // beyond pairMaxFrames of every other peak
+	}}
+
+	type pair struct{ anchorBin, targetBin, delta, offset int }
+	var got []pair
+	result := fp.pairs()
+	if len(result.Hashes) != len(result.Offsets) {
+		t.Fatalf("%d hashes but %d offsets", len(result.Hashes), len(result.Offsets))
+	}
+	for i, hash := range result.Hashes {
+		got = append(got, pair{
+			anchorBin: int(hash >> (hashBinBits + hashDeltaBits)),
+			targetBin: int(hash>>hashDeltaBits) & (1<<hashBinBits - 1),
+			delta:     int(hash & hashDeltaMask),
+			offset:    int(result.Offsets[i]),
+		})
+	}
+
+	want := []pair{
+		{anchorBin: 100, targetBin: 120, delta: 2, offset: 10},
+		{anchorBin: 140, targetBin: 120, delta: 2, offset: 10},
+		{anchorBin: 140, targetBin: 230, delta: 5, offset: 10},
+		{anchorBin: 120, targetBin: 230, delta: 3, offset: 12},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("pairs = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("pair %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestFingerprintFanOut(t *testing.T) {
+	fp := &fingerprinter{}
+	for frame := 0; frame < 20; frame++ {
+		fp.peaks = append(fp.peaks, spectralPeak{frame: frame, bin: 200})
+	}
+	result := fp.pairs()
+	counts := make(map[uint32]int)
+	for _, offset := range result.Offsets {
+		counts[offset]++
+	}
+	if counts[0] != pairFanOut {
+		t.Errorf("anchor at frame 0 paired %d times, want %d", counts[0], pairFanOut)
+	}
+}
+
+func TestFingerprintAlignment(t *testing.T) {
+	const shiftFrames = 5
+	audio := melody(8)
+	// leading silence produces no peaks and moves every frame of the copy by whole hops
+	shifted := append(make([]float32, shiftFrames*fingerprintHop), audio...)
+
+	original := fingerprintOf(t, audio)
+	moved := fingerprintOf(t, shifted)
+	if len(original.Hashes) < 100 {
+		t.Fatalf("only %d hashes for 8 s of audio", len(original.Hashes))
+	}
+
+	offsets := make(map[uint32][]uint32)
+	for i, hash := range original.Hashes {
+		offsets[hash] = append(offsets[hash], original.Offsets[i])
+	}
+	aligned := 0
+	for i, hash := range moved.Hashes {
+		for _, offset := range offsets[hash] {
+			if moved.Offsets[i]-offset == shiftFrames {
+				aligned++
+				break
+			}
+		}
+	}
+	if ratio := float64(aligned) / float64(len(moved.Hashes)); ratio < 0.8 {
+		t.Errorf("%d of %d hashes of the shifted copy align with the original (%.2f), want at least 0.8", aligned, len(moved.Hashes), ratio)
+	}
+
+	other := fingerprintOf(t, bandLimited(fingerprintSampleRate, 4000, 8))
+	shared := 0
+	for _, hash := range other.Hashes {
+		if len(offsets[hash]) > 0 {
+			shared++
+		}
+	}
+	if ratio := float64(shared) / float64(len(other.Hashes)); ratio > 0.2 {
+		t.Errorf("unrelated audio shares %.2f of its hashes, want at most 0.2", ratio)
+	}
+}
+
+func TestFingerprintWindowLimit(t *testing.T) {
+	fp := newFingerprinter()
+	block := make([]float32, fingerprintSampleRate*60)
+	var err error
+	written := 0
+	for written < fingerprintLimit+len(block) && err == nil {
+		err = fp.write(block)
+		written += len(block)
+	}
+	if !errors.Is(err, errFingerprintWindowFull) {
+		t.Fatalf("write() error = %v, want errFingerprintWindowFull", err)
+	}
+	if fp.decoded != fingerprintLimit {
+		t.Errorf("decoded %d samples, want the %d sample window", fp.decoded, fingerprintLimit)
+	}
+}
+
+func TestGenerateFingerprint(t *testing.T) {
+	runner := &fakeRunner{t: t, commands: []fakeCommand{{tool: "ffmpeg", match: withArg("-f", "s16le"), run: decodeTone(4)}}}
+	tr := &FFmpegTranscoder{runner: runner, ffmpegPath: "ffmpeg"}
+
+	fp, err := tr.generateFingerprint(context.Background(), "source")
+	if err != nil {
+		t.Fatalf("generateFingerprint() error = %v", err)
+	}
+	if len(fp.Hashes) == 0 || len(fp.Hashes) != len(fp.Offsets) {
+		t.Fatalf("generateFingerprint() = %d hashes, %d offsets", len(fp.Hashes), len(fp.Offsets))
+	}
+	if n := runner.callCount("-ar 11025", "-ac 1"); n != 1 {
+		t.Errorf("decoder called %d time(s) with the fingerprint format, want 1", n)
+	}
+	// a steady 440 Hz tone only has peaks in the bin of the tone
+	toneBin := uint32(math.Round(440 * fingerprintFrameSize / fingerprintSampleRate))
+	for _, hash := range fp.Hashes {
+		if anchor := hash >> (hashBinBits + hashDeltaBits); anchor < toneBin-1 || anchor > toneBin+1 {
+			t.Fatalf("hash %#x anchored at bin %d, want the tone bin %d", hash, anchor, toneBin)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package transcoder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	gaplessFileName = "gapless.json"
+	// gaplessDataID names the EXT-X-SESSION-DATA entry of the master playlist pointing at gapless.json.
+	gaplessDataID = "com.musicsocial.gapless"
+)
+
+// codecFraming is the encoder delay (priming samples) and frame length of the encoders in codecSpecs,
+// in samples at the output rate. FLAC has no priming and a short last block, so it never pads.
+// The delay is only a fallback: the one the encoder actually used is read back from the init
+// section, see probeEncoderDelays.
+var codecFraming = map[string]struct{ delay, frame int }{
+	"aac":       {delay: 1024, frame: 1024},
+	"he-aac":    {delay: 2048, frame: 2048},
+	"he-aac-v2": {delay: 2048, frame: 2048},
+	"opus":      {delay: 312, frame: 960},
+	"flac":      {delay: 0, frame: 0},
+}
+
+// GaplessInfo lets players drop encoder priming and padding so album tracks join without a gap.
+type GaplessInfo struct {
+	Version     int     `json:"version"`
+	DurationSec float64 `json:"duration_sec"`
+	// LeadingTrimSec and TrailingTrimSec are the silence cut from the source, see SilenceInfo.
+	LeadingTrimSec  float64                   `json:"leading_trim_sec"`
+	TrailingTrimSec float64                   `json:"trailing_trim_sec"`
+	Variants        map[string]VariantGapless `json:"variants"`
+}
+
+// VariantGapless follows the iTunSMPB model: skip EncoderDelay samples, play ValidSamples, drop Padding.
+type VariantGapless struct {
+	Codec        string `json:"codec"`
+	SampleRate   int    `json:"sample_rate"`
+	EncoderDelay int    `json:"encoder_delay"`
+	Padding      int    `json:"padding"`
+	ValidSamples int64  `json:"valid_samples"`
+}
+
+// newGaplessInfo takes the probed encoder delay of each variant from delays, by variant name.
+func newGaplessInfo(variants []rendition, durationSec float64, sourceSampleRate int, silence *SilenceInfo, delays map[string]int) *GaplessInfo {
+	info := &GaplessInfo{
+		Version:     1,
+		DurationSec: roundToDecimals(durationSec, 3),
+		Variants:    make(map[string]VariantGapless, len(variants)),
+	}
+	if silence != nil && silence.Trimmed {
+		info.LeadingTrimSec = silence.LeadingSec
+		info.TrailingTrimSec = silence.TrailingSec
+	}
+
+	for _, variant := range variants {
+		sampleRate := variant.SampleRate
+		if sampleRate == 0 {
+			sampleRate = sourceSampleRate
+		}
+		framing := codecFraming[variant.Codec]
+		if delay, ok := delays[variant.Name]; ok {
+			framing.delay = delay
+		}
+		samples := int64(math.Round(durationSec * float64(sampleRate)))
+
+		padding := 0
+		if framing.frame > 0 {
+			total := samples + int64(framing.delay)
+			frames := (total + int64(framing.frame) - 1) / int64(framing.frame)
+			padding = int(frames*int64(framing.frame) - total)
+		}
+		info.Variants[variant.Name] = VariantGapless{
+			Codec:        variant.Codec,
+			SampleRate:   sampleRate,
+			EncoderDelay: framing.delay,
+			Padding:      padding,
+			ValidSamples: samples,
+		}
+	}
+	return info
+}
+
+func (g *GaplessInfo) write(outputDir string) error {
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal gapless info: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, gaplessFileName), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write gapless info: %w", err)
+	}
+	return nil
+}
+
+// probeEncoderDelays reads the encoder delay each variant declares in its init section (the
+// initial_padding ffprobe reports from the edit list or the codec config). Variants it cannot be
+// read from keep the codecFraming estimate: a wrong delay only costs gapless playback, not the track.
+func (t *FFmpegTranscoder) probeEncoderDelays(ctx context.Context, outputDir string, variants []rendition, segments segmentLayout) map[string]int {
+	initName := "init.mp4"
+	if segments.singleFile {
+		initName = singleFileName
+	}
+
+	delays := make(map[string]int, len(variants))
+	for _, variant := range variants {
+		if codecFraming[variant.Codec].frame == 0 {
+			continue
+		}
+		delay, err := t.probeInitialPadding(ctx, filepath.Join(outputDir, variant.Name, initName))
+		if err != nil {
+			t.logger.Printf("failed to read encoder delay of variant %s, using the %s default: %v", variant.Name, variant.Codec, err)
+			continue
+		}
+		if delay > 0 {
+			delays[variant.Name] = delay
+		}
+	}
+	return delays
+}
+
+func (t *FFmpegTranscoder) probeInitialPadding(ctx context.Context, path string) (int, error) {
+	var stdout, stderr bytes.Buffer
+	err := t.runner.Run(ctx, t.ffprobePath, []string{
+		"-v", "error",
+		"-select_streams", "a:0",
+		"-print_format", "json",
+		"-show_entries", "stream=initial_padding",
+		path,
+	}, &stdout, &stderr)
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe failed: %w (output=%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	var probe ffprobeOutput
+	if err := json.Unmarshal(stdout.Bytes(), &probe); err != nil {
+		return 0, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+	if len(probe.Streams) == 0 {
+		return 0, fmt.Errorf("no audio stream in %s", filepath.Base(path))
+	}
+	return probe.Streams[0].InitialPadding, nil
+}
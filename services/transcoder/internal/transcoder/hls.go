@@ -0,0 +1,144 @@
+package transcoder
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// byteRange addresses part of an object, as in EXT-X-BYTERANGE.
+type byteRange struct {
+	Length int64
+	Offset int64
+}
+
+// dashRange formats the range as the inclusive first-last pair DASH expects.
+func (r *byteRange) dashRange() string {
+	if r == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", r.Offset, r.Offset+r.Length-1)
+}
+
+type mediaSegment struct {
+	URI         string
+	DurationSec float64
+	// ByteRange is set for single-file variants.
+	ByteRange *byteRange
+}
+
+type mediaPlaylist struct {
+	InitURI       string
+	InitByteRange *byteRange
+	Segments      []mediaSegment
+}
+
+func (p mediaPlaylist) totalDuration() float64 {
+	var total float64
+	for _, segment := range p.Segments {
+		total += segment.DurationSec
+	}
+	return total
+}
+
+func parseMediaPlaylist(playlistPath string) (*mediaPlaylist, error) {
+	file, err := os.Open(playlistPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open playlist %s: %w", playlistPath, err)
+	}
+	defer file.Close()
+
+	playlist := &mediaPlaylist{}
+	var pendingDuration *float64
+	var pendingRange *byteRange
+	// next offsets of each file, for EXT-X-BYTERANGE without an explicit offset
+	nextOffset := make(map[string]int64)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			attributes := strings.TrimPrefix(line, "#EXT-X-MAP:")
+			playlist.InitURI = attributeValue(attributes, "URI")
+			if raw := attributeValue(attributes, "BYTERANGE"); raw != "" {
+				r, err := parseByteRange(raw, 0)
+				if err != nil {
+					return nil, fmt.Errorf("invalid EXT-X-MAP in %s: %w", playlistPath, err)
+				}
+				playlist.InitByteRange = r
+				nextOffset[playlist.InitURI] = r.Offset + r.Length
+			}
+		case strings.HasPrefix(line, "#EXTINF:"):
+			raw := strings.TrimPrefix(line, "#EXTINF:")
+			if idx := strings.IndexByte(raw, ','); idx >= 0 {
+				raw = raw[:idx]
+			}
+			v, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid EXTINF in %s: %q", playlistPath, line)
+			}
+			pendingDuration = &v
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			// the offset defaults to the end of the previous range of the same file, known once the URI is read
+			raw := strings.TrimPrefix(line, "#EXT-X-BYTERANGE:")
+			r, err := parseByteRange(raw, -1)
+			if err != nil {
+				return nil, fmt.Errorf("invalid EXT-X-BYTERANGE in %s: %w", playlistPath, err)
+			}
+			pendingRange = r
+		case strings.HasPrefix(line, "#"):
+			continue
+		default:
+			if pendingDuration == nil {
+				return nil, fmt.Errorf("segment %s in %s has no EXTINF", line, playlistPath)
+			}
+			segment := mediaSegment{URI: line, DurationSec: *pendingDuration}
+			if pendingRange != nil {
+				if pendingRange.Offset < 0 {
+					pendingRange.Offset = nextOffset[line]
+				}
+				nextOffset[line] = pendingRange.Offset + pendingRange.Length
+				segment.ByteRange = pendingRange
+			}
+			playlist.Segments = append(playlist.Segments, segment)
+			pendingDuration, pendingRange = nil, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read playlist %s: %w", playlistPath, err)
+	}
+
+	return playlist, nil
+}
+
+func attributeValue(attributes, name string) string {
+	for _, part := range strings.Split(attributes, ",") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || strings.TrimSpace(key) != name {
+			continue
+		}
+		return strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return ""
+}
+
+// parseByteRange reads <length>[@<offset>]; a missing offset is returned as defaultOffset.
+func parseByteRange(raw string, defaultOffset int64) (*byteRange, error) {
+	lengthRaw, offsetRaw, hasOffset := strings.Cut(raw, "@")
+	length, err := strconv.ParseInt(lengthRaw, 10, 64)
+	if err != nil || length <= 0 {
+		return nil, fmt.Errorf("bad byte range %q", raw)
+	}
+	r := &byteRange{Length: length, Offset: defaultOffset}
+	if hasOffset {
+		if r.Offset, err = strconv.ParseInt(offsetRaw, 10, 64); err != nil || r.Offset < 0 {
+			return nil, fmt.Errorf("bad byte range %q", raw)
+		}
+	}
+	return r, nil
+}
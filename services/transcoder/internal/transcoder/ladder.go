@@ -0,0 +1,171 @@
+package transcoder
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/MusicSocial/transcoder/internal/config"
+)
+
+type codecSpec struct {
+	encoderArgs []string
+	// hlsCodec is the RFC 6381 value for the CODECS attribute of the master playlist.
+	hlsCodec string
+	// probeName is the codec_name ffprobe reports for the encoded stream.
+	probeName string
+	label     string
+	// sampleRates lists rates the codec accepts inside fMP4; empty means any.
+	sampleRates []int
+}
+
+var codecSpecs = map[string]codecSpec{
+	"aac": {
+		encoderArgs: []string{"-c:a", "aac"},
+		hlsCodec:    "mp4a.40.2",
+		probeName:   "aac",
+		label:       "AAC",
+	},
+	"he-aac": {
+		encoderArgs: []string{"-c:a", "libfdk_aac", "-profile:a", "aac_he"},
+		hlsCodec:    "mp4a.40.5",
+		probeName:   "aac",
+		label:       "HE-AAC",
+	},
+	"he-aac-v2": {
+		encoderArgs: []string{"-c:a", "libfdk_aac", "-profile:a", "aac_he_v2"},
+		hlsCodec:    "mp4a.40.29",
+		probeName:   "aac",
+		label:       "HE-AACv2",
+	},
+	"opus": {
+		encoderArgs: []string{"-c:a", "libopus", "-vbr", "on"},
+		hlsCodec:    "opus",
+		probeName:   "opus",
+		label:       "Opus",
+		sampleRates: []int{48000},
+	},
+	"flac": {
+		encoderArgs: []string{"-c:a", "flac", "-strict", "experimental"},
+		hlsCodec:    "fLaC",
+		probeName:   "flac",
+		label:       "FLAC",
+	},
+}
+
+const (
+	segmentModeSingleFile = "single_file"
+	// singleFileName holds the init section and every segment of a single_file variant.
+	singleFileName = "media.mp4"
+	// legacySegmentSec is the segment duration used before it became configurable.
+	legacySegmentSec = 2.0
+)
+
+// segmentLayout is how the renditions of a profile are cut into objects.
+type segmentLayout struct {
+	singleFile  bool
+	durationSec float64
+}
+
+func resolveSegments(settings config.TranscodingConfig, profile config.LadderProfile) segmentLayout {
+	layout := segmentLayout{
+		singleFile:  profile.SegmentMode == segmentModeSingleFile,
+		durationSec: settings.SegmentDurationSec,
+	}
+	if profile.SegmentDurationSec > 0 {
+		layout.durationSec = profile.SegmentDurationSec
+	}
+	if layout.durationSec <= 0 {
+		layout.durationSec = legacySegmentSec
+	}
+	return layout
+}
+
+// hlsArgs are the ffmpeg HLS muxer options writing the variant playlist into dir.
+func (l segmentLayout) hlsArgs(dir string) []string {
+	args := []string{
+		"-hls_time", strconv.FormatFloat(l.durationSec, 'f', -1, 64),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_type", "fmp4",
+	}
+	if l.singleFile {
+		// the init section goes first into the same file and is referenced with a byte range too
+		return append(args,
+			"-hls_flags", "single_file",
+			"-hls_segment_filename", filepath.ToSlash(filepath.Join(dir, singleFileName)),
+		)
+	}
+	return append(args,
+		"-hls_fmp4_init_filename", "init.mp4",
+		"-hls_segment_filename", filepath.ToSlash(filepath.Join(dir, "chunk_%05d.m4s")),
+	)
+}
+
+type rendition struct {
+	config.VariantConfig
+	codec codecSpec
+}
+
+func resolveLadder(profile config.LadderProfile) ([]rendition, error) {
+	if len(profile.Variants) == 0 {
+		return nil, fmt.Errorf("ladder profile %q has no variants", profile.Name)
+	}
+
+	variants := make([]rendition, 0, len(profile.Variants))
+	for _, v := range profile.Variants {
+		v.Codec = strings.ToLower(v.Codec)
+		spec, ok := codecSpecs[v.Codec]
+		if !ok {
+			return nil, fmt.Errorf("variant %s: unsupported codec %q", v.Name, v.Codec)
+		}
+		if len(spec.sampleRates) > 0 && v.SampleRate != 0 && !containsInt(spec.sampleRates, v.SampleRate) {
+			return nil, fmt.Errorf("variant %s: codec %s does not support sample rate %d", v.Name, v.Codec, v.SampleRate)
+		}
+		if v.Channels == 0 {
+			v.Channels = 2
+		}
+		if v.SampleRate == 0 && len(spec.sampleRates) > 0 {
+			v.SampleRate = spec.sampleRates[0]
+		}
+		variants = append(variants, rendition{VariantConfig: v, codec: spec})
+	}
+	return variants, nil
+}
+
+func (v rendition) encoderArgs(fallbackSampleRate int) []string {
+	args := append([]string{}, v.codec.encoderArgs...)
+	if v.Codec != "flac" && v.BitrateK > 0 {
+		args = append(args, "-b:a", fmt.Sprintf("%dk", v.BitrateK))
+	}
+	args = append(args, "-ac", fmt.Sprintf("%d", v.Channels))
+	sampleRate := v.SampleRate
+	if sampleRate == 0 {
+		sampleRate = fallbackSampleRate
+	}
+	if sampleRate > 0 {
+		args = append(args, "-ar", fmt.Sprintf("%d", sampleRate))
+	}
+	return args
+}
+
+// bandwidth is the peak bitrate advertised in the master playlist; for lossless codecs BitrateK is a nominal estimate.
+func (v rendition) bandwidth() int {
+	return v.BitrateK * 1000
+}
+
+func (v rendition) displayName() string {
+	if v.Codec == "flac" {
+		return v.codec.label
+	}
+	return fmt.Sprintf("%s %d", v.codec.label, v.BitrateK)
+}
+
+func containsInt(values []int, target int) bool {
+	for _, v := range values {
+		if v == target {
+			return true
+		}
+	}
+	return false
+}
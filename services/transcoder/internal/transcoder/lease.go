@@ -0,0 +1,219 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/MusicSocial/transcoder/internal/storage"
+)
+
+const (
+	leaseFileName = "lease.json"
+
+	LeaseHeld     = "held"
+	LeaseReleased = "released"
+)
+
+// JobLease is kept next to a track's metadata while a job runs on it. The holder renews it every
+// heartbeat interval; a held lease past ExpiresAt belongs to an instance that died mid-job.
+type JobLease struct {
+	TrackID     string     `json:"track_id"`
+	Instance    string     `json:"instance"`
+	JobID       string     `json:"job_id"`
+	State       string     `json:"state"`
+	AcquiredAt  time.Time  `json:"acquired_at"`
+	HeartbeatAt time.Time  `json:"heartbeat_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	ReleasedAt  *time.Time `json:"released_at,omitempty"`
+}
+
+// Active reports whether the lease still belongs to a live job at now.
+func (l *JobLease) Active(now time.Time) bool {
+	return l.State == LeaseHeld && now.Before(l.ExpiresAt)
+}
+
+// LeaseKey is where the lease of a track is stored.
+func LeaseKey(artistID, trackID string) string {
+	return path.Join(artistID, trackID, "metadata", leaseFileName)
+}
+
+// errLeaseLost cancels a job whose lease was overwritten by another job or ran out because
+// it could not be renewed.
+var errLeaseLost = errors.New("job lease was lost")
+
+// jobLease renews a held lease until release is called. Every write is conditional on the ETag
+// of the previous one, so a lease that another job took over is never overwritten.
+type jobLease struct {
+	t      *FFmpegTranscoder
+	bucket string
+	key    string
+	lease  JobLease
+	etag   string
+
+	// expires is the ExpiresAt of the last write that succeeded
+	expires time.Time
+
+	// ctx is cancelled with errLeaseLost when the lease is lost
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// acquireLease waits while another job holds a live lease on the track, then takes the lease
+// and starts renewing it. An expired lease is taken over. Of several jobs writing the lease at
+// once only one wins the conditional write; the others read it again and wait.
+func (t *FFmpegTranscoder) acquireLease(ctx context.Context, bucket, key, trackID string) (*jobLease, error) {
+	jobID := shortID()
+	waiting := false
+	for {
+		var current JobLease
+		etag, err := t.storage.ReadJSONVersion(ctx, bucket, key, &current)
+		switch {
+		case errors.Is(err, storage.ErrObjectNotFound):
+			etag = ""
+		case err != nil:
+			return nil, fmt.Errorf("failed to read job lease: %w", err)
+		case current.Active(time.Now()):
+			if !waiting {
+				t.logger.Printf("track_id=%s is being processed by %s (job %s, lease expires %s), waiting",
+					trackID, current.Instance, current.JobID, current.ExpiresAt.Format(time.RFC3339))
+				waiting = true
+			}
+			if !Sleep(ctx, nil, min(time.Until(current.ExpiresAt), t.limits.HeartbeatInterval)) {
+				return nil, ctx.Err()
+			}
+			continue
+		case current.State == LeaseHeld:
+			t.logger.Printf("taking over abandoned lease on track_id=%s from %s (last heartbeat %s)",
+				trackID, current.Instance, current.HeartbeatAt.Format(time.RFC3339))
+		}
+
+		now := time.Now().UTC()
+		lease := JobLease{
+			TrackID:     trackID,
+			Instance:    t.limits.InstanceID,
+			JobID:       jobID,
+			State:       LeaseHeld,
+			AcquiredAt:  now,
+			HeartbeatAt: now,
+			ExpiresAt:   now.Add(t.limits.LeaseTTL),
+		}
+		etag, err = t.storage.UploadJSONIf(ctx, bucket, key, lease, etag)
+		if errors.Is(err, storage.ErrPreconditionFailed) {
+			// another job wrote the lease since we read it
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to write job lease: %w", err)
+		}
+
+		leaseCtx, cancel := context.WithCancelCause(ctx)
+		l := &jobLease{
+			t:       t,
+			bucket:  bucket,
+			key:     key,
+			lease:   lease,
+			etag:    etag,
+			expires: lease.ExpiresAt,
+			ctx:     leaseCtx,
+			cancel:  cancel,
+			stop:    make(chan struct{}),
+			done:    make(chan struct{}),
+		}
+		go l.heartbeat()
+		return l, nil
+	}
+}
+
+func (l *jobLease) heartbeat() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.t.limits.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now().UTC()
+		l.lease.HeartbeatAt = now
+		l.lease.ExpiresAt = now.Add(l.t.limits.LeaseTTL)
+		err := l.write(l.ctx)
+		switch {
+		case errors.Is(err, errLeaseLost):
+			l.t.logger.Printf("lost lease on track_id=%s, cancelling job %s: %v", l.lease.TrackID, l.lease.JobID, err)
+			l.cancel(errLeaseLost)
+			return
+		case err != nil && l.ctx.Err() == nil:
+			// the stored lease may still be ours: keep retrying until it would have expired anyway
+			if !time.Now().Before(l.expires) {
+				l.t.logger.Printf("lease on track_id=%s expired without renewal, cancelling job %s: %v", l.lease.TrackID, l.lease.JobID, err)
+				l.cancel(errLeaseLost)
+				return
+			}
+			l.t.logger.Printf("failed to renew lease on track_id=%s: %v", l.lease.TrackID, err)
+		}
+	}
+}
+
+// release stops the heartbeat and marks the lease released, also when ctx is already cancelled,
+// so the next job on the track does not wait for the lease to expire.
+func (l *jobLease) release(ctx context.Context) {
+	close(l.stop)
+	<-l.done
+	defer l.cancel(nil)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	now := time.Now().UTC()
+	l.lease.State = LeaseReleased
+	l.lease.ReleasedAt = &now
+	if err := l.write(ctx); err != nil {
+		l.t.logger.Printf("failed to release lease on track_id=%s: %v", l.lease.TrackID, err)
+	}
+}
+
+// write stores the lease if it is still the version we wrote last. When the condition fails
+// because the response to our previous write was lost, the stored lease is still ours and the
+// write is repeated on its ETag. errLeaseLost is returned only when the stored lease belongs to
+// another job; any other error leaves it to the next heartbeat to try again.
+func (l *jobLease) write(ctx context.Context) error {
+	etag, err := l.t.storage.UploadJSONIf(ctx, l.bucket, l.key, l.lease, l.etag)
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		var current JobLease
+		stored, readErr := l.t.storage.ReadJSONVersion(ctx, l.bucket, l.key, &current)
+		if readErr != nil {
+			return fmt.Errorf("failed to read job lease: %w", readErr)
+		}
+		if current.JobID != l.lease.JobID || current.State != LeaseHeld {
+			return fmt.Errorf("%w: now held by %s (job %s)", errLeaseLost, current.Instance, current.JobID)
+		}
+		etag, err = l.t.storage.UploadJSONIf(ctx, l.bucket, l.key, l.lease, stored)
+	}
+	if err != nil {
+		return err
+	}
+	l.etag = etag
+	l.expires = l.lease.ExpiresAt
+	return nil
+}
+
+// Sleep waits for d and reports false when ctx is cancelled or stop is closed first.
+func Sleep(ctx context.Context, stop <-chan struct{}, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
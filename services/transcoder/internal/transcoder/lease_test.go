@@ -0,0 +1,152 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MusicSocial/transcoder/internal/storage"
+)
+
+func TestAcquireLeaseConcurrently(t *testing.T) {
+	env := newTranscodeEnv(t, nil)
+	ctx := context.Background()
+
+	const jobs = 4
+	var (
+		mu     sync.Mutex
+		active int
+		peak   int
+		wg     sync.WaitGroup
+	)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lease, err := env.transcoder.acquireLease(ctx, testBucket, testLeaseKey, "track-1")
+			if err != nil {
+				t.Errorf("acquireLease() error = %v", err)
+				return
+			}
+			mu.Lock()
+			active++
+			peak = max(peak, active)
+			mu.Unlock()
+
+			time.Sleep(2 * testHeartbeat)
+
+			mu.Lock()
+			active--
+			mu.Unlock()
+			lease.release(ctx)
+		}()
+	}
+	wg.Wait()
+
+	if peak != 1 {
+		t.Errorf("%d jobs held the lease at once, want 1", peak)
+	}
+	var lease JobLease
+	env.readJSON(t, testLeaseKey, &lease)
+	if lease.State != LeaseReleased {
+		t.Errorf("lease after all jobs = %+v, want released", lease)
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	env := newTranscodeEnv(t, nil)
+	ctx := context.Background()
+
+	lease, err := env.transcoder.acquireLease(ctx, testBucket, testLeaseKey, "track-1")
+	if err != nil {
+		t.Fatalf("acquireLease() error = %v", err)
+	}
+	// another instance takes the lease over, as if ours had expired
+	env.putLease(t, "other-worker", time.Now().Add(time.Minute))
+
+	select {
+	case <-lease.ctx.Done():
+	case <-time.After(20 * testHeartbeat):
+		t.Fatal("job was not cancelled after its lease was taken over")
+	}
+	if cause := context.Cause(lease.ctx); !errors.Is(cause, errLeaseLost) {
+		t.Errorf("job cancelled with %v, want errLeaseLost", cause)
+	}
+
+	lease.release(ctx)
+	var stored JobLease
+	env.readJSON(t, testLeaseKey, &stored)
+	if stored.Instance != "other-worker" || stored.State != LeaseHeld {
+		t.Errorf("lease after release = %+v, want still held by other-worker", stored)
+	}
+}
+
+// flakyStorage fails lease reads and writes while failing is set, like an unreachable MinIO.
+type flakyStorage struct {
+	storage.Storage
+	failing atomic.Bool
+}
+
+var errStorageDown = errors.New("connection refused")
+
+func (s *flakyStorage) ReadJSONVersion(ctx context.Context, bucket, objectKey string, v interface{}) (string, error) {
+	if s.failing.Load() {
+		return "", errStorageDown
+	}
+	return s.Storage.ReadJSONVersion(ctx, bucket, objectKey, v)
+}
+
+func (s *flakyStorage) UploadJSONIf(ctx context.Context, bucket, objectKey string, payload interface{}, matchETag string) (string, error) {
+	if s.failing.Load() {
+		return "", errStorageDown
+	}
+	return s.Storage.UploadJSONIf(ctx, bucket, objectKey, payload, matchETag)
+}
+
+func TestLeaseStorageErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		outage     time.Duration
+		wantCancel bool
+	}{
+		// LeaseTTL defaults to three heartbeats
+		{name: "outage shorter than the lease is ridden out", outage: testHeartbeat + testHeartbeat/2},
+		{name: "outage past the lease cancels the job", outage: 10 * testHeartbeat, wantCancel: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTranscodeEnv(t, nil)
+			store := &flakyStorage{Storage: env.store}
+			env.transcoder.storage = store
+			ctx := context.Background()
+
+			lease, err := env.transcoder.acquireLease(ctx, testBucket, testLeaseKey, "track-1")
+			if err != nil {
+				t.Fatalf("acquireLease() error = %v", err)
+			}
+			store.failing.Store(true)
+			time.Sleep(tt.outage)
+			store.failing.Store(false)
+			time.Sleep(2 * testHeartbeat)
+
+			cancelled := lease.ctx.Err() != nil
+			if cancelled != tt.wantCancel {
+				t.Fatalf("job cancelled = %v (cause %v), want %v", cancelled, context.Cause(lease.ctx), tt.wantCancel)
+			}
+			if cancelled && !errors.Is(context.Cause(lease.ctx), errLeaseLost) {
+				t.Errorf("job cancelled with %v, want errLeaseLost", context.Cause(lease.ctx))
+			}
+			if !cancelled {
+				var stored JobLease
+				env.readJSON(t, testLeaseKey, &stored)
+				if stored.JobID != lease.lease.JobID || !stored.Active(time.Now()) {
+					t.Errorf("lease after the outage = %+v, want renewed by job %s", stored, lease.lease.JobID)
+				}
+			}
+			lease.release(ctx)
+		})
+	}
+}
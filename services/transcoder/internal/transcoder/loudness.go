@@ -0,0 +1,174 @@
+package transcoder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/MusicSocial/transcoder/internal/config"
+)
+
+const (
+	// silenceFloorLUFS is the absolute gate of BS.1770; anything quieter is reported as silence.
+	silenceFloorLUFS = -70
+
+	normalizationOff        = "off"
+	normalizationLoudnorm   = "loudnorm"
+	normalizationReplayGain = "replaygain"
+)
+
+type LoudnessMetrics struct {
+	InputI         float64 `json:"input_i"`
+	InputTP        float64 `json:"input_tp"`
+	InputLRA       float64 `json:"input_lra"`
+	InputThreshold float64 `json:"input_thresh"`
+	TargetOffset   float64 `json:"target_offset"`
+	// Silent is set when the input measured below silenceFloorLUFS; loudnorm reports -inf for it,
+	// so the measurements are clamped to the floor and no gain is derived.
+	Silent bool `json:"silent,omitempty"`
+
+	Normalization LoudnessNormalization `json:"normalization"`
+}
+
+// LoudnessNormalization records which correction was applied to the renditions.
+type LoudnessNormalization struct {
+	Mode     string  `json:"mode"`
+	TargetI  float64 `json:"target_i"`
+	TargetTP float64 `json:"target_tp"`
+	// TrackGainDB and TrackPeak are ReplayGain-style values for players that apply gain themselves.
+	TrackGainDB float64 `json:"track_gain_db"`
+	TrackPeak   float64 `json:"track_peak"`
+}
+
+type loudnessRaw struct {
+	InputI       float64 `json:"input_i,string"`
+	InputTP      float64 `json:"input_tp,string"`
+	InputLRA     float64 `json:"input_lra,string"`
+	InputThresh  float64 `json:"input_thresh,string"`
+	TargetOffset float64 `json:"target_offset,string"`
+}
+
+type loudnessSettings struct {
+	mode string
+	cfg  config.LoudnessConfig
+}
+
+func resolveLoudness(defaults config.LoudnessConfig, task Task) (loudnessSettings, error) {
+	settings := loudnessSettings{mode: defaults.Mode, cfg: defaults}
+	if task.Normalization != "" {
+		settings.mode = task.Normalization
+	}
+	if task.TargetLUFS != nil {
+		settings.cfg.TargetLUFS = *task.TargetLUFS
+	}
+
+	switch settings.mode {
+	case normalizationOff, normalizationLoudnorm, normalizationReplayGain:
+	default:
+		return loudnessSettings{}, fmt.Errorf("unknown normalization mode %q", settings.mode)
+	}
+	if settings.cfg.TargetLUFS < -70 || settings.cfg.TargetLUFS > -5 {
+		return loudnessSettings{}, fmt.Errorf("target loudness %.1f LUFS is out of range [-70, -5]", settings.cfg.TargetLUFS)
+	}
+	return settings, nil
+}
+
+func (s loudnessSettings) filterTargets() string {
+	return fmt.Sprintf("I=%.1f:LRA=%.1f:TP=%.1f", s.cfg.TargetLUFS, s.cfg.LRA, s.cfg.TruePeak)
+}
+
+// measureLoudness runs the first loudnorm pass and derives the gain needed to hit the target.
+func (t *FFmpegTranscoder) measureLoudness(ctx context.Context, input string, settings loudnessSettings) (*LoudnessMetrics, error) {
+	var output bytes.Buffer
+	err := t.runner.Run(ctx, t.ffmpegPath, []string{
+		"-hide_banner",
+		"-i", input,
+		"-af", "loudnorm=" + settings.filterTargets() + ":print_format=json",
+		"-f", "null",
+		"-",
+	}, &output, &output)
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg loudnorm failed: %w (output=%s)", err, output.String())
+	}
+
+	jsonPayload, err := extractJSONBlock(output.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract loudness json: %w", err)
+	}
+
+	var raw loudnessRaw
+	if err := json.Unmarshal(jsonPayload, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse loudness json: %w", err)
+	}
+
+	metrics := &LoudnessMetrics{
+		InputI:         raw.InputI,
+		InputTP:        raw.InputTP,
+		InputLRA:       raw.InputLRA,
+		InputThreshold: raw.InputThresh,
+		TargetOffset:   raw.TargetOffset,
+		Normalization: LoudnessNormalization{
+			Mode:     settings.mode,
+			TargetI:  settings.cfg.TargetLUFS,
+			TargetTP: settings.cfg.TruePeak,
+		},
+	}
+	// JSON cannot encode the -inf loudnorm measures for silent input
+	if !isFinite(raw.InputI) || raw.InputI < silenceFloorLUFS {
+		metrics.Silent = true
+		metrics.InputI = silenceFloorLUFS
+		metrics.InputTP = clampFloor(raw.InputTP, silenceFloorLUFS)
+		metrics.InputLRA = clampFloor(raw.InputLRA, 0)
+		metrics.InputThreshold = clampFloor(raw.InputThresh, silenceFloorLUFS)
+		metrics.TargetOffset = 0
+		return metrics, nil
+	}
+	metrics.InputTP = clampFloor(raw.InputTP, silenceFloorLUFS)
+	metrics.InputThreshold = clampFloor(raw.InputThresh, silenceFloorLUFS)
+	if !isFinite(raw.TargetOffset) {
+		metrics.TargetOffset = 0
+	}
+	metrics.Normalization.TrackGainDB = roundToDecimals(settings.cfg.TargetLUFS-metrics.InputI, 2)
+	metrics.Normalization.TrackPeak = roundToDecimals(math.Pow(10, metrics.InputTP/20), 6)
+	return metrics, nil
+}
+
+func isFinite(v float64) bool {
+	return !math.IsInf(v, 0) && !math.IsNaN(v)
+}
+
+// clampFloor replaces non-finite values and values below floor with floor.
+func clampFloor(v, floor float64) float64 {
+	if !isFinite(v) || v < floor {
+		return floor
+	}
+	return v
+}
+
+// normalizationFilter returns the second-pass loudnorm filter built from the measured values,
+// or an empty string when the renditions must keep the source gain.
+func (m *LoudnessMetrics) normalizationFilter(settings loudnessSettings) string {
+	if settings.mode != normalizationLoudnorm {
+		return ""
+	}
+	// silent or near-silent input gives -inf measurements that loudnorm cannot use
+	if m.Silent {
+		return ""
+	}
+	return fmt.Sprintf("loudnorm=%s:measured_I=%.2f:measured_TP=%.2f:measured_LRA=%.2f:measured_thresh=%.2f:offset=%.2f:linear=true",
+		settings.filterTargets(), m.InputI, m.InputTP, m.InputLRA, m.InputThreshold, m.TargetOffset)
+}
+
+// gainTags are the ReplayGain tags written into the renditions in replaygain mode, so players that
+// read them apply the gain without fetching loudness.json.
+func (m *LoudnessMetrics) gainTags(settings loudnessSettings) []string {
+	if settings.mode != normalizationReplayGain || m.Silent {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("REPLAYGAIN_TRACK_GAIN=%.2f dB", m.Normalization.TrackGainDB),
+		fmt.Sprintf("REPLAYGAIN_TRACK_PEAK=%.6f", m.Normalization.TrackPeak),
+	}
+}
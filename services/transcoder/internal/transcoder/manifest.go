@@ -0,0 +1,124 @@
+package transcoder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/MusicSocial/transcoder/internal/config"
+	"github.com/MusicSocial/transcoder/internal/storage"
+	"github.com/MusicSocial/transcoder/internal/tracks"
+)
+
+const (
+	manifestFileName = "outputs.json"
+	// pipelineVersion must be bumped whenever the pipeline starts producing different outputs
+	// for the same ladder, so existing manifests stop matching.
+	pipelineVersion = 6
+)
+
+// OutputManifest records what a completed job produced; it is written after every upload succeeded.
+type OutputManifest struct {
+	Profile       string           `json:"profile"`
+	LadderVersion string           `json:"ladder_version"`
+	SourceSHA256  string           `json:"source_sha256"`
+	Outputs       []string         `json:"outputs"`
+	TrackInfo     tracks.TrackInfo `json:"track_info"`
+	CompletedAt   time.Time        `json:"completed_at"`
+}
+
+func (m *OutputManifest) matches(profile, ladderVersion, sourceHash string) bool {
+	return m.Profile == profile && m.LadderVersion == ladderVersion && m.SourceSHA256 == sourceHash
+}
+
+// ladderVersion fingerprints every setting that changes the produced renditions.
+func ladderVersion(profile config.LadderProfile, segments segmentLayout, loudness loudnessSettings, encryption string, preview config.PreviewConfig, silence config.SilenceConfig) (string, error) {
+	// the segment layout is left out at its historical values so existing manifests keep matching
+	var segmentMode string
+	if segments.singleFile {
+		segmentMode = segmentModeSingleFile
+	}
+	var segmentSec float64
+	if segments.durationSec != legacySegmentSec {
+		segmentSec = segments.durationSec
+	}
+	data, err := json.Marshal(struct {
+		Pipeline    int                    `json:"pipeline"`
+		Variants    []config.VariantConfig `json:"variants"`
+		SegmentMode string                 `json:"segment_mode,omitempty"`
+		SegmentSec  float64                `json:"segment_sec,omitempty"`
+		Mode        string                 `json:"mode"`
+		Loudness    config.LoudnessConfig  `json:"loudness"`
+		Encryption  string                 `json:"encryption"`
+		Preview     config.PreviewConfig   `json:"preview"`
+		Silence     config.SilenceConfig   `json:"silence"`
+	}{pipelineVersion, profile.Variants, segmentMode, segmentSec, loudness.mode, loudness.cfg, encryption, preview, silence})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+func hashFile(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// completedManifest returns the manifest of an earlier run whose outputs can be reused, or nil.
+func (t *FFmpegTranscoder) completedManifest(ctx context.Context, bucket, manifestKey, masterKey, profile, version, sourceHash string) (*OutputManifest, error) {
+	var manifest OutputManifest
+	if err := t.storage.ReadJSON(ctx, bucket, manifestKey, &manifest); err != nil {
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !manifest.matches(profile, version, sourceHash) {
+		return nil, nil
+	}
+
+	// the manifest outlives manual cleanups of the bucket, so check the entry point is still there
+	exists, err := t.storage.Exists(ctx, bucket, masterKey)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// objectKeys lists the keys a directory is uploaded to by UploadDirectory.
+func objectKeys(prefix, dir string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(dir, func(entryPath string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, entryPath)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path for %s: %w", entryPath, err)
+		}
+		keys = append(keys, path.Join(prefix, filepath.ToSlash(rel)))
+		return nil
+	})
+	return keys, err
+}
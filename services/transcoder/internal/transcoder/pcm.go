@@ -0,0 +1,74 @@
+package transcoder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const pcmBlockSamples = 8192
+
+// decodePCM decodes the first audio stream into mono float samples in [-1, 1]
+// and hands them to handle in blocks, so whole tracks never sit in memory.
+func (t *FFmpegTranscoder) decodePCM(ctx context.Context, input string, sampleRate int, handle func(samples []float32) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stdout, pipe := io.Pipe()
+	var stderr bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		err := t.runner.Run(ctx, t.ffmpegPath, []string{
+			"-hide_banner",
+			"-v", "error",
+			"-i", input,
+			"-map", "0:a:0",
+			"-ac", "1",
+			"-ar", strconv.Itoa(sampleRate),
+			"-f", "s16le",
+			"-acodec", "pcm_s16le",
+			"-",
+		}, pipe, &stderr)
+		pipe.Close()
+		done <- err
+	}()
+	// stop stops the decoder early; closing the reader unblocks its pending writes
+	stop := func() {
+		cancel()
+		stdout.Close()
+		<-done
+	}
+
+	reader := bufio.NewReaderSize(stdout, pcmBlockSamples*2)
+	raw := make([]byte, pcmBlockSamples*2)
+	samples := make([]float32, pcmBlockSamples)
+
+	for {
+		n, err := io.ReadFull(reader, raw)
+		if count := n / 2; count > 0 {
+			for i := 0; i < count; i++ {
+				samples[i] = float32(int16(binary.LittleEndian.Uint16(raw[i*2:]))) / 32768
+			}
+			if handleErr := handle(samples[:count]); handleErr != nil {
+				stop()
+				return handleErr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			stop()
+			return fmt.Errorf("failed to read decoded audio: %w", err)
+		}
+	}
+
+	if err := <-done; err != nil {
+		return fmt.Errorf("ffmpeg decode failed: %w (output=%s)", err, stderr.String())
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package transcoder
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/MusicSocial/transcoder/internal/config"
+)
+
+const previewDirName = "preview"
+
+// PreviewWindow is the part of the track played to signed-out listeners.
+type PreviewWindow struct {
+	OffsetSec   float64 `json:"offset_sec"`
+	DurationSec float64 `json:"duration_sec"`
+	// Auto is true when the offset was picked from the loudest section of the waveform.
+	Auto bool `json:"auto"`
+}
+
+// resolvePreview applies the task override on top of the configured preview settings.
+func resolvePreview(defaults config.PreviewConfig, task Task) config.PreviewConfig {
+	preview := defaults
+	if task.PreviewOffsetSec != nil {
+		preview.OffsetSec = *task.PreviewOffsetSec
+	}
+	return preview
+}
+
+// choosePreviewWindow picks the clip bounds. Without a fixed offset it slides a window of the
+// clip length over the finest waveform level and takes the one with the most peak energy.
+func choosePreviewWindow(cfg config.PreviewConfig, trackDuration float64, waveform *Waveform) PreviewWindow {
+	if trackDuration <= cfg.DurationSec {
+		return PreviewWindow{OffsetSec: 0, DurationSec: trackDuration}
+	}
+	window := PreviewWindow{DurationSec: cfg.DurationSec}
+	latest := trackDuration - cfg.DurationSec
+
+	if cfg.OffsetSec >= 0 || waveform == nil || len(waveform.Levels) == 0 {
+		window.OffsetSec = math.Min(math.Max(cfg.OffsetSec, 0), latest)
+		return window
+	}
+
+	level := waveform.Levels[0]
+	pixelSec := float64(level.SamplesPerPixel) / float64(waveform.SampleRate)
+	span := int(cfg.DurationSec / pixelSec)
+	if span <= 0 || span >= level.Length {
+		return window
+	}
+
+	energy := func(i int) int {
+		return int(level.Data[i*2+1]) - int(level.Data[i*2])
+	}
+	sum := 0
+	for i := 0; i < span; i++ {
+		sum += energy(i)
+	}
+	best, bestStart := sum, 0
+	for start := 1; start+span <= level.Length; start++ {
+		sum += energy(start+span-1) - energy(start-1)
+		if sum > best {
+			best, bestStart = sum, start
+		}
+	}
+
+	window.OffsetSec = math.Min(roundToDecimals(float64(bestStart)*pixelSec, 1), latest)
+	window.Auto = true
+	return window
+}
+
+// previewRendition is the single low-bitrate variant the clip is encoded with.
+func previewRendition(cfg config.PreviewConfig) (rendition, error) {
+	ladder, err := resolveLadder(config.LadderProfile{
+		Name:     previewDirName,
+		Variants: []config.VariantConfig{{Name: previewDirName, Codec: cfg.Codec, BitrateK: cfg.BitrateK, Channels: 2}},
+	})
+	if err != nil {
+		return rendition{}, err
+	}
+	return ladder[0], nil
+}
+
+// generatePreview encodes the clip with short fades into outputDir/preview/index.m3u8. The clip
+// is never encrypted: it exists precisely for listeners who cannot fetch keys.
+func (t *FFmpegTranscoder) generatePreview(ctx context.Context, input, outputDir string, cfg config.PreviewConfig, window PreviewWindow, opts encodeOptions) error {
+	variant, err := previewRendition(cfg)
+	if err != nil {
+		return err
+	}
+
+	fade := math.Min(cfg.FadeSec, window.DurationSec/2)
+	fades := fmt.Sprintf("afade=t=in:st=0:d=%.2f,afade=t=out:st=%.2f:d=%.2f", fade, window.DurationSec-fade, fade)
+	if opts.audioFilter != "" {
+		opts.audioFilter += "," + fades
+	} else {
+		opts.audioFilter = fades
+	}
+	opts.keyInfoFile = ""
+	opts.clip = &window
+
+	return t.encodeVariant(ctx, input, outputDir, variant, opts)
+}
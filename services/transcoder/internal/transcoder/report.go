@@ -0,0 +1,112 @@
+package transcoder
+
+import (
+	"sync"
+	"time"
+
+	"github.com/MusicSocial/transcoder/internal/metrics"
+	"github.com/MusicSocial/transcoder/internal/tracks"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var ffmpegDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "transcoder_ffmpeg_duration_seconds",
+	Help:    "Wall time of one ffmpeg rendition encode.",
+	Buckets: metrics.DefaultBuckets,
+}, []string{"variant", "codec"})
+
+// StageTiming is how long one step of a job took.
+type StageTiming struct {
+	Stage       string  `json:"stage"`
+	DurationSec float64 `json:"duration_sec"`
+}
+
+// Outputs locates what a job published.
+type Outputs struct {
+	Bucket      string `json:"bucket"`
+	ManifestKey string `json:"manifest_key"`
+	AudioURL    string `json:"audio_url"`
+	DashURL     string `json:"dash_url,omitempty"`
+	PreviewURL  string `json:"preview_url,omitempty"`
+	WaveformURL string `json:"waveform_url,omitempty"`
+	CoverURL    string `json:"cover_url,omitempty"`
+}
+
+// Report collects the timings and outputs of one Transcode call for the admin job history.
+// It is safe for concurrent use, and a nil *Report records nothing.
+type Report struct {
+	mu      sync.Mutex
+	skipped bool
+	timings []StageTiming
+	outputs *Outputs
+}
+
+// Skipped reports whether the outputs were already up to date.
+func (r *Report) Skipped() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.skipped
+}
+
+func (r *Report) Timings() []StageTiming {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]StageTiming(nil), r.timings...)
+}
+
+func (r *Report) Outputs() *Outputs {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.outputs
+}
+
+// since records the time elapsed from start under stage; meant for defer or right after a step.
+func (r *Report) since(stage string, start time.Time) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timings = append(r.timings, StageTiming{Stage: stage, DurationSec: roundToDecimals(time.Since(start).Seconds(), 3)})
+}
+
+func (r *Report) setSkipped(outputs Outputs) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.skipped = true
+	r.outputs = &outputs
+}
+
+func (r *Report) setOutputs(outputs Outputs) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outputs = &outputs
+}
+
+func newOutputs(bucket, manifestKey string, info tracks.TrackInfo) Outputs {
+	return Outputs{
+		Bucket:      bucket,
+		ManifestKey: manifestKey,
+		AudioURL:    info.AudioURL,
+		DashURL:     info.DashURL,
+		PreviewURL:  info.PreviewURL,
+		WaveformURL: info.WaveformURL,
+		CoverURL:    info.CoverURL,
+	}
+}
@@ -0,0 +1,25 @@
+package transcoder
+
+import (
+	"context"
+	"io"
+	"os/exec"
+)
+
+// Runner starts the external tools (ffmpeg, ffprobe). Tests swap in a runner that replays
+// recorded output instead of executing binaries.
+type Runner interface {
+	// Run executes name with args and waits for it, streaming stdout and stderr into the writers.
+	// A nil writer discards the stream. Cancelling ctx kills the process.
+	Run(ctx context.Context, name string, args []string, stdout, stderr io.Writer) error
+}
+
+// ExecRunner runs real binaries from PATH.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, name string, args []string, stdout, stderr io.Writer) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
@@ -0,0 +1,152 @@
+package transcoder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/MusicSocial/transcoder/internal/config"
+)
+
+const (
+	silencePolicyOff    = "off"
+	silencePolicyRecord = "record"
+	silencePolicyTrim   = "trim"
+
+	// silenceEdgeTolerance absorbs decoder timestamp jitter at the track edges.
+	silenceEdgeTolerance = 0.05
+	// minAudibleSec keeps silent or nearly silent uploads from being trimmed to nothing.
+	minAudibleSec = 1.0
+)
+
+// SilenceInfo is written to tech_meta.json. AudioStartSec and AudioEndSec are the audible part
+// on the source timeline, so clients can start a crossfade where the music actually ends.
+type SilenceInfo struct {
+	Policy        string  `json:"policy"`
+	LeadingSec    float64 `json:"leading_sec"`
+	TrailingSec   float64 `json:"trailing_sec"`
+	AudioStartSec float64 `json:"audio_start_sec"`
+	AudioEndSec   float64 `json:"audio_end_sec"`
+	// Trimmed is true when the renditions start at AudioStartSec and end at AudioEndSec.
+	Trimmed bool `json:"trimmed"`
+}
+
+func resolveSilence(defaults config.SilenceConfig, task Task) (config.SilenceConfig, error) {
+	settings := defaults
+	if task.SilencePolicy != "" {
+		settings.Policy = task.SilencePolicy
+	}
+	switch settings.Policy {
+	case silencePolicyOff, silencePolicyRecord, silencePolicyTrim:
+	default:
+		return config.SilenceConfig{}, fmt.Errorf("unknown silence policy %q", settings.Policy)
+	}
+	return settings, nil
+}
+
+// detectSilence finds leading and trailing silence with ffmpeg silencedetect.
+func (t *FFmpegTranscoder) detectSilence(ctx context.Context, input string, cfg config.SilenceConfig, durationSec float64) (*SilenceInfo, error) {
+	var output bytes.Buffer
+	err := t.runner.Run(ctx, t.ffmpegPath, []string{
+		"-hide_banner",
+		"-i", input,
+		"-map", "0:a:0",
+		"-af", fmt.Sprintf("silencedetect=noise=%.1fdB:duration=%.2f", cfg.ThresholdDB, cfg.MinDurationSec),
+		"-f", "null",
+		"-",
+	}, &output, &output)
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg silencedetect failed: %w (output=%s)", err, output.String())
+	}
+
+	info := &SilenceInfo{Policy: cfg.Policy, AudioEndSec: durationSec}
+	leading, trailing := silenceEdges(parseSilenceIntervals(output.Bytes()), durationSec)
+	if leading+trailing > durationSec-minAudibleSec {
+		// nothing audible to keep; report the track as is
+		return info, nil
+	}
+	info.LeadingSec = roundToDecimals(leading, 3)
+	info.TrailingSec = roundToDecimals(trailing, 3)
+	info.AudioStartSec = info.LeadingSec
+	info.AudioEndSec = roundToDecimals(durationSec-trailing, 3)
+	return info, nil
+}
+
+type silenceInterval struct {
+	start float64
+	// end is NaN when the input ended before the silence did.
+	end float64
+}
+
+func parseSilenceIntervals(output []byte) []silenceInterval {
+	var intervals []silenceInterval
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if v, ok := silenceValue(line, "silence_start:"); ok {
+			intervals = append(intervals, silenceInterval{start: v, end: math.NaN()})
+		} else if v, ok := silenceValue(line, "silence_end:"); ok && len(intervals) > 0 {
+			intervals[len(intervals)-1].end = v
+		}
+	}
+	return intervals
+}
+
+func silenceValue(line, key string) (float64, bool) {
+	idx := strings.Index(line, key)
+	if idx < 0 {
+		return 0, false
+	}
+	fields := strings.Fields(line[idx+len(key):])
+	if len(fields) == 0 {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	return v, err == nil
+}
+
+// silenceEdges keeps only the silences touching the start and the end of the track.
+func silenceEdges(intervals []silenceInterval, durationSec float64) (leading, trailing float64) {
+	for i, interval := range intervals {
+		end := interval.end
+		if math.IsNaN(end) {
+			end = durationSec
+		}
+		if i == 0 && interval.start <= silenceEdgeTolerance {
+			leading = math.Max(end, 0)
+		}
+		if i == len(intervals)-1 && end >= durationSec-silenceEdgeTolerance && interval.start > leading {
+			trailing = durationSec - interval.start
+		}
+	}
+	return leading, trailing
+}
+
+// trimWaveform cuts the silent edges off the finest level and rebuilds the zoom levels,
+// so the scrubber matches trimmed renditions.
+func trimWaveform(waveform *Waveform, leadingSec, trailingSec float64) *Waveform {
+	level := waveform.Levels[0]
+	pixelSec := float64(level.SamplesPerPixel) / float64(waveform.SampleRate)
+	from := int(math.Round(leadingSec / pixelSec))
+	to := level.Length - int(math.Round(trailingSec/pixelSec))
+	if from < 0 || to > level.Length || from >= to {
+		return waveform
+	}
+
+	trimmed := &Waveform{Version: waveform.Version, SampleRate: waveform.SampleRate, Bits: waveform.Bits}
+	level = WaveformLevel{
+		SamplesPerPixel: level.SamplesPerPixel,
+		Length:          to - from,
+		Data:            append([]int8(nil), level.Data[from*2:to*2]...),
+	}
+	trimmed.Levels = append(trimmed.Levels, level)
+	for i := 1; i < waveformZoomLevels && level.Length > 1; i++ {
+		level = downsampleLevel(level)
+		trimmed.Levels = append(trimmed.Levels, level)
+	}
+	return trimmed
+}
@@ -0,0 +1,257 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/cmplx"
+	"strings"
+)
+
+const (
+	spectralFrameSize = 8192
+	// spectralMaxSec bounds the decode; a lowpass applies to the whole file, so a few minutes settle it.
+	spectralMaxSec = 180
+	spectralBandHz = 250
+	// spectralEdgeBands is how many bands below an edge count as the content it cuts off (1 kHz).
+	spectralEdgeBands = 4
+	// a cliff is a drop of at least spectralMinCliffDB from the content below an edge to
+	// everything above it; lossy encoders leave nothing but the decoder's noise floor there
+	spectralMinCliffDB = 20
+	// below spectralMinCutoffHz no encoder lowpasses music, so a narrow spectrum is the content itself
+	spectralMinCutoffHz = 8000
+	// spectralMinVoicedSec is how much non-silent audio a verdict needs.
+	spectralMinVoicedSec = 5
+	suspectedConfidence  = 0.5
+)
+
+var errSpectralWindowFull = errors.New("spectral window reached")
+
+// losslessCodecs are stream codecs that should carry everything the sample rate allows.
+var losslessCodecs = map[string]bool{
+	"flac": true, "alac": true, "wavpack": true, "ape": true, "tta": true, "truehd": true, "mlp": true,
+}
+
+// lossyLowpass is roughly where common MP3/AAC/Vorbis encoders cut off at a stereo bitrate,
+// highest bitrate first.
+var lossyLowpass = []struct {
+	minBitrateK int
+	cutoffHz    int
+}{
+	{320, 20000},
+	{256, 19500},
+	{224, 19000},
+	{192, 18000},
+	{160, 17000},
+	{128, 16000},
+	{96, 15000},
+	{0, 11000},
+}
+
+// SpectralInfo is the estimated effective bandwidth of the source, written to tech_meta.json.
+// A source whose cutoff is well below what its declared codec and sample rate should carry was
+// most likely converted from a lossy file, e.g. an MP3 saved as FLAC.
+type SpectralInfo struct {
+	// CutoffHz is where the content ends in a cliff; the Nyquist frequency when there is none.
+	CutoffHz int `json:"cutoff_hz"`
+	// ExpectedCutoffHz is what the declared codec should reach; 0 when it is not known.
+	ExpectedCutoffHz int `json:"expected_cutoff_hz"`
+	// CliffDB is how far the level falls at the cutoff.
+	CliffDB            float64 `json:"cliff_db"`
+	SuspectedTranscode bool    `json:"suspected_transcode"`
+	// Confidence is in [0, 1]; 0 also means the audio did not allow a verdict.
+	Confidence float64 `json:"confidence"`
+	Reason     string  `json:"reason,omitempty"`
+}
+
+type spectrumAnalyzer struct {
+	sampleRate int
+	window     []float64
+	buf        []complex128
+	pending    []float32
+	decoded    int
+	power      []float64 // summed over voiced frames, per bin
+	voiced     int
+}
+
+func newSpectrumAnalyzer(sampleRate int) *spectrumAnalyzer {
+	window := make([]float64, spectralFrameSize)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(spectralFrameSize-1))
+	}
+	return &spectrumAnalyzer{
+		sampleRate: sampleRate,
+		window:     window,
+		buf:        make([]complex128, spectralFrameSize),
+		power:      make([]float64, spectralFrameSize/2),
+	}
+}
+
+// analyzeSpectrum decodes the source at its own sample rate, so nothing above the
+// resampler's band edge is lost, and judges its bandwidth against the declared codec.
+func (t *FFmpegTranscoder) analyzeSpectrum(ctx context.Context, input string, meta *TechMetadata) (*SpectralInfo, error) {
+	if meta.SampleRate <= 0 {
+		return nil, errors.New("unknown sample rate")
+	}
+	a := newSpectrumAnalyzer(meta.SampleRate)
+	err := t.decodePCM(ctx, input, meta.SampleRate, a.write)
+	if err != nil && !errors.Is(err, errSpectralWindowFull) {
+		return nil, err
+	}
+	return a.result(meta.OriginalCodec, meta.OriginalBitrate), nil
+}
+
+func (a *spectrumAnalyzer) write(samples []float32) error {
+	limit := spectralMaxSec * a.sampleRate
+	if remaining := limit - a.decoded; len(samples) > remaining {
+		samples = samples[:remaining]
+	}
+	a.decoded += len(samples)
+	a.pending = append(a.pending, samples...)
+
+	for len(a.pending) >= spectralFrameSize {
+		a.addFrame(a.pending[:spectralFrameSize])
+		a.pending = a.pending[spectralFrameSize:]
+	}
+	a.pending = append(a.pending[:0:0], a.pending...)
+
+	if a.decoded >= limit {
+		return errSpectralWindowFull
+	}
+	return nil
+}
+
+func (a *spectrumAnalyzer) addFrame(frame []float32) {
+	energy := 0.0
+	for _, s := range frame {
+		energy += float64(s) * float64(s)
+	}
+	// silence only shows the noise floor and would pull the average towards it
+	if math.Sqrt(energy/float64(len(frame))) <= silenceRMS {
+		return
+	}
+	a.voiced++
+	for i, s := range frame {
+		a.buf[i] = complex(float64(s)*a.window[i], 0)
+	}
+	fft(a.buf)
+	for bin := range a.power {
+		m := cmplx.Abs(a.buf[bin])
+		a.power[bin] += m * m
+	}
+}
+
+// bandLevels averages the power spectrum into spectralBandHz bands, in dB.
+func (a *spectrumAnalyzer) bandLevels() []float64 {
+	binHz := float64(a.sampleRate) / spectralFrameSize
+	bands := int(float64(a.sampleRate) / 2 / spectralBandHz)
+	sums := make([]float64, bands)
+	counts := make([]int, bands)
+	for bin, p := range a.power {
+		band := int(float64(bin) * binHz / spectralBandHz)
+		if band >= bands {
+			break
+		}
+		sums[band] += p
+		counts[band]++
+	}
+	levels := make([]float64, bands)
+	for band := range levels {
+		mean := 0.0
+		if counts[band] > 0 {
+			mean = sums[band] / float64(counts[band]) / float64(a.voiced)
+		}
+		levels[band] = 10 * math.Log10(mean+1e-20)
+	}
+	return levels
+}
+
+// findCutoff returns the highest band edge the spectrum falls off a cliff at and the height of the
+// cliff, or the Nyquist frequency and 0 when the content runs to the top.
+func findCutoff(levels []float64) (cutoffHz int, cliffDB float64) {
+	cliff := func(edge int) (below, above float64) {
+		for _, level := range levels[edge-spectralEdgeBands : edge] {
+			below += level
+		}
+		below /= spectralEdgeBands
+		above = math.Inf(-1)
+		for _, level := range levels[edge:] {
+			above = math.Max(above, level)
+		}
+		return below, above
+	}
+
+	for edge := len(levels) - 1; edge >= spectralEdgeBands; edge-- {
+		below, above := cliff(edge)
+		if below-above < spectralMinCliffDB {
+			continue
+		}
+		// the first edge that qualifies may still have floor bands below it; move down to the content
+		for edge > spectralEdgeBands && levels[edge-1]-above < spectralMinCliffDB/2 {
+			edge--
+		}
+		below, above = cliff(edge)
+		return edge * spectralBandHz, below - above
+	}
+	return len(levels) * spectralBandHz, 0
+}
+
+// expectedCutoff is where the declared codec should reach, or 0 when it has no expectation.
+func expectedCutoff(codec string, bitrate, sampleRate int) int {
+	nyquist := sampleRate / 2
+	codec = strings.ToLower(codec)
+	switch {
+	case losslessCodecs[codec] || strings.HasPrefix(codec, "pcm_"):
+		// CD-rate masters carry content up to the anti-alias filter around 20 kHz; a hi-res file
+		// must reach beyond what a 48 kHz master could hold
+		if sampleRate > 48000 {
+			return 24000
+		}
+		return min(20000, nyquist-1000)
+	case codec == "mp3" || codec == "aac" || codec == "vorbis" || codec == "opus" || strings.HasPrefix(codec, "wma"):
+		if bitrate <= 0 {
+			return 0
+		}
+		for _, entry := range lossyLowpass {
+			if bitrate/1000 >= entry.minBitrateK {
+				return min(entry.cutoffHz, nyquist-1000)
+			}
+		}
+	}
+	return 0
+}
+
+func (a *spectrumAnalyzer) result(codec string, bitrate int) *SpectralInfo {
+	info := &SpectralInfo{CutoffHz: a.sampleRate / 2}
+	if float64(a.voiced*spectralFrameSize)/float64(a.sampleRate) < spectralMinVoicedSec {
+		info.Reason = "too little non-silent audio"
+		return info
+	}
+	info.CutoffHz, info.CliffDB = findCutoff(a.bandLevels())
+	info.CliffDB = roundToDecimals(info.CliffDB, 1)
+	info.ExpectedCutoffHz = expectedCutoff(codec, bitrate, a.sampleRate)
+
+	switch {
+	case info.ExpectedCutoffHz == 0:
+		info.Reason = fmt.Sprintf("no expected bandwidth for %s", codec)
+		return info
+	case info.CliffDB == 0:
+		return info
+	case info.CutoffHz < spectralMinCutoffHz:
+		info.Reason = fmt.Sprintf("content ends at %.1f kHz, too low to tell a lowpass from the music itself", float64(info.CutoffHz)/1000)
+		return info
+	}
+
+	// a steep cliff well below the expected bandwidth is the lowpass of a lossy encoder;
+	// natural roll-off is gradual and a small shortfall is within encoder differences
+	steepness := clamp01((info.CliffDB - spectralMinCliffDB) / 20)
+	shortfall := clamp01(float64(info.ExpectedCutoffHz-info.CutoffHz-500) / 1500)
+	info.Confidence = roundToDecimals(steepness*shortfall, 2)
+	info.SuspectedTranscode = info.Confidence >= suspectedConfidence
+	if info.SuspectedTranscode {
+		info.Reason = fmt.Sprintf("%s at %d Hz is band-limited at %.1f kHz, expected at least %.1f kHz",
+			codec, a.sampleRate, float64(info.CutoffHz)/1000, float64(info.ExpectedCutoffHz)/1000)
+	}
+	return info
+}
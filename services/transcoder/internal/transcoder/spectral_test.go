@@ -0,0 +1,85 @@
+package transcoder
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+// bandLimited synthesizes seconds of dense music-like content up to cutoffHz, quantized to
+// 16 bits like the decoder output, so everything above the cutoff is the noise floor.
+func bandLimited(sampleRate int, cutoffHz, seconds float64) []float32 {
+	rng := rand.New(rand.NewSource(1))
+	// each partial is a phasor rotated once per sample; the level falls 3 dB per octave
+	var phasors, steps []complex128
+	var amps []float64
+	norm := 0.0
+	for hz := 100.0; hz < cutoffHz; hz += 190 {
+		amp := 1 / math.Sqrt(hz/100)
+		phasors = append(phasors, cmplx.Rect(1, rng.Float64()*2*math.Pi))
+		steps = append(steps, cmplx.Rect(1, 2*math.Pi*hz/float64(sampleRate)))
+		amps = append(amps, amp)
+		norm += amp
+	}
+	samples := make([]float32, int(seconds*float64(sampleRate)))
+	for i := range samples {
+		v := 0.0
+		for k := range phasors {
+			v += amps[k] * imag(phasors[k])
+			phasors[k] *= steps[k]
+		}
+		samples[i] = float32(math.Round(0.9*v/norm*32767) / 32768)
+	}
+	return samples
+}
+
+func TestSpectrumVerdict(t *testing.T) {
+	tests := []struct {
+		name       string
+		codec      string
+		bitrate    int
+		sampleRate int
+		cutoffHz   float64
+		tone       bool
+		wantCutoff [2]int // inclusive range
+		want       bool
+	}{
+		{name: "full band flac", codec: "FLAC", sampleRate: 44100, cutoffHz: 21500, wantCutoff: [2]int{21000, 22050}},
+		{name: "flac from a 128k mp3", codec: "FLAC", sampleRate: 44100, cutoffHz: 16000, wantCutoff: [2]int{15750, 16250}, want: true},
+		{name: "wav from a 192k mp3", codec: "PCM_S16LE", sampleRate: 44100, cutoffHz: 18000, wantCutoff: [2]int{17750, 18250}, want: true},
+		{name: "128k mp3 at its own lowpass", codec: "MP3", bitrate: 128000, sampleRate: 44100, cutoffHz: 16000, wantCutoff: [2]int{15750, 16250}},
+		{name: "320k mp3 from a 128k mp3", codec: "MP3", bitrate: 320000, sampleRate: 44100, cutoffHz: 16000, wantCutoff: [2]int{15750, 16250}, want: true},
+		{name: "hi-res flac upsampled from cd", codec: "FLAC", sampleRate: 96000, cutoffHz: 21000, wantCutoff: [2]int{20750, 21250}, want: true},
+		{name: "pure tone allows no verdict", codec: "FLAC", sampleRate: 44100, tone: true, wantCutoff: [2]int{0, spectralMinCutoffHz}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var samples []float32
+			if tt.tone {
+				samples = make([]float32, 8*tt.sampleRate)
+				for i := range samples {
+					samples[i] = float32(0.5 * math.Sin(2*math.Pi*440*float64(i)/float64(tt.sampleRate)))
+				}
+			} else {
+				samples = bandLimited(tt.sampleRate, tt.cutoffHz, 6)
+			}
+
+			a := newSpectrumAnalyzer(tt.sampleRate)
+			if err := a.write(samples); err != nil {
+				t.Fatal(err)
+			}
+			info := a.result(tt.codec, tt.bitrate)
+			if info.CutoffHz < tt.wantCutoff[0] || info.CutoffHz > tt.wantCutoff[1] {
+				t.Errorf("cutoff = %d Hz, want %d..%d (info %+v)", info.CutoffHz, tt.wantCutoff[0], tt.wantCutoff[1], info)
+			}
+			if info.SuspectedTranscode != tt.want {
+				t.Errorf("suspected = %t, want %t (info %+v)", info.SuspectedTranscode, tt.want, info)
+			}
+			if tt.want && info.Confidence < 0.9 {
+				t.Errorf("confidence = %.2f, want a clear verdict (info %+v)", info.Confidence, info)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package transcoder
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TrackTags is the embedded tag metadata (ID3, Vorbis comments, MP4 atoms) as normalized by ffprobe.
+type TrackTags struct {
+	Title       string   `json:"title,omitempty"`
+	Artists     []string `json:"artists,omitempty"`
+	Album       string   `json:"album,omitempty"`
+	TrackNumber int      `json:"track_number,omitempty"`
+	Year        int      `json:"year,omitempty"`
+	ISRC        string   `json:"isrc,omitempty"`
+	Genre       string   `json:"genre,omitempty"`
+	Explicit    *bool    `json:"explicit,omitempty"`
+}
+
+func (t TrackTags) empty() bool {
+	return t.Title == "" && len(t.Artists) == 0 && t.Album == "" && t.TrackNumber == 0 &&
+		t.Year == 0 && t.ISRC == "" && t.Genre == "" && t.Explicit == nil
+}
+
+// Column limits of the tracks table in Track Service; longer tags would fail the whole UpdateTrackInfo.
+const (
+	maxTitleLen = 255
+	maxAlbumLen = 255
+	maxGenreLen = 100
+)
+
+var (
+	isrcPattern = regexp.MustCompile(`^[A-Z]{2}[A-Z0-9]{3}[0-9]{7}$`)
+	yearPattern = regexp.MustCompile(`\b(1[89][0-9]{2}|2[0-9]{3})\b`)
+)
+
+// extractTags merges container and stream tags; Ogg/Opus files keep their Vorbis comments on the stream.
+func (o ffprobeOutput) extractTags() TrackTags {
+	raw := make(map[string]string)
+	collect := func(tags map[string]string) {
+		for key, value := range tags {
+			key = strings.ToLower(strings.TrimSpace(key))
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			if _, exists := raw[key]; !exists {
+				raw[key] = value
+			}
+		}
+	}
+	collect(o.Format.Tags)
+	if stream := o.primaryAudioStream(); stream != nil {
+		collect(stream.Tags)
+	}
+
+	first := func(keys ...string) string {
+		for _, key := range keys {
+			if v, ok := raw[key]; ok {
+				return v
+			}
+		}
+		return ""
+	}
+
+	tags := TrackTags{
+		Title: truncateRunes(first("title"), maxTitleLen),
+		Album: truncateRunes(first("album"), maxAlbumLen),
+		Genre: truncateRunes(first("genre"), maxGenreLen),
+	}
+
+	if artist := first("artist", "artists", "album_artist"); artist != "" {
+		for _, name := range strings.Split(artist, ";") {
+			if name = strings.TrimSpace(name); name != "" {
+				tags.Artists = append(tags.Artists, name)
+			}
+		}
+	}
+
+	if track := first("track", "tracknumber"); track != "" {
+		number, _, _ := strings.Cut(track, "/")
+		if v, err := strconv.Atoi(strings.TrimSpace(number)); err == nil && v > 0 {
+			tags.TrackNumber = v
+		}
+	}
+
+	if date := first("date", "year", "originaldate", "tdrc", "tyer"); date != "" {
+		if match := yearPattern.FindString(date); match != "" {
+			tags.Year, _ = strconv.Atoi(match)
+		}
+	}
+
+	// The pattern also pins the length to the 12 characters of the isrc column
+	if isrc := strings.ToUpper(strings.ReplaceAll(first("isrc", "tsrc"), "-", "")); isrcPattern.MatchString(isrc) {
+		tags.ISRC = isrc
+	}
+
+	// "rating" is left out on purpose: POPM and WMA use it for stars or play popularity, not advisories
+	tags.Explicit = parseExplicit(first("itunesadvisory", "explicit"))
+
+	return tags
+}
+
+// truncateRunes cuts s to at most limit characters without splitting a multi-byte rune.
+func truncateRunes(s string, limit int) string {
+	count := 0
+	for i := range s {
+		if count == limit {
+			return strings.TrimSpace(s[:i])
+		}
+		count++
+	}
+	return s
+}
+
+// parseExplicit understands the iTunes advisory values (1/4 explicit, 2 clean) and plain flags.
+// Advisory 0 means no advisory was given, so it stays unknown like any other unrecognized value.
+func parseExplicit(value string) *bool {
+	var explicit bool
+	switch strings.ToLower(value) {
+	case "1", "4", "explicit", "true", "yes":
+		explicit = true
+	case "2", "clean", "false", "no":
+		explicit = false
+	default:
+		return nil
+	}
+	return &explicit
+}
@@ -1,13 +1,78 @@
 package transcoder
 
-import "context"
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// TaskSchemaVersion is the newest task layout this transcoder understands. Version 1 messages
+// carry no schema_version and reference the source only through TrackURL.
+const TaskSchemaVersion = 2
 
 type Task struct {
-	TrackID  string `json:"track_id"`
-	ArtistID string `json:"artist_id"`
-	TrackURL string `json:"track_url"`
+	// SchemaVersion is 0 for version 1 messages.
+	SchemaVersion int    `json:"schema_version,omitempty"`
+	TrackID       string `json:"track_id"`
+	ArtistID      string `json:"artist_id"`
+	// Source is the uploaded original; set from schema version 2.
+	Source *SourceObject `json:"source,omitempty"`
+	// TrackURL is the version 1 reference to the original, decoded for messages still in the topic.
+	TrackURL string `json:"track_url,omitempty"`
+	// Profile selects the ladder profile from config; empty means the default profile.
+	Profile string `json:"profile,omitempty"`
+	// Normalization overrides the configured loudness mode: off, loudnorm or replaygain.
+	Normalization string `json:"normalization,omitempty"`
+	// TargetLUFS overrides the configured integrated loudness target.
+	TargetLUFS *float64 `json:"target_lufs,omitempty"`
+	// SilencePolicy overrides the configured silence handling: off, record or trim.
+	SilencePolicy string `json:"silence_policy,omitempty"`
+	// PreviewOffsetSec fixes where the preview clip starts instead of picking the loudest section.
+	PreviewOffsetSec *float64 `json:"preview_offset_sec,omitempty"`
+	// ForceReprocess runs the full pipeline even if the output manifest matches the source.
+	ForceReprocess bool `json:"force_reprocess,omitempty"`
+}
+
+// SourceObject names the original upload in the object store. Size and SHA256 are checked
+// against the downloaded file when they are set.
+type SourceObject struct {
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+}
+
+// ResolveSource returns the source object of a task of any supported schema version. An empty
+// bucket is filled in with defaultBucket.
+func (t Task) ResolveSource(defaultBucket string) (SourceObject, error) {
+	if t.SchemaVersion > TaskSchemaVersion {
+		return SourceObject{}, fmt.Errorf("unsupported task schema version %d (newest known is %d)", t.SchemaVersion, TaskSchemaVersion)
+	}
+
+	var source SourceObject
+	switch {
+	case t.Source != nil:
+		source = *t.Source
+		if source.Key == "" {
+			return SourceObject{}, errors.New("task source has no object key")
+		}
+	case t.TrackURL != "":
+		bucket, key, err := parseTrackURL(t.TrackURL)
+		if err != nil {
+			return SourceObject{}, err
+		}
+		source = SourceObject{Bucket: bucket, Key: key}
+	default:
+		return SourceObject{}, errors.New("task has neither a source object nor a track url")
+	}
+	if source.Bucket == "" {
+		source.Bucket = defaultBucket
+	}
+	return source, nil
 }
 
 type Transcoder interface {
-	Transcode(ctx context.Context, task Task) error
+	// Transcode processes the task; report may be nil when nobody keeps the job history.
+	Transcode(ctx context.Context, task Task, report *Report) error
 }
@@ -0,0 +1,370 @@
+package transcoder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/MusicSocial/transcoder/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Verification checks, reported in VerificationFailure.Check.
+const (
+	checkPlaylist = "playlist"
+	checkSegments = "segments"
+	checkProbe    = "probe"
+	checkCodec    = "codec"
+	checkDuration = "duration"
+	checkObject   = "object"
+)
+
+var verificationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "transcoder_verification_failures_total",
+	Help: "Failed output checks, by check.",
+}, []string{"check"})
+
+// VerificationFailure is one failed check of the encoded outputs.
+type VerificationFailure struct {
+	Check     string `json:"check"`
+	Rendition string `json:"rendition,omitempty"`
+	Object    string `json:"object,omitempty"`
+	Detail    string `json:"detail"`
+}
+
+func (f VerificationFailure) String() string {
+	subject := f.Rendition
+	if f.Object != "" {
+		subject = f.Object
+	}
+	if subject == "" {
+		return f.Check + ": " + f.Detail
+	}
+	return fmt.Sprintf("%s %s: %s", f.Check, subject, f.Detail)
+}
+
+// VerificationError rejects outputs that do not match the source or did not reach the bucket.
+type VerificationError struct {
+	Failures []VerificationFailure
+}
+
+func (e *VerificationError) Error() string {
+	const shown = 3
+	parts := make([]string, 0, shown+1)
+	for i, failure := range e.Failures {
+		if i == shown {
+			parts = append(parts, fmt.Sprintf("and %d more", len(e.Failures)-shown))
+			break
+		}
+		parts = append(parts, failure.String())
+	}
+	return "output verification failed: " + strings.Join(parts, "; ")
+}
+
+// VerificationFailures returns the failed checks behind err, or nil when err is not a verification error.
+func VerificationFailures(err error) []VerificationFailure {
+	var verr *VerificationError
+	if errors.As(err, &verr) {
+		return verr.Failures
+	}
+	return nil
+}
+
+// measuredDuration replaces a duration ffprobe only estimated from the bitrate with the length of
+// the first rendition's playlist, so verification compares the renditions with what the decoder
+// actually produced instead of failing every VBR MP3 without a Xing header. The other renditions
+// are still checked against it, and every rendition against its own packets.
+func (t *FFmpegTranscoder) measuredDuration(trackID, outputDir string, variants []rendition, estimated float64) float64 {
+	playlist, err := parseMediaPlaylist(filepath.Join(outputDir, variants[0].Name, "index.m3u8"))
+	if err != nil || len(playlist.Segments) == 0 {
+		// verification reports the broken playlist
+		return estimated
+	}
+	measured := playlist.totalDuration()
+	if math.Abs(measured-estimated) > t.settings.Verify.DurationToleranceSec {
+		t.logger.Printf("track_id=%s: source duration %.3fs was estimated from the bitrate, the renditions last %.3fs",
+			trackID, estimated, measured)
+	}
+	return measured
+}
+
+// verificationError is transient when an object is missing, since a retry uploads everything
+// again; a rendition that does not match the source would be encoded the same way again.
+func verificationError(failures []VerificationFailure) error {
+	for _, failure := range failures {
+		verificationFailures.WithLabelValues(failure.Check).Inc()
+	}
+	err := &VerificationError{Failures: failures}
+	for _, failure := range failures {
+		if failure.Check == checkObject {
+			return err
+		}
+	}
+	return Permanent(err)
+}
+
+// renditionCheck is one encoded variant directory and the duration it must play for.
+type renditionCheck struct {
+	variant     rendition
+	dir         string
+	durationSec float64
+}
+
+// verifyRenditions checks the local renditions before anything is uploaded, so broken outputs never
+// replace the published ones. scratchDir receives the probe playlists and must not be uploaded.
+func (t *FFmpegTranscoder) verifyRenditions(ctx context.Context, checks []renditionCheck, segments segmentLayout, keyFile, scratchDir string, sourceSampleRate int) ([]VerificationFailure, error) {
+	if err := os.MkdirAll(scratchDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create verification directory: %w", err)
+	}
+	tolerance := t.settings.Verify.DurationToleranceSec
+
+	var failures []VerificationFailure
+	for _, check := range checks {
+		name := check.variant.Name
+		fail := func(kind, format string, args ...any) {
+			failures = append(failures, VerificationFailure{Check: kind, Rendition: name, Detail: fmt.Sprintf(format, args...)})
+		}
+
+		playlistPath := filepath.Join(check.dir, "index.m3u8")
+		playlist, err := parseMediaPlaylist(playlistPath)
+		if err != nil {
+			fail(checkPlaylist, "%v", err)
+			continue
+		}
+		if len(playlist.Segments) == 0 {
+			fail(checkPlaylist, "no segments")
+			continue
+		}
+		if got := playlist.totalDuration(); math.Abs(got-check.durationSec) > tolerance {
+			fail(checkDuration, "playlist lasts %.3fs, want %.3fs", got, check.durationSec)
+		}
+		// segments are cut at frame boundaries, so the count may be one off either way
+		if want := int(math.Ceil(check.durationSec / segments.durationSec)); abs(len(playlist.Segments)-want) > 1 {
+			fail(checkSegments, "playlist has %d segments, want %d of %gs", len(playlist.Segments), want, segments.durationSec)
+		}
+		if detail := checkSegmentFiles(check.dir, playlist); detail != "" {
+			fail(checkSegments, "%s", detail)
+			// probing a playlist with missing media only repeats the same failure
+			continue
+		}
+
+		probePath := filepath.Join(scratchDir, name+".m3u8")
+		if err := writeProbePlaylist(playlistPath, probePath, check.dir, keyFile); err != nil {
+			return nil, err
+		}
+		probe, err := t.probeRendition(ctx, probePath)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			fail(checkProbe, "%v", err)
+			continue
+		}
+		stream := probe.primaryAudioStream()
+		if stream == nil {
+			fail(checkProbe, "no audio stream")
+			continue
+		}
+
+		if stream.CodecName != check.variant.codec.probeName {
+			fail(checkCodec, "codec %s, want %s", stream.CodecName, check.variant.codec.probeName)
+		}
+		wantRate := check.variant.SampleRate
+		if wantRate == 0 {
+			wantRate = sourceSampleRate
+		}
+		if wantRate > 0 && stream.sampleRate() != wantRate {
+			fail(checkCodec, "sample rate %d, want %d", stream.sampleRate(), wantRate)
+		}
+		// parametric stereo is decoded from a mono core, which ffprobe reports as one channel
+		if check.variant.Codec != "he-aac-v2" && stream.Channels != check.variant.Channels {
+			fail(checkCodec, "%d channels, want %d", stream.Channels, check.variant.Channels)
+		}
+		if got := probe.formatDuration(); math.Abs(got-check.durationSec) > tolerance {
+			fail(checkDuration, "probed %.3fs, want %.3fs", got, check.durationSec)
+		}
+		// the packet count covers every segment, unlike the duration the demuxer takes from the playlist
+		if frame := codecFraming[check.variant.Codec].frame; frame > 0 && stream.sampleRate() > 0 {
+			packets, _ := strconv.Atoi(stream.NbReadPackets)
+			got := float64(packets*frame-codecFraming[check.variant.Codec].delay) / float64(stream.sampleRate())
+			if math.Abs(got-check.durationSec) > tolerance {
+				fail(checkDuration, "%d packets hold %.3fs of audio, want %.3fs", packets, got, check.durationSec)
+			}
+		}
+	}
+	return failures, nil
+}
+
+// checkSegmentFiles reports what is wrong with the media files behind the playlist, or "".
+func checkSegmentFiles(dir string, playlist *mediaPlaylist) string {
+	type reference struct {
+		uri       string
+		byteRange *byteRange
+	}
+	refs := []reference{{playlist.InitURI, playlist.InitByteRange}}
+	for _, segment := range playlist.Segments {
+		refs = append(refs, reference{segment.URI, segment.ByteRange})
+	}
+
+	referenced := make(map[string]bool)
+	ranges := make(map[string][]*byteRange)
+	for _, ref := range refs {
+		if ref.uri == "" {
+			return "playlist has no init segment"
+		}
+		referenced[ref.uri] = true
+		if ref.byteRange != nil {
+			ranges[ref.uri] = append(ranges[ref.uri], ref.byteRange)
+		}
+	}
+
+	for uri := range referenced {
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(uri)))
+		if err != nil {
+			return fmt.Sprintf("%s is referenced but was not produced", uri)
+		}
+		if info.Size() == 0 {
+			return fmt.Sprintf("%s is empty", uri)
+		}
+		// a single file is the init section followed by every segment, back to back
+		var end int64
+		for _, r := range ranges[uri] {
+			if r.Offset != end {
+				return fmt.Sprintf("%s: range at %d does not follow the previous one ending at %d", uri, r.Offset, end)
+			}
+			end = r.Offset + r.Length
+		}
+		if len(ranges[uri]) > 0 && end != info.Size() {
+			return fmt.Sprintf("%s: ranges cover %d of %d bytes", uri, end, info.Size())
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err.Error()
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && name != "index.m3u8" && !referenced[name] {
+			return fmt.Sprintf("%s is not referenced by the playlist", name)
+		}
+	}
+	return ""
+}
+
+var playlistURIAttr = regexp.MustCompile(`URI="[^"]*"`)
+
+// writeProbePlaylist copies the variant playlist with absolute media paths and the local key,
+// since the published key URI needs a signed-in player.
+func writeProbePlaylist(src, dst, mediaDir, keyFile string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("failed to read playlist for verification: %w", err)
+	}
+	var out strings.Builder
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-KEY:") && keyFile != "":
+			line = playlistURIAttr.ReplaceAllLiteralString(line, `URI="`+keyFile+`"`)
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			uri := attributeValue(strings.TrimPrefix(line, "#EXT-X-MAP:"), "URI")
+			line = playlistURIAttr.ReplaceAllLiteralString(line, `URI="`+filepath.Join(mediaDir, uri)+`"`)
+		case line != "" && !strings.HasPrefix(line, "#"):
+			line = filepath.Join(mediaDir, line)
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if err := os.WriteFile(dst, []byte(out.String()), 0o644); err != nil {
+		return fmt.Errorf("failed to write playlist for verification: %w", err)
+	}
+	return nil
+}
+
+// probeRendition reads every packet of the playlist; a truncated or unreadable segment fails the probe.
+func (t *FFmpegTranscoder) probeRendition(ctx context.Context, playlistPath string) (*ffprobeOutput, error) {
+	var stdout, stderr bytes.Buffer
+	err := t.runner.Run(ctx, t.ffprobePath, []string{
+		"-v", "error",
+		"-protocol_whitelist", "file,crypto",
+		"-count_packets",
+		"-print_format", "json",
+		"-show_entries", "format=duration:stream=codec_type,codec_name,sample_rate,channels,nb_read_packets",
+		playlistPath,
+	}, &stdout, &stderr)
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %w (output=%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	if stderr.Len() > 0 {
+		return nil, fmt.Errorf("ffprobe reported errors: %s", strings.TrimSpace(stderr.String()))
+	}
+	var probe ffprobeOutput
+	if err := json.Unmarshal(stdout.Bytes(), &probe); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+	return &probe, nil
+}
+
+// verifyUploaded confirms every local output, which includes everything the playlists and the
+// DASH manifest reference, is in the bucket with the same size, and that extraKeys exist.
+func (t *FFmpegTranscoder) verifyUploaded(ctx context.Context, bucket, prefix, localDir string, extraKeys []string) ([]VerificationFailure, error) {
+	uploaded := make(map[string]int64)
+	err := t.storage.ListObjects(ctx, bucket, prefix+"/", func(obj storage.ObjectInfo) error {
+		uploaded[obj.Key] = obj.Size
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list uploaded outputs: %w", err)
+	}
+
+	var failures []VerificationFailure
+	err = filepath.WalkDir(localDir, func(entryPath string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, entryPath)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		key := path.Join(prefix, filepath.ToSlash(rel))
+		size, ok := uploaded[key]
+		switch {
+		case !ok:
+			failures = append(failures, VerificationFailure{Check: checkObject, Object: key, Detail: "missing from the bucket"})
+		case size != info.Size():
+			failures = append(failures, VerificationFailure{Check: checkObject, Object: key, Detail: fmt.Sprintf("%d bytes in the bucket, want %d", size, info.Size())})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk outputs: %w", err)
+	}
+
+	for _, key := range extraKeys {
+		exists, err := t.storage.Exists(ctx, bucket, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check %s: %w", key, err)
+		}
+		if !exists {
+			failures = append(failures, VerificationFailure{Check: checkObject, Object: key, Detail: "missing from the bucket"})
+		}
+	}
+	return failures, nil
+}
@@ -0,0 +1,208 @@
+package transcoder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/MusicSocial/transcoder/internal/config"
+)
+
+func TestVerifyRenditions(t *testing.T) {
+	ladder, err := resolveLadder(config.LadderProfile{Name: "test", Variants: []config.VariantConfig{
+		{Name: "aac_256", Codec: "aac", BitrateK: 256},
+	}})
+	if err != nil {
+		t.Fatalf("resolveLadder() error = %v", err)
+	}
+	segmented := segmentLayout{durationSec: 2}
+	singleFile := segmentLayout{singleFile: true, durationSec: 6}
+
+	tests := []struct {
+		name     string
+		segments segmentLayout
+		// durationSec defaults to the 8 s of the recorded playlists
+		durationSec float64
+		// corrupt changes the encoded variant in dir before the check
+		corrupt func(t *testing.T, dir string)
+		probe   func(args []string, stdout io.Writer) error
+		// want lists the failed checks in order
+		want []string
+	}{
+		{
+			name:     "recorded playlist passes",
+			segments: segmented,
+		},
+		{
+			name:     "recorded single file passes",
+			segments: singleFile,
+		},
+		{
+			name:     "missing segment",
+			segments: segmented,
+			corrupt: func(t *testing.T, dir string) {
+				removeFile(t, filepath.Join(dir, "chunk_00002.m4s"))
+			},
+			want: []string{checkSegments},
+		},
+		{
+			name:     "empty init segment",
+			segments: segmented,
+			corrupt: func(t *testing.T, dir string) {
+				writeFile(t, filepath.Join(dir, "init.mp4"), nil)
+			},
+			want: []string{checkSegments},
+		},
+		{
+			name:     "file the playlist does not reference",
+			segments: segmented,
+			corrupt: func(t *testing.T, dir string) {
+				writeFile(t, filepath.Join(dir, "chunk_00004.m4s"), []byte("fmp4"))
+			},
+			want: []string{checkSegments},
+		},
+		{
+			name:     "byte ranges do not cover the single file",
+			segments: singleFile,
+			corrupt: func(t *testing.T, dir string) {
+				if err := os.Truncate(filepath.Join(dir, singleFileName), 100000); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{checkSegments},
+		},
+		{
+			name:     "playlist without segments",
+			segments: segmented,
+			corrupt: func(t *testing.T, dir string) {
+				writeFile(t, filepath.Join(dir, "index.m3u8"), []byte("#EXTM3U\n#EXT-X-ENDLIST\n"))
+			},
+			want: []string{checkPlaylist},
+		},
+		{
+			name:     "wrong codec",
+			segments: segmented,
+			probe: func(args []string, stdout io.Writer) error {
+				_, err := fmt.Fprint(stdout, `{"streams": [{"codec_type": "audio", "codec_name": "mp3", "sample_rate": "44100", "channels": 2, "nb_read_packets": "346"}], "format": {"duration": "8.000000"}}`)
+				return err
+			},
+			want: []string{checkCodec},
+		},
+		{
+			name:     "unreadable segment",
+			segments: segmented,
+			probe: func(args []string, stdout io.Writer) error {
+				return fmt.Errorf("exit status 1")
+			},
+			want: []string{checkProbe},
+		},
+		{
+			name:     "truncated segments decode short",
+			segments: segmented,
+			probe:    probeRendition(5),
+			want:     []string{checkDuration, checkDuration},
+		},
+		{
+			name:        "rendition shorter than the source",
+			segments:    segmented,
+			durationSec: 10,
+			want:        []string{checkDuration, checkDuration, checkDuration},
+		},
+		{
+			name:        "within the tolerance",
+			segments:    segmented,
+			durationSec: 8.4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputDir := t.TempDir()
+			dir := filepath.Join(outputDir, "aac_256")
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			// the fake encode takes the output playlist last, like ffmpeg
+			encodeArgs := append(append([]string{"-f", "hls"}, tt.segments.hlsArgs(dir)...), filepath.Join(dir, "index.m3u8"))
+			if err := writeHLSVariant(encodeArgs, nil); err != nil {
+				t.Fatalf("writeHLSVariant() error = %v", err)
+			}
+			if tt.corrupt != nil {
+				tt.corrupt(t, dir)
+			}
+			probe := tt.probe
+			if probe == nil {
+				probe = probeRendition(0)
+			}
+			tr := &FFmpegTranscoder{
+				runner:      &fakeRunner{t: t, commands: []fakeCommand{{tool: "ffprobe", run: probe}}},
+				ffprobePath: "ffprobe",
+				settings:    config.TranscodingConfig{Verify: config.VerifyConfig{Enabled: true, DurationToleranceSec: 0.5}},
+			}
+			durationSec := tt.durationSec
+			if durationSec == 0 {
+				durationSec = 8
+			}
+
+			failures, err := tr.verifyRenditions(context.Background(),
+				[]renditionCheck{{variant: ladder[0], dir: dir, durationSec: durationSec}},
+				tt.segments, "", filepath.Join(outputDir, "verify"), 44100)
+			if err != nil {
+				t.Fatalf("verifyRenditions() error = %v", err)
+			}
+			var got []string
+			for _, failure := range failures {
+				got = append(got, failure.Check)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("failed checks = %v (%+v), want %v", got, failures, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerificationErrorPermanence(t *testing.T) {
+	tests := []struct {
+		name          string
+		checks        []string
+		wantPermanent bool
+	}{
+		{name: "broken rendition", checks: []string{checkSegments}, wantPermanent: true},
+		{name: "duration mismatch", checks: []string{checkDuration}, wantPermanent: true},
+		{name: "missing upload", checks: []string{checkObject}, wantPermanent: false},
+		{name: "missing upload among broken renditions", checks: []string{checkCodec, checkObject}, wantPermanent: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var failures []VerificationFailure
+			for _, check := range tt.checks {
+				failures = append(failures, VerificationFailure{Check: check, Detail: "test"})
+			}
+			err := verificationError(failures)
+			if IsPermanent(err) != tt.wantPermanent {
+				t.Errorf("IsPermanent(%v) = %t, want %t", err, IsPermanent(err), tt.wantPermanent)
+			}
+			if got := VerificationFailures(err); !reflect.DeepEqual(got, failures) {
+				t.Errorf("VerificationFailures() = %+v, want %+v", got, failures)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func removeFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,119 @@
+package transcoder
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+const (
+	waveformSampleRate          = 22050
+	waveformBaseSamplesPerPixel = 256
+	waveformZoomLevels          = 5
+)
+
+// Waveform holds min/max peak pairs for the player scrubber. Level 0 is the
+// finest resolution; every next level halves the number of pixels.
+type Waveform struct {
+	Version    int             `json:"version"`
+	SampleRate int             `json:"sample_rate"`
+	Bits       int             `json:"bits"`
+	Levels     []WaveformLevel `json:"levels"`
+}
+
+type WaveformLevel struct {
+	SamplesPerPixel int `json:"samples_per_pixel"`
+	Length          int `json:"length"`
+	// Data is a flat list of min/max pairs.
+	Data []int8 `json:"data"`
+}
+
+func (t *FFmpegTranscoder) generateWaveform(ctx context.Context, input string) (*Waveform, error) {
+	var (
+		peaks    []int8
+		bucketN  int
+		min, max float32
+	)
+	flush := func() {
+		peaks = append(peaks, quantizePeak(min), quantizePeak(max))
+		bucketN, min, max = 0, 0, 0
+	}
+
+	err := t.decodePCM(ctx, input, waveformSampleRate, func(samples []float32) error {
+		for _, s := range samples {
+			if bucketN == 0 || s < min {
+				min = s
+			}
+			if bucketN == 0 || s > max {
+				max = s
+			}
+			bucketN++
+			if bucketN == waveformBaseSamplesPerPixel {
+				flush()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if bucketN > 0 {
+		flush()
+	}
+	if len(peaks) == 0 {
+		return nil, errors.New("no audio samples decoded")
+	}
+
+	waveform := &Waveform{
+		Version:    1,
+		SampleRate: waveformSampleRate,
+		Bits:       8,
+	}
+	level := WaveformLevel{SamplesPerPixel: waveformBaseSamplesPerPixel, Length: len(peaks) / 2, Data: peaks}
+	waveform.Levels = append(waveform.Levels, level)
+	for i := 1; i < waveformZoomLevels && level.Length > 1; i++ {
+		level = downsampleLevel(level)
+		waveform.Levels = append(waveform.Levels, level)
+	}
+	return waveform, nil
+}
+
+func downsampleLevel(level WaveformLevel) WaveformLevel {
+	next := WaveformLevel{SamplesPerPixel: level.SamplesPerPixel * 2}
+	for i := 0; i < level.Length; i += 2 {
+		min, max := level.Data[i*2], level.Data[i*2+1]
+		if i+1 < level.Length {
+			if v := level.Data[(i+1)*2]; v < min {
+				min = v
+			}
+			if v := level.Data[(i+1)*2+1]; v > max {
+				max = v
+			}
+		}
+		next.Data = append(next.Data, min, max)
+	}
+	next.Length = len(next.Data) / 2
+	return next
+}
+
+func quantizePeak(v float32) int8 {
+	scaled := math.Round(float64(v) * 127)
+	return int8(math.Max(-128, math.Min(127, scaled)))
+}
+
+// EncodeDAT serializes the finest level in the audiowaveform binary format (version 1, 8-bit),
+// which waveform libraries such as peaks.js read directly.
+func (w *Waveform) EncodeDAT() []byte {
+	level := w.Levels[0]
+
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, int32(1))
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(1)) // flags: 8-bit samples
+	_ = binary.Write(&buf, binary.LittleEndian, int32(w.SampleRate))
+	_ = binary.Write(&buf, binary.LittleEndian, int32(level.SamplesPerPixel))
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(level.Length))
+	_ = binary.Write(&buf, binary.LittleEndian, level.Data)
+	return buf.Bytes()
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/MusicSocial/upload/internal/config"
 	"github.com/MusicSocial/upload/internal/messaging"
 	"github.com/MusicSocial/upload/internal/server"
+	"github.com/MusicSocial/upload/internal/sessions"
 	"github.com/MusicSocial/upload/internal/storage"
 	"github.com/MusicSocial/upload/internal/tracks"
 	pb "github.com/MusicSocial/upload/proto"
@@ -29,6 +32,12 @@ func main() {
 	}
 	log.Println("MinIO storage initialized successfully")
 
+	// Resumable upload sessions
+	sessionManager := sessions.NewManager(minioStorage, cfg.Sessions, cfg.Upload.MaxSize)
+	sweepCtx, stopSweep := context.WithCancel(context.Background())
+	defer stopSweep()
+	go sweepUploads(sweepCtx, sessionManager, cfg.Sessions)
+
 	// Redpanda
 	producer, err := messaging.NewProducer(&cfg.Redpanda)
 	if err != nil {
@@ -50,7 +59,7 @@ func main() {
 		grpc.MaxRecvMsgSize(100*1024*1024),
 		grpc.MaxSendMsgSize(100*1024*1024),
 	)
-	uploadServer := server.NewUploadServer(cfg, minioStorage, producer, trackClient)
+	uploadServer := server.NewUploadServer(cfg, minioStorage, sessionManager, producer, trackClient)
 	pb.RegisterUploadServiceServer(grpcServer, uploadServer)
 
 	addr := fmt.Sprintf(":%s", cfg.Server.GRPCPort)
@@ -76,3 +85,19 @@ func main() {
 	grpcServer.GracefulStop()
 	log.Println("Upload Service stopped")
 }
+
+// sweepUploads deletes expired upload sessions with their parts until ctx is cancelled.
+func sweepUploads(ctx context.Context, manager *sessions.Manager, cfg config.UploadSessionConfig) {
+	ticker := time.NewTicker(cfg.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := manager.Sweep(ctx); err != nil {
+				log.Printf("Failed to sweep upload sessions: %v", err)
+			}
+		}
+	}
+}
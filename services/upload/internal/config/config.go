@@ -2,6 +2,8 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"time"
 )
 
 type Config struct {
@@ -9,6 +11,8 @@ type Config struct {
 	MinIO    MinIOConfig
 	Redpanda RedpandaConfig
 	Tracks   TrackServiceConfig
+	Upload   UploadConfig
+	Sessions UploadSessionConfig
 }
 
 type ServerConfig struct {
@@ -32,6 +36,22 @@ type TrackServiceConfig struct {
 	Address string
 }
 
+type UploadConfig struct {
+	// MaxSize bounds a file of both direct and resumable uploads; direct uploads are cut off
+	// as soon as they exceed it.
+	MaxSize int64
+}
+
+// UploadSessionConfig controls resumable uploads. Parts are MinIO multipart parts, so PartSize
+// must be at least 5 MiB, and a file may have at most 10000 parts.
+type UploadSessionConfig struct {
+	PartSize int64
+	// TTL is how long an unfinished session may take before it is deleted.
+	TTL time.Duration
+	// SweepInterval is how often expired sessions are cleaned up.
+	SweepInterval time.Duration
+}
+
 func Load() *Config {
 	return &Config{
 		Server: ServerConfig{
@@ -51,6 +71,14 @@ func Load() *Config {
 		Tracks: TrackServiceConfig{
 			Address: getEnv("TRACK_SERVICE_ADDR", "track-service:50052"),
 		},
+		Upload: UploadConfig{
+			MaxSize: int64(getEnvInt("UPLOAD_MAX_SIZE_MB", 1024)) << 20,
+		},
+		Sessions: UploadSessionConfig{
+			PartSize:      int64(getEnvInt("UPLOAD_PART_SIZE_MB", 8)) << 20,
+			TTL:           getEnvDuration("UPLOAD_SESSION_TTL", 24*time.Hour),
+			SweepInterval: getEnvDuration("UPLOAD_SESSION_SWEEP_INTERVAL", 10*time.Minute),
+		},
 	}
 }
 
@@ -60,3 +88,21 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if v, err := strconv.Atoi(value); err == nil {
+			return v
+		}
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if v, err := time.ParseDuration(value); err == nil {
+			return v
+		}
+	}
+	return defaultValue
+}
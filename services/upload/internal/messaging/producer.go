@@ -13,10 +13,24 @@ type Producer struct {
 	transcoderWriter *kafka.Writer
 }
 
+// TranscoderTaskSchemaVersion is the layout of TranscoderTask. Version 1 carried a MinIO URL in
+// track_url instead of Source; the transcoder still decodes it.
+const TranscoderTaskSchemaVersion = 2
+
 type TranscoderTask struct {
-	TrackID  string `json:"track_id"`
-	ArtistID string `json:"artist_id"`
-	TrackURL string `json:"track_url"`
+	SchemaVersion int          `json:"schema_version"`
+	TrackID       string       `json:"track_id"`
+	ArtistID      string       `json:"artist_id"`
+	Source        SourceObject `json:"source"`
+}
+
+// SourceObject names the uploaded original in the object store.
+type SourceObject struct {
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
 }
 
 func NewProducer(cfg *config.RedpandaConfig) (*Producer, error) {
@@ -32,6 +46,9 @@ func NewProducer(cfg *config.RedpandaConfig) (*Producer, error) {
 }
 
 func (p *Producer) SendTranscoderTask(ctx context.Context, task TranscoderTask) error {
+	if task.SchemaVersion == 0 {
+		task.SchemaVersion = TranscoderTaskSchemaVersion
+	}
 	data, err := json.Marshal(task)
 	if err != nil {
 		return fmt.Errorf("failed to marshal transcoder task: %w", err)
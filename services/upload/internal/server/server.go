@@ -2,6 +2,10 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,36 +13,37 @@ import (
 	"github.com/MusicSocial/upload/internal/audio"
 	"github.com/MusicSocial/upload/internal/config"
 	"github.com/MusicSocial/upload/internal/messaging"
+	"github.com/MusicSocial/upload/internal/sessions"
 	"github.com/MusicSocial/upload/internal/storage"
 	"github.com/MusicSocial/upload/internal/tracks"
 	pb "github.com/MusicSocial/upload/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type UploadServer struct {
 	pb.UnimplementedUploadServiceServer
 	storage     *storage.MinIOStorage
+	sessions    *sessions.Manager
 	producer    *messaging.Producer
 	trackClient tracks.Client
 	config      *config.Config
 }
 
-func NewUploadServer(cfg *config.Config, storage *storage.MinIOStorage, producer *messaging.Producer, trackClient tracks.Client) *UploadServer {
+func NewUploadServer(cfg *config.Config, storage *storage.MinIOStorage, sessions *sessions.Manager, producer *messaging.Producer, trackClient tracks.Client) *UploadServer {
 	return &UploadServer{
 		storage:     storage,
+		sessions:    sessions,
 		producer:    producer,
 		trackClient: trackClient,
 		config:      cfg,
 	}
 }
 
+// UploadTrack streams the file into MinIO as it arrives: the format is checked on the first
+// bytes, the track is created right after, and the file goes straight to the original of the
+// track while the size limit is enforced. A track whose file could not be stored is deleted.
 func (s *UploadServer) UploadTrack(stream pb.UploadService_UploadTrackServer) error {
-	var (
-		artistIDs []string
-		trackName string
-		genre     string
-		buffer    bytes.Buffer
-	)
-
 	firstMsg, err := stream.Recv()
 	if err != nil {
 		return fmt.Errorf("failed to receive metadata: %w", err)
@@ -46,43 +51,37 @@ func (s *UploadServer) UploadTrack(stream pb.UploadService_UploadTrackServer) er
 
 	metadata := firstMsg.GetMetadata()
 	if metadata == nil {
-		return fmt.Errorf("first message must contain metadata")
+		return status.Error(codes.InvalidArgument, "first message must contain metadata")
 	}
 
-	artistIDs = metadata.ArtistIds
-	trackName = metadata.TrackName
-	genre = metadata.Genre
+	artistIDs := metadata.ArtistIds
+	trackName := metadata.TrackName
+	genre := metadata.Genre
 
 	if len(artistIDs) == 0 {
-		return fmt.Errorf("metadata must include at least one artist_id")
+		return status.Error(codes.InvalidArgument, "metadata must include at least one artist_id")
 	}
 
 	primaryArtist := artistIDs[0]
 
 	log.Printf("Starting track upload: artist_ids=%v, track_name=%s, genre=%s", artistIDs, trackName, genre)
 
-	for {
-		msg, err := stream.Recv()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("failed to receive chunk: %w", err)
-		}
-
-		chunk := msg.GetChunk()
-		if chunk == nil {
-			continue
-		}
+	ctx := stream.Context()
+	data := &limitedReader{r: &chunkReader{stream: stream}, remaining: s.config.Upload.MaxSize}
 
-		if _, err := buffer.Write(chunk); err != nil {
-			return fmt.Errorf("failed to write chunk to buffer: %w", err)
-		}
+	// Detect file extension from content
+	head := make([]byte, formatProbeSize)
+	n, err := io.ReadFull(data, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return uploadError(err)
 	}
+	head = head[:n]
+	extension, err := audio.DetectExtension(head)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "failed to detect audio format: %v", err)
+	}
+	log.Printf("Detected audio format: %s", extension)
 
-	log.Printf("Received track data: %d bytes", buffer.Len())
-
-	ctx := stream.Context()
 	trackID, err := s.trackClient.CreateTrack(ctx, trackName, artistIDs, genre, 0)
 	if err != nil {
 		return fmt.Errorf("failed to create track in track service: %w", err)
@@ -90,34 +89,19 @@ func (s *UploadServer) UploadTrack(stream pb.UploadService_UploadTrackServer) er
 
 	log.Printf("Track created in Track Service: track_id=%s", trackID)
 
-	// Detect file extension from content
-	extension, err := audio.DetectExtension(buffer.Bytes())
+	hasher := sha256.New()
+	object, err := s.storage.PutTrack(ctx, io.TeeReader(io.MultiReader(bytes.NewReader(head), data), hasher), primaryArtist, trackID, extension)
 	if err != nil {
-		return fmt.Errorf("failed to detect audio format: %w", err)
-	}
-	log.Printf("Detected audio format: %s", extension)
-
-	reader := bytes.NewReader(buffer.Bytes())
-	objectName, err := s.storage.UploadTrack(ctx, reader, primaryArtist, trackID, extension)
-	if err != nil {
-		return fmt.Errorf("failed to upload to storage: %w", err)
+		// the client may be gone, the track must not stay behind without its file
+		if deleteErr := s.trackClient.DeleteUploadedTrack(context.WithoutCancel(ctx), trackID); deleteErr != nil {
+			log.Printf("Failed to delete track %s after a failed upload: %v", trackID, deleteErr)
+		}
+		return uploadError(err)
 	}
 
-	trackURL := fmt.Sprintf("http://minio:9000/%s/%s", s.config.MinIO.BucketName, objectName)
-
-	log.Printf("Track uploaded to MinIO: %s", trackURL)
+	log.Printf("Track uploaded to MinIO: bucket=%s key=%s size=%d", object.Bucket, object.Key, object.Size)
 
-	transcoderTask := messaging.TranscoderTask{
-		TrackID:  trackID,
-		ArtistID: primaryArtist,
-		TrackURL: trackURL,
-	}
-
-	if err := s.producer.SendTranscoderTask(ctx, transcoderTask); err != nil {
-		log.Printf("Failed to send transcoder task: %v", err)
-	} else {
-		log.Printf("Transcoder task sent for track: %s", trackID)
-	}
+	s.sendTranscoderTask(ctx, trackID, primaryArtist, object, hex.EncodeToString(hasher.Sum(nil)))
 
 	response := &pb.UploadTrackResponse{
 		Success: true,
@@ -132,3 +116,72 @@ func (s *UploadServer) UploadTrack(stream pb.UploadService_UploadTrackServer) er
 	log.Printf("Track upload completed successfully: %s", trackID)
 	return nil
 }
+
+var errTooLarge = errors.New("file exceeds the maximum upload size")
+
+// chunkReader reads the file chunks of an UploadTrack stream.
+type chunkReader struct {
+	stream pb.UploadService_UploadTrackServer
+	chunk  []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		msg, err := r.stream.Recv()
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to receive chunk: %w", err)
+		}
+		r.chunk = msg.GetChunk()
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// limitedReader fails with errTooLarge once more than remaining bytes were read, unlike
+// io.LimitReader, which would silently truncate the file.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if l.remaining -= int64(n); l.remaining < 0 {
+		return 0, errTooLarge
+	}
+	return n, err
+}
+
+func uploadError(err error) error {
+	if errors.Is(err, errTooLarge) {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return err
+}
+
+// sendTranscoderTask hands the uploaded original to the transcoder. A failure is only logged:
+// the track exists and can be reprocessed later.
+func (s *UploadServer) sendTranscoderTask(ctx context.Context, trackID, artistID string, object storage.Object, checksum string) {
+	transcoderTask := messaging.TranscoderTask{
+		SchemaVersion: messaging.TranscoderTaskSchemaVersion,
+		TrackID:       trackID,
+		ArtistID:      artistID,
+		Source: messaging.SourceObject{
+			Bucket:      object.Bucket,
+			Key:         object.Key,
+			ContentType: object.ContentType,
+			Size:        object.Size,
+			SHA256:      checksum,
+		},
+	}
+
+	if err := s.producer.SendTranscoderTask(ctx, transcoderTask); err != nil {
+		log.Printf("Failed to send transcoder task: %v", err)
+	} else {
+		log.Printf("Transcoder task sent for track: %s", trackID)
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	pb "github.com/MusicSocial/upload/proto"
+	"google.golang.org/grpc"
+)
+
+// fakeStream replays chunk messages, then fails with err or io.EOF.
+type fakeStream struct {
+	grpc.ServerStream
+	chunks []string
+	err    error
+}
+
+func (s *fakeStream) Recv() (*pb.UploadTrackRequest, error) {
+	if len(s.chunks) == 0 {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, io.EOF
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return &pb.UploadTrackRequest{Data: &pb.UploadTrackRequest_Chunk{Chunk: []byte(chunk)}}, nil
+}
+
+func (s *fakeStream) SendAndClose(*pb.UploadTrackResponse) error {
+	return nil
+}
+
+func TestChunkReader(t *testing.T) {
+	errBroken := errors.New("connection reset")
+	tests := []struct {
+		name    string
+		chunks  []string
+		err     error
+		readLen int
+		want    string
+		wantErr error
+	}{
+		{name: "chunks in sequence", chunks: []string{"ab", "cde", "f"}, readLen: 64, want: "abcdef"},
+		{name: "reads smaller than a chunk", chunks: []string{"abcde", "fg"}, readLen: 2, want: "abcdefg"},
+		{name: "empty chunks are skipped", chunks: []string{"", "ab", "", "", "c"}, readLen: 64, want: "abc"},
+		{name: "no chunks", readLen: 64, want: ""},
+		{name: "stream error after data", chunks: []string{"ab"}, err: errBroken, readLen: 64, want: "ab", wantErr: errBroken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &chunkReader{stream: &fakeStream{chunks: tt.chunks, err: tt.err}}
+			var got []byte
+			buf := make([]byte, tt.readLen)
+			var err error
+			for {
+				var n int
+				n, err = r.Read(buf)
+				got = append(got, buf[:n]...)
+				if err != nil {
+					break
+				}
+			}
+			if tt.wantErr == nil && err != io.EOF {
+				t.Fatalf("Read() error = %v, want io.EOF", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Read() error = %v, want %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		limit   int64
+		oneByte bool
+		wantErr error
+	}{
+		{name: "below the limit", input: "abcd", limit: 5},
+		{name: "exactly the limit", input: "abcde", limit: 5},
+		{name: "one byte over the limit", input: "abcdef", limit: 5, wantErr: errTooLarge},
+		{name: "over the limit in small reads", input: "abcdef", limit: 5, oneByte: true, wantErr: errTooLarge},
+		{name: "empty input", input: "", limit: 0},
+		{name: "zero limit", input: "a", limit: 0, wantErr: errTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var src io.Reader = &chunkReader{stream: &fakeStream{chunks: []string{tt.input}}}
+			if tt.oneByte {
+				src = iotest.OneByteReader(src)
+			}
+			got, err := io.ReadAll(&limitedReader{r: src, remaining: tt.limit})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadAll() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && string(got) != tt.input {
+				t.Errorf("read %q, want %q", got, tt.input)
+			}
+			if int64(len(got)) > tt.limit {
+				t.Errorf("read %d bytes past the limit of %d", len(got), tt.limit)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/MusicSocial/upload/internal/audio"
+	"github.com/MusicSocial/upload/internal/sessions"
+	pb "github.com/MusicSocial/upload/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// formatProbeSize is enough of the file start for audio.DetectExtension.
+const formatProbeSize = 64
+
+func (s *UploadServer) CreateUploadSession(ctx context.Context, req *pb.CreateUploadSessionRequest) (*pb.UploadSession, error) {
+	metadata := req.GetMetadata()
+	if metadata == nil {
+		return nil, status.Error(codes.InvalidArgument, "metadata is required")
+	}
+	if len(metadata.ArtistIds) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "metadata must include at least one artist_id")
+	}
+
+	sess, err := s.sessions.Create(ctx, sessions.Metadata{
+		ArtistIDs: metadata.ArtistIds,
+		TrackName: metadata.TrackName,
+		Genre:     metadata.Genre,
+	}, req.Filename, req.Size)
+	if err != nil {
+		return nil, sessionError(err)
+	}
+
+	log.Printf("Upload session created: session_id=%s, size=%d, artist_ids=%v, track_name=%s",
+		sess.ID, sess.Size, metadata.ArtistIds, metadata.TrackName)
+	return toProto(sess, sessions.Progress{}), nil
+}
+
+func (s *UploadServer) GetUploadSession(ctx context.Context, req *pb.GetUploadSessionRequest) (*pb.UploadSession, error) {
+	sess, progress, err := s.sessions.Get(ctx, req.SessionId)
+	if err != nil {
+		return nil, sessionError(err)
+	}
+	return toProto(sess, progress), nil
+}
+
+func (s *UploadServer) UploadChunk(ctx context.Context, req *pb.UploadChunkRequest) (*pb.UploadSession, error) {
+	// an unsupported file is rejected with its first chunk instead of after the whole upload;
+	// a first chunk too short to tell is checked when the session is finalized
+	if req.Offset == 0 && len(req.Data) >= formatProbeSize {
+		if _, err := audio.DetectExtension(req.Data); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed to detect audio format: %v", err)
+		}
+	}
+
+	sess, progress, err := s.sessions.WriteChunk(ctx, req.SessionId, req.Offset, req.Data)
+	if err != nil {
+		return nil, sessionError(err)
+	}
+	return toProto(sess, progress), nil
+}
+
+// FinalizeUploadSession turns a complete session into a track, like the end of UploadTrack.
+// Every step can be retried: the created track is remembered in the session, and a finalized
+// session answers with the same track. The session is claimed first, so of concurrent
+// requests on any instances only one creates the track.
+func (s *UploadServer) FinalizeUploadSession(ctx context.Context, req *pb.FinalizeUploadSessionRequest) (*pb.UploadTrackResponse, error) {
+	unlock := s.sessions.Lock(req.SessionId)
+	defer unlock()
+
+	sess, err := s.sessions.Claim(ctx, req.SessionId)
+	if err != nil {
+		return nil, sessionError(err)
+	}
+	if sess.Finalized() {
+		return finalizedResponse(sess.TrackID), nil
+	}
+	defer s.sessions.Release(context.WithoutCancel(ctx), sess)
+
+	if err := s.sessions.Assemble(ctx, sess); err != nil {
+		return nil, sessionError(err)
+	}
+
+	head, err := s.storage.ReadHead(ctx, sess.DataKey(), formatProbeSize)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read uploaded file: %v", err)
+	}
+	extension, err := audio.DetectExtension(head)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to detect audio format: %v", err)
+	}
+
+	if sess.TrackID == "" {
+		trackID, err := s.trackClient.CreateTrack(ctx, sess.Metadata.TrackName, sess.Metadata.ArtistIDs, sess.Metadata.Genre, 0)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to create track in track service: %v", err)
+		}
+		if err := s.sessions.SetTrack(ctx, sess, trackID); err != nil {
+			return nil, sessionError(fmt.Errorf("failed to save upload session: %w", err))
+		}
+		log.Printf("Track created in Track Service: track_id=%s, session_id=%s", trackID, sess.ID)
+	}
+
+	primaryArtist := sess.Metadata.ArtistIDs[0]
+	object, err := s.storage.CopyToTrack(ctx, sess.DataKey(), primaryArtist, sess.TrackID, extension)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to store track: %v", err)
+	}
+	checksum, err := s.storage.Checksum(ctx, object.Key)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to hash track: %v", err)
+	}
+	log.Printf("Track uploaded to MinIO: bucket=%s key=%s size=%d", object.Bucket, object.Key, object.Size)
+
+	s.sendTranscoderTask(ctx, sess.TrackID, primaryArtist, object, checksum)
+
+	if err := s.sessions.Finish(ctx, sess); err != nil {
+		log.Printf("Failed to clean up upload session %s: %v", sess.ID, err)
+	}
+	log.Printf("Upload session finalized: session_id=%s, track_id=%s", sess.ID, sess.TrackID)
+	return finalizedResponse(sess.TrackID), nil
+}
+
+func (s *UploadServer) AbortUploadSession(ctx context.Context, req *pb.AbortUploadSessionRequest) (*pb.AbortUploadSessionResponse, error) {
+	if err := s.sessions.Abort(ctx, req.SessionId); err != nil {
+		return nil, sessionError(err)
+	}
+	log.Printf("Upload session aborted: session_id=%s", req.SessionId)
+	return &pb.AbortUploadSessionResponse{}, nil
+}
+
+func finalizedResponse(trackID string) *pb.UploadTrackResponse {
+	return &pb.UploadTrackResponse{
+		Success: true,
+		Message: "Track uploaded successfully",
+		TrackId: trackID,
+	}
+}
+
+func toProto(sess *sessions.Session, progress sessions.Progress) *pb.UploadSession {
+	return &pb.UploadSession{
+		SessionId:     sess.ID,
+		Size:          sess.Size,
+		PartSize:      sess.PartSize,
+		Offset:        progress.Offset,
+		ReceivedBytes: progress.Received,
+		ExpiresAt:     sess.ExpiresAt.Unix(),
+		TrackId:       sess.TrackID,
+	}
+}
+
+func sessionError(err error) error {
+	switch {
+	case errors.Is(err, sessions.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, sessions.ErrInvalidChunk):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, sessions.ErrTooLarge):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, sessions.ErrIncomplete), errors.Is(err, sessions.ErrFinalized):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, sessions.ErrBusy):
+		return status.Error(codes.Aborted, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
@@ -0,0 +1,523 @@
+package sessions
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MusicSocial/upload/internal/config"
+	"github.com/MusicSocial/upload/internal/storage"
+)
+
+const (
+	// keyPrefix holds the state and data of unfinished uploads, apart from track originals.
+	keyPrefix     = "upload-sessions"
+	stateFileName = "session.json"
+	dataFileName  = "data"
+	// tailDirName holds the received bytes of the part being filled, see WriteChunk.
+	tailDirName = "tail"
+	// MinIO rejects multipart parts below 5 MiB, except the last, and more than 10000 parts.
+	minPartSize = 5 << 20
+	maxParts    = 10000
+	// finalizedTTL is how long a finalized session answers retries with its track.
+	finalizedTTL = time.Hour
+	// claimTTL bounds how long one request may take to finalize or abort a session before
+	// another request may take the session over.
+	claimTTL = 10 * time.Minute
+
+	stateUploading = "uploading"
+	stateAssembled = "assembled"
+	stateFinalized = "finalized"
+)
+
+var (
+	ErrNotFound = errors.New("upload session not found")
+	// ErrInvalidChunk and ErrIncomplete are wrapped with the details.
+	ErrInvalidChunk = errors.New("invalid chunk")
+	ErrIncomplete   = errors.New("upload is incomplete")
+	ErrFinalized    = errors.New("upload session is already finalized")
+	ErrTooLarge     = errors.New("file is too large")
+	// ErrBusy is returned while another request, possibly on another instance, finalizes or
+	// aborts the session.
+	ErrBusy = errors.New("upload session is being finalized by another request")
+)
+
+// Store is the part of storage.MinIOStorage the sessions are kept in.
+type Store interface {
+	NewMultipartUpload(ctx context.Context, key string) (string, error)
+	PutPart(ctx context.Context, key, uploadID string, number int, data []byte) error
+	ListParts(ctx context.Context, key, uploadID string) ([]storage.Part, error)
+	CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []storage.Part) error
+	AbortMultipartUpload(ctx context.Context, key, uploadID string) error
+	PutJSON(ctx context.Context, key string, v interface{}) error
+	ReadJSON(ctx context.Context, key string, v interface{}) error
+	ReadJSONVersion(ctx context.Context, key string, v interface{}) (string, error)
+	PutJSONIf(ctx context.Context, key string, v interface{}, etag string) (string, error)
+	PutBytes(ctx context.Context, key string, data []byte) error
+	ReadAll(ctx context.Context, key string) ([]byte, error)
+	Size(ctx context.Context, key string) (int64, error)
+	Remove(ctx context.Context, key string) error
+	RemovePrefix(ctx context.Context, prefix string) error
+	ListKeys(ctx context.Context, prefix, suffix string) ([]string, error)
+}
+
+type Metadata struct {
+	ArtistIDs []string `json:"artist_ids"`
+	TrackName string   `json:"track_name"`
+	Genre     string   `json:"genre"`
+}
+
+// Session is the state of one resumable upload, kept in MinIO next to its data. Which parts
+// have arrived is not stored here but read from the multipart upload, so concurrent chunks
+// never race on the state object. Finalizing and aborting claim the session first and then
+// write it only if it is still the version they claimed, so requests on different instances
+// cannot both finalize it.
+type Session struct {
+	ID        string    `json:"id"`
+	Metadata  Metadata  `json:"metadata"`
+	Filename  string    `json:"filename,omitempty"`
+	Size      int64     `json:"size"`
+	PartSize  int64     `json:"part_size"`
+	UploadID  string    `json:"upload_id"`
+	State     string    `json:"state"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// TrackID is set as soon as the track exists, so a retried finalize does not create another one.
+	TrackID string `json:"track_id,omitempty"`
+	// ClaimedUntil is set while a request finalizes or aborts the session.
+	ClaimedUntil *time.Time `json:"claimed_until,omitempty"`
+
+	// etag is the version of the state object this copy was read as or written to.
+	etag string
+}
+
+// DataKey is where the parts are assembled.
+func (s *Session) DataKey() string {
+	return path.Join(keyPrefix, s.ID, dataFileName)
+}
+
+func (s *Session) stateKey() string {
+	return path.Join(keyPrefix, s.ID, stateFileName)
+}
+
+// tailKey is where the bytes received from start, a part boundary, are kept until they fill the part.
+func (s *Session) tailKey(start int64) string {
+	return path.Join(keyPrefix, s.ID, tailDirName, strconv.FormatInt(start, 10))
+}
+
+func (s *Session) claimed(now time.Time) bool {
+	return s.ClaimedUntil != nil && now.Before(*s.ClaimedUntil)
+}
+
+// Finalized reports whether the session has been fully processed.
+func (s *Session) Finalized() bool {
+	return s.State == stateFinalized
+}
+
+func (s *Session) partCount() int {
+	return int((s.Size + s.PartSize - 1) / s.PartSize)
+}
+
+// partLength is the expected length of a 1-based part.
+func (s *Session) partLength(number int) int64 {
+	return min(s.PartSize, s.Size-int64(number-1)*s.PartSize)
+}
+
+// Progress is what has been received so far.
+type Progress struct {
+	// Offset is how many bytes from the start arrived without a gap.
+	Offset   int64
+	Received int64
+	parts    []storage.Part
+	// tail is how many bytes of Offset are kept in the tail object rather than in parts.
+	tail int64
+}
+
+type Manager struct {
+	store    Store
+	partSize int64
+	maxSize  int64
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	locks map[string]*sessionLock
+}
+
+type sessionLock struct {
+	sync.Mutex
+	waiters int
+}
+
+func NewManager(store Store, cfg config.UploadSessionConfig, maxSize int64) *Manager {
+	partSize := cfg.PartSize
+	if partSize < minPartSize {
+		partSize = minPartSize
+	}
+	return &Manager{
+		store:    store,
+		partSize: partSize,
+		maxSize:  min(maxSize, partSize*maxParts),
+		ttl:      cfg.TTL,
+		locks:    make(map[string]*sessionLock),
+	}
+}
+
+func (m *Manager) Create(ctx context.Context, meta Metadata, filename string, size int64) (*Session, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: size must be positive", ErrInvalidChunk)
+	}
+	if size > m.maxSize {
+		return nil, fmt.Errorf("%w: %d bytes exceed the limit of %d", ErrTooLarge, size, m.maxSize)
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	sess := &Session{
+		ID:        id,
+		Metadata:  meta,
+		Filename:  filename,
+		Size:      size,
+		PartSize:  m.partSize,
+		State:     stateUploading,
+		CreatedAt: now,
+		ExpiresAt: now.Add(m.ttl),
+	}
+	if sess.UploadID, err = m.store.NewMultipartUpload(ctx, sess.DataKey()); err != nil {
+		return nil, err
+	}
+	if err := m.store.PutJSON(ctx, sess.stateKey(), sess); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// Get returns the session and what has been received; an expired unfinished session is not found.
+func (m *Manager) Get(ctx context.Context, id string) (*Session, Progress, error) {
+	sess, err := m.load(ctx, id)
+	if err != nil {
+		return nil, Progress{}, err
+	}
+	if sess.State != stateUploading {
+		return sess, Progress{Offset: sess.Size, Received: sess.Size}, nil
+	}
+	progress, err := m.progress(ctx, sess)
+	return sess, progress, err
+}
+
+// WriteChunk stores a chunk. A chunk that starts at a multiple of the part size and fills the
+// part becomes that multipart part, so parts may arrive in any order and a resent chunk
+// replaces the earlier copy. Any other chunk must continue the upload at its offset: it is
+// added to the tail, the received bytes of the part being filled, and every part the tail
+// completes is stored.
+func (m *Manager) WriteChunk(ctx context.Context, id string, offset int64, data []byte) (*Session, Progress, error) {
+	sess, err := m.load(ctx, id)
+	if err != nil {
+		return nil, Progress{}, err
+	}
+	if sess.State != stateUploading {
+		return nil, Progress{}, ErrFinalized
+	}
+	if offset < 0 || offset >= sess.Size || int64(len(data)) > sess.Size-offset {
+		return nil, Progress{}, fmt.Errorf("%w: %d bytes at offset %d do not fit the size %d", ErrInvalidChunk, len(data), offset, sess.Size)
+	}
+
+	number := int(offset/sess.PartSize) + 1
+	if offset%sess.PartSize == 0 && int64(len(data)) == sess.partLength(number) {
+		if err := m.store.PutPart(ctx, sess.DataKey(), sess.UploadID, number, data); err != nil {
+			return nil, Progress{}, err
+		}
+	} else if err := m.appendTail(ctx, sess, offset, data); err != nil {
+		return nil, Progress{}, err
+	}
+	progress, err := m.progress(ctx, sess)
+	return sess, progress, err
+}
+
+// appendTail adds a chunk at the current offset to the tail and stores the parts it completes.
+func (m *Manager) appendTail(ctx context.Context, sess *Session, offset int64, data []byte) error {
+	progress, err := m.progress(ctx, sess)
+	if err != nil {
+		return err
+	}
+	if offset != progress.Offset {
+		return fmt.Errorf("%w: chunk at offset %d does not continue the upload at %d; only whole parts may arrive out of order",
+			ErrInvalidChunk, offset, progress.Offset)
+	}
+
+	start := progress.Offset - progress.tail
+	buf := data
+	if progress.tail > 0 {
+		tail, err := m.store.ReadAll(ctx, sess.tailKey(start))
+		if err != nil {
+			return err
+		}
+		buf = append(tail, data...)
+	}
+
+	// parts first: until the tail below is written, a failure leaves the previous tail in place
+	tailStart := start
+	for number := int(start/sess.PartSize) + 1; int64(len(buf)) >= sess.partLength(number) && len(buf) > 0; number++ {
+		length := sess.partLength(number)
+		if err := m.store.PutPart(ctx, sess.DataKey(), sess.UploadID, number, buf[:length]); err != nil {
+			return err
+		}
+		buf = buf[length:]
+		tailStart += length
+	}
+	if len(buf) > 0 {
+		if err := m.store.PutBytes(ctx, sess.tailKey(tailStart), buf); err != nil {
+			return err
+		}
+	}
+	if progress.tail > 0 && tailStart != start {
+		// a completed tail no longer counts, removing it only saves space
+		if err := m.store.Remove(ctx, sess.tailKey(start)); err != nil {
+			log.Printf("Failed to remove the tail of upload session %s: %v", sess.ID, err)
+		}
+	}
+	return nil
+}
+
+// Claim reserves the session for the caller to finalize or abort until claimTTL passes, also
+// against requests on other instances; meanwhile they get ErrBusy. A finalized session is
+// returned as it is. Release ends the claim early.
+func (m *Manager) Claim(ctx context.Context, id string) (*Session, error) {
+	sess, err := m.load(ctx, id)
+	if err != nil || sess.Finalized() {
+		return sess, err
+	}
+	now := time.Now().UTC()
+	if sess.claimed(now) {
+		return nil, ErrBusy
+	}
+	until := now.Add(claimTTL)
+	sess.ClaimedUntil = &until
+	// a claimed session does not expire under the request
+	if sess.ExpiresAt.Before(until) {
+		sess.ExpiresAt = until
+	}
+	if err := m.save(ctx, sess); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// Release ends the claim of a session that was not finalized.
+func (m *Manager) Release(ctx context.Context, sess *Session) {
+	if sess.Finalized() || sess.ClaimedUntil == nil {
+		return
+	}
+	sess.ClaimedUntil = nil
+	if err := m.save(ctx, sess); err != nil {
+		log.Printf("Failed to release upload session %s: %v", sess.ID, err)
+	}
+}
+
+// Assemble joins the parts of a claimed session into the data object and moves it to the
+// assembled state. A session that got further already is left as it is.
+func (m *Manager) Assemble(ctx context.Context, sess *Session) error {
+	if sess.State != stateUploading {
+		return nil
+	}
+	progress, err := m.progress(ctx, sess)
+	if err != nil {
+		return err
+	}
+	if progress.Offset != sess.Size {
+		return fmt.Errorf("%w: %d of %d bytes received without a gap", ErrIncomplete, progress.Offset, sess.Size)
+	}
+	if err := m.store.CompleteMultipartUpload(ctx, sess.DataKey(), sess.UploadID, progress.parts); err != nil {
+		return err
+	}
+	sess.State = stateAssembled
+	return m.save(ctx, sess)
+}
+
+// SetTrack records the track created for a claimed assembled session.
+func (m *Manager) SetTrack(ctx context.Context, sess *Session, trackID string) error {
+	sess.TrackID = trackID
+	return m.save(ctx, sess)
+}
+
+// Finish marks the session finalized and removes its data. The state is kept for a while so
+// a retried finalize gets the same track back.
+func (m *Manager) Finish(ctx context.Context, sess *Session) error {
+	sess.State = stateFinalized
+	sess.ExpiresAt = time.Now().UTC().Add(finalizedTTL)
+	sess.ClaimedUntil = nil
+	if err := m.save(ctx, sess); err != nil {
+		return err
+	}
+	if err := m.store.RemovePrefix(ctx, sess.DataKey()); err != nil {
+		return err
+	}
+	return m.store.RemovePrefix(ctx, path.Join(keyPrefix, sess.ID, tailDirName)+"/")
+}
+
+func (m *Manager) Abort(ctx context.Context, id string) error {
+	unlock := m.Lock(id)
+	defer unlock()
+
+	sess, err := m.Claim(ctx, id)
+	if err != nil {
+		return err
+	}
+	if sess.State != stateUploading {
+		m.Release(ctx, sess)
+		return ErrFinalized
+	}
+	return m.remove(ctx, sess)
+}
+
+// Sweep deletes expired sessions and their parts.
+func (m *Manager) Sweep(ctx context.Context) error {
+	keys, err := m.store.ListKeys(ctx, keyPrefix+"/", "/"+stateFileName)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, key := range keys {
+		var sess Session
+		if err := m.store.ReadJSON(ctx, key, &sess); err != nil {
+			log.Printf("Skipping unreadable upload session %s: %v", key, err)
+			continue
+		}
+		if now.Before(sess.ExpiresAt) {
+			continue
+		}
+		if err := m.remove(ctx, &sess); err != nil {
+			log.Printf("Failed to remove expired upload session %s: %v", sess.ID, err)
+			continue
+		}
+		if sess.State != stateFinalized {
+			log.Printf("Removed expired upload session %s (%s, %d bytes)", sess.ID, sess.State, sess.Size)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) remove(ctx context.Context, sess *Session) error {
+	if sess.State == stateUploading {
+		if err := m.store.AbortMultipartUpload(ctx, sess.DataKey(), sess.UploadID); err != nil {
+			return err
+		}
+	}
+	return m.store.RemovePrefix(ctx, path.Join(keyPrefix, sess.ID)+"/")
+}
+
+func (m *Manager) load(ctx context.Context, id string) (*Session, error) {
+	if id == "" || strings.ContainsAny(id, "/.") {
+		return nil, ErrNotFound
+	}
+	var sess Session
+	etag, err := m.store.ReadJSONVersion(ctx, path.Join(keyPrefix, id, stateFileName), &sess)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sess.State == stateUploading && time.Now().After(sess.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	sess.etag = etag
+	return &sess, nil
+}
+
+// save writes the state if nobody changed it since it was read; losing a claim that ran past
+// claimTTL to another request is reported as ErrBusy.
+func (m *Manager) save(ctx context.Context, sess *Session) error {
+	etag, err := m.store.PutJSONIf(ctx, sess.stateKey(), sess, sess.etag)
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		return fmt.Errorf("%w: the session was changed by another request", ErrBusy)
+	}
+	if err != nil {
+		return err
+	}
+	sess.etag = etag
+	return nil
+}
+
+// progress reads the received parts and the tail that continues them; parts with an
+// unexpected size do not count.
+func (m *Manager) progress(ctx context.Context, sess *Session) (Progress, error) {
+	parts, err := m.store.ListParts(ctx, sess.DataKey(), sess.UploadID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return Progress{}, ErrNotFound
+	}
+	if err != nil {
+		return Progress{}, err
+	}
+
+	var progress Progress
+	next := 1
+	for _, part := range parts {
+		if part.Number > sess.partCount() || part.Size != sess.partLength(part.Number) {
+			continue
+		}
+		progress.Received += part.Size
+		if part.Number == next {
+			progress.Offset += part.Size
+			progress.parts = append(progress.parts, part)
+			next++
+		} else {
+			next = -1
+		}
+	}
+
+	if progress.Offset < sess.Size {
+		tail, err := m.store.Size(ctx, sess.tailKey(progress.Offset))
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+		case err != nil:
+			return Progress{}, err
+		default:
+			progress.tail = tail
+			progress.Offset += tail
+			progress.Received += tail
+		}
+	}
+	return progress, nil
+}
+
+// Lock serializes finalizing and aborting a session within this instance, so a concurrent
+// request waits instead of getting ErrBusy from Claim; it returns the unlock function.
+func (m *Manager) Lock(id string) func() {
+	m.mu.Lock()
+	l, ok := m.locks[id]
+	if !ok {
+		l = &sessionLock{}
+		m.locks[id] = l
+	}
+	l.waiters++
+	m.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.mu.Lock()
+		if l.waiters--; l.waiters == 0 {
+			delete(m.locks, id)
+		}
+		m.mu.Unlock()
+	}
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate session id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
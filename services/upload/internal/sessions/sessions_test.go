@@ -0,0 +1,485 @@
+package sessions
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MusicSocial/upload/internal/storage"
+)
+
+// memoryStore keeps objects and multipart uploads in memory; ETags are the MD5 of the content.
+type memoryStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	aborted []string
+	nextID  int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+}
+
+func etagOf(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *memoryStore) NewMultipartUpload(ctx context.Context, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	s.uploads[id] = make(map[int][]byte)
+	return id, nil
+}
+
+func (s *memoryStore) PutPart(ctx context.Context, key, uploadID string, number int, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	parts, ok := s.uploads[uploadID]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	parts[number] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *memoryStore) ListParts(ctx context.Context, key, uploadID string) ([]storage.Part, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	parts, ok := s.uploads[uploadID]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	var list []storage.Part
+	for number, data := range parts {
+		list = append(list, storage.Part{Number: number, ETag: etagOf(data), Size: int64(len(data))})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Number < list[j].Number })
+	return list, nil
+}
+
+func (s *memoryStore) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []storage.Part) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uploaded, ok := s.uploads[uploadID]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	var data []byte
+	for _, part := range parts {
+		if etagOf(uploaded[part.Number]) != part.ETag {
+			return errors.New("part " + strconv.Itoa(part.Number) + " changed")
+		}
+		data = append(data, uploaded[part.Number]...)
+	}
+	s.objects[key] = data
+	delete(s.uploads, uploadID)
+	return nil
+}
+
+func (s *memoryStore) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, uploadID)
+	s.aborted = append(s.aborted, uploadID)
+	return nil
+}
+
+func (s *memoryStore) PutJSON(ctx context.Context, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.PutBytes(ctx, key, data)
+}
+
+func (s *memoryStore) ReadJSON(ctx context.Context, key string, v interface{}) error {
+	_, err := s.ReadJSONVersion(ctx, key, v)
+	return err
+}
+
+func (s *memoryStore) ReadJSONVersion(ctx context.Context, key string, v interface{}) (string, error) {
+	data, err := s.ReadAll(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return etagOf(data), json.Unmarshal(data, v)
+}
+
+func (s *memoryStore) PutJSONIf(ctx context.Context, key string, v interface{}, etag string) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.objects[key]
+	if !ok || etagOf(current) != etag {
+		return "", storage.ErrPreconditionFailed
+	}
+	s.objects[key] = data
+	return etagOf(data), nil
+}
+
+func (s *memoryStore) PutBytes(ctx context.Context, key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *memoryStore) ReadAll(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (s *memoryStore) Size(ctx context.Context, key string) (int64, error) {
+	data, err := s.ReadAll(ctx, key)
+	return int64(len(data)), err
+}
+
+func (s *memoryStore) Remove(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memoryStore) RemovePrefix(ctx context.Context, prefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.objects, key)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ListKeys(ctx context.Context, prefix, suffix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) && strings.HasSuffix(key, suffix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// newTestManager uses parts of 4 bytes, far below the MinIO minimum NewManager enforces.
+func newTestManager(store Store) *Manager {
+	return &Manager{store: store, partSize: 4, maxSize: 1 << 20, ttl: time.Hour, locks: make(map[string]*sessionLock)}
+}
+
+const testFile = "0123456789"
+
+func TestWriteChunk(t *testing.T) {
+	type chunk struct {
+		offset  int64
+		data    string
+		wantErr error
+	}
+	tests := []struct {
+		name         string
+		chunks       []chunk
+		wantOffset   int64
+		wantReceived int64
+		// wantData is the assembled file; empty when Assemble must fail with ErrIncomplete
+		wantData string
+	}{
+		{
+			name:         "whole parts in order",
+			chunks:       []chunk{{offset: 0, data: "0123"}, {offset: 4, data: "4567"}, {offset: 8, data: "89"}},
+			wantOffset:   10,
+			wantReceived: 10,
+			wantData:     testFile,
+		},
+		{
+			name:         "whole parts out of order",
+			chunks:       []chunk{{offset: 8, data: "89"}, {offset: 4, data: "4567"}, {offset: 0, data: "0123"}},
+			wantOffset:   10,
+			wantReceived: 10,
+			wantData:     testFile,
+		},
+		{
+			name:         "resent part replaces the earlier copy",
+			chunks:       []chunk{{offset: 0, data: "xxxx"}, {offset: 4, data: "4567"}, {offset: 8, data: "89"}, {offset: 0, data: "0123"}},
+			wantOffset:   10,
+			wantReceived: 10,
+			wantData:     testFile,
+		},
+		{
+			name:         "gap before the last part",
+			chunks:       []chunk{{offset: 0, data: "0123"}, {offset: 8, data: "89"}},
+			wantOffset:   4,
+			wantReceived: 6,
+		},
+		{
+			name: "last part of the wrong size",
+			chunks: []chunk{
+				{offset: 0, data: "0123"},
+				{offset: 4, data: "4567"},
+				{offset: 8, data: "890", wantErr: ErrInvalidChunk},
+			},
+			wantOffset:   8,
+			wantReceived: 8,
+		},
+		{
+			name:         "short chunks fill the parts through the tail",
+			chunks:       []chunk{{offset: 0, data: "0"}, {offset: 1, data: "12"}, {offset: 3, data: "345"}, {offset: 6, data: "6789"}},
+			wantOffset:   10,
+			wantReceived: 10,
+			wantData:     testFile,
+		},
+		{
+			name:         "tail after whole parts",
+			chunks:       []chunk{{offset: 0, data: "0123"}, {offset: 4, data: "45"}},
+			wantOffset:   6,
+			wantReceived: 6,
+		},
+		{
+			name:         "short chunk must continue the upload",
+			chunks:       []chunk{{offset: 0, data: "01"}, {offset: 1, data: "12", wantErr: ErrInvalidChunk}, {offset: 4, data: "45", wantErr: ErrInvalidChunk}},
+			wantOffset:   2,
+			wantReceived: 2,
+		},
+		{
+			name:         "chunk past the end",
+			chunks:       []chunk{{offset: 10, data: "x", wantErr: ErrInvalidChunk}, {offset: -1, data: "x", wantErr: ErrInvalidChunk}},
+			wantOffset:   0,
+			wantReceived: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newMemoryStore()
+			m := newTestManager(store)
+			sess, err := m.Create(ctx, Metadata{ArtistIDs: []string{"artist-1"}}, "file.flac", int64(len(testFile)))
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+
+			for _, c := range tt.chunks {
+				_, _, err := m.WriteChunk(ctx, sess.ID, c.offset, []byte(c.data))
+				if !errors.Is(err, c.wantErr) {
+					t.Fatalf("WriteChunk(%d, %q) error = %v, want %v", c.offset, c.data, err, c.wantErr)
+				}
+			}
+
+			_, progress, err := m.Get(ctx, sess.ID)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if progress.Offset != tt.wantOffset || progress.Received != tt.wantReceived {
+				t.Errorf("progress = offset %d, received %d, want %d, %d", progress.Offset, progress.Received, tt.wantOffset, tt.wantReceived)
+			}
+
+			claimed, err := m.Claim(ctx, sess.ID)
+			if err != nil {
+				t.Fatalf("Claim() error = %v", err)
+			}
+			err = m.Assemble(ctx, claimed)
+			if tt.wantData == "" {
+				if !errors.Is(err, ErrIncomplete) {
+					t.Fatalf("Assemble() error = %v, want ErrIncomplete", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Assemble() error = %v", err)
+			}
+			if got := string(store.objects[sess.DataKey()]); got != tt.wantData {
+				t.Errorf("assembled %q, want %q", got, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestFinish(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	m := newTestManager(store)
+	sess, err := m.Create(ctx, Metadata{ArtistIDs: []string{"artist-1"}}, "", int64(len(testFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tail of an earlier attempt is left behind when a whole part replaces it
+	for _, c := range []struct {
+		offset int64
+		data   string
+	}{{0, "01"}, {0, "0123"}, {4, "4567"}, {8, "89"}} {
+		if _, _, err := m.WriteChunk(ctx, sess.ID, c.offset, []byte(c.data)); err != nil {
+			t.Fatalf("WriteChunk(%d, %q) error = %v", c.offset, c.data, err)
+		}
+	}
+
+	claimed, err := m.Claim(ctx, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Assemble(ctx, claimed); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetTrack(ctx, claimed, "track-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Finish(ctx, claimed); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, _ := store.ListKeys(ctx, keyPrefix+"/", "")
+	if len(keys) != 1 || keys[0] != sess.stateKey() {
+		t.Errorf("objects after Finish = %v, want only %s", keys, sess.stateKey())
+	}
+	again, err := m.Claim(ctx, sess.ID)
+	if err != nil || !again.Finalized() || again.TrackID != "track-1" {
+		t.Errorf("Claim() after Finish = %+v, %v, want the finalized session with track-1", again, err)
+	}
+	if _, _, err := m.WriteChunk(ctx, sess.ID, 0, []byte("0123")); !errors.Is(err, ErrFinalized) {
+		t.Errorf("WriteChunk() after Finish error = %v, want ErrFinalized", err)
+	}
+}
+
+func TestClaim(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	// two managers on one store stand for two instances of the service
+	first, second := newTestManager(store), newTestManager(store)
+	sess, err := first.Create(ctx, Metadata{ArtistIDs: []string{"artist-1"}}, "", int64(len(testFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, err := first.Claim(ctx, sess.ID)
+	if err != nil {
+		t.Fatalf("Claim() error = %v", err)
+	}
+	if _, err := second.Claim(ctx, sess.ID); !errors.Is(err, ErrBusy) {
+		t.Errorf("second Claim() error = %v, want ErrBusy", err)
+	}
+	if err := second.Abort(ctx, sess.ID); !errors.Is(err, ErrBusy) {
+		t.Errorf("Abort() of a claimed session error = %v, want ErrBusy", err)
+	}
+
+	first.Release(ctx, claimed)
+	taken, err := second.Claim(ctx, sess.ID)
+	if err != nil {
+		t.Fatalf("Claim() after Release error = %v", err)
+	}
+	// the first request ran past its claim: its writes must not land
+	if err := first.SetTrack(ctx, claimed, "track-1"); !errors.Is(err, ErrBusy) {
+		t.Errorf("SetTrack() with a lost claim error = %v, want ErrBusy", err)
+	}
+	if err := second.SetTrack(ctx, taken, "track-2"); err != nil {
+		t.Errorf("SetTrack() error = %v", err)
+	}
+}
+
+func TestClaimExpired(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	m := newTestManager(store)
+	sess, err := m.Create(ctx, Metadata{ArtistIDs: []string{"artist-1"}}, "", int64(len(testFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a request that died holding the claim
+	expired := time.Now().UTC().Add(-time.Second)
+	sess.ClaimedUntil = &expired
+	if err := store.PutJSON(ctx, sess.stateKey(), sess); err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, err := m.Claim(ctx, sess.ID)
+	if err != nil {
+		t.Fatalf("Claim() of an expired claim error = %v", err)
+	}
+	if claimed.ClaimedUntil == nil || !claimed.ClaimedUntil.After(time.Now()) {
+		t.Errorf("ClaimedUntil = %v, want in the future", claimed.ClaimedUntil)
+	}
+	if claimed.ExpiresAt.Before(*claimed.ClaimedUntil) {
+		t.Errorf("session expires at %s, before its claim ends at %s", claimed.ExpiresAt, claimed.ClaimedUntil)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	m := newTestManager(store)
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name        string
+		state       string
+		expiresAt   time.Time
+		wantRemoved bool
+		wantAborted bool
+	}{
+		{name: "live upload", state: stateUploading, expiresAt: now.Add(time.Hour)},
+		{name: "expired upload", state: stateUploading, expiresAt: now.Add(-time.Second), wantRemoved: true, wantAborted: true},
+		{name: "expired assembled upload", state: stateAssembled, expiresAt: now.Add(-time.Second), wantRemoved: true},
+		{name: "recently finalized", state: stateFinalized, expiresAt: now.Add(finalizedTTL)},
+		{name: "finalized long ago", state: stateFinalized, expiresAt: now.Add(-time.Second), wantRemoved: true},
+	}
+	created := make([]*Session, len(tests))
+	for i, tt := range tests {
+		sess, err := m.Create(ctx, Metadata{ArtistIDs: []string{"artist-1"}}, "", int64(len(testFile)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := m.WriteChunk(ctx, sess.ID, 0, []byte("0123")); err != nil {
+			t.Fatal(err)
+		}
+		sess.State = tt.state
+		sess.ExpiresAt = tt.expiresAt
+		if err := store.PutJSON(ctx, sess.stateKey(), sess); err != nil {
+			t.Fatal(err)
+		}
+		created[i] = sess
+	}
+
+	if err := m.Sweep(ctx); err != nil {
+		t.Fatalf("Sweep() error = %v", err)
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess := created[i]
+			_, kept := store.objects[sess.stateKey()]
+			if kept == tt.wantRemoved {
+				t.Errorf("state kept = %t, want %t", kept, !tt.wantRemoved)
+			}
+			aborted := false
+			for _, id := range store.aborted {
+				aborted = aborted || id == sess.UploadID
+			}
+			if aborted != tt.wantAborted {
+				t.Errorf("multipart upload aborted = %t, want %t", aborted, tt.wantAborted)
+			}
+			_, _, err := m.Get(ctx, sess.ID)
+			if gone := errors.Is(err, ErrNotFound); gone != (tt.wantRemoved || tt.state == stateUploading && tt.expiresAt.Before(now)) {
+				t.Errorf("Get() error = %v", err)
+			}
+		})
+	}
+}
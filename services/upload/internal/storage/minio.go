@@ -1,7 +1,12 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -12,8 +17,27 @@ import (
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
+// Object describes an uploaded object.
+type Object struct {
+	Bucket      string
+	Key         string
+	ContentType string
+	Size        int64
+}
+
+var (
+	// ErrNotFound is returned for a missing object or multipart upload.
+	ErrNotFound = errors.New("not found")
+	// ErrPreconditionFailed is returned by a conditional write after another writer changed the object.
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// streamPartSize is the part size of streamed uploads and the buffer each of them holds.
+const streamPartSize = 8 << 20
+
 type MinIOStorage struct {
 	client     *minio.Client
+	core       minio.Core
 	bucketName string
 }
 
@@ -41,39 +65,323 @@ func NewMinIOStorage(cfg *config.MinIOConfig) (*MinIOStorage, error) {
 
 	return &MinIOStorage{
 		client:     client,
+		core:       minio.Core{Client: client},
 		bucketName: cfg.BucketName,
 	}, nil
 }
 
-func (s *MinIOStorage) UploadTrack(ctx context.Context, reader io.Reader, artistID, trackID, extension string) (string, error) {
+// PutTrack streams an upload of unknown size into the original of a track. The data goes to
+// MinIO part by part, so at most one part is held in memory; on error the multipart upload is
+// aborted and no object is created.
+func (s *MinIOStorage) PutTrack(ctx context.Context, reader io.Reader, artistID, trackID, extension string) (Object, error) {
+	objectName, contentType, err := trackObject(artistID, trackID, extension)
+	if err != nil {
+		return Object{}, err
+	}
+
+	info, err := s.client.PutObject(ctx, s.bucketName, objectName, reader, -1, minio.PutObjectOptions{
+		ContentType: contentType,
+		PartSize:    streamPartSize,
+	})
+	if err != nil {
+		return Object{}, fmt.Errorf("failed to upload %s: %w", objectName, err)
+	}
+
+	return Object{
+		Bucket:      s.bucketName,
+		Key:         objectName,
+		ContentType: contentType,
+		Size:        info.Size,
+	}, nil
+}
+
+func (s *MinIOStorage) Remove(ctx context.Context, key string) error {
+	if err := s.client.RemoveObject(ctx, s.bucketName, key, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", key, err)
+	}
+	return nil
+}
+
+// CopyToTrack stores an already uploaded object as the original of a track. The copy happens
+// inside MinIO, so the file does not pass through the service again.
+func (s *MinIOStorage) CopyToTrack(ctx context.Context, srcKey, artistID, trackID, extension string) (Object, error) {
+	objectName, contentType, err := trackObject(artistID, trackID, extension)
+	if err != nil {
+		return Object{}, err
+	}
+
+	info, err := s.client.ComposeObject(ctx,
+		minio.CopyDestOptions{
+			Bucket:          s.bucketName,
+			Object:          objectName,
+			UserMetadata:    map[string]string{"Content-Type": contentType},
+			ReplaceMetadata: true,
+		},
+		minio.CopySrcOptions{Bucket: s.bucketName, Object: srcKey},
+	)
+	if err != nil {
+		return Object{}, fmt.Errorf("failed to copy %s to %s: %w", srcKey, objectName, err)
+	}
+
+	return Object{
+		Bucket:      s.bucketName,
+		Key:         objectName,
+		ContentType: contentType,
+		Size:        info.Size,
+	}, nil
+}
+
+func trackObject(artistID, trackID, extension string) (objectName, contentType string, err error) {
 	if extension != "" {
 		if !strings.HasPrefix(extension, ".") {
 			extension = "." + extension
 		}
 	} else {
-		return "", fmt.Errorf("extension is required")
+		return "", "", fmt.Errorf("extension is required")
 	}
 
-	objectName := fmt.Sprintf("%s/%s/original/original%s", artistID, trackID, extension)
+	objectName = fmt.Sprintf("%s/%s/original/original%s", artistID, trackID, extension)
 
-	contentType := mime.TypeByExtension(extension)
+	contentType = mime.TypeByExtension(extension)
 	if contentType == "" {
 		contentType = "application/octet-stream"
 	}
+	return objectName, contentType, nil
+}
+
+// Part is an uploaded part of a multipart upload.
+type Part struct {
+	Number int
+	ETag   string
+	Size   int64
+}
+
+func (s *MinIOStorage) NewMultipartUpload(ctx context.Context, key string) (string, error) {
+	uploadID, err := s.core.NewMultipartUpload(ctx, s.bucketName, key, minio.PutObjectOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to start multipart upload of %s: %w", key, err)
+	}
+	return uploadID, nil
+}
 
-	_, err := s.client.PutObject(
-		ctx,
-		s.bucketName,
-		objectName,
-		reader,
-		-1, // unknown size
-		minio.PutObjectOptions{
-			ContentType: contentType,
-		},
-	)
+// PutPart stores one part; uploading the same part number again replaces it.
+func (s *MinIOStorage) PutPart(ctx context.Context, key, uploadID string, number int, data []byte) error {
+	_, err := s.core.PutObjectPart(ctx, s.bucketName, key, uploadID, number, bytes.NewReader(data), int64(len(data)), minio.PutObjectPartOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to upload part %d of %s: %w", number, key, err)
+	}
+	return nil
+}
+
+// ListParts returns the uploaded parts in part number order.
+func (s *MinIOStorage) ListParts(ctx context.Context, key, uploadID string) ([]Part, error) {
+	var parts []Part
+	marker := 0
+	for {
+		result, err := s.core.ListObjectParts(ctx, s.bucketName, key, uploadID, marker, 1000)
+		if err != nil {
+			if isNoSuchUpload(err) {
+				return nil, ErrNotFound
+			}
+			return nil, fmt.Errorf("failed to list parts of %s: %w", key, err)
+		}
+		for _, p := range result.ObjectParts {
+			parts = append(parts, Part{Number: p.PartNumber, ETag: p.ETag, Size: p.Size})
+		}
+		if !result.IsTruncated {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+func (s *MinIOStorage) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []Part) error {
+	complete := make([]minio.CompletePart, 0, len(parts))
+	for _, p := range parts {
+		complete = append(complete, minio.CompletePart{PartNumber: p.Number, ETag: p.ETag})
+	}
+	if _, err := s.core.CompleteMultipartUpload(ctx, s.bucketName, key, uploadID, complete, minio.PutObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to complete multipart upload of %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *MinIOStorage) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	if err := s.core.AbortMultipartUpload(ctx, s.bucketName, key, uploadID); err != nil && !isNoSuchUpload(err) {
+		return fmt.Errorf("failed to abort multipart upload of %s: %w", key, err)
+	}
+	return nil
+}
+
+// ReadHead returns up to n bytes from the start of an object.
+func (s *MinIOStorage) ReadHead(ctx context.Context, key string, n int64) ([]byte, error) {
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(0, n-1); err != nil {
+		return nil, err
+	}
+	reader, err := s.client.GetObject(ctx, s.bucketName, key, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return data, nil
+}
+
+// Checksum returns the hex SHA-256 of an object.
+func (s *MinIOStorage) Checksum(ctx context.Context, key string) (string, error) {
+	reader, err := s.client.GetObject(ctx, s.bucketName, key, minio.GetObjectOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	defer reader.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, reader); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", key, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *MinIOStorage) PutJSON(ctx context.Context, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(ctx, s.bucketName, key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/json"})
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	return nil
+}
+
+// ReadJSON decodes an object; a missing object is reported as ErrNotFound.
+func (s *MinIOStorage) ReadJSON(ctx context.Context, key string, v interface{}) error {
+	reader, err := s.client.GetObject(ctx, s.bucketName, key, minio.GetObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	defer reader.Close()
+	if err := json.NewDecoder(reader).Decode(v); err != nil {
+		if isNoSuchKey(err) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("failed to decode %s: %w", key, err)
+	}
+	return nil
+}
+
+// ReadJSONVersion is ReadJSON that also returns the ETag of the version it decoded.
+func (s *MinIOStorage) ReadJSONVersion(ctx context.Context, key string, v interface{}) (string, error) {
+	reader, err := s.client.GetObject(ctx, s.bucketName, key, minio.GetObjectOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	defer reader.Close()
+	info, err := reader.Stat()
+	if err != nil {
+		if isNoSuchKey(err) {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	if err := json.NewDecoder(reader).Decode(v); err != nil {
+		return "", fmt.Errorf("failed to decode %s: %w", key, err)
+	}
+	return info.ETag, nil
+}
+
+// PutJSONIf replaces an object only while its ETag is still etag and returns the new ETag;
+// otherwise it fails with ErrPreconditionFailed.
+func (s *MinIOStorage) PutJSONIf(ctx context.Context, key string, v interface{}, etag string) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	opts := minio.PutObjectOptions{ContentType: "application/json"}
+	opts.SetMatchETag(etag)
+	info, err := s.client.PutObject(ctx, s.bucketName, key, bytes.NewReader(data), int64(len(data)), opts)
 	if err != nil {
-		return "", fmt.Errorf("failed to upload track: %w", err)
+		if minio.ToErrorResponse(err).Code == "PreconditionFailed" {
+			return "", ErrPreconditionFailed
+		}
+		return "", fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	return info.ETag, nil
+}
+
+func (s *MinIOStorage) PutBytes(ctx context.Context, key string, data []byte) error {
+	_, err := s.client.PutObject(ctx, s.bucketName, key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	return nil
+}
+
+// ReadAll returns a whole object; a missing object is reported as ErrNotFound.
+func (s *MinIOStorage) ReadAll(ctx context.Context, key string) ([]byte, error) {
+	reader, err := s.client.GetObject(ctx, s.bucketName, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		if isNoSuchKey(err) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return data, nil
+}
+
+// Size returns the size of an object; a missing object is reported as ErrNotFound.
+func (s *MinIOStorage) Size(ctx context.Context, key string) (int64, error) {
+	info, err := s.client.StatObject(ctx, s.bucketName, key, minio.StatObjectOptions{})
+	if err != nil {
+		if isNoSuchKey(err) {
+			return 0, ErrNotFound
+		}
+		return 0, fmt.Errorf("failed to stat %s: %w", key, err)
+	}
+	return info.Size, nil
+}
+
+// RemovePrefix deletes every object under prefix.
+func (s *MinIOStorage) RemovePrefix(ctx context.Context, prefix string) error {
+	for obj := range s.client.ListObjects(ctx, s.bucketName, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return fmt.Errorf("failed to list %s: %w", prefix, obj.Err)
+		}
+		if err := s.Remove(ctx, obj.Key); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// ListKeys returns the keys under prefix that end with suffix.
+func (s *MinIOStorage) ListKeys(ctx context.Context, prefix, suffix string) ([]string, error) {
+	var keys []string
+	for obj := range s.client.ListObjects(ctx, s.bucketName, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", prefix, obj.Err)
+		}
+		if strings.HasSuffix(obj.Key, suffix) {
+			keys = append(keys, obj.Key)
+		}
+	}
+	return keys, nil
+}
+
+func isNoSuchUpload(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchUpload"
+}
 
-	return objectName, nil
+func isNoSuchKey(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
 }
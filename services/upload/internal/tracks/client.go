@@ -12,6 +12,8 @@ import (
 
 type Client interface {
 	CreateTrack(ctx context.Context, name string, artistIDs []string, genre string, duration int32) (string, error)
+	// DeleteUploadedTrack removes a track whose original could not be stored.
+	DeleteUploadedTrack(ctx context.Context, trackID string) error
 	Close() error
 }
 
@@ -50,6 +52,13 @@ func (c *GRPCClient) CreateTrack(ctx context.Context, name string, artistIDs []s
 	return trackID, nil
 }
 
+func (c *GRPCClient) DeleteUploadedTrack(ctx context.Context, trackID string) error {
+	if _, err := c.client.DeleteUploadedTrack(ctx, &trackspb.DeleteUploadedTrackRequest{TrackId: trackID}); err != nil {
+		return fmt.Errorf("failed to delete track in track service: %w", err)
+	}
+	return nil
+}
+
 func (c *GRPCClient) Close() error {
 	return c.conn.Close()
 }